@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
@@ -13,28 +14,29 @@ import (
 
 // ##### Constants ############################################################
 
-const SQL_ALERTS_UNCLASSIFIED string = `SELECT * 
+// The WHERE clause, ORDER BY clause, prevalence joins, sort key and LIMIT clause are substituted
+const SQL_ALERTS_UNCLASSIFIED string = `SELECT alert.*, COALESCE(alert_state.state, 0) AS state, COALESCE(assignee.username, '') AS assigned_to,
+			COALESCE(alert_state.assigned_user_id, 0) AS assigned_user_id, ` + SQL_PREVALENCE_COLUMNS + `, a.sort_key
 	   FROM alert 
-	   JOIN (SELECT alert.id FROM alert
+	   JOIN (SELECT alert.id, %[4]s FROM alert
   LEFT JOIN classification ON (classification.alert_id = alert.id)
-      WHERE classification.id IS NULL
-      LIMIT $1 
-	 OFFSET $2) AS a ON a.id = alert.id
-   ORDER BY alert.timestamp`
-
-const SQL_ALERTS_UNCLASSIFIED_FILTERED string = `SELECT * 
-	   FROM alert 
-	   JOIN (SELECT alert.id FROM alert
-  LEFT JOIN classification ON (classification.alert_id = alert.id)
-      WHERE classification.id IS NULL AND alert.verified = $3
-      LIMIT $1 
-	 OFFSET $2) AS a ON a.id = alert.id
-   ORDER BY alert.timestamp`
-
-const SQL_ALERTS_CLASSIFIED string = `SELECT alert.*, users.username as classified_by, classification.timestamp as classified 
+  LEFT JOIN alert_state ON (alert_state.alert_id = alert.id)
+  %[3]s
+      WHERE %[1]s
+   ORDER BY %[2]s
+      %[5]s) AS a ON a.id = alert.id
+  LEFT JOIN alert_state ON (alert_state.alert_id = alert.id)
+  LEFT JOIN users AS assignee ON (assignee.id = alert_state.assigned_user_id)
+  %[3]s
+   ORDER BY %[2]s`
+
+// Alerts classified by a rule have no user, so the rule's name is used instead
+const SQL_ALERTS_CLASSIFIED string = `SELECT alert.*, COALESCE(users.username, 'Rule: ' || classification_rule.name, '') as classified_by,
+			classification.timestamp as classified, classification.disposition, classification.reason
 	   FROM alert
   LEFT JOIN classification ON (classification.alert_id = alert.id)
-  	   JOIN users on (users.id = classification.user_id)
+  LEFT JOIN users on (users.id = classification.user_id)
+  LEFT JOIN classification_rule ON (classification_rule.id = classification.rule_id)
        JOIN (SELECT alert.id FROM alert
   LEFT JOIN classification ON (classification.alert_id = alert.id)
       WHERE classification.id IS NOT NULL
@@ -42,114 +44,374 @@ const SQL_ALERTS_CLASSIFIED string = `SELECT alert.*, users.username as classifi
 	 OFFSET $2) AS a ON a.id = alert.id
    ORDER BY alert.timestamp `
 
+const ALERT_FILTER_ANY int = -1
+const ALERT_ASSIGNEE_NONE int64 = 0
+
+// The formats of the timestamp filters, which can be a date or a date and time
+const ALERT_FILTER_DATE_FORMAT string = "2006/01/02"
+const ALERT_FILTER_TIMESTAMP_FORMAT string = "2006/01/02 15:04"
+
+// ##### Variables ############################################################
+
+// The columns that the alerts can be sorted by
+var ALERT_SORT_COLUMNS = map[string]string{
+	"timestamp":  "alert.timestamp",
+	"domain":     "alert.domain",
+	"host":       "alert.host",
+	"location":   "alert.location",
+	"item_name":  "alert.item_name",
+	"profile":    "alert.profile",
+	"state":      "COALESCE(alert_state.state, 0)",
+	"prevalence": SQL_PREVALENCE_SORT,
+}
+
+// ##### Structs ##############################################################
+
+// AlertFilter contains the filters and sort order for the open (unclassified) alerts. The
+// text fields are case insensitive and are ignored if empty. The exact matches are used by
+// the bulk classification, and the substring matches (which can include * and ? wildcards)
+// by the alerts view
+type AlertFilter struct {
+	Verified     int
+	State        int   // ALERT_FILTER_ANY or one of the open states
+	Assignee     int64 // ALERT_FILTER_ANY, ALERT_ASSIGNEE_NONE or a user ID
+	Sha256       string
+	Signer       string
+	ItemName     string
+	Host         string
+	Location     string
+	Domain       string
+	HostLike     string
+	LocationLike string
+	SignerLike   string
+	From         *time.Time
+	To           *time.Time
+	GroupKeys    []string   // The alert groups (see SQL_ALERT_GROUP_KEY)
+	Scope        *HostScope // The host group and/or tag, which is optional
+	Sort         string     // One of ALERT_SORT_COLUMNS, defaults to the timestamp
+	Descending   bool
+}
+
 // ##### Methods ##############################################################
 
-//
-func routeAlerts(c *gin.Context) {
+// processAlertFilter validates the filter parameters, using the defaults (all open alerts) for invalid values
+func processAlertFilter(verified string, state string, assignee string) *AlertFilter {
+
+	f := &AlertFilter{Verified: VERIFIED_ALL, State: ALERT_FILTER_ANY, Assignee: int64(ALERT_FILTER_ANY)}
 
-	numRecsPerPage, successful := processIntParameter(c.PostForm("num_recs_per_page"))
-	if successful == false {
-		numRecsPerPage = 10
+	v, successful := processIntParameter(verified)
+	if successful == true && v >= VERIFIED_ALL && v <= VERIFIED_MS {
+		f.Verified = v
 	}
 
-	verified, successful := processIntParameter(c.PostForm("verified"))
-	if successful == false {
-		numRecsPerPage = 10
+	st, successful := processIntParameter(state)
+	if successful == true && (AlertState(st) == ALERT_STATE_NEW || AlertState(st) == ALERT_STATE_INVESTIGATING) {
+		f.State = st
 	}
 
-	// Appears to be the first request to send the initial set of data
-	if verified != VERIFIED_ALL &&
-		verified != VERIFIED_TRUE &&
-		verified != VERIFIED_FALSE &&
-		verified != VERIFIED_MS {
+	a, successful := processInt64Parameter(assignee)
+	if successful == true && a >= ALERT_ASSIGNEE_NONE {
+		f.Assignee = a
+	}
 
-		loadAlertData(c, 0, numRecsPerPage, VERIFIED_ALL, "")
-		return
+	return f
+}
+
+// processAlertViewFilter returns the filter and sort order for the alerts view, along with the
+// values so that they can be redisplayed. The parameters are read using the supplied function
+// e.g. from the query string or POST form. An error is returned if the host scope is invalid
+func processAlertViewFilter(param func(string) string) (*AlertFilter, gin.H, error) {
+
+	f := processAlertFilter(param("verified"), param("state"), param("assignee"))
+	f.Domain = strings.TrimSpace(param("domain"))
+	f.HostLike = strings.TrimSpace(param("host"))
+	f.LocationLike = strings.TrimSpace(param("location"))
+	f.SignerLike = strings.TrimSpace(param("signer"))
+	f.From = processTimestampParameter(param("from"), false)
+	f.To = processTimestampParameter(param("to"), true)
+
+	var scopeErr error
+	f.Scope, scopeErr = processHostScope(param)
+
+	f.Sort = "timestamp"
+	_, exists := ALERT_SORT_COLUMNS[param("sort")]
+	if exists == true {
+		f.Sort = param("sort")
 	}
+	f.Descending = param("dir") == "desc"
 
-	mode, hasMode := c.GetPostForm("mode")
+	direction := "asc"
+	if f.Descending == true {
+		direction = "desc"
+	}
 
-	// Appears to be the first request to send the initial set of data
-	if (mode != "first" &&
-		mode != "next" &&
-		mode != "previous" &&
-		mode != "classify") || hasMode == false {
+	values := gin.H{
+		"verified": f.Verified,
+		"state":    f.State,
+		"assignee": f.Assignee,
+		"domain":   f.Domain,
+		"host":     f.HostLike,
+		"location": f.LocationLike,
+		"signer":   f.SignerLike,
+		"from":     strings.TrimSpace(param("from")),
+		"to":       strings.TrimSpace(param("to")),
+		"sort":     f.Sort,
+		"dir":      direction,
+	}
 
-		loadAlertData(c, 0, numRecsPerPage, verified, "")
-		return
+	return f, values, scopeErr
+}
+
+// processTimestampParameter parses a date or a date and time, returning nil if invalid. The
+// end of a range is exclusive, so it is moved to the end of the day or minute supplied
+func processTimestampParameter(data string, end bool) *time.Time {
+
+	data = strings.TrimSpace(data)
+
+	t, err := time.Parse(ALERT_FILTER_TIMESTAMP_FORMAT, data)
+	if err == nil {
+		if end == true {
+			t = t.Add(time.Minute)
+		}
+		return &t
+	}
+
+	t, err = time.Parse(ALERT_FILTER_DATE_FORMAT, data)
+	if err == nil {
+		if end == true {
+			t = t.AddDate(0, 0, 1)
+		}
+		return &t
 	}
 
-	currentPageNumber := processCurrentPageNumber(c.PostForm("current_page_num"), mode)
+	return nil
+}
+
+// buildWhere returns the SQL WHERE clause for the filter. The args are the parameters
+// already used by the query e.g. the limit and offset
+func (f *AlertFilter) buildWhere(args []interface{}) (string, []interface{}) {
+
+	where := []string{"classification.id IS NULL"}
+
+	if f.Verified != VERIFIED_ALL {
+		args = append(args, f.Verified)
+		where = append(where, fmt.Sprintf("alert.verified = $%d", len(args)))
+	}
+
+	if f.State != ALERT_FILTER_ANY {
+		args = append(args, f.State)
+		where = append(where, fmt.Sprintf("COALESCE(alert_state.state, 0) = $%d", len(args)))
+	}
 
-	message := ""
-	if mode == "classify" {
-		// Ensure that we have some alert ID's to classify
-		ids, idsExist := c.GetPostForm("ids")
-		if idsExist == false {
+	if f.Assignee == ALERT_ASSIGNEE_NONE {
+		where = append(where, "alert_state.assigned_user_id IS NULL")
+	} else if f.Assignee > ALERT_ASSIGNEE_NONE {
+		args = append(args, f.Assignee)
+		where = append(where, fmt.Sprintf("alert_state.assigned_user_id = $%d", len(args)))
+	}
 
-			loadAlertData(c, currentPageNumber, numRecsPerPage, verified, "No alert's supplied for classification")
-			return
+	equals := []struct {
+		column string
+		value  string
+	}{
+		{"alert.sha256", f.Sha256},
+		{"alert.signer", f.Signer},
+		{"alert.item_name", f.ItemName},
+		{"alert.host", f.Host},
+		{"alert.location", f.Location},
+		{"alert.domain", f.Domain},
+	}
+
+	for _, e := range equals {
+		if len(e.value) == 0 {
+			continue
 		}
 
-		userID := getCookieInt64Value(c, "user_id")
-		if userID == -1 {
-			log.Println("Error retrieving user: invalid user ID")
-			goToErrorPage(c, "Unable to perform classification")
-			return
+		args = append(args, e.value)
+		where = append(where, fmt.Sprintf("LOWER(%s) = LOWER($%d)", e.column, len(args)))
+	}
+
+	likes := []struct {
+		column string
+		value  string
+	}{
+		{"alert.host", f.HostLike},
+		{"alert.location", f.LocationLike},
+		{"alert.signer", f.SignerLike},
+	}
+
+	for _, l := range likes {
+		if len(l.value) == 0 {
+			continue
 		}
 
-		message = performAlertClassification(userID, ids, false)
+		args = append(args, "%"+convertGlobToLike(l.value)+"%")
+		where = append(where, fmt.Sprintf("%s ILIKE $%d", l.column, len(args)))
+	}
+
+	if f.From != nil {
+		args = append(args, *f.From)
+		where = append(where, fmt.Sprintf("alert.timestamp >= $%d", len(args)))
+	}
+
+	if f.To != nil {
+		args = append(args, *f.To)
+		where = append(where, fmt.Sprintf("alert.timestamp < $%d", len(args)))
+	}
+
+	if len(f.GroupKeys) > 0 {
+		args = append(args, strings.Join(f.GroupKeys, ","))
+		where = append(where, fmt.Sprintf("%s = ANY(string_to_array($%d, ','))", SQL_ALERT_GROUP_KEY, len(args)))
+	}
+
+	if f.Scope != nil && f.Scope.IsSet() == true {
+		var scope string
+		scope, args = f.Scope.buildWhere("alert.domain", "alert.host", args)
+		where = append(where, scope)
+	}
+
+	return strings.Join(where, " AND "), args
+}
+
+// keyset returns the sort order of the filter. The ID ensures that the order is stable across pages
+func (f *AlertFilter) keyset() *Keyset {
+
+	column, exists := ALERT_SORT_COLUMNS[f.Sort]
+	if exists == false {
+		column = ALERT_SORT_COLUMNS["timestamp"]
+	}
+
+	if f.Sort == "prevalence" && f.Descending == true {
+		column = SQL_PREVALENCE_SORT_DESC
+	}
+
+	return &Keyset{Columns: []string{column, "alert.id"}, Descending: f.Descending}
+}
+
+// routeAlerts displays the open alerts. The filters and paging are sent using GET so that the
+// views can be bookmarked, whereas the classification is POSTed along with the same parameters
+func routeAlerts(c *gin.Context) {
+
+	param := c.Query
+	if c.Request.Method == http.MethodPost {
+		param = c.PostForm
+	}
+
+	filter, values, err := processAlertViewFilter(param)
+	paging := processPaging(param)
+
+	if err != nil {
+		loadAlertData(c, paging, filter, values, err.Error())
+		return
+	}
+
+	// Classification changes data so must be POSTed
+	mode := param("mode")
+	if mode != "classify" || c.Request.Method != http.MethodPost {
+		loadAlertData(c, paging, filter, values, "")
+		return
+	}
+
+	// Ensure that we have some alert ID's to classify
+	ids, idsExist := c.GetPostForm("ids")
+	if idsExist == false {
+
+		loadAlertData(c, paging, filter, values, "No alert's supplied for classification")
+		return
+	}
+
+	disposition := AlertState(convertStringToInt16(c.PostForm("disposition")))
+	if disposition.IsDisposition() == false {
+		loadAlertData(c, paging, filter, values, "Invalid disposition")
+		return
+	}
+
+	userID := getCookieInt64Value(c, "user_id")
+	if userID == -1 {
+		log.Println("Error retrieving user: invalid user ID")
+		goToErrorPage(c, "Unable to perform classification")
+		return
 	}
 
-	loadAlertData(c, currentPageNumber, numRecsPerPage, verified, message)
+	message := performAlertClassification(c, userID, ids, false, disposition, strings.TrimSpace(c.PostForm("reason")))
+
+	loadAlertData(c, paging, filter, values, message)
 }
 
 //
 func loadAlertData(
 	c *gin.Context,
-	currentPageNumber int,
-	numRecsPerPage int,
-	verified int, error string) {
+	paging *Paging,
+	filter *AlertFilter,
+	values gin.H,
+	error string) {
 
-	errored, noMoreRecords, data := getAlerts(numRecsPerPage, currentPageNumber, verified)
+	errored, data := getAlerts(paging, filter)
 	if errored == true {
 		c.String(http.StatusInternalServerError, "")
 		return
 	}
 
-	c.HTML(http.StatusOK, "alerts", gin.H{
-		"current_page_num":  currentPageNumber,
-		"num_recs_per_page": numRecsPerPage,
-		"no_more_records":   noMoreRecords,
-		"verified":          verified,
-		"data":              data,
-		"error":             error,
-	})
+	users, err := getUsers()
+	if err != nil {
+		log.Printf("Error loading users for alerts: %v\n", err)
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	values["current_page_num"] = paging.Number
+	values["num_recs_per_page"] = paging.Size
+	values["paging"] = paging
+	values["users"] = users
+	values["data"] = data
+	values["error"] = error
+
+	err = filter.Scope.setTemplateValues(values)
+	if err != nil {
+		log.Printf("Error loading host groups and tags for alerts: %v\n", err)
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	c.HTML(http.StatusOK, "alerts", getTemplateData(c, values))
 }
 
-//
-func getAlerts(numRecsPerPage int, currentPageNumber int, verified int) (bool, bool, []*Alert) {
+// getAlerts returns a page of the open alerts that match the filter, and sets the total and cursors of the page
+func getAlerts(paging *Paging, filter *AlertFilter) (bool, []*Alert) {
 
 	var data []*Alert
-	var err error
 
-	if verified == VERIFIED_ALL {
-		err = db.SQL(SQL_ALERTS_UNCLASSIFIED, numRecsPerPage+1, numRecsPerPage*currentPageNumber).QueryStructs(&data)
-	} else {
-		err = db.SQL(SQL_ALERTS_UNCLASSIFIED_FILTERED, numRecsPerPage+1, numRecsPerPage*currentPageNumber, verified).QueryStructs(&data)
+	where, args := filter.buildWhere(nil)
+
+	total, exact, err := countRecords(fmt.Sprintf("SELECT 1 "+SQL_BULK_MATCH, where), args)
+	if err != nil {
+		logger.Errorf("Error counting alerts: %v", err)
+		return true, data
 	}
+	paging.setTotal(total, exact)
 
+	keyset := filter.keyset()
+	cursor, orderBy, limit, args, err := keyset.page(paging, args)
+	if err != nil {
+		logger.Errorf("Error reading alerts cursor: %v", err)
+		return true, data
+	}
+
+	err = db.SQL(fmt.Sprintf(SQL_ALERTS_UNCLASSIFIED, where+" AND "+cursor, orderBy, prevalenceJoins("alert"), keyset.selectKey(), limit), args...).QueryStructs(&data)
 	if err != nil {
 		logger.Errorf("Error querying for alerts: %v", err)
-		return true, false, data
+		return true, data
 	}
 
+	data = data[:paging.trim(data, func(i int) string { return data[i].SortKey })]
+
 	// Perform some cleaning of the data, so that it displays better in the HTML
 	for _, v := range data {
 		v.LocationStr = template.HTML("<td class=\"poppy\" data-variation=\"basic\" data-content=\"" + v.Location + "\">" + splitRegKey(v.Location) + "</td>")
 		v.UtcTimeStr = v.UtcTime.Format("15:04:05 02/01/2006")
 		v.TextStr = template.HTML(v.Text)
 		v.LinkedStr = template.HTML(v.Linked)
+		v.StateString = AlertState(v.State).String()
 
 		if len(v.Linked) > 0 {
 			v.LinkedColumn = template.HTML("<td style=\"text-align:center\"><a href=\"#\" class=\"togglerLinked\" other-data=\"" + util.ConvertInt64ToString(v.Id) + "\"><i class=\"checkmark icon\"></i></a></td>")
@@ -158,19 +420,14 @@ func getAlerts(numRecsPerPage int, currentPageNumber int, verified int) (bool, b
 		}
 	}
 
-	noMoreRecords := false
-	if len(data) < numRecsPerPage+1 {
-		noMoreRecords = true
-	} else {
-		// Remove the last item in the slice/array
-		data = data[:len(data)-1]
-	}
-
-	return false, noMoreRecords, data
+	return false, data
 }
 
-//
-func performAlertClassification(userID int64, data string, delete bool) string {
+// performAlertClassification classifies the comma separated alert ID's with the
+// disposition and reason, or unclassifies them when delete is true. The audit
+// record is written within the same transaction, so that every change to the
+// classifications is recorded
+func performAlertClassification(c *gin.Context, userID int64, data string, delete bool, disposition AlertState, reason string) string {
 
 	ids := strings.Split(data, ",")
 	for _, id := range ids {
@@ -184,44 +441,64 @@ func performAlertClassification(userID int64, data string, delete bool) string {
 		logger.Errorf("Error starting classication transaction: %v", err)
 		return "Error performing classification"
 	}
+	defer tx.AutoRollback()
 
-	errorOccurred := false
+	// Existing classifications are replaced, so that the disposition of a classified alert can be changed
+	for _, id1 := range ids {
+		_, err = tx.
+			DeleteFrom("classification").
+			Where("alert_id = $1", id1).
+			Exec()
 
-	if delete == true {
-
-		for _, id1 := range ids {
-			_, err = db.
-				DeleteFrom("classification").
-				Where("alert_id = $1", id1).
-				Exec()
+		if err != nil {
+			logger.Errorf("Error deleting classification: %v (Alert: %s)", err, id1)
+			return "Error performing classification. Refresh the page"
+		}
+	}
 
+	// Unclassified alerts are marked as triaged, so that the classification rules do not reclassify them
+	if delete == true {
+		for _, id3 := range ids {
+			err = setAlertState(tx, util.ConvertStringToInt64(id3), ALERT_STATE_NEW, userID)
 			if err != nil {
-				errorOccurred = true
-				logger.Errorf("Error deleting classification: %v (Alert: %d)", err, id1)
-				break
+				logger.Errorf("Error resetting alert state: %v (Alert: %s)", err, id3)
+				return "Error performing classification. Refresh the page"
 			}
 		}
-	} else {
+	}
 
-		b := db.InsertInto("classification").Columns("alert_id", "user_id", "timestamp")
+	action := AUDIT_ALERT_UNCLASSIFY
+	details := ""
+	if delete == false {
+		action = AUDIT_ALERT_CLASSIFY
+		details = disposition.String()
+		if len(reason) > 0 {
+			details += ": " + reason
+		}
+
+		b := tx.InsertInto("classification").Columns("alert_id", "user_id", "timestamp", "disposition", "reason")
 
 		for _, id2 := range ids {
-			b.Values(id2, userID, time.Now().UTC().Format(time.RFC3339))
+			b.Values(id2, userID, time.Now().UTC().Format(time.RFC3339), int16(disposition), reason)
 		}
 
 		_, err = b.Exec()
 		if err != nil {
-			errorOccurred = true
 			logger.Errorf("Error inserting classification: %v", err)
+			return "Error performing classification. Refresh the page"
 		}
 	}
 
-	err = tx.Commit()
+	_, username := getAuditActor(c)
+	err = insertAuditEntry(tx, c, userID, username, action, AUDIT_TARGET_ALERT, data, details)
 	if err != nil {
-		logger.Errorf("Error commiting classication transaction: %v", err)
+		logger.Errorf("Error writing classification audit entry: %v", err)
+		return "Error performing classification. Refresh the page"
 	}
 
-	if errorOccurred == true {
+	err = tx.Commit()
+	if err != nil {
+		logger.Errorf("Error commiting classication transaction: %v", err)
 		return "Error performing classification. Refresh the page"
 	}
 
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	util "github.com/woanware/goutil"
+)
+
+// ##### Structs ##############################################################
+
+// Represents the body returned for any failed API request
+type ApiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// Represents a page of data returned from one of the paged API end-points. The total and
+// cursors are only returned by the end-points that support keyset paging
+type ApiPage struct {
+	CurrentPageNumber int         `json:"current_page_num"`
+	NumRecsPerPage    int         `json:"num_recs_per_page"`
+	NoMoreRecords     bool        `json:"no_more_records"`
+	Total             int64       `json:"total,omitempty"`
+	TotalExact        bool        `json:"total_exact,omitempty"`
+	NextCursor        string      `json:"next_cursor,omitempty"`
+	PreviousCursor    string      `json:"previous_cursor,omitempty"`
+	Data              interface{} `json:"data"`
+}
+
+// Represents the body of a classify/unclassify request. The disposition
+// defaults to benign if not supplied
+type ApiClassifyRequest struct {
+	Ids         []int64 `json:"ids"`
+	Disposition int16   `json:"disposition"`
+	Reason      string  `json:"reason"`
+}
+
+// ##### Methods ##############################################################
+
+// setupApiRoutes registers the versioned JSON API, which mirrors the HTML views
+func setupApiRoutes(router *gin.Engine) {
+
+	api := router.Group("/api/v1")
+	api.Use(ApiAuthorizeMiddleware())
+	{
+		api.GET("/alerts", routeApiAlerts)
+		api.GET("/classified", routeApiClassified)
+		api.POST("/classify", requireApiScope(TOKEN_SCOPE_CLASSIFY), routeApiClassify)
+		api.POST("/unclassify", requireApiScope(TOKEN_SCOPE_CLASSIFY), routeApiUnclassify)
+		api.GET("/hosts", routeApiHosts)
+		api.GET("/hosts/:host/autoruns", routeApiHostAutoruns)
+		api.GET("/hosts/:host/instances", routeApiHostInstances)
+		api.GET("/compare", routeApiCompare)
+		api.GET("/groups", routeApiGroups)
+		api.GET("/groups/:id/baseline", routeApiBaseline)
+		api.GET("/tags", routeApiTags)
+		api.GET("/inventory", routeApiInventory)
+		api.GET("/search", routeApiSearch)
+		api.GET("/exports", routeApiExports)
+		api.GET("/exports/:id", routeApiExportData)
+	}
+}
+
+// ApiAuthorizeMiddleware authorizes a request for the API end-point group, using
+// either an API token or the session cookie. Unlike AuthorizeMiddleware,
+// failures are returned as JSON rather than redirects
+func ApiAuthorizeMiddleware() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		token, exists := getBearerToken(c)
+		if exists == true {
+			if authorizeBearerToken(c, token) == true {
+				c.Next()
+			}
+			return
+		}
+
+		session, err := sessionStore.Get(c.Request, APP_NAME)
+		if err != nil {
+			abortApiRequest(c, http.StatusUnauthorized, "Not authenticated")
+			return
+		}
+
+		authed, ok := session.Values["authed"].(bool)
+		if ok == false || authed == false {
+			abortApiRequest(c, http.StatusUnauthorized, "Not authenticated")
+			return
+		}
+
+		mfaVerified, ok := session.Values["mfa_verified"].(bool)
+		if ok == false || mfaVerified == false {
+			abortApiRequest(c, http.StatusUnauthorized, "Two factor authentication not completed")
+			return
+		}
+
+		mustChangePassword, _ := session.Values["must_change_password"].(bool)
+		if mustChangePassword == true {
+			abortApiRequest(c, http.StatusForbidden, "Password must be changed")
+			return
+		}
+
+		userID := getCookieInt64Value(c, "user_id")
+		if userID == -1 {
+			abortApiRequest(c, http.StatusUnauthorized, "Not authenticated")
+			return
+		}
+
+		// Requests authorized by the session cookie must also supply the CSRF token,
+		// since the browser sends the cookie with cross-site requests
+		if isSafeMethod(c.Request.Method) == false {
+			token, _ := session.Values[CSRF_FIELD_NAME].(string)
+			if isValidCsrfToken(c.GetHeader(CSRF_HEADER_NAME), token) == false {
+				abortApiRequest(c, http.StatusForbidden, "Invalid CSRF token")
+				return
+			}
+		}
+
+		username, _ := session.Values["username"].(string)
+		c.Set("user_id", userID)
+		c.Set("username", username)
+		c.Set("account_type", getAccountType(c).String())
+		c.Next()
+	}
+}
+
+// abortApiRequest stops the handler chain and returns a consistent JSON error body
+func abortApiRequest(c *gin.Context, status int, message string) {
+
+	c.AbortWithStatusJSON(status, gin.H{"error": ApiError{Status: status, Message: message}})
+}
+
+// processApiPaging returns the page number and records per page from the query string
+func processApiPaging(c *gin.Context) (int, int, bool) {
+
+	currentPageNumber := 0
+	if len(c.Query("page")) > 0 {
+		page, successful := processIntParameter(c.Query("page"))
+		if successful == false || page < 0 {
+			return 0, 0, false
+		}
+		currentPageNumber = page
+	}
+
+	numRecsPerPage := 10
+	if len(c.Query("num_recs_per_page")) > 0 {
+		num, successful := processIntParameter(c.Query("num_recs_per_page"))
+		if successful == false || num < 1 || num > 1000 {
+			return 0, 0, false
+		}
+		numRecsPerPage = num
+	}
+
+	return currentPageNumber, numRecsPerPage, true
+}
+
+// processApiKeysetPaging returns the paging parameters from the query string. The after and before
+// parameters are the next_cursor and previous_cursor of a page, in which case the page parameter is
+// optional and is the number of the page being requested. Otherwise the page is jumped to
+func processApiKeysetPaging(c *gin.Context) (*Paging, bool) {
+
+	currentPageNumber, numRecsPerPage, successful := processApiPaging(c)
+	if successful == false {
+		return nil, false
+	}
+
+	paging := &Paging{Mode: "first", Number: currentPageNumber, Size: numRecsPerPage}
+
+	if len(c.Query("after")) > 0 {
+		paging.Mode = "next"
+		paging.Cursor = c.Query("after")
+	} else if len(c.Query("before")) > 0 {
+		paging.Mode = "previous"
+		paging.Cursor = c.Query("before")
+	} else if currentPageNumber > 0 {
+		if currentPageNumber >= PAGING_JUMP_MAX {
+			return nil, false
+		}
+		paging.Mode = "page"
+	}
+
+	return paging, true
+}
+
+// newApiPage returns the API representation of a page that was read using keyset paging
+func newApiPage(paging *Paging, data interface{}) ApiPage {
+
+	p := ApiPage{
+		CurrentPageNumber: paging.Number,
+		NumRecsPerPage:    paging.Size,
+		NoMoreRecords:     paging.HasNext == false,
+		Total:             paging.Total,
+		TotalExact:        paging.TotalExact,
+		Data:              data,
+	}
+
+	if paging.HasNext == true {
+		p.NextCursor = paging.LastCursor
+	}
+
+	if paging.HasPrevious == true {
+		p.PreviousCursor = paging.FirstCursor
+	}
+
+	return p
+}
+
+//
+func routeApiAlerts(c *gin.Context) {
+
+	paging, successful := processApiKeysetPaging(c)
+	if successful == false {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid paging parameters")
+		return
+	}
+
+	verified := VERIFIED_ALL
+	if len(c.Query("verified")) > 0 {
+		verified, successful = processIntParameter(c.Query("verified"))
+		if successful == false || verified > VERIFIED_MS {
+			abortApiRequest(c, http.StatusBadRequest, "Invalid verified parameter")
+			return
+		}
+	}
+
+	filter, _, err := processAlertViewFilter(c.Query)
+	if err != nil {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid group parameter")
+		return
+	}
+	if processOrderParameter(c.Query("order")) == ORDER_PREVALENCE {
+		filter.Sort = "prevalence"
+		filter.Descending = false
+	}
+	filter.Verified = verified
+
+	errored, data := getAlerts(paging, filter)
+	if errored == true {
+		abortApiRequest(c, http.StatusInternalServerError, "Error retrieving alerts")
+		return
+	}
+
+	c.JSON(http.StatusOK, newApiPage(paging, data))
+}
+
+//
+func routeApiClassified(c *gin.Context) {
+
+	currentPageNumber, numRecsPerPage, successful := processApiPaging(c)
+	if successful == false {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid paging parameters")
+		return
+	}
+
+	errored, noMoreRecords, data := getClassifiedAlerts(numRecsPerPage, currentPageNumber)
+	if errored == true {
+		abortApiRequest(c, http.StatusInternalServerError, "Error retrieving classified alerts")
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiPage{
+		CurrentPageNumber: currentPageNumber,
+		NumRecsPerPage:    numRecsPerPage,
+		NoMoreRecords:     noMoreRecords,
+		Data:              data,
+	})
+}
+
+//
+func routeApiClassify(c *gin.Context) {
+
+	performApiClassification(c, false)
+}
+
+//
+func routeApiUnclassify(c *gin.Context) {
+
+	performApiClassification(c, true)
+}
+
+// performApiClassification validates the JSON list of alert ID's and (un)classifies them
+func performApiClassification(c *gin.Context, delete bool) {
+
+	var req ApiClassifyRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if len(req.Ids) == 0 {
+		abortApiRequest(c, http.StatusBadRequest, "No alert's supplied for classification")
+		return
+	}
+
+	ids := make([]string, 0, len(req.Ids))
+	for _, id := range req.Ids {
+		if id < 1 {
+			abortApiRequest(c, http.StatusBadRequest, "Invalid alert ID")
+			return
+		}
+		ids = append(ids, convertInt64ToString(id))
+	}
+
+	disposition := AlertState(req.Disposition)
+	if disposition == ALERT_STATE_NEW {
+		disposition = ALERT_STATE_BENIGN
+	}
+
+	if delete == false && disposition.IsDisposition() == false {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid disposition")
+		return
+	}
+
+	message := performAlertClassification(c, c.GetInt64("user_id"), strings.Join(ids, ","), delete, disposition, strings.TrimSpace(req.Reason))
+	if len(message) > 0 {
+		abortApiRequest(c, http.StatusInternalServerError, message)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ids": req.Ids})
+}
+
+//
+func routeApiHosts(c *gin.Context) {
+
+	hosts, err := getHosts(c.Query("host"))
+	if err != nil {
+		logger.Errorf("Error retrieving hosts for API: %v (%s)", err, c.Query("host"))
+		abortApiRequest(c, http.StatusInternalServerError, "Error retrieving hosts")
+		return
+	}
+
+	data := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		data = append(data, h.Host)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": data})
+}
+
+//
+func routeApiInventory(c *gin.Context) {
+
+	paging, successful := processApiKeysetPaging(c)
+	if successful == false {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid paging parameters")
+		return
+	}
+
+	filter, _, err := processHostFilter(c.Query)
+	if err != nil {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid group parameter")
+		return
+	}
+
+	errored, data := getHostInventory(paging, filter)
+	if errored == true {
+		abortApiRequest(c, http.StatusInternalServerError, "Error retrieving host inventory")
+		return
+	}
+
+	c.JSON(http.StatusOK, newApiPage(paging, data))
+}
+
+//
+func routeApiHostAutoruns(c *gin.Context) {
+
+	host := c.Param("host")
+
+	paging, successful := processApiKeysetPaging(c)
+	if successful == false {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid paging parameters")
+		return
+	}
+
+	var instanceID int64
+	if len(c.Query("instance")) > 0 {
+		instanceID, successful = processInt64Parameter(c.Query("instance"))
+		if successful == false {
+			abortApiRequest(c, http.StatusBadRequest, "Invalid instance parameter")
+			return
+		}
+	} else {
+		instanceID = getInstanceFromHost(host)
+		if instanceID == -1 {
+			abortApiRequest(c, http.StatusNotFound, "Host not found")
+			return
+		}
+	}
+
+	errored, data := getPagedSingleHostAutoruns(instanceID, paging, processOrderParameter(c.Query("order")))
+	if errored == true {
+		abortApiRequest(c, http.StatusInternalServerError, "Error retrieving host autoruns")
+		return
+	}
+
+	page := newApiPage(paging, data)
+	c.JSON(http.StatusOK, gin.H{
+		"host":              host,
+		"instance":          instanceID,
+		"current_page_num":  page.CurrentPageNumber,
+		"num_recs_per_page": page.NumRecsPerPage,
+		"no_more_records":   page.NoMoreRecords,
+		"total":             page.Total,
+		"total_exact":       page.TotalExact,
+		"next_cursor":       page.NextCursor,
+		"previous_cursor":   page.PreviousCursor,
+		"data":              page.Data,
+	})
+}
+
+//
+func routeApiHostInstances(c *gin.Context) {
+
+	paging, successful := processApiKeysetPaging(c)
+	if successful == false {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid paging parameters")
+		return
+	}
+
+	errored, data := getHostInstances(c.Param("host"), paging)
+	if errored == true {
+		abortApiRequest(c, http.StatusInternalServerError, "Error retrieving host instances")
+		return
+	}
+
+	c.JSON(http.StatusOK, newApiPage(paging, data))
+}
+
+//
+func routeApiCompare(c *gin.Context) {
+
+	fromID, successful := processInt64Parameter(c.Query("from"))
+	if successful == false {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid from parameter")
+		return
+	}
+
+	toID, successful := processInt64Parameter(c.Query("to"))
+	if successful == false {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid to parameter")
+		return
+	}
+
+	comparison, message := getInstanceComparison(fromID, toID)
+	if len(message) > 0 {
+		abortApiRequest(c, http.StatusBadRequest, message)
+		return
+	}
+
+	c.JSON(http.StatusOK, comparison)
+}
+
+//
+func routeApiGroups(c *gin.Context) {
+
+	data, err := getHostGroups()
+	if err != nil {
+		logger.Errorf("Error retrieving groups for API: %v", err)
+		abortApiRequest(c, http.StatusInternalServerError, "Error retrieving groups")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": data})
+}
+
+//
+func routeApiTags(c *gin.Context) {
+
+	data, err := getTags()
+	if err != nil {
+		logger.Errorf("Error retrieving tags for API: %v", err)
+		abortApiRequest(c, http.StatusInternalServerError, "Error retrieving tags")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": data})
+}
+
+//
+func routeApiBaseline(c *gin.Context) {
+
+	id, successful := processInt64Parameter(c.Param("id"))
+	if successful == false {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid group")
+		return
+	}
+
+	g, err := NewHostGroupByID(id)
+	if err != nil {
+		abortApiRequest(c, http.StatusNotFound, "Group not found")
+		return
+	}
+
+	comparison, message := getBaselineComparison(g, c.Query("host"))
+	if len(message) > 0 {
+		abortApiRequest(c, http.StatusBadRequest, message)
+		return
+	}
+
+	c.JSON(http.StatusOK, comparison)
+}
+
+//
+func routeApiSearch(c *gin.Context) {
+
+	paging, successful := processApiKeysetPaging(c)
+	if successful == false {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid paging parameters")
+		return
+	}
+
+	dataType, successful := processIntParameter(c.Query("data_type"))
+	if successful == false || dataType < DATA_TYPE_ALERTS || dataType > DATA_TYPE_AUTORUNS {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid data_type parameter")
+		return
+	}
+
+	searchType, successful := processIntParameter(c.Query("search_type"))
+	if successful == false || searchType < SEARCH_TYPE_FILE_PATH || searchType > SEARCH_TYPE_MD5 {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid search_type parameter")
+		return
+	}
+
+	searchValue := c.Query("search_value")
+	if len(searchValue) == 0 {
+		abortApiRequest(c, http.StatusBadRequest, "No search_value supplied")
+		return
+	}
+
+	scope, err := processHostScope(c.Query)
+	if err != nil {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid group parameter")
+		return
+	}
+
+	writeAudit(c, AUDIT_SEARCH, AUDIT_TARGET_NONE, "", formatSearchAudit(dataType, searchType, searchValue, paging.Number, scope))
+
+	errored, data := getSearch(dataType, searchType, searchValue, paging, processOrderParameter(c.Query("order")), scope)
+	if errored == true {
+		abortApiRequest(c, http.StatusInternalServerError, "Error performing search")
+		return
+	}
+
+	c.JSON(http.StatusOK, newApiPage(paging, data))
+}
+
+//
+func routeApiExports(c *gin.Context) {
+
+	exportType, successful := processIntParameter(c.Query("export_type"))
+	if successful == false || exportType < EXPORT_TYPE_SHA256 || exportType > EXPORT_TYPE_HOST {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid export_type parameter")
+		return
+	}
+
+	errored, data := getExports(exportType)
+	if errored == true {
+		abortApiRequest(c, http.StatusInternalServerError, "Error retrieving exports")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": data})
+}
+
+//
+func routeApiExportData(c *gin.Context) {
+
+	id, successful := processInt64Parameter(c.Param("id"))
+	if successful == false || id < 1 {
+		abortApiRequest(c, http.StatusBadRequest, "Invalid export ID")
+		return
+	}
+
+	errored, export := getExport(id)
+	if errored == true {
+		abortApiRequest(c, http.StatusNotFound, "Export not found")
+		return
+	}
+
+	if util.DoesFileExist(path.Join(config.ExportDir, export.FileName)) == false {
+		logger.Errorf("Export file does not exist: %s", export.FileName)
+		abortApiRequest(c, http.StatusNotFound, "Export file not found")
+		return
+	}
+
+	data, err := util.ReadTextFromFile(path.Join(config.ExportDir, export.FileName))
+	if err != nil {
+		logger.Errorf("Error reading export file: %v (%s)", err, export.FileName)
+		abortApiRequest(c, http.StatusInternalServerError, "Error reading export file")
+		return
+	}
+
+	writeAudit(c, AUDIT_EXPORT_DOWNLOAD, AUDIT_TARGET_EXPORT, convertInt64ToString(id), export.FileName)
+
+	c.Header("Content-Disposition", "attachment; filename=\""+export.FileName+"\"")
+	c.Data(http.StatusOK, "text/csv", []byte(data))
+}
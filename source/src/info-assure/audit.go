@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	runner "gopkg.in/mgutz/dat.v1/sqlx-runner"
+)
+
+// ##### Constants ############################################################
+
+// Audit actions
+const (
+	AUDIT_LOGON_SUCCESS           string = "logon_success"
+	AUDIT_LOGON_FAILURE           string = "logon_failure"
+	AUDIT_LOGON_LOCKOUT           string = "logon_lockout"
+	AUDIT_LOGOUT                  string = "logout"
+	AUDIT_MFA_ENROLL              string = "mfa_enroll"
+	AUDIT_MFA_VERIFY_SUCCESS      string = "mfa_verify_success"
+	AUDIT_MFA_VERIFY_FAILURE      string = "mfa_verify_failure"
+	AUDIT_MFA_RECOVERY_GENERATE   string = "mfa_recovery_generate"
+	AUDIT_MFA_RESET               string = "mfa_reset"
+	AUDIT_WEBAUTHN_ADD            string = "webauthn_add"
+	AUDIT_WEBAUTHN_DELETE         string = "webauthn_delete"
+	AUDIT_ALERT_CLASSIFY          string = "alert_classify"
+	AUDIT_ALERT_UNCLASSIFY        string = "alert_unclassify"
+	AUDIT_ALERT_BULK_CLASSIFY     string = "alert_bulk_classify"
+	AUDIT_ALERT_STATE             string = "alert_state"
+	AUDIT_ALERT_ASSIGN            string = "alert_assign"
+	AUDIT_ALERT_COMMENT           string = "alert_comment"
+	AUDIT_RULE_CREATE             string = "rule_create"
+	AUDIT_RULE_EDIT               string = "rule_edit"
+	AUDIT_RULE_DELETE             string = "rule_delete"
+	AUDIT_RULE_APPLY              string = "rule_apply"
+	AUDIT_USER_CREATE             string = "user_create"
+	AUDIT_USER_EDIT               string = "user_edit"
+	AUDIT_USER_LOCK               string = "user_lock"
+	AUDIT_USER_UNLOCK             string = "user_unlock"
+	AUDIT_USER_DELETE             string = "user_delete"
+	AUDIT_USER_PASSWORD_RESET     string = "user_password_reset"
+	AUDIT_USER_LOGOUT             string = "user_logout"
+	AUDIT_PASSWORD_CHANGE         string = "password_change"
+	AUDIT_PASSWORD_CHANGE_FAILURE string = "password_change_failure"
+	AUDIT_SESSION_REVOKE          string = "session_revoke"
+	AUDIT_API_TOKEN_CREATE        string = "api_token_create"
+	AUDIT_API_TOKEN_REVOKE        string = "api_token_revoke"
+	AUDIT_EXPORT_DOWNLOAD         string = "export_download"
+	AUDIT_SINGLE_HOST_DOWNLOAD    string = "single_host_download"
+	AUDIT_COMPARE_DOWNLOAD        string = "compare_download"
+	AUDIT_GROUP_CREATE            string = "group_create"
+	AUDIT_GROUP_EDIT              string = "group_edit"
+	AUDIT_GROUP_DELETE            string = "group_delete"
+	AUDIT_GROUP_BASELINE          string = "group_baseline"
+	AUDIT_BASELINE_DOWNLOAD       string = "baseline_download"
+	AUDIT_HOST_TAG                string = "host_tag"
+	AUDIT_SEARCH                  string = "search"
+)
+
+var AUDIT_ACTIONS = []string{
+	AUDIT_LOGON_SUCCESS,
+	AUDIT_LOGON_FAILURE,
+	AUDIT_LOGON_LOCKOUT,
+	AUDIT_LOGOUT,
+	AUDIT_MFA_ENROLL,
+	AUDIT_MFA_VERIFY_SUCCESS,
+	AUDIT_MFA_VERIFY_FAILURE,
+	AUDIT_MFA_RECOVERY_GENERATE,
+	AUDIT_MFA_RESET,
+	AUDIT_WEBAUTHN_ADD,
+	AUDIT_WEBAUTHN_DELETE,
+	AUDIT_ALERT_CLASSIFY,
+	AUDIT_ALERT_UNCLASSIFY,
+	AUDIT_ALERT_BULK_CLASSIFY,
+	AUDIT_ALERT_STATE,
+	AUDIT_ALERT_ASSIGN,
+	AUDIT_ALERT_COMMENT,
+	AUDIT_RULE_CREATE,
+	AUDIT_RULE_EDIT,
+	AUDIT_RULE_DELETE,
+	AUDIT_RULE_APPLY,
+	AUDIT_USER_CREATE,
+	AUDIT_USER_EDIT,
+	AUDIT_USER_LOCK,
+	AUDIT_USER_UNLOCK,
+	AUDIT_USER_DELETE,
+	AUDIT_USER_PASSWORD_RESET,
+	AUDIT_USER_LOGOUT,
+	AUDIT_PASSWORD_CHANGE,
+	AUDIT_PASSWORD_CHANGE_FAILURE,
+	AUDIT_SESSION_REVOKE,
+	AUDIT_API_TOKEN_CREATE,
+	AUDIT_API_TOKEN_REVOKE,
+	AUDIT_EXPORT_DOWNLOAD,
+	AUDIT_SINGLE_HOST_DOWNLOAD,
+	AUDIT_COMPARE_DOWNLOAD,
+	AUDIT_GROUP_CREATE,
+	AUDIT_GROUP_EDIT,
+	AUDIT_GROUP_DELETE,
+	AUDIT_GROUP_BASELINE,
+	AUDIT_BASELINE_DOWNLOAD,
+	AUDIT_HOST_TAG,
+	AUDIT_SEARCH,
+}
+
+// Audit target types
+const (
+	AUDIT_TARGET_NONE      string = ""
+	AUDIT_TARGET_ALERT     string = "alert"
+	AUDIT_TARGET_USER      string = "user"
+	AUDIT_TARGET_SESSION   string = "session"
+	AUDIT_TARGET_API_TOKEN string = "api_token"
+	AUDIT_TARGET_WEBAUTHN  string = "webauthn_credential"
+	AUDIT_TARGET_EXPORT    string = "export"
+	AUDIT_TARGET_INSTANCE  string = "instance"
+	AUDIT_TARGET_RULE      string = "classification_rule"
+	AUDIT_TARGET_GROUP     string = "host_group"
+	AUDIT_TARGET_HOST      string = "host"
+)
+
+// Second factor methods, recorded within the MFA audit details
+const (
+	MFA_METHOD_TOTP          string = "totp"
+	MFA_METHOD_RECOVERY_CODE string = "recovery_code"
+	MFA_METHOD_WEBAUTHN      string = "webauthn"
+)
+
+const AUDIT_PAGE_SIZE int = 50
+const AUDIT_DOWNLOAD_MAX_RECORDS int = 100000
+
+// ##### Structs ##############################################################
+
+// Represents an "audit_log" record. The table is append only, which is enforced
+// by the database, and the actor's username is stored so that the record is
+// still meaningful once the user has been deleted
+type AuditEntry struct {
+	ID              int64     `db:"id" json:"id"`
+	Timestamp       time.Time `db:"timestamp" json:"timestamp"`
+	UserID          *int64    `db:"user_id" json:"user_id"`
+	Username        string    `db:"username" json:"username"`
+	IpAddress       string    `db:"ip_address" json:"ip_address"`
+	Action          string    `db:"action" json:"action"`
+	TargetType      string    `db:"target_type" json:"target_type"`
+	TargetIDs       string    `db:"target_ids" json:"target_ids"`
+	Details         string    `db:"details" json:"details"`
+	TimestampString string    `db:"-" json:"-"`
+}
+
+// AuditFilter contains the optional filters for the audit view and downloads
+type AuditFilter struct {
+	Username string
+	Action   string
+	TargetID string
+	From     *time.Time
+	To       *time.Time
+}
+
+// ##### Methods ##############################################################
+
+// getAuditActor returns the user performing the request. API token requests set
+// the user within the context, otherwise the user is taken from the session
+func getAuditActor(c *gin.Context) (int64, string) {
+
+	if value, exists := c.Get("user_id"); exists == true {
+		return value.(int64), c.GetString("username")
+	}
+
+	session, err := sessionStore.Get(c.Request, APP_NAME)
+	if err != nil {
+		return -1, ""
+	}
+
+	userID, _ := session.Values["user_id"].(int64)
+	username, _ := session.Values["username"].(string)
+	if userID == 0 {
+		userID = -1
+	}
+
+	return userID, username
+}
+
+// writeAudit records an action performed by the current user
+func writeAudit(c *gin.Context, action string, targetType string, targetIDs string, details string) {
+
+	userID, username := getAuditActor(c)
+	writeAuditFor(c, userID, username, action, targetType, targetIDs, details)
+}
+
+// writeAuditFor records an action performed by a specific user, which is used
+// before the session has been authenticated e.g. failed logons
+func writeAuditFor(c *gin.Context, userID int64, username string, action string, targetType string, targetIDs string, details string) {
+
+	err := insertAuditEntry(db, c, userID, username, action, targetType, targetIDs, details)
+	if err != nil {
+		log.Printf("Error writing audit entry: %v (%s %s %s)\n", err, username, action, targetIDs)
+	}
+}
+
+// insertAuditEntry inserts the audit record using the connection, so that the
+// record can be part of the transaction that performed the action
+func insertAuditEntry(
+	conn runner.Connection,
+	c *gin.Context,
+	userID int64,
+	username string,
+	action string,
+	targetType string,
+	targetIDs string,
+	details string) error {
+
+	var actor *int64
+	if userID > 0 {
+		actor = &userID
+	}
+
+	// There is no request for the actions performed by the server e.g. scheduled rules
+	ipAddress := ""
+	if c != nil {
+		ipAddress = getRequestIp(c.Request)
+	}
+
+	_, err := conn.
+		InsertInto("audit_log").
+		Columns("timestamp", "user_id", "username", "ip_address", "action", "target_type", "target_ids", "details").
+		Values(time.Now().UTC(), actor, username, ipAddress, action, targetType, targetIDs, details).
+		Exec()
+
+	return err
+}
+
+// auditFailedAttempt counts a failed logon or MFA attempt towards the account
+// lockout, recording the attempt and the lockout if the account is now locked
+func auditFailedAttempt(c *gin.Context, u *User, action string, details string) {
+
+	locked := u.Locked
+	u.IncrementLoginAttempts()
+	writeAuditFor(c, u.ID, u.Username, action, AUDIT_TARGET_USER, convertInt64ToString(u.ID), details)
+
+	if locked == false && u.Locked == true {
+		writeAuditFor(c, u.ID, u.Username, AUDIT_LOGON_LOCKOUT, AUDIT_TARGET_USER, convertInt64ToString(u.ID),
+			fmt.Sprintf("Locked after %d failed attempts", config.MaxFailedLogins))
+	}
+}
+
+// formatSearchAudit returns the audit details for a search
+func formatSearchAudit(dataType int, searchType int, searchValue string, currentPageNumber int, scope *HostScope) string {
+
+	details := fmt.Sprintf("Data Type: %d, Search Type: %d, Value: %s, Page: %d", dataType, searchType, searchValue, currentPageNumber)
+	if scope.IsSet() == true {
+		details += ", " + scope.String()
+	}
+
+	return details
+}
+
+// parseAuditFilter extracts the filters from the query string. Dates are in the
+// format used by the date picker (YYYY/MM/DD), and the "to" date is inclusive
+func parseAuditFilter(c *gin.Context) *AuditFilter {
+
+	f := new(AuditFilter)
+	f.Username = strings.TrimSpace(c.Query("username"))
+	f.Action = strings.TrimSpace(c.Query("action"))
+	f.TargetID = strings.TrimSpace(c.Query("target_id"))
+
+	from, err := time.Parse("2006/01/02", strings.TrimSpace(c.Query("from")))
+	if err == nil {
+		f.From = &from
+	}
+
+	to, err := time.Parse("2006/01/02", strings.TrimSpace(c.Query("to")))
+	if err == nil {
+		to = to.AddDate(0, 0, 1)
+		f.To = &to
+	}
+
+	return f
+}
+
+// buildWhere returns the SQL WHERE clause and arguments for the filter
+func (f *AuditFilter) buildWhere() (string, []interface{}) {
+
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+
+	if len(f.Username) > 0 {
+		args = append(args, strings.ToLower(f.Username))
+		where = append(where, fmt.Sprintf("LOWER(username) = $%d", len(args)))
+	}
+
+	if len(f.Action) > 0 {
+		args = append(args, f.Action)
+		where = append(where, fmt.Sprintf("action = $%d", len(args)))
+	}
+
+	if len(f.TargetID) > 0 {
+		args = append(args, f.TargetID)
+		where = append(where, fmt.Sprintf("$%d = ANY(string_to_array(target_ids, ','))", len(args)))
+	}
+
+	if f.From != nil {
+		args = append(args, *f.From)
+		where = append(where, fmt.Sprintf("timestamp >= $%d", len(args)))
+	}
+
+	if f.To != nil {
+		args = append(args, *f.To)
+		where = append(where, fmt.Sprintf("timestamp < $%d", len(args)))
+	}
+
+	return strings.Join(where, " AND "), args
+}
+
+// getAuditEntries returns the audit records matching the filter, most recent first
+func getAuditEntries(f *AuditFilter, limit int, offset int) ([]*AuditEntry, error) {
+
+	var data []*AuditEntry
+
+	where, args := f.buildWhere()
+	err := db.
+		Select("*").
+		From("audit_log").
+		Where(where, args...).
+		OrderBy("timestamp DESC, id DESC").
+		Offset(uint64(offset)).
+		Limit(uint64(limit)).
+		QueryStructs(&data)
+
+	if err != nil {
+		return data, err
+	}
+
+	if data == nil {
+		data = []*AuditEntry{}
+	}
+
+	for _, e := range data {
+		e.TimestampString = e.Timestamp.Format("15:04:05 02/01/2006")
+	}
+
+	return data, nil
+}
+
+// generateAuditCsv returns the audit records as CSV
+func generateAuditCsv(data []*AuditEntry) []byte {
+
+	buffer := new(bytes.Buffer)
+	cw := csv.NewWriter(buffer)
+	cw.Write([]string{"ID", "TIMESTAMP", "USER_ID", "USERNAME", "IP_ADDRESS", "ACTION", "TARGET_TYPE", "TARGET_IDS", "DETAILS"})
+
+	for _, e := range data {
+		userID := ""
+		if e.UserID != nil {
+			userID = convertInt64ToString(*e.UserID)
+		}
+
+		cw.Write([]string{
+			convertInt64ToString(e.ID),
+			e.Timestamp.Format(time.RFC3339),
+			userID,
+			e.Username,
+			e.IpAddress,
+			e.Action,
+			e.TargetType,
+			e.TargetIDs,
+			e.Details})
+	}
+
+	cw.Flush()
+	return buffer.Bytes()
+}
+
+// ***** Routing Methods ******************************************************
+
+//
+func routeAuditGet(c *gin.Context) {
+
+	if getAccountType(c) != ADMIN {
+		c.Redirect(http.StatusFound, "/logout")
+		return
+	}
+
+	currentPageNumber, successful := processIntParameter(c.Query("page"))
+	if successful == false || currentPageNumber < 0 {
+		currentPageNumber = 0
+	}
+
+	f := parseAuditFilter(c)
+	data, err := getAuditEntries(f, AUDIT_PAGE_SIZE+1, AUDIT_PAGE_SIZE*currentPageNumber)
+	if err != nil {
+		log.Printf("Error loading audit log: %v\n", err)
+		goToErrorPage(c, "Unable to load audit log")
+		return
+	}
+
+	noMoreRecords := true
+	if len(data) > AUDIT_PAGE_SIZE {
+		noMoreRecords = false
+		data = data[:AUDIT_PAGE_SIZE]
+	}
+
+	var message template.HTML
+	if len(data) == 0 {
+		message = template.HTML(fmt.Sprintf(ALERT_YELLOW, "No audit records match the filter"))
+	}
+
+	// The filter is passed to the paging and download links
+	query := c.Request.URL.Query()
+	query.Del("page")
+	query.Del("format")
+
+	c.HTML(http.StatusOK, "audit", getTemplateData(c, gin.H{
+		"data":             data,
+		"filter":           f,
+		"from":             c.Query("from"),
+		"to":               c.Query("to"),
+		"actions":          AUDIT_ACTIONS,
+		"query":            template.URL(query.Encode()),
+		"current_page_num": currentPageNumber,
+		"previous_page":    currentPageNumber - 1,
+		"next_page":        currentPageNumber + 1,
+		"no_more_records":  noMoreRecords,
+		"message":          message,
+	}))
+}
+
+//
+func routeAuditDownload(c *gin.Context) {
+
+	if getAccountType(c) != ADMIN {
+		c.Redirect(http.StatusFound, "/logout")
+		return
+	}
+
+	data, err := getAuditEntries(parseAuditFilter(c), AUDIT_DOWNLOAD_MAX_RECORDS, 0)
+	if err != nil {
+		log.Printf("Error loading audit log for download: %v\n", err)
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	fileName := "audit_" + time.Now().UTC().Format("20060102150405")
+
+	if c.Query("format") == "json" {
+		output, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			log.Printf("Error encoding audit log: %v\n", err)
+			c.String(http.StatusInternalServerError, "")
+			return
+		}
+
+		c.Header("Content-Disposition", "attachment; filename="+fileName+".json")
+		c.Data(http.StatusOK, "application/json", output)
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+fileName+".csv")
+	c.Data(http.StatusOK, "text/csv", generateAuditCsv(data))
+}
@@ -46,13 +46,37 @@ func AuthorizeMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		if c.Request.URL.Path != "/enroll" {
-			ret = session.Values["mfa_set"].(bool)
-			if ret == false {
+		// Until the second factor has been enrolled and verified, the session can only
+		// be used to perform the enroll or verify step respectively
+		mfaSet, _ := session.Values["mfa_set"].(bool)
+		mfaVerified, _ := session.Values["mfa_verified"].(bool)
+		enrollPath := isPathWithin(c.Request.URL.Path, "/enroll")
+		verifyPath := isPathWithin(c.Request.URL.Path, "/verify")
+		switch {
+		case mfaSet == false:
+			if enrollPath == false {
 				c.Abort()
 				c.Redirect(http.StatusFound, "/enroll")
 				return
 			}
+		case mfaVerified == false:
+			if verifyPath == false {
+				c.Abort()
+				c.Redirect(http.StatusFound, "/verify")
+				return
+			}
+		case enrollPath == true || verifyPath == true:
+			c.Abort()
+			c.Redirect(http.StatusFound, "/alerts")
+			return
+		}
+
+		// One-time passwords must be changed before the session can be used
+		mustChangePassword, _ := session.Values["must_change_password"].(bool)
+		if mustChangePassword == true && c.Request.URL.Path != "/account/password" {
+			c.Abort()
+			c.Redirect(http.StatusFound, "/account/password")
+			return
 		}
 
 		accountType := getAccountType(c)
@@ -61,10 +85,56 @@ func AuthorizeMiddleware() gin.HandlerFunc {
 	}
 }
 
+// isPathWithin returns true if the path is the prefix path or one of its sub-paths
+func isPathWithin(path string, prefix string) bool {
+
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
 //
 func routeLogonGet(c *gin.Context) {
 
-	c.HTML(http.StatusOK, "logon", gin.H{})
+	renderLogon(c, "")
+}
+
+// renderLogon displays the logon page with an optional message
+func renderLogon(c *gin.Context, message template.HTML) {
+
+	c.HTML(http.StatusOK, "logon", gin.H{"message": message, "sso": config.Oidc.Enabled})
+}
+
+// startUserSession stores the authenticated user's details within the session.
+// Sessions are not fully authorized until mfaVerified is set
+func startUserSession(c *gin.Context, u *User, mfaSet bool, mfaVerified bool) error {
+
+	session, _ := sessionStore.Get(c.Request, APP_NAME)
+	regenerateSession(session)
+	// A new CSRF token is generated for the authenticated session
+	delete(session.Values, CSRF_FIELD_NAME)
+	session.Values["authed"] = true
+	session.Values["user_id"] = u.ID
+	session.Values["username"] = u.Username
+	session.Values["account_type"] = u.AccountType
+	session.Values["mfa_set"] = mfaSet
+	session.Values["mfa_verified"] = mfaVerified
+	session.Values["must_change_password"] = u.MustChangePassword
+	return session.Save(c.Request, c.Writer)
+}
+
+// findLogonUser returns true if the username has an account, setting the username to that
+// of the account. Externally authenticated users are also matched by their external ID (the
+// lower case username), so that the lock and failed logon count apply whatever the case typed
+func findLogonUser(u *User) (bool, error) {
+
+	if authBackend.Name() != AUTH_PROVIDER_LOCAL {
+		existing, err := NewUserByExternalID(authBackend.Name(), strings.ToLower(u.Username))
+		if err == nil {
+			u.Username = existing.Username
+			return true, nil
+		}
+	}
+
+	return u.Exists()
 }
 
 //
@@ -72,63 +142,108 @@ func routeLogonPost(c *gin.Context) {
 
 	u := new(User)
 	u.Username = c.PostForm("username")
-	exists, err := u.Exists()
+	exists, err := findLogonUser(u)
 	if err != nil {
 		log.Printf("Error checking user existance: %v\n", err)
 		goToErrorPage(c, "Unable to perform login")
 		return
 	}
 
+	// Users without a local account can only logon via an external backend, which
+	// provisions the account on the first successful logon
+	backend := authBackend
 	if exists == false {
-		log.Printf("Error user does not exist: %v\n", u.Username)
-		c.HTML(http.StatusOK, "logon", gin.H{"message": template.HTML(fmt.Sprintf(ALERT_YELLOW, "User does not exist"))})
-		return
-	}
+		if backend.Name() == AUTH_PROVIDER_LOCAL {
+			log.Printf("Error user does not exist: %v\n", u.Username)
+			writeAuditFor(c, -1, u.Username, AUDIT_LOGON_FAILURE, AUDIT_TARGET_NONE, "", "User does not exist")
+			renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "User does not exist")))
+			return
+		}
+	} else {
+		u, err = NewUserByUsername(u.Username)
+		if err != nil {
+			log.Printf("Error loading user details: %v\n", err)
+			goToErrorPage(c, "Unable to perform login")
+			return
+		}
 
-	u, err = NewUserByUsername(u.Username)
-	if err != nil {
-		log.Printf("Error loading user details: %v\n", err)
-		goToErrorPage(c, "Unable to perform login")
-		return
-	}
+		if u.Locked == true {
+			log.Printf("Error user locked: %v\n", u.Username)
+			writeAuditFor(c, u.ID, u.Username, AUDIT_LOGON_FAILURE, AUDIT_TARGET_USER, convertInt64ToString(u.ID), "Account locked")
+			renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Account locked")))
+			return
+		}
 
-	if u.Locked == true {
-		log.Printf("Error user locked: %v\n", u.Username)
-		c.HTML(http.StatusOK, "logon", gin.H{"message": template.HTML(fmt.Sprintf(ALERT_YELLOW, "Account locked"))})
-		return
-	}
+		if u.AuthProvider == AUTH_PROVIDER_OIDC {
+			log.Printf("Error local logon attempted for single sign-on user: %v\n", u.Username)
+			writeAuditFor(c, u.ID, u.Username, AUDIT_LOGON_FAILURE, AUDIT_TARGET_USER, convertInt64ToString(u.ID), "Single sign-on user")
+			renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Use single sign-on to logon")))
+			return
+		}
 
-	u.Password = c.PostForm("password")
+		backend, err = getAuthBackendForUser(u)
+		if err != nil {
+			log.Printf("Error selecting auth backend: %v (%s)\n", err, u.Username)
+			renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, err)))
+			return
+		}
+	}
 
-	err = u.CheckPassword()
+	result, err := backend.Authenticate(u.Username, c.PostForm("password"))
 	if err != nil {
-		log.Printf("Error checking password: %v\n", err)
+		log.Printf("Error checking password (%s): %v\n", backend.Name(), err)
 
-		if strings.Contains(err.Error(), "Password is incorrect") {
-			u.IncrementLoginAttempts()
+		switch err {
+		case ErrInvalidCredentials:
+			if exists == true {
+				auditFailedAttempt(c, u, AUDIT_LOGON_FAILURE, "Invalid credentials ("+backend.Name()+")")
+			} else {
+				writeAuditFor(c, -1, u.Username, AUDIT_LOGON_FAILURE, AUDIT_TARGET_NONE, "", "Invalid credentials ("+backend.Name()+")")
+			}
+		case ErrNotPermitted:
+			writeAuditFor(c, u.ID, u.Username, AUDIT_LOGON_FAILURE, AUDIT_TARGET_NONE, "", "Not permitted ("+backend.Name()+")")
+		default:
+			writeAuditFor(c, u.ID, u.Username, AUDIT_LOGON_FAILURE, AUDIT_TARGET_NONE, "", "Unable to verify credentials ("+backend.Name()+")")
+			renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Unable to verify credentials")))
+			return
 		}
 
-		//c.HTML(http.StatusOK, "password", getTemplateData(c, ROUTE_LOGON,
-		c.HTML(http.StatusOK, "logon", gin.H{"message": template.HTML(fmt.Sprintf(ALERT_YELLOW, err))})
+		renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, err)))
 		return
 	}
 
-	u.ResetLoginAttempts()
+	if backend.Name() != AUTH_PROVIDER_LOCAL {
+		if len(result.Name) == 0 {
+			result.Name = u.Username
+		}
 
-	session, _ := sessionStore.Get(c.Request, APP_NAME)
-	session.Options = &gorilla.Options{MaxAge: config.InactiveSessionTimeoutSeconds}
-	session.Values["authed"] = true
-	session.Values["user_id"] = u.ID
-	session.Values["username"] = u.Username
-	session.Values["account_type"] = u.AccountType
-	session.Values["mfa_set"] = u.MfaSet
-	err = session.Save(c.Request, c.Writer)
+		u, err = provisionExternalUser(backend.Name(), result.ExternalID, u.Username, result.Name, result.AccountType)
+		if err != nil {
+			log.Printf("Error provisioning %s user: %v (%s)\n", backend.Name(), err, u.Username)
+			renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Unable to provision account")))
+			return
+		}
+
+		if u.Locked == true {
+			log.Printf("Error user locked: %v\n", u.Username)
+			writeAuditFor(c, u.ID, u.Username, AUDIT_LOGON_FAILURE, AUDIT_TARGET_USER, convertInt64ToString(u.ID), "Account locked")
+			renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Account locked")))
+			return
+		}
+	}
+
+	// The failed logon count is only reset once the second factor has been verified, so
+	// that knowing the password does not allow unlimited guesses of the second factor
+	err = startUserSession(c, u, u.MfaSet, false)
 	if err != nil {
 		log.Printf("Error saving user session (logon): %v\n", err)
 		goToErrorPage(c, "Unable to perform login")
 		return
 	}
 
+	// The logon is not complete until the second factor has been verified, which is audited separately
+	writeAuditFor(c, u.ID, u.Username, AUDIT_LOGON_SUCCESS, AUDIT_TARGET_USER, convertInt64ToString(u.ID), backend.Name())
+
 	if u.MfaSet == false {
 		c.Redirect(http.StatusFound, "/enroll")
 	} else {
@@ -141,8 +256,13 @@ func routeLogout(c *gin.Context) {
 
 	session, err := sessionStore.Get(c.Request, APP_NAME)
 	if err == nil {
+		if authed, _ := session.Values["authed"].(bool); authed == true {
+			writeAudit(c, AUDIT_LOGOUT, AUDIT_TARGET_NONE, "", "")
+		}
+
 		session.Options = &gorilla.Options{MaxAge: -1}
 		session.Values["authed"] = false
+		session.Values["mfa_verified"] = false
 		err = session.Save(c.Request, c.Writer)
 		if err != nil {
 			log.Printf("Error logging out session: %v\n", err)
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgryski/dgoogauth"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/mgutz/dat.v1/sqlx-runner"
+)
+
+// ##### Mock Database ########################################################
+
+const (
+	TEST_USER_NAME       = "alice"
+	TEST_USER_PASSWORD   = "Correct-Horse-1"
+	TEST_USER_MFA_SECRET = "JBSWY3DPEHPK3PXP"
+)
+
+var (
+	testSelectRegex = regexp.MustCompile(`^SELECT (.+) FROM "?users"? WHERE \((username|id) = \$1\)`)
+	testUpdateRegex = regexp.MustCompile(`^UPDATE "?users"? SET "?(\w+)"? = \$1 WHERE \(id = \$2`)
+)
+
+// testDatabase is a minimal database, which holds a single user and answers the
+// statements sent by the logon and verify end-points
+type testDatabase struct {
+	user   map[string]driver.Value // Keyed by the column name
+	audits []string                // The action of each audit entry
+	mutex  sync.Mutex
+}
+
+// newTestDatabase creates the database with a user who has enrolled a second factor, and sets it as the database
+func newTestDatabase(t *testing.T) *testDatabase {
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(TEST_USER_PASSWORD), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+
+	d := &testDatabase{user: map[string]driver.Value{
+		"id":                   int64(1),
+		"username":             TEST_USER_NAME,
+		"name":                 "Alice Smith",
+		"password_hash":        string(hash),
+		"account_type":         int64(ADMIN),
+		"timestamp_created":    time.Now().UTC(),
+		"login_attempts":       int64(0),
+		"is_locked":            false,
+		"mfa_secret":           TEST_USER_MFA_SECRET,
+		"is_mfa_set":           true,
+		"auth_provider":        AUTH_PROVIDER_LOCAL,
+		"external_id":          "",
+		"mfa_last_counter":     int64(0),
+		"must_change_password": false,
+	}}
+
+	db = runner.NewDB(sql.OpenDB(d), "postgres")
+	t.Cleanup(func() { db = nil })
+
+	return d
+}
+
+func (d *testDatabase) Connect(ctx context.Context) (driver.Conn, error) {
+
+	return &testDatabaseConn{d}, nil
+}
+
+func (d *testDatabase) Driver() driver.Driver {
+
+	return nil
+}
+
+func (d *testDatabase) value(column string) driver.Value {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.user[column]
+}
+
+func (d *testDatabase) query(query string, args []driver.NamedValue) (driver.Rows, error) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if query == "SHOW server_version_num" {
+		return &testDatabaseRows{columns: []string{"server_version_num"}, values: [][]driver.Value{{"100000"}}}, nil
+	}
+
+	if query == "SELECT count(1) from users where username = $1" {
+		count := int64(0)
+		if args[0].Value == d.user["username"] {
+			count = 1
+		}
+		return &testDatabaseRows{columns: []string{"count"}, values: [][]driver.Value{{count}}}, nil
+	}
+
+	match := testSelectRegex.FindStringSubmatch(query)
+	if match == nil {
+		return nil, fmt.Errorf("Unexpected query: %s", query)
+	}
+
+	columns := strings.Split(match[1], ", ")
+	if match[1] == "*" {
+		columns = make([]string, 0, len(d.user))
+		for column := range d.user {
+			columns = append(columns, column)
+		}
+	}
+
+	rows := &testDatabaseRows{columns: columns}
+	if args[0].Value == d.user[match[2]] {
+		row := make([]driver.Value, 0, len(columns))
+		for _, column := range columns {
+			row = append(row, d.user[column])
+		}
+		rows.values = append(rows.values, row)
+	}
+
+	return rows, nil
+}
+
+func (d *testDatabase) exec(query string, args []driver.NamedValue) (driver.Result, error) {
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if strings.HasPrefix(strings.Replace(query, `"`, "", -1), "INSERT INTO audit_log") {
+		d.audits = append(d.audits, args[4].Value.(string))
+		return driver.RowsAffected(1), nil
+	}
+
+	if strings.HasPrefix(strings.Replace(query, `"`, "", -1), "DELETE FROM user_session") {
+		return driver.RowsAffected(0), nil
+	}
+
+	match := testUpdateRegex.FindStringSubmatch(query)
+	if match == nil {
+		return nil, fmt.Errorf("Unexpected statement: %s", query)
+	}
+
+	d.user[match[1]] = args[0].Value
+	return driver.RowsAffected(1), nil
+}
+
+// testDatabaseConn is a connection to the mock database, which runs statements without preparing them
+type testDatabaseConn struct {
+	database *testDatabase
+}
+
+func (c *testDatabaseConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+
+	return c.database.query(query, args)
+}
+
+func (c *testDatabaseConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+
+	return c.database.exec(query, args)
+}
+
+func (c *testDatabaseConn) Prepare(query string) (driver.Stmt, error) {
+
+	return nil, errors.New("Prepared statements are not supported")
+}
+
+func (c *testDatabaseConn) Begin() (driver.Tx, error) {
+
+	return nil, errors.New("Transactions are not supported")
+}
+
+func (c *testDatabaseConn) Close() error {
+
+	return nil
+}
+
+type testDatabaseRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *testDatabaseRows) Columns() []string {
+
+	return r.columns
+}
+
+func (r *testDatabaseRows) Next(dest []driver.Value) error {
+
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func (r *testDatabaseRows) Close() error {
+
+	return nil
+}
+
+// ##### Helpers ##############################################################
+
+// newTestLogonRouter returns a router for the logon and verify end-points, using a cookie session store
+func newTestLogonRouter() *gin.Engine {
+
+	gin.SetMode(gin.TestMode)
+	sessionStore = cookie.NewStore([]byte("0123456789abcdef0123456789abcdef"))
+	config = &Config{MaxFailedLogins: 3}
+	authBackend = new(DatabaseAuthBackend)
+
+	router := gin.New()
+	router.HTMLRender = loadTemplates("templates")
+	router.POST("/", routeLogonPost)
+	router.POST("/verify", routeVerifyPost)
+
+	return router
+}
+
+// postTestForm posts the form with the cookies, returning the response
+func postTestForm(router *gin.Engine, path string, cookies []*http.Cookie, form url.Values) *httptest.ResponseRecorder {
+
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	return w
+}
+
+// logonTestUser logs on with the correct password, returning the session cookies for the verify page
+func logonTestUser(t *testing.T, router *gin.Engine) []*http.Cookie {
+
+	w := postTestForm(router, "/", nil, url.Values{"username": {TEST_USER_NAME}, "password": {TEST_USER_PASSWORD}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/verify" {
+		t.Fatalf("Logon status = %d (%s), expected a redirect to /verify", w.Code, w.Header().Get("Location"))
+	}
+
+	return w.Result().Cookies()
+}
+
+// testMfaCodes returns a valid TOTP code for the secret, and a code that is not valid at any time step accepted
+func testMfaCodes() (string, string) {
+
+	t0 := time.Now().Unix() / 30
+	valid := map[int]bool{}
+	for counter := t0 - 1; counter <= t0+1; counter++ {
+		valid[dgoogauth.ComputeCode(TEST_USER_MFA_SECRET, counter)] = true
+	}
+
+	invalid := 0
+	for valid[invalid] == true {
+		invalid++
+	}
+
+	return fmt.Sprintf("%06d", dgoogauth.ComputeCode(TEST_USER_MFA_SECRET, t0)), fmt.Sprintf("%06d", invalid)
+}
+
+// ##### Tests ################################################################
+
+func TestLogonFailedMfaLocks(t *testing.T) {
+
+	d := newTestDatabase(t)
+	router := newTestLogonRouter()
+	_, invalid := testMfaCodes()
+
+	// Logging on again with the password must not reset the failed second factor count
+	for i := int16(1); i <= config.MaxFailedLogins; i++ {
+		cookies := logonTestUser(t, router)
+
+		w := postTestForm(router, "/verify", cookies, url.Values{"code": {invalid}})
+		if i < config.MaxFailedLogins {
+			if strings.Contains(w.Body.String(), "Invalid verification code") == false {
+				t.Fatalf("Attempt %d: expected an invalid verification code", i)
+			}
+
+			if d.value("login_attempts") != int64(i) {
+				t.Fatalf("Attempt %d: login attempts = %v, expected %d", i, d.value("login_attempts"), i)
+			}
+		} else if strings.Contains(w.Body.String(), "Account locked") == false {
+			t.Fatalf("Attempt %d: expected the account to be locked", i)
+		}
+	}
+
+	if d.value("is_locked") != true {
+		t.Fatal("Expected the account to be locked")
+	}
+
+	if strings.Contains(strings.Join(d.audits, ","), AUDIT_LOGON_LOCKOUT) == false {
+		t.Errorf("Audit %q, expected a lockout", d.audits)
+	}
+
+	w := postTestForm(router, "/", nil, url.Values{"username": {TEST_USER_NAME}, "password": {TEST_USER_PASSWORD}})
+	if w.Code == http.StatusFound || strings.Contains(w.Body.String(), "Account locked") == false {
+		t.Errorf("Logon status = %d, expected the account to be locked", w.Code)
+	}
+}
+
+func TestLogonVerifyResetsAttempts(t *testing.T) {
+
+	d := newTestDatabase(t)
+	router := newTestLogonRouter()
+	valid, invalid := testMfaCodes()
+
+	cookies := logonTestUser(t, router)
+	postTestForm(router, "/verify", cookies, url.Values{"code": {invalid}})
+	if d.value("login_attempts") != int64(1) {
+		t.Fatalf("Login attempts = %v, expected 1", d.value("login_attempts"))
+	}
+
+	cookies = logonTestUser(t, router)
+	w := postTestForm(router, "/verify", cookies, url.Values{"code": {valid}})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/alerts" {
+		t.Fatalf("Verify status = %d (%s), expected a redirect to /alerts", w.Code, w.Header().Get("Location"))
+	}
+
+	if d.value("login_attempts") != int64(0) {
+		t.Errorf("Login attempts = %v, expected the count to be reset", d.value("login_attempts"))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// ##### Variables ############################################################
+
+var (
+	ErrInvalidCredentials = errors.New("Password is incorrect")
+	ErrNotPermitted       = errors.New("Account not permitted")
+)
+
+var authBackend AuthBackend
+
+// ##### Interfaces ###########################################################
+
+// AuthBackend verifies a username and password against an authentication source
+type AuthBackend interface {
+	// Name returns the auth provider name stored against users of the backend
+	Name() string
+	// Authenticate returns ErrInvalidCredentials if the password is wrong
+	Authenticate(username string, password string) (*AuthResult, error)
+}
+
+// ##### Structs ##############################################################
+
+// Represents a successful authentication. External backends supply the details
+// used to provision the user within the "users" table
+type AuthResult struct {
+	ExternalID  string
+	Name        string
+	AccountType AccountType
+}
+
+// DatabaseAuthBackend checks passwords against the bcrypt hashes in the "users" table
+type DatabaseAuthBackend struct{}
+
+// ##### Methods ##############################################################
+
+// initialiseAuthBackend selects the backend used for usernames that do not have a local account
+func initialiseAuthBackend() {
+
+	switch strings.ToLower(config.AuthBackend) {
+	case "", AUTH_BACKEND_DATABASE:
+		authBackend = new(DatabaseAuthBackend)
+	case AUTH_PROVIDER_LDAP:
+		authBackend = NewLdapAuthBackend(config.Ldap)
+	default:
+		logger.Fatalf("Unknown auth backend in config file: %s", config.AuthBackend)
+	}
+}
+
+// getAuthBackendForUser returns the backend that authenticates an existing user.
+// Local accounts are always checked against the database, so that break glass
+// accounts continue to work when the directory is unavailable
+func getAuthBackendForUser(u *User) (AuthBackend, error) {
+
+	switch u.AuthProvider {
+	case AUTH_PROVIDER_LOCAL:
+		return new(DatabaseAuthBackend), nil
+	case authBackend.Name():
+		return authBackend, nil
+	}
+
+	return nil, errors.New("Account cannot logon with a password")
+}
+
+//
+func (b *DatabaseAuthBackend) Name() string {
+
+	return AUTH_PROVIDER_LOCAL
+}
+
+//
+func (b *DatabaseAuthBackend) Authenticate(username string, password string) (*AuthResult, error) {
+
+	u := User{Username: username, Password: password}
+	err := u.CheckPassword()
+	if err != nil {
+		if err.Error() == ErrInvalidCredentials.Error() {
+			return nil, ErrInvalidCredentials
+		}
+
+		return nil, err
+	}
+
+	return new(AuthResult), nil
+}
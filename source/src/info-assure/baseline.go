@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+// The deviations of a host from its group's baseline
+const BASELINE_NOT_IN string = "not_in_baseline"
+const BASELINE_MISSING string = "missing"
+
+// ##### Structs ##############################################################
+
+// Represents an autorun of a host that is not in the baseline, or a baseline autorun that the host does not have
+type BaselineDeviation struct {
+	Host    string   `json:"host"`
+	Status  string   `json:"status"`
+	Autorun *Autorun `json:"autorun"`
+}
+
+// Represents the deviations of a host's current autoruns from the baseline. The instance
+// is nil if the host has not been collected, in which case there are no deviations
+type HostBaseline struct {
+	Host          string               `json:"host"`
+	Instance      *Instance            `json:"instance"`
+	InstanceStr   string               `json:"-"`
+	NotInBaseline int                  `json:"not_in_baseline"`
+	Missing       int                  `json:"missing"`
+	Deviations    []*BaselineDeviation `json:"deviations"`
+}
+
+// Represents a deviation across the hosts of the group, with the number of hosts that have it
+type BaselineItem struct {
+	Status    string   `json:"status"`
+	Autorun   *Autorun `json:"autorun"`
+	HostCount int      `json:"host_count"`
+	lastHost  string
+}
+
+// Represents the comparison of hosts to a group's baseline
+type BaselineComparison struct {
+	Group         *HostGroup      `json:"group"`
+	Baseline      *Instance       `json:"baseline"`
+	NotInBaseline int             `json:"not_in_baseline"`
+	Missing       int             `json:"missing"`
+	Hosts         []*HostBaseline `json:"hosts"`
+	Items         []*BaselineItem `json:"items"`
+}
+
+// ##### Methods ##############################################################
+
+// baselineKey identifies the same autorun across hosts. The profile is ignored, since the
+// user profiles differ between hosts, and the launch string and SHA256 must also match
+func baselineKey(a *Autorun) string {
+
+	return a.Location + "\x1f" + a.ItemName + "\x1f" + strings.ToLower(a.LaunchString) + "\x1f" + strings.ToLower(a.Sha256)
+}
+
+// compareToBaseline returns the autoruns that are not in the baseline, and the baseline autoruns
+// that are missing. Duplicate autoruns are matched one for one
+func compareToBaseline(baseline []*Autorun, autoruns []*Autorun) ([]*Autorun, []*Autorun) {
+
+	remaining := make(map[string]int)
+	for _, a := range baseline {
+		remaining[baselineKey(a)]++
+	}
+
+	var notIn []*Autorun
+	for _, a := range autoruns {
+		if remaining[baselineKey(a)] > 0 {
+			remaining[baselineKey(a)]--
+			continue
+		}
+
+		notIn = append(notIn, a)
+	}
+
+	var missing []*Autorun
+	for _, a := range baseline {
+		if remaining[baselineKey(a)] > 0 {
+			remaining[baselineKey(a)]--
+			missing = append(missing, a)
+		}
+	}
+
+	return notIn, missing
+}
+
+// getBaselineAutoruns returns the autoruns that were copied from the group's baseline instance
+func getBaselineAutoruns(groupID int64) ([]*Autorun, error) {
+
+	var data []*Autorun
+	err := db.
+		Select(SQL_AUTORUN_COLUMNS).
+		From("host_group_baseline_autorun").
+		Where("group_id = $1", groupID).
+		OrderBy("location, item_name").
+		QueryStructs(&data)
+
+	if err != nil && strings.Contains(err.Error(), "no rows in result set") == false {
+		return data, err
+	}
+
+	return data, nil
+}
+
+// getLatestInstances returns the latest instance of each of the hosts that have been collected,
+// keyed by the lower case host
+func getLatestInstances(hosts []string) (map[string]*Instance, error) {
+
+	instances := make(map[string]*Instance)
+	if len(hosts) == 0 {
+		return instances, nil
+	}
+
+	lower := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		lower = append(lower, strings.ToLower(h))
+	}
+
+	var data []*Instance
+	err := db.SQL(`SELECT DISTINCT ON (LOWER(host)) id, domain, host, timestamp
+	   FROM instance
+	  WHERE LOWER(host) = ANY(string_to_array($1, chr(31)))
+   ORDER BY LOWER(host), timestamp DESC`, strings.Join(lower, "\x1f")).QueryStructs(&data)
+
+	if err != nil && strings.Contains(err.Error(), "no rows in result set") == false {
+		return instances, err
+	}
+
+	for _, i := range data {
+		instances[strings.ToLower(i.Host)] = i
+	}
+
+	return instances, nil
+}
+
+// getInstancesAutoruns returns the autoruns of the instances, keyed by the instance
+func getInstancesAutoruns(ids []int64) (map[int64][]*Autorun, error) {
+
+	autoruns := make(map[int64][]*Autorun)
+	if len(ids) == 0 {
+		return autoruns, nil
+	}
+
+	values := make([]string, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, convertInt64ToString(id))
+	}
+
+	var data []*Autorun
+	err := db.
+		Select(SQL_AUTORUN_COLUMNS).
+		From(SQL_AUTORUN_HISTORY+" AS h").
+		Where("instance = ANY(string_to_array($1, ',')::BIGINT[])", strings.Join(values, ",")).
+		OrderBy("location, item_name").
+		QueryStructs(&data)
+
+	if err != nil && strings.Contains(err.Error(), "no rows in result set") == false {
+		return autoruns, err
+	}
+
+	for _, a := range data {
+		autoruns[a.Instance] = append(autoruns[a.Instance], a)
+	}
+
+	return autoruns, nil
+}
+
+// getBaselineComparison compares the current autoruns of the host, or of each of the group's
+// hosts if no host is specified, to the group's baseline
+func getBaselineComparison(g *HostGroup, host string) (*BaselineComparison, string) {
+
+	if g.BaselineInstance == nil {
+		return nil, "The group does not have a baseline"
+	}
+
+	b := &Instance{Id: *g.BaselineInstance, Domain: g.BaselineDomain, Host: g.BaselineHost}
+	if g.BaselineInstanceTimestamp != nil {
+		b.Timestamp = *g.BaselineInstanceTimestamp
+	}
+
+	baseline, err := getBaselineAutoruns(g.ID)
+	if err != nil {
+		logger.Errorf("Error querying for baseline autoruns: %v (%s)", err, g.Name)
+		return nil, "Error retrieving autoruns"
+	}
+
+	if len(baseline) == 0 {
+		return nil, "The baseline does not have any autoruns"
+	}
+
+	hosts := []string{host}
+	if len(host) == 0 {
+		hosts, err = g.getMemberHosts()
+		if err != nil {
+			logger.Errorf("Error querying for group hosts: %v (%s)", err, g.Name)
+			return nil, "Error retrieving the group's hosts"
+		}
+	}
+
+	instances, err := getLatestInstances(hosts)
+	if err != nil {
+		logger.Errorf("Error querying for baseline host instances: %v (%s)", err, g.Name)
+		return nil, "Error retrieving instance"
+	}
+
+	ids := make([]int64, 0, len(instances))
+	for _, i := range instances {
+		ids = append(ids, i.Id)
+	}
+
+	hostAutoruns, err := getInstancesAutoruns(ids)
+	if err != nil {
+		logger.Errorf("Error querying for baseline host autoruns: %v (%s)", err, g.Name)
+		return nil, "Error retrieving autoruns"
+	}
+
+	comparison := &BaselineComparison{Group: g, Baseline: b}
+	items := make(map[string]*BaselineItem)
+
+	for _, h := range hosts {
+		hb := &HostBaseline{Host: h}
+		comparison.Hosts = append(comparison.Hosts, hb)
+
+		instance, exists := instances[strings.ToLower(h)]
+		if exists == false {
+			continue
+		}
+
+		hb.Instance = instance
+		hb.Host = hb.Instance.Host
+		hb.InstanceStr = hb.Instance.Timestamp.Format("15:04:05 02/01/2006")
+		autoruns := hostAutoruns[instance.Id]
+
+		notIn, missing := compareToBaseline(baseline, autoruns)
+		for _, a := range notIn {
+			hb.Deviations = append(hb.Deviations, &BaselineDeviation{Host: hb.Host, Status: BASELINE_NOT_IN, Autorun: a})
+		}
+		for _, a := range missing {
+			hb.Deviations = append(hb.Deviations, &BaselineDeviation{Host: hb.Host, Status: BASELINE_MISSING, Autorun: a})
+		}
+
+		hb.NotInBaseline = len(notIn)
+		hb.Missing = len(missing)
+		comparison.NotInBaseline += hb.NotInBaseline
+		comparison.Missing += hb.Missing
+
+		for _, d := range hb.Deviations {
+			key := d.Status + "\x1e" + baselineKey(d.Autorun)
+
+			item, exists := items[key]
+			if exists == false {
+				item = &BaselineItem{Status: d.Status, Autorun: d.Autorun}
+				items[key] = item
+				comparison.Items = append(comparison.Items, item)
+			}
+
+			if item.lastHost != hb.Host {
+				item.lastHost = hb.Host
+				item.HostCount++
+			}
+		}
+	}
+
+	// The deviations that are common to the most hosts are listed first
+	sort.SliceStable(comparison.Items, func(i, j int) bool {
+		if comparison.Items[i].HostCount != comparison.Items[j].HostCount {
+			return comparison.Items[i].HostCount > comparison.Items[j].HostCount
+		}
+		if comparison.Items[i].Status != comparison.Items[j].Status {
+			return comparison.Items[i].Status > comparison.Items[j].Status
+		}
+		if comparison.Items[i].Autorun.Location != comparison.Items[j].Autorun.Location {
+			return comparison.Items[i].Autorun.Location < comparison.Items[j].Autorun.Location
+		}
+		return comparison.Items[i].Autorun.ItemName < comparison.Items[j].Autorun.ItemName
+	})
+
+	return comparison, ""
+}
+
+// generateBaselineCsv returns the CSV content as a byte slice. There is one row per deviation of each host,
+// using the same autorun columns as the single host export
+func generateBaselineCsv(comparison *BaselineComparison) []byte {
+
+	buffer := new(bytes.Buffer)
+	cw := csv.NewWriter(buffer)
+	cw.Write(append([]string{"HOST", "STATUS"}, AUTORUN_CSV_HEADER...))
+
+	for _, h := range comparison.Hosts {
+		for _, d := range h.Deviations {
+			cw.Write(append([]string{d.Host, d.Status}, autorunCsvRecord(d.Autorun)...))
+		}
+	}
+
+	cw.Flush()
+
+	return buffer.Bytes()
+}
+
+// ***** Routing Methods ******************************************************
+
+// routeBaseline compares the current autoruns of a group's hosts, or of any single host, to the group's
+// baseline. The deviations can be downloaded as CSV or JSON
+func routeBaseline(c *gin.Context) {
+
+	g, successful := loadGroupForAction(c, c.Param("id"))
+	if successful == false {
+		return
+	}
+
+	host := strings.TrimSpace(c.Query("host"))
+
+	comparison, message := getBaselineComparison(g, host)
+	if len(message) > 0 {
+		c.HTML(http.StatusOK, "baseline", getTemplateData(c, gin.H{
+			"group":   g,
+			"host":    host,
+			"message": template.HTML(fmt.Sprintf(ALERT_YELLOW, message)),
+		}))
+		return
+	}
+
+	format := c.Query("format")
+	if format == "csv" || format == "json" {
+		details := g.Name
+		if len(host) > 0 {
+			details += ": " + host
+		}
+		writeAudit(c, AUDIT_BASELINE_DOWNLOAD, AUDIT_TARGET_GROUP, convertInt64ToString(g.ID), details)
+
+		filename := fmt.Sprintf("baseline-%d.%s", g.ID, format)
+		if len(host) > 0 {
+			filename = fmt.Sprintf("baseline-%d-%s.%s", g.ID, host, format)
+		}
+		c.Header("Content-Disposition", "attachment; filename="+filename)
+
+		if format == "json" {
+			c.JSON(http.StatusOK, comparison)
+			return
+		}
+
+		c.Data(http.StatusOK, "text/csv", generateBaselineCsv(comparison))
+		return
+	}
+
+	for _, h := range comparison.Hosts {
+		for _, d := range h.Deviations {
+			d.Autorun.LocationStr = template.HTML("<td class=\"poppy\" data-variation=\"basic\" data-content=\"" + template.HTMLEscapeString(d.Autorun.Location) + "\">" + template.HTMLEscapeString(splitRegKey(d.Autorun.Location)) + "</td>")
+		}
+	}
+
+	c.HTML(http.StatusOK, "baseline", getTemplateData(c, gin.H{
+		"group":         g,
+		"host":          host,
+		"comparison":    comparison,
+		"baseline_time": comparison.Baseline.Timestamp.Format("15:04:05 02/01/2006"),
+	}))
+}
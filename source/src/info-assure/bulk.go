@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+const SQL_BULK_MATCH string = `FROM alert
+  LEFT JOIN classification ON (classification.alert_id = alert.id)
+  LEFT JOIN alert_state ON (alert_state.alert_id = alert.id)
+      WHERE %s`
+
+const SQL_BULK_CLASSIFY string = `INSERT INTO classification (alert_id, user_id, timestamp, disposition, reason)
+	 SELECT alert.id, $1, $2, $3, $4 ` + SQL_BULK_MATCH + `
+  RETURNING alert_id`
+
+// ##### Methods ##############################################################
+
+// processBulkFilter returns the filter from the bulk classification form, along with the form values so that they can be redisplayed
+func processBulkFilter(c *gin.Context) (*AlertFilter, gin.H) {
+
+	f := processAlertFilter(c.PostForm("verified"), "", "")
+	f.Sha256 = strings.ToLower(strings.TrimSpace(c.PostForm("sha256")))
+	f.Signer = strings.TrimSpace(c.PostForm("signer"))
+	f.ItemName = strings.TrimSpace(c.PostForm("item_name"))
+	f.Host = strings.TrimSpace(c.PostForm("host"))
+	f.Location = strings.TrimSpace(c.PostForm("location"))
+
+	from, err := time.Parse("2006/01/02", strings.TrimSpace(c.PostForm("from")))
+	if err == nil {
+		f.From = &from
+	}
+
+	to, err := time.Parse("2006/01/02", strings.TrimSpace(c.PostForm("to")))
+	if err == nil {
+		to = to.AddDate(0, 0, 1)
+		f.To = &to
+	}
+
+	values := gin.H{
+		"sha256":      f.Sha256,
+		"signer":      f.Signer,
+		"item_name":   f.ItemName,
+		"host":        f.Host,
+		"location":    f.Location,
+		"verified":    f.Verified,
+		"from":        strings.TrimSpace(c.PostForm("from")),
+		"to":          strings.TrimSpace(c.PostForm("to")),
+		"disposition": convertStringToInt16(c.PostForm("disposition")),
+		"reason":      strings.TrimSpace(c.PostForm("reason")),
+	}
+
+	return f, values
+}
+
+// validateBulkFilter ensures that at least one filter is set, so that all of the open alerts cannot be classified by mistake
+func validateBulkFilter(f *AlertFilter) error {
+
+	if len(f.Sha256) == 0 && len(f.Signer) == 0 && len(f.ItemName) == 0 && len(f.Host) == 0 &&
+		len(f.Location) == 0 && f.Verified == VERIFIED_ALL && f.From == nil && f.To == nil {
+		return errors.New("At least one filter must be supplied")
+	}
+
+	return nil
+}
+
+// String returns a description of the bulk filter, which is used for the audit records
+func (f *AlertFilter) String() string {
+
+	var filters []string
+	for _, v := range []struct {
+		name  string
+		value string
+	}{
+		{"SHA256", f.Sha256},
+		{"Signer", f.Signer},
+		{"Item Name", f.ItemName},
+		{"Host", f.Host},
+		{"Location", f.Location},
+	} {
+		if len(v.value) > 0 {
+			filters = append(filters, v.name+": "+v.value)
+		}
+	}
+
+	if f.Verified != VERIFIED_ALL {
+		filters = append(filters, fmt.Sprintf("Verified: %d", f.Verified))
+	}
+
+	if f.From != nil {
+		filters = append(filters, "From: "+f.From.Format("2006/01/02"))
+	}
+
+	if f.To != nil {
+		filters = append(filters, "To: "+f.To.AddDate(0, 0, -1).Format("2006/01/02"))
+	}
+
+	if len(f.GroupKeys) > 0 {
+		filters = append(filters, "Groups: "+strings.Join(f.GroupKeys, " "))
+	}
+
+	return strings.Join(filters, ", ")
+}
+
+// getBulkCount returns the number of open alerts that match the filter
+func getBulkCount(f *AlertFilter) (int64, error) {
+
+	where, args := f.buildWhere(nil)
+
+	var count int64
+	err := db.SQL(fmt.Sprintf("SELECT COUNT(*) "+SQL_BULK_MATCH, where), args...).QueryScalar(&count)
+
+	return count, err
+}
+
+// performBulkClassification classifies every open alert that matches the filter within a single
+// transaction. The number of matching alerts must equal the count that the user confirmed, otherwise
+// nothing is classified. Returns the number of matching alerts and an error message
+func performBulkClassification(
+	c *gin.Context,
+	userID int64,
+	f *AlertFilter,
+	disposition AlertState,
+	reason string,
+	expected int64) (int64, string) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Errorf("Error starting bulk classification transaction: %v", err)
+		return 0, "Error performing classification"
+	}
+	defer tx.AutoRollback()
+
+	now := time.Now().UTC()
+	where, args := f.buildWhere([]interface{}{userID, now, int16(disposition), reason})
+
+	var ids []int64
+	err = tx.SQL(fmt.Sprintf(SQL_BULK_CLASSIFY, where), args...).QuerySlice(&ids)
+	if err != nil {
+		logger.Errorf("Error performing bulk classification: %v", err)
+		return 0, "Error performing classification"
+	}
+
+	if int64(len(ids)) != expected {
+		return int64(len(ids)), fmt.Sprintf("The number of matching alerts has changed to %d. Confirm the classification again", len(ids))
+	}
+
+	targets := make([]string, 0, len(ids))
+	for _, id := range ids {
+		targets = append(targets, convertInt64ToString(id))
+	}
+
+	details := disposition.String()
+	if len(reason) > 0 {
+		details += ": " + reason
+	}
+
+	_, username := getAuditActor(c)
+	err = insertAuditEntry(tx, c, userID, username, AUDIT_ALERT_BULK_CLASSIFY, AUDIT_TARGET_ALERT, strings.Join(targets, ","),
+		fmt.Sprintf("%s (%s)", details, f.String()))
+	if err != nil {
+		logger.Errorf("Error writing bulk classification audit entry: %v", err)
+		return 0, "Error performing classification"
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		logger.Errorf("Error commiting bulk classification transaction: %v", err)
+		return 0, "Error performing classification"
+	}
+
+	return int64(len(ids)), ""
+}
+
+// ***** Routing Methods ******************************************************
+
+//
+func routeBulkGet(c *gin.Context) {
+
+	c.HTML(http.StatusOK, "bulk", getTemplateData(c, gin.H{"verified": VERIFIED_ALL, "disposition": int16(ALERT_STATE_BENIGN)}))
+}
+
+//
+func routeBulkPost(c *gin.Context) {
+
+	f, data := processBulkFilter(c)
+
+	err := validateBulkFilter(f)
+	if err != nil {
+		data["message"] = template.HTML(fmt.Sprintf(ALERT_YELLOW, err.Error()))
+		c.HTML(http.StatusOK, "bulk", getTemplateData(c, data))
+		return
+	}
+
+	disposition := AlertState(convertStringToInt16(c.PostForm("disposition")))
+	if disposition.IsDisposition() == false {
+		data["message"] = template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid disposition"))
+		c.HTML(http.StatusOK, "bulk", getTemplateData(c, data))
+		return
+	}
+
+	// The first step counts the matching alerts, which the user must then confirm
+	if c.PostForm("mode") != "classify" {
+		count, err := getBulkCount(f)
+		if err != nil {
+			log.Printf("Error counting bulk classification alerts: %v\n", err)
+			data["message"] = template.HTML(fmt.Sprintf(ALERT_RED, "Unable to count the matching alerts"))
+			c.HTML(http.StatusOK, "bulk", getTemplateData(c, data))
+			return
+		}
+
+		data["count"] = count
+		data["message"] = template.HTML(fmt.Sprintf(ALERT_BLUE, fmt.Sprintf("%d open alerts match the filter", count)))
+		c.HTML(http.StatusOK, "bulk", getTemplateData(c, data))
+		return
+	}
+
+	expected, successful := processInt64Parameter(c.PostForm("count"))
+	if successful == false {
+		data["message"] = template.HTML(fmt.Sprintf(ALERT_YELLOW, "The number of matching alerts must be confirmed"))
+		c.HTML(http.StatusOK, "bulk", getTemplateData(c, data))
+		return
+	}
+
+	userID := getCookieInt64Value(c, "user_id")
+	if userID == -1 {
+		log.Println("Error retrieving user: invalid user ID")
+		goToErrorPage(c, "Unable to perform classification")
+		return
+	}
+
+	count, message := performBulkClassification(c, userID, f, disposition, strings.TrimSpace(c.PostForm("reason")), expected)
+	if len(message) > 0 {
+		// The new count is confirmed if the matching alerts have changed
+		if count > 0 {
+			data["count"] = count
+		}
+		data["message"] = template.HTML(fmt.Sprintf(ALERT_YELLOW, message))
+		c.HTML(http.StatusOK, "bulk", getTemplateData(c, data))
+		return
+	}
+
+	data["message"] = template.HTML(fmt.Sprintf(ALERT_GREEN, fmt.Sprintf("%d alerts classified as %s", count, disposition)))
+	c.HTML(http.StatusOK, "bulk", getTemplateData(c, data))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// ##### Constants ############################################################
+
+// CBOR (RFC 7049) major types
+const (
+	CBOR_UNSIGNED byte = 0
+	CBOR_NEGATIVE byte = 1
+	CBOR_BYTES    byte = 2
+	CBOR_TEXT     byte = 3
+	CBOR_ARRAY    byte = 4
+	CBOR_MAP      byte = 5
+	CBOR_TAG      byte = 6
+	CBOR_SIMPLE   byte = 7
+)
+
+const CBOR_MAX_DEPTH int = 16
+
+// ##### Methods ##############################################################
+
+// decodeCbor decodes the first CBOR item in data, returning the item and the
+// remaining data. Only the definite length encodings produced by authenticators
+// are supported. Integers are returned as int64, byte strings as []byte, text
+// as string, arrays as []interface{} and maps as map[interface{}]interface{}
+func decodeCbor(data []byte) (interface{}, []byte, error) {
+
+	return decodeCborItem(data, 0)
+}
+
+// decodeCborItem decodes a single item, limiting the nesting depth
+func decodeCborItem(data []byte, depth int) (interface{}, []byte, error) {
+
+	if depth > CBOR_MAX_DEPTH {
+		return nil, nil, errors.New("CBOR nesting too deep")
+	}
+
+	if len(data) == 0 {
+		return nil, nil, errors.New("Unexpected end of CBOR data")
+	}
+
+	majorType := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	// Floats are the only type where the additional information is not a length/value
+	if majorType == CBOR_SIMPLE {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		case 25, 26, 27:
+			size := 1 << (info - 24)
+			if len(data) < size {
+				return nil, nil, errors.New("Unexpected end of CBOR data")
+			}
+			if size == 4 {
+				return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[size:], nil
+			}
+			if size == 8 {
+				return math.Float64frombits(binary.BigEndian.Uint64(data)), data[size:], nil
+			}
+			// Half precision floats are not used by authenticators
+			return nil, data[size:], nil
+		}
+
+		return nil, nil, errors.New("Unsupported CBOR simple value")
+	}
+
+	var value uint64
+	switch {
+	case info < 24:
+		value = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, errors.New("Unexpected end of CBOR data")
+		}
+		for _, b := range data[:size] {
+			value = value<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, errors.New("Unsupported CBOR length encoding")
+	}
+
+	switch majorType {
+	case CBOR_UNSIGNED:
+		if value > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer overflow")
+		}
+		return int64(value), data, nil
+
+	case CBOR_NEGATIVE:
+		if value > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer overflow")
+		}
+		return -1 - int64(value), data, nil
+
+	case CBOR_BYTES, CBOR_TEXT:
+		if value > uint64(len(data)) {
+			return nil, nil, errors.New("Unexpected end of CBOR data")
+		}
+		content := data[:value]
+		if majorType == CBOR_TEXT {
+			return string(content), data[value:], nil
+		}
+		return append([]byte{}, content...), data[value:], nil
+
+	case CBOR_ARRAY:
+		// Every item is at least one byte, which bounds the allocation
+		if value > uint64(len(data)) {
+			return nil, nil, errors.New("Unexpected end of CBOR data")
+		}
+		items := make([]interface{}, 0, value)
+		for i := uint64(0); i < value; i++ {
+			var item interface{}
+			var err error
+			item, data, err = decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+
+	case CBOR_MAP:
+		if value > uint64(len(data)) {
+			return nil, nil, errors.New("Unexpected end of CBOR data")
+		}
+		items := make(map[interface{}]interface{}, value)
+		for i := uint64(0); i < value; i++ {
+			var key, item interface{}
+			var err error
+			key, data, err = decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("Unsupported CBOR map key")
+			}
+
+			item, data, err = decodeCborItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = item
+		}
+		return items, data, nil
+
+	case CBOR_TAG:
+		// Tags only add semantics to the item that follows
+		return decodeCborItem(data, depth+1)
+	}
+
+	return nil, nil, errors.New("Unsupported CBOR major type")
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ##### CBOR Encoding Helpers ################################################
+
+// cborHead returns the initial byte(s) of an item, using the shortest encoding of the value
+func cborHead(majorType byte, value uint64) []byte {
+
+	switch {
+	case value < 24:
+		return []byte{majorType<<5 | byte(value)}
+	case value <= math.MaxUint8:
+		return []byte{majorType<<5 | 24, byte(value)}
+	case value <= math.MaxUint16:
+		return []byte{majorType<<5 | 25, byte(value >> 8), byte(value)}
+	case value <= math.MaxUint32:
+		head := []byte{majorType<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(head[1:], uint32(value))
+		return head
+	}
+
+	head := []byte{majorType<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(head[1:], value)
+	return head
+}
+
+func cborInt(value int64) []byte {
+
+	if value < 0 {
+		return cborHead(CBOR_NEGATIVE, uint64(-1-value))
+	}
+
+	return cborHead(CBOR_UNSIGNED, uint64(value))
+}
+
+func cborBytes(value []byte) []byte {
+
+	return append(cborHead(CBOR_BYTES, uint64(len(value))), value...)
+}
+
+func cborText(value string) []byte {
+
+	return append(cborHead(CBOR_TEXT, uint64(len(value))), value...)
+}
+
+func cborArray(items ...[]byte) []byte {
+
+	return append(cborHead(CBOR_ARRAY, uint64(len(items))), bytes.Join(items, nil)...)
+}
+
+// cborMap returns a map of the alternating keys and values
+func cborMap(keysAndValues ...[]byte) []byte {
+
+	return append(cborHead(CBOR_MAP, uint64(len(keysAndValues)/2)), bytes.Join(keysAndValues, nil)...)
+}
+
+// ##### Tests ################################################################
+
+func TestDecodeCbor(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected interface{}
+	}{
+		{"small unsigned", cborInt(10), int64(10)},
+		{"one byte unsigned", cborInt(200), int64(200)},
+		{"two byte unsigned", cborInt(1000), int64(1000)},
+		{"four byte unsigned", cborInt(100000), int64(100000)},
+		{"eight byte unsigned", cborInt(1 << 40), int64(1 << 40)},
+		{"negative", cborInt(-7), int64(-7)},
+		{"large negative", cborInt(-257), int64(-257)},
+		{"bytes", cborBytes([]byte{1, 2, 3}), []byte{1, 2, 3}},
+		{"text", cborText("none"), "none"},
+		{"array", cborArray(cborInt(1), cborText("a")), []interface{}{int64(1), "a"}},
+		{"map", cborMap(cborInt(1), cborInt(2), cborText("fmt"), cborText("none")), map[interface{}]interface{}{int64(1): int64(2), "fmt": "none"}},
+		{"tag", append([]byte{0xc1}, cborInt(5)...), int64(5)},
+		{"false", []byte{0xf4}, false},
+		{"true", []byte{0xf5}, true},
+		{"null", []byte{0xf6}, nil},
+		{"float", []byte{0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, 1.5},
+	}
+
+	for _, test := range tests {
+		item, rest, err := decodeCbor(append(test.data, 0xff))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if reflect.DeepEqual(item, test.expected) == false {
+			t.Errorf("%s: decoded %#v, expected %#v", test.name, item, test.expected)
+		}
+
+		if bytes.Equal(rest, []byte{0xff}) == false {
+			t.Errorf("%s: remaining data % x, expected ff", test.name, rest)
+		}
+	}
+}
+
+func TestDecodeCborTruncated(t *testing.T) {
+
+	items := [][]byte{
+		cborInt(1000),
+		cborInt(1 << 40),
+		cborBytes([]byte{1, 2, 3, 4}),
+		cborText("webauthn"),
+		cborArray(cborInt(1), cborText("abc")),
+		cborMap(cborInt(1), cborInt(2), cborInt(3), cborBytes(make([]byte, 32))),
+		append([]byte{0xc1}, cborText("abc")...),
+		[]byte{0xfa, 0x3f, 0xc0, 0x00, 0x00},
+	}
+
+	// Every prefix of a valid item is incomplete
+	for _, item := range items {
+		for i := 0; i < len(item); i++ {
+			_, _, err := decodeCbor(item[:i])
+			if err == nil {
+				t.Errorf("Expected an error for % x truncated to %d bytes", item, i)
+			}
+		}
+	}
+
+	// Lengths that exceed the data must not be allocated
+	for _, data := range [][]byte{
+		{0x5b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0x9b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	} {
+		_, _, err := decodeCbor(data)
+		if err == nil {
+			t.Errorf("Expected an error for % x", data)
+		}
+	}
+}
+
+func TestDecodeCborInvalid(t *testing.T) {
+
+	tests := map[string][]byte{
+		"indefinite length array": {0x9f, 0x01, 0xff},
+		"reserved length":         {0x1c},
+		"unsigned overflow":       {0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"negative overflow":       {0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"unsupported simple":      {0xf8, 0x20},
+		"byte string map key":     cborMap(cborBytes([]byte{1}), cborInt(1)),
+	}
+
+	for name, data := range tests {
+		_, _, err := decodeCbor(data)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestDecodeCborDepth(t *testing.T) {
+
+	nested := func(depth int, open byte) []byte {
+		return append(bytes.Repeat([]byte{open}, depth), 0x00)
+	}
+
+	// Arrays (0x81) and maps (0xa1) of one item, with the innermost item at the maximum depth
+	_, _, err := decodeCbor(nested(CBOR_MAX_DEPTH, 0x81))
+	if err != nil {
+		t.Errorf("Error decoding arrays nested to the maximum depth: %v", err)
+	}
+
+	_, _, err = decodeCbor(nested(CBOR_MAX_DEPTH+1, 0x81))
+	if err == nil || strings.Contains(err.Error(), "too deep") == false {
+		t.Errorf("Error = %v, expected nesting too deep", err)
+	}
+
+	mapNested := append(bytes.Repeat([]byte{0xa1, 0x01}, CBOR_MAX_DEPTH+1), 0x00)
+	_, _, err = decodeCbor(mapNested)
+	if err == nil || strings.Contains(err.Error(), "too deep") == false {
+		t.Errorf("Map error = %v, expected nesting too deep", err)
+	}
+
+	// Tags also count towards the depth
+	_, _, err = decodeCbor(nested(CBOR_MAX_DEPTH+1, 0xc1))
+	if err == nil || strings.Contains(err.Error(), "too deep") == false {
+		t.Errorf("Tag error = %v, expected nesting too deep", err)
+	}
+
+	// A deeply nested input must fail quickly rather than exhausting the stack
+	_, _, err = decodeCbor(nested(1000000, 0x81))
+	if err == nil {
+		t.Error("Expected an error for a deeply nested input")
+	}
+}
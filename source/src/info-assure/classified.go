@@ -47,7 +47,7 @@ func routeClassified(c *gin.Context) {
 			goToErrorPage(c, "Unable to perform classification")
 			return
 		}
-		message = performAlertClassification(userID, ids, true)
+		message = performAlertClassification(c, userID, ids, true, ALERT_STATE_NEW, "")
 	}
 
 	loadClassifiedAlertData(c, currentPageNumber, numRecsPerPage, message)
@@ -66,13 +66,13 @@ func loadClassifiedAlertData(
 		return
 	}
 
-	c.HTML(http.StatusOK, "classified", gin.H{
+	c.HTML(http.StatusOK, "classified", getTemplateData(c, gin.H{
 		"current_page_num":  currentPageNumber,
 		"num_recs_per_page": numRecsPerPage,
 		"no_more_records":   noMoreRecords,
 		"data":              data,
 		"error":             error,
-	})
+	}))
 }
 
 //
@@ -94,6 +94,7 @@ func getClassifiedAlerts(numRecsPerPage int, currentPageNumber int) (bool, bool,
 		v.UtcTimeStr = v.UtcTime.Format("15:04:05 02/01/2006")
 		v.TextStr = template.HTML(v.Text)
 		v.LinkedStr = template.HTML(v.Linked)
+		v.DispositionString = AlertState(v.Disposition).String()
 
 		if len(v.Linked) > 0 {
 			v.LinkedColumn = template.HTML("<td style=\"text-align:center\"><a href=\"#\" class=\"togglerLinked\" other-data=\"" + util.ConvertInt64ToString(v.Id) + "\"><i class=\"checkmark icon\"></i></a></td>")
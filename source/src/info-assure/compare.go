@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+// The differences between two sets of autoruns
+const AUTORUN_ADDED string = "added"
+const AUTORUN_REMOVED string = "removed"
+const AUTORUN_MODIFIED string = "modified"
+
+// ##### Structs ##############################################################
+
+// Represents an autorun that differs between two instances of a host. Previous is nil for an added
+// autorun and Current is nil for a removed autorun. Changes only contains the changed fields
+type AutorunDiff struct {
+	Status   string           `json:"status"`
+	Location string           `json:"location"`
+	ItemName string           `json:"item_name"`
+	Profile  string           `json:"profile"`
+	Previous *Autorun         `json:"previous,omitempty"`
+	Current  *Autorun         `json:"current,omitempty"`
+	Changes  []*AutorunChange `json:"changes,omitempty"`
+}
+
+// Represents the comparison of two instances of a host
+type InstanceComparison struct {
+	Host     string         `json:"host"`
+	From     *Instance      `json:"from"`
+	To       *Instance      `json:"to"`
+	Added    int            `json:"added"`
+	Removed  int            `json:"removed"`
+	Modified int            `json:"modified"`
+	Diffs    []*AutorunDiff `json:"diffs"`
+}
+
+// ##### Methods ##############################################################
+
+// autorunKey identifies the same autorun across instances
+func autorunKey(a *Autorun) string {
+
+	return a.Location + "\x1f" + a.ItemName + "\x1f" + a.Profile
+}
+
+// compareFields compares all of the fields of two versions of an autorun, which are named as in AUTORUN_CSV_HEADER
+func compareFields(previous *Autorun, current *Autorun) []*AutorunChange {
+
+	before := autorunCsvRecord(previous)
+	after := autorunCsvRecord(current)
+
+	changes := make([]*AutorunChange, 0, len(AUTORUN_CSV_HEADER))
+	for i, name := range AUTORUN_CSV_HEADER {
+		changes = append(changes, &AutorunChange{
+			Field:    name,
+			Previous: before[i],
+			Current:  after[i],
+			Changed:  before[i] != after[i],
+		})
+	}
+
+	return changes
+}
+
+// changedFields returns the fields that differ between two versions of an autorun
+func changedFields(previous *Autorun, current *Autorun) []*AutorunChange {
+
+	var changes []*AutorunChange
+	for _, c := range compareFields(previous, current) {
+		if c.Changed == true {
+			changes = append(changes, c)
+		}
+	}
+
+	return changes
+}
+
+// compareAutoruns returns the autoruns that were added, removed or modified between the previous and current
+// autoruns. Autoruns are matched by location, name and profile. If there are several autoruns with the same
+// key, the identical autoruns are matched first and the remainder are treated as modified, added or removed
+func compareAutoruns(previous []*Autorun, current []*Autorun) []*AutorunDiff {
+
+	previousKeys := make(map[string][]*Autorun)
+	for _, a := range previous {
+		previousKeys[autorunKey(a)] = append(previousKeys[autorunKey(a)], a)
+	}
+
+	currentKeys := make(map[string][]*Autorun)
+	for _, a := range current {
+		currentKeys[autorunKey(a)] = append(currentKeys[autorunKey(a)], a)
+	}
+
+	var diffs []*AutorunDiff
+
+	for key, before := range previousKeys {
+		after := currentKeys[key]
+
+		// Remove the identical autoruns
+		var unmatched []*Autorun
+		for _, p := range before {
+			matched := false
+			for i, c := range after {
+				if len(changedFields(p, c)) == 0 {
+					after = append(after[:i:i], after[i+1:]...)
+					matched = true
+					break
+				}
+			}
+
+			if matched == false {
+				unmatched = append(unmatched, p)
+			}
+		}
+
+		for i, p := range unmatched {
+			if i < len(after) {
+				diffs = append(diffs, &AutorunDiff{Status: AUTORUN_MODIFIED, Previous: p, Current: after[i], Changes: changedFields(p, after[i])})
+			} else {
+				diffs = append(diffs, &AutorunDiff{Status: AUTORUN_REMOVED, Previous: p})
+			}
+		}
+
+		for i := len(unmatched); i < len(after); i++ {
+			diffs = append(diffs, &AutorunDiff{Status: AUTORUN_ADDED, Current: after[i]})
+		}
+
+		delete(currentKeys, key)
+	}
+
+	for _, after := range currentKeys {
+		for _, c := range after {
+			diffs = append(diffs, &AutorunDiff{Status: AUTORUN_ADDED, Current: c})
+		}
+	}
+
+	for _, d := range diffs {
+		a := d.Current
+		if a == nil {
+			a = d.Previous
+		}
+
+		d.Location = a.Location
+		d.ItemName = a.ItemName
+		d.Profile = a.Profile
+	}
+
+	sort.SliceStable(diffs, func(i, j int) bool {
+		if diffs[i].Location != diffs[j].Location {
+			return diffs[i].Location < diffs[j].Location
+		}
+		if diffs[i].ItemName != diffs[j].ItemName {
+			return diffs[i].ItemName < diffs[j].ItemName
+		}
+		if diffs[i].Profile != diffs[j].Profile {
+			return diffs[i].Profile < diffs[j].Profile
+		}
+		return diffs[i].Status < diffs[j].Status
+	})
+
+	return diffs
+}
+
+// getInstanceComparison compares the autoruns of two instances of the same host
+func getInstanceComparison(fromID int64, toID int64) (*InstanceComparison, string) {
+
+	from, err := getInstance(fromID)
+	if err != nil {
+		logger.Errorf("Error querying for compare instance: %v (Instance: %d)", err, fromID)
+		return nil, "Invalid instance"
+	}
+
+	to, err := getInstance(toID)
+	if err != nil {
+		logger.Errorf("Error querying for compare instance: %v (Instance: %d)", err, toID)
+		return nil, "Invalid instance"
+	}
+
+	if strings.ToLower(from.Host) != strings.ToLower(to.Host) {
+		return nil, "The instances must be from the same host"
+	}
+
+	previous, errored := getSingleHostAutoruns(fromID)
+	if errored == true {
+		return nil, "Error retrieving autoruns"
+	}
+
+	current, errored := getSingleHostAutoruns(toID)
+	if errored == true {
+		return nil, "Error retrieving autoruns"
+	}
+
+	comparison := &InstanceComparison{
+		Host:  to.Host,
+		From:  from,
+		To:    to,
+		Diffs: compareAutoruns(previous, current),
+	}
+
+	for _, d := range comparison.Diffs {
+		switch d.Status {
+		case AUTORUN_ADDED:
+			comparison.Added++
+		case AUTORUN_REMOVED:
+			comparison.Removed++
+		case AUTORUN_MODIFIED:
+			comparison.Modified++
+		}
+	}
+
+	return comparison, ""
+}
+
+// generateComparisonCsv returns the CSV content as a byte slice. There is one row per changed field of a modified
+// autorun, and one row per field of an added or removed autorun
+func generateComparisonCsv(comparison *InstanceComparison) []byte {
+
+	buffer := new(bytes.Buffer)
+	cw := csv.NewWriter(buffer)
+	cw.Write([]string{"STATUS", "LOCATION", "NAME", "PROFILE", "FIELD", "PREVIOUS", "CURRENT"})
+
+	for _, d := range comparison.Diffs {
+		switch d.Status {
+		case AUTORUN_MODIFIED:
+			for _, c := range d.Changes {
+				cw.Write([]string{d.Status, d.Location, d.ItemName, d.Profile, c.Field, c.Previous, c.Current})
+			}
+		case AUTORUN_ADDED:
+			for _, c := range compareFields(d.Current, d.Current) {
+				cw.Write([]string{d.Status, d.Location, d.ItemName, d.Profile, c.Field, "", c.Current})
+			}
+		case AUTORUN_REMOVED:
+			for _, c := range compareFields(d.Previous, d.Previous) {
+				cw.Write([]string{d.Status, d.Location, d.ItemName, d.Profile, c.Field, c.Previous, ""})
+			}
+		}
+	}
+
+	cw.Flush()
+
+	return buffer.Bytes()
+}
+
+// ***** Routing Methods ******************************************************
+
+// routeCompare compares the autoruns of two instances of a host. The comparison can be downloaded as CSV or JSON
+func routeCompare(c *gin.Context) {
+
+	fromID, successful := processInt64Parameter(c.Query("from"))
+	if successful == false {
+		c.String(http.StatusBadRequest, "Invalid instance")
+		return
+	}
+
+	toID, successful := processInt64Parameter(c.Query("to"))
+	if successful == false {
+		c.String(http.StatusBadRequest, "Invalid instance")
+		return
+	}
+
+	comparison, message := getInstanceComparison(fromID, toID)
+	if len(message) > 0 {
+		c.String(http.StatusBadRequest, message)
+		return
+	}
+
+	format := c.Query("format")
+	if format == "csv" || format == "json" {
+		writeAudit(c, AUDIT_COMPARE_DOWNLOAD, AUDIT_TARGET_INSTANCE, fmt.Sprintf("%d,%d", fromID, toID), comparison.Host)
+
+		filename := fmt.Sprintf("%s-%d-%d.%s", comparison.Host, fromID, toID, format)
+		c.Header("Content-Disposition", "attachment; filename="+filename)
+
+		if format == "json" {
+			c.JSON(http.StatusOK, comparison)
+			return
+		}
+
+		c.Data(http.StatusOK, "text/csv", generateComparisonCsv(comparison))
+		return
+	}
+
+	for _, d := range comparison.Diffs {
+		a := d.Current
+		if a == nil {
+			a = d.Previous
+		}
+		a.LocationStr = template.HTML("<td class=\"poppy\" data-variation=\"basic\" data-content=\"" + template.HTMLEscapeString(a.Location) + "\">" + template.HTMLEscapeString(splitRegKey(a.Location)) + "</td>")
+	}
+
+	c.HTML(http.StatusOK, "compare", getTemplateData(c, gin.H{
+		"comparison": comparison,
+		"from":       comparison.From.Timestamp.Format("15:04:05 02/01/2006"),
+		"to":         comparison.To.Timestamp.Format("15:04:05 02/01/2006"),
+	}))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ##### Helpers ##############################################################
+
+// testAutorun returns an autorun of the location, name and profile. The launch string identifies
+// the version of the autorun within the tests
+func testAutorun(location string, itemName string, profile string, launchString string) *Autorun {
+
+	return &Autorun{
+		Location:      location,
+		ItemName:      itemName,
+		Profile:       profile,
+		LaunchString:  launchString,
+		Enabled:       true,
+		Description:   "Test",
+		Company:       "Test Ltd",
+		Signer:        "Test Signer",
+		VersionNumber: "1.0",
+		FilePath:      "c:\\test\\test.exe",
+		Time:          time.Date(2019, 5, 1, 10, 0, 0, 0, time.UTC),
+		Sha256:        strings.Repeat("a", 64),
+		Md5:           strings.Repeat("b", 32),
+	}
+}
+
+// formatDiffs returns a summary of each diff i.e. the status, name, launch strings and changed fields
+func formatDiffs(diffs []*AutorunDiff) []string {
+
+	ret := make([]string, 0, len(diffs))
+	for _, d := range diffs {
+		previous, current := "", ""
+		if d.Previous != nil {
+			previous = d.Previous.LaunchString
+		}
+		if d.Current != nil {
+			current = d.Current.LaunchString
+		}
+
+		fields := make([]string, 0, len(d.Changes))
+		for _, c := range d.Changes {
+			fields = append(fields, c.Field)
+		}
+
+		ret = append(ret, fmt.Sprintf("%s %s/%s %s>%s %s", d.Status, d.ItemName, d.Profile, previous, current, strings.Join(fields, ",")))
+	}
+
+	return ret
+}
+
+// ##### Tests ################################################################
+
+func TestCompareAutoruns(t *testing.T) {
+
+	describe := func(a *Autorun, description string) *Autorun {
+		a.Description = description
+		return a
+	}
+
+	timed := func(a *Autorun, t time.Time) *Autorun {
+		a.Time = t
+		return a
+	}
+
+	hashed := func(a *Autorun, sha256 string, md5 string) *Autorun {
+		a.Sha256 = sha256
+		a.Md5 = md5
+		return a
+	}
+
+	tests := []struct {
+		name     string
+		previous []*Autorun
+		current  []*Autorun
+		expected []string
+	}{
+		{"identical",
+			[]*Autorun{testAutorun("Run", "a", "", "x"), testAutorun("Run", "b", "", "y")},
+			[]*Autorun{testAutorun("Run", "b", "", "y"), testAutorun("Run", "a", "", "x")},
+			[]string{}},
+		{"added and removed",
+			[]*Autorun{testAutorun("Run", "a", "", "x")},
+			[]*Autorun{testAutorun("Run", "b", "", "y")},
+			[]string{"removed a/ x> ", "added b/ >y "}},
+		{"launch string modified",
+			[]*Autorun{testAutorun("Run", "a", "", "x")},
+			[]*Autorun{testAutorun("Run", "a", "", "y")},
+			[]string{"modified a/ x>y LAUNCH_STRING"}},
+		{"description modified",
+			[]*Autorun{testAutorun("Run", "a", "", "x")},
+			[]*Autorun{describe(testAutorun("Run", "a", "", "x"), "Changed")},
+			[]string{"modified a/ x>x DESCRIPTION"}},
+		{"timestamp modified",
+			[]*Autorun{testAutorun("Run", "a", "", "x")},
+			[]*Autorun{timed(testAutorun("Run", "a", "", "x"), time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC))},
+			[]string{"modified a/ x>x TIMESTAMP"}},
+		{"several fields modified",
+			[]*Autorun{testAutorun("Run", "a", "", "x")},
+			[]*Autorun{hashed(testAutorun("Run", "a", "", "y"), strings.Repeat("c", 64), strings.Repeat("d", 32))},
+			[]string{"modified a/ x>y LAUNCH_STRING,SHA256,MD5"}},
+		{"profiles are separate autoruns",
+			[]*Autorun{testAutorun("Run", "a", "alice", "x")},
+			[]*Autorun{testAutorun("Run", "a", "bob", "x")},
+			[]string{"removed a/alice x> ", "added a/bob >x "}},
+		{"duplicate keys matched identically first",
+			[]*Autorun{testAutorun("Run", "a", "", "x"), testAutorun("Run", "a", "", "y")},
+			[]*Autorun{testAutorun("Run", "a", "", "y"), testAutorun("Run", "a", "", "z")},
+			[]string{"modified a/ x>z LAUNCH_STRING"}},
+		{"duplicate keys unchanged",
+			[]*Autorun{testAutorun("Run", "a", "", "x"), testAutorun("Run", "a", "", "y")},
+			[]*Autorun{testAutorun("Run", "a", "", "y"), testAutorun("Run", "a", "", "x")},
+			[]string{}},
+		{"duplicate keys added",
+			[]*Autorun{testAutorun("Run", "a", "", "x")},
+			[]*Autorun{testAutorun("Run", "a", "", "x"), testAutorun("Run", "a", "", "z")},
+			[]string{"added a/ >z "}},
+		{"duplicate keys removed",
+			[]*Autorun{testAutorun("Run", "a", "", "x"), testAutorun("Run", "a", "", "y")},
+			[]*Autorun{testAutorun("Run", "a", "", "y")},
+			[]string{"removed a/ x> "}},
+		{"identical duplicates",
+			[]*Autorun{testAutorun("Run", "a", "", "x"), testAutorun("Run", "a", "", "x")},
+			[]*Autorun{testAutorun("Run", "a", "", "x")},
+			[]string{"removed a/ x> "}},
+		{"duplicate keys all modified",
+			[]*Autorun{testAutorun("Run", "a", "", "w"), testAutorun("Run", "a", "", "x")},
+			[]*Autorun{testAutorun("Run", "a", "", "y"), testAutorun("Run", "a", "", "z")},
+			[]string{"modified a/ w>y LAUNCH_STRING", "modified a/ x>z LAUNCH_STRING"}},
+		{"sorted by location and name",
+			[]*Autorun{testAutorun("Services", "a", "", "x"), testAutorun("Run", "c", "", "x")},
+			[]*Autorun{testAutorun("Run", "b", "", "y")},
+			[]string{"added b/ >y ", "removed c/ x> ", "removed a/ x> "}},
+		{"no previous autoruns",
+			nil,
+			[]*Autorun{testAutorun("Run", "a", "", "x")},
+			[]string{"added a/ >x "}},
+	}
+
+	for _, test := range tests {
+		diffs := formatDiffs(compareAutoruns(test.previous, test.current))
+
+		if reflect.DeepEqual(diffs, test.expected) == false {
+			t.Errorf("%s: diffs %q, expected %q", test.name, diffs, test.expected)
+		}
+	}
+}
+
+func TestCompareFields(t *testing.T) {
+
+	previous := testAutorun("Run", "a", "", "x")
+	current := testAutorun("Run", "a", "", "x")
+	current.Company = "Other Ltd"
+	current.Enabled = false
+
+	changes := compareFields(previous, current)
+	if len(changes) != len(AUTORUN_CSV_HEADER) {
+		t.Fatalf("Compared %d fields, expected %d", len(changes), len(AUTORUN_CSV_HEADER))
+	}
+
+	var changed []string
+	for i, c := range changes {
+		if c.Field != AUTORUN_CSV_HEADER[i] {
+			t.Errorf("Field %d is %s, expected %s", i, c.Field, AUTORUN_CSV_HEADER[i])
+		}
+
+		if c.Changed == true {
+			changed = append(changed, fmt.Sprintf("%s:%s>%s", c.Field, c.Previous, c.Current))
+		}
+	}
+
+	expected := []string{"ENABLED:true>false", "COMPANY:Test Ltd>Other Ltd"}
+	if reflect.DeepEqual(changed, expected) == false {
+		t.Errorf("Changed %q, expected %q", changed, expected)
+	}
+}
@@ -11,7 +11,62 @@ type Config struct {
 	Debug            bool   `yaml:"debug"`
 	//StaticDir                     string `yaml:"static_dir"`
 	//TemplateDir                   string `yaml:"template_dir"`
-	ExportDir                     string `yaml:"export_dir"`
-	MaxFailedLogins               int16  `yaml:"max_failed_logins"`
-	InactiveSessionTimeoutSeconds int    `yaml:"session_timeout_seconds`
+	ExportDir                     string               `yaml:"export_dir"`
+	MaxFailedLogins               int16                `yaml:"max_failed_logins"`
+	InactiveSessionTimeoutSeconds int                  `yaml:"session_timeout_seconds"`
+	Oidc                          OidcConfig           `yaml:"oidc"`
+	AuthBackend                   string               `yaml:"auth_backend"`
+	Ldap                          LdapConfig           `yaml:"ldap"`
+	Webauthn                      WebauthnConfig       `yaml:"webauthn"`
+	PasswordPolicy                PasswordPolicyConfig `yaml:"password_policy"`
+	SessionSecret                 string               `yaml:"session_secret"`
+	RuleIntervalMinutes           int                  `yaml:"rule_interval_minutes"`
+	PrevalenceIntervalMinutes     int                  `yaml:"prevalence_interval_minutes"`
+	HostStaleHours                int                  `yaml:"host_stale_hours"`
+}
+
+// Stores the OpenID Connect single sign-on configuration
+type OidcConfig struct {
+	Enabled               bool     `yaml:"enabled"`
+	Issuer                string   `yaml:"issuer"`
+	ClientID              string   `yaml:"client_id"`
+	ClientSecret          string   `yaml:"client_secret"`
+	RedirectUrl           string   `yaml:"redirect_url"`
+	Scopes                []string `yaml:"scopes"`
+	UsernameClaim         string   `yaml:"username_claim"`
+	GroupClaim            string   `yaml:"group_claim"`
+	AdminGroups           []string `yaml:"admin_groups"`
+	UserGroups            []string `yaml:"user_groups"`
+	TlsInsecureSkipVerify bool     `yaml:"tls_insecure_skip_verify"`
+}
+
+// Stores the LDAP/Active Directory authentication configuration
+type LdapConfig struct {
+	Url                   string   `yaml:"url"`
+	StartTls              bool     `yaml:"start_tls"`
+	TlsInsecureSkipVerify bool     `yaml:"tls_insecure_skip_verify"`
+	BindDn                string   `yaml:"bind_dn"`
+	BindPassword          string   `yaml:"bind_password"`
+	BaseDn                string   `yaml:"base_dn"`
+	UserAttribute         string   `yaml:"user_attribute"`
+	UserObjectClass       string   `yaml:"user_object_class"`
+	NameAttribute         string   `yaml:"name_attribute"`
+	GroupAttribute        string   `yaml:"group_attribute"`
+	AdminGroups           []string `yaml:"admin_groups"`
+	UserGroups            []string `yaml:"user_groups"`
+	TimeoutSeconds        int      `yaml:"timeout_seconds"`
+}
+
+// Stores the WebAuthn (security key) relying party configuration
+type WebauthnConfig struct {
+	RpID    string   `yaml:"rp_id"`
+	RpName  string   `yaml:"rp_name"`
+	Origins []string `yaml:"origins"`
+}
+
+// Stores the password policy applied to local users
+type PasswordPolicyConfig struct {
+	MinLength            int  `yaml:"min_length"`
+	CheckCommonPasswords bool `yaml:"check_common_passwords"`
+	HistoryCount         int  `yaml:"history_count"`
 }
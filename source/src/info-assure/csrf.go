@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+const CSRF_FIELD_NAME string = "csrf_token"
+const CSRF_HEADER_NAME string = "X-CSRF-Token"
+
+// ##### Methods ##############################################################
+
+// CsrfMiddleware implements synchronizer token CSRF protection. Each session has a
+// random token, which must be supplied with every state changing request either
+// as a form field (HTML forms) or as a header (AJAX requests)
+func CsrfMiddleware() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		session, err := sessionStore.Get(c.Request, APP_NAME)
+		if err != nil {
+			c.Abort()
+			c.Redirect(http.StatusFound, "/")
+			return
+		}
+
+		token, _ := session.Values[CSRF_FIELD_NAME].(string)
+		if len(token) == 0 {
+			token, err = generateSessionToken()
+			if err != nil {
+				log.Printf("Error generating CSRF token: %v\n", err)
+				c.Abort()
+				goToErrorPage(c, "Unable to generate CSRF token")
+				return
+			}
+
+			session.Values[CSRF_FIELD_NAME] = token
+			err = session.Save(c.Request, c.Writer)
+			if err != nil {
+				log.Printf("Error saving CSRF token: %v\n", err)
+				c.Abort()
+				goToErrorPage(c, "Unable to save CSRF token")
+				return
+			}
+		}
+
+		if isSafeMethod(c.Request.Method) == false {
+			supplied := c.GetHeader(CSRF_HEADER_NAME)
+			if len(supplied) == 0 {
+				supplied = c.PostForm(CSRF_FIELD_NAME)
+			}
+
+			if isValidCsrfToken(supplied, token) == false {
+				log.Printf("Error validating CSRF token: %s %s (%s)\n", c.Request.Method, c.Request.URL.Path, getRequestIp(c.Request))
+				c.Abort()
+				c.HTML(http.StatusForbidden, "forbidden", gin.H{})
+				return
+			}
+		}
+
+		c.Set(CSRF_FIELD_NAME, token)
+		c.Next()
+	}
+}
+
+// isSafeMethod returns true for the HTTP methods that do not change state
+func isSafeMethod(method string) bool {
+
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	return false
+}
+
+// isValidCsrfToken compares the supplied token with the session's token in constant time
+func isValidCsrfToken(supplied string, token string) bool {
+
+	if len(token) == 0 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(supplied), []byte(token)) == 1
+}
+
+// getTemplateData adds the values required by every authorized page (the CSRF token) to the template data
+func getTemplateData(c *gin.Context, data gin.H) gin.H {
+
+	data[CSRF_FIELD_NAME] = c.GetString(CSRF_FIELD_NAME)
+	return data
+}
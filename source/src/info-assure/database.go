@@ -9,113 +9,133 @@ import (
 
 // Represents an "instance" record
 type Instance struct {
-	Id        int64     `db:"id"`
-	Domain    string    `db:"domain"`
-	Host      string    `db:"host"`
-	Timestamp time.Time `db:"timestamp"`
+	Id        int64     `db:"id" json:"id"`
+	Domain    string    `db:"domain" json:"domain"`
+	Host      string    `db:"host" json:"host"`
+	Timestamp time.Time `db:"timestamp" json:"timestamp"`
 }
 
 // Base fields that all database tables support
 type Base struct {
-	Id         int64     `db:"id"`
-	Domain     string    `db:"domain"`
-	Host       string    `db:"host"`
-	UtcTime    time.Time `db:"timestamp"`
-	UtcTimeStr string    `db:"-"`
+	Id         int64     `db:"id" json:"id"`
+	Domain     string    `db:"domain" json:"domain"`
+	Host       string    `db:"host" json:"host"`
+	UtcTime    time.Time `db:"timestamp" json:"timestamp"`
+	UtcTimeStr string    `db:"-" json:"-"`
+}
+
+// Represents the number of hosts that share an autorun's artefacts (see SQL_PREVALENCE_COLUMNS). The
+// prevalence is nil if the artefacts have not been counted yet
+type ArtefactPrevalence struct {
+	Prevalence             *int64 `db:"prevalence" json:"prevalence"`
+	PrevalenceSha256       int64  `db:"prevalence_sha256" json:"prevalence_sha256"`
+	PrevalenceLaunchString int64  `db:"prevalence_launch_string" json:"prevalence_launch_string"`
+	PrevalenceItem         int64  `db:"prevalence_item" json:"prevalence_item"`
 }
 
 // Represents an "autorun" record
 type Autorun struct {
-	Id            int64         `db:"id"`
-	Instance      int64         `db:"instance"`
-	FilePath      string        `db:"file_path"`
-	FileName      string        `db:"file_name"`
-	FileDirectory string        `db:"file_directory"`
-	Location      string        `db:"location"`
-	LocationStr   template.HTML `db:"-"`
-	ItemName      string        `db:"item_name"`
-	Enabled       bool          `db:"enabled"`
-	Profile       string        `db:"profile"`
-	LaunchString  string        `db:"launch_string"`
-	Description   string        `db:"description"`
-	Company       string        `db:"company"`
-	Signer        string        `db:"signer"`
-	VersionNumber string        `db:"version_number"`
-	Time          time.Time     `db:"time"`
-	TimeStr       string        `db:"-"`
-	Sha256        string        `db:"sha256"`
-	Md5           string        `db:"md5"`
-	Text          string        `db:"text"`
-	TextStr       template.HTML `db:"-"`
+	Id            int64         `db:"id" json:"id"`
+	Instance      int64         `db:"instance" json:"instance"`
+	FilePath      string        `db:"file_path" json:"file_path"`
+	FileName      string        `db:"file_name" json:"file_name"`
+	FileDirectory string        `db:"file_directory" json:"file_directory"`
+	Location      string        `db:"location" json:"location"`
+	LocationStr   template.HTML `db:"-" json:"-"`
+	ItemName      string        `db:"item_name" json:"item_name"`
+	Enabled       bool          `db:"enabled" json:"enabled"`
+	Profile       string        `db:"profile" json:"profile"`
+	LaunchString  string        `db:"launch_string" json:"launch_string"`
+	Description   string        `db:"description" json:"description"`
+	Company       string        `db:"company" json:"company"`
+	Signer        string        `db:"signer" json:"signer"`
+	VersionNumber string        `db:"version_number" json:"version_number"`
+	Time          time.Time     `db:"time" json:"time"`
+	TimeStr       string        `db:"-" json:"-"`
+	Sha256        string        `db:"sha256" json:"sha256"`
+	Md5           string        `db:"md5" json:"md5"`
+	Text          string        `db:"text" json:"text"`
+	TextStr       template.HTML `db:"-" json:"-"`
+	SortKey       string        `db:"sort_key" json:"-"`
+	ArtefactPrevalence
 }
 
 // Represents an "alert" record
 type Alert struct {
 	Base
-	AutorunId     int64         `db:"autorun_id"`
-	Instance      int64         `db:"instance"`
-	FilePath      string        `db:"file_path"`
-	FileName      string        `db:"file_name"`
-	FileDirectory string        `db:"file_directory"`
-	Location      string        `db:"location"`
-	LocationStr   template.HTML `db:"-"`
-	ItemName      string        `db:"item_name"`
-	Enabled       bool          `db:"enabled"`
-	Profile       string        `db:"profile"`
-	LaunchString  string        `db:"launch_string"`
-	Description   string        `db:"description"`
-	Company       string        `db:"company"`
-	Signer        string        `db:"signer"`
-	VersionNumber string        `db:"version_number"`
-	Time          time.Time     `db:"time"`
-	TimeStr       string        `db:"-"`
-	Sha256        string        `db:"sha256"`
-	Md5           string        `db:"md5"`
-	Text          string        `db:"text"`
-	TextStr       template.HTML `db:"-"`
-	Linked        string        `db:"linked"`
-	LinkedStr     template.HTML `db:"-"`
-	LinkedColumn  template.HTML `db:"-"`
-	Verified      int8          `db:"verified"`
+	AutorunId     int64         `db:"autorun_id" json:"autorun_id"`
+	Instance      int64         `db:"instance" json:"instance"`
+	FilePath      string        `db:"file_path" json:"file_path"`
+	FileName      string        `db:"file_name" json:"file_name"`
+	FileDirectory string        `db:"file_directory" json:"file_directory"`
+	Location      string        `db:"location" json:"location"`
+	LocationStr   template.HTML `db:"-" json:"-"`
+	ItemName      string        `db:"item_name" json:"item_name"`
+	Enabled       bool          `db:"enabled" json:"enabled"`
+	Profile       string        `db:"profile" json:"profile"`
+	LaunchString  string        `db:"launch_string" json:"launch_string"`
+	Description   string        `db:"description" json:"description"`
+	Company       string        `db:"company" json:"company"`
+	Signer        string        `db:"signer" json:"signer"`
+	VersionNumber string        `db:"version_number" json:"version_number"`
+	Time          time.Time     `db:"time" json:"time"`
+	TimeStr       string        `db:"-" json:"-"`
+	Sha256        string        `db:"sha256" json:"sha256"`
+	Md5           string        `db:"md5" json:"md5"`
+	Text          string        `db:"text" json:"text"`
+	TextStr       template.HTML `db:"-" json:"-"`
+	Linked        string        `db:"linked" json:"linked"`
+	LinkedStr     template.HTML `db:"-" json:"-"`
+	LinkedColumn  template.HTML `db:"-" json:"-"`
+	Verified      int8          `db:"verified" json:"verified"`
+	State         int16         `db:"state" json:"state"`
+	StateString   string        `db:"-" json:"-"`
+	AssignedTo    string        `db:"assigned_to" json:"assigned_to"`
+	AssignedID    int64         `db:"assigned_user_id" json:"assigned_user_id"`
+	SortKey       string        `db:"sort_key" json:"-"`
+	ArtefactPrevalence
 }
 
 // Represents an "classification" record
 type ClassifiedAlert struct {
 	Base
-	AutorunId     int64         `db:"autorun_id"`
-	Instance      int64         `db:"instance"`
-	FilePath      string        `db:"file_path"`
-	FileName      string        `db:"file_name"`
-	FileDirectory string        `db:"file_directory"`
-	Location      string        `db:"location"`
-	LocationStr   template.HTML `db:"-"`
-	ItemName      string        `db:"item_name"`
-	Enabled       bool          `db:"enabled"`
-	Profile       string        `db:"profile"`
-	LaunchString  string        `db:"launch_string"`
-	Description   string        `db:"description"`
-	Company       string        `db:"company"`
-	Signer        string        `db:"signer"`
-	VersionNumber string        `db:"version_number"`
-	Time          time.Time     `db:"time"`
-	TimeStr       string        `db:"-"`
-	Sha256        string        `db:"sha256"`
-	Md5           string        `db:"md5"`
-	Text          string        `db:"text"`
-	TextStr       template.HTML `db:"-"`
-	Linked        string        `db:"linked"`
-	LinkedStr     template.HTML `db:"-"`
-	LinkedColumn  template.HTML `db:"-"`
-	Verified      int8          `db:"verified"`
-	ClassifiedBy  string        `db:"classified_by"`
-	Classified    time.Time     `db:"classified"`
+	AutorunId         int64         `db:"autorun_id" json:"autorun_id"`
+	Instance          int64         `db:"instance" json:"instance"`
+	FilePath          string        `db:"file_path" json:"file_path"`
+	FileName          string        `db:"file_name" json:"file_name"`
+	FileDirectory     string        `db:"file_directory" json:"file_directory"`
+	Location          string        `db:"location" json:"location"`
+	LocationStr       template.HTML `db:"-" json:"-"`
+	ItemName          string        `db:"item_name" json:"item_name"`
+	Enabled           bool          `db:"enabled" json:"enabled"`
+	Profile           string        `db:"profile" json:"profile"`
+	LaunchString      string        `db:"launch_string" json:"launch_string"`
+	Description       string        `db:"description" json:"description"`
+	Company           string        `db:"company" json:"company"`
+	Signer            string        `db:"signer" json:"signer"`
+	VersionNumber     string        `db:"version_number" json:"version_number"`
+	Time              time.Time     `db:"time" json:"time"`
+	TimeStr           string        `db:"-" json:"-"`
+	Sha256            string        `db:"sha256" json:"sha256"`
+	Md5               string        `db:"md5" json:"md5"`
+	Text              string        `db:"text" json:"text"`
+	TextStr           template.HTML `db:"-" json:"-"`
+	Linked            string        `db:"linked" json:"linked"`
+	LinkedStr         template.HTML `db:"-" json:"-"`
+	LinkedColumn      template.HTML `db:"-" json:"-"`
+	Verified          int8          `db:"verified" json:"verified"`
+	ClassifiedBy      string        `db:"classified_by" json:"classified_by"`
+	Classified        time.Time     `db:"classified" json:"classified"`
+	Disposition       int16         `db:"disposition" json:"disposition"`
+	DispositionString string        `db:"-" json:"-"`
+	Reason            string        `db:"reason" json:"reason"`
 }
 
 // Represents an "export" record
 type Export struct {
-	Id        int64         `db:"id"`
-	DataType  string        `db:"data_type"`
-	FileName  string        `db:"file_name"`
-	Updated   time.Time     `db:"updated"`
-	OtherData template.HTML `db:"-"`
+	Id        int64         `db:"id" json:"id"`
+	DataType  string        `db:"data_type" json:"data_type"`
+	FileName  string        `db:"file_name" json:"file_name"`
+	Updated   time.Time     `db:"updated" json:"updated"`
+	OtherData template.HTML `db:"-" json:"-"`
 }
@@ -1,11 +1,10 @@
 package main
 
 import (
+	"html/template"
 	"log"
 	"net/http"
-	"strings"
 
-	"github.com/dgryski/dgoogauth"
 	"github.com/gin-gonic/gin"
 )
 
@@ -26,13 +25,19 @@ func routeEnrollGet(c *gin.Context) {
 		return
 	}
 
+	loadEnrollData(c, u, "")
+}
+
+// loadEnrollData renders the enroll page, with the QR code for the user's MFA secret
+func loadEnrollData(c *gin.Context, u *User, message template.HTML) {
+
 	qr, err := generateQr(u.MfaSecret)
 	if err != nil {
 		goToErrorPage(c, "Unable to perform login")
 		return
 	}
 
-	c.HTML(http.StatusOK, "enroll", gin.H{"qr": qr, "code": ""})
+	c.HTML(http.StatusOK, "enroll", getTemplateData(c, gin.H{"qr": qr, "code": "", "webauthn": webauthnRP != nil, "message": message}))
 }
 
 //
@@ -52,46 +57,52 @@ func routeEnrollPost(c *gin.Context) {
 		return
 	}
 
-	token := c.Request.FormValue("code")
-
-	// setup the one-time-password configuration.
-	otpConfig := &dgoogauth.OTPConfig{
-		Secret:      strings.TrimSpace(u.MfaSecret),
-		WindowSize:  3,
-		HotpCounter: 0,
+	ok, err := u.VerifyMfaCode(c.Request.FormValue("code"))
+	if err != nil {
+		log.Printf("Error verifying MFA code for enroll: %v\n", err)
+		goToErrorPage(c, "Unable perform enroll")
+		return
 	}
 
-	// Validate token
-	ok, err := otpConfig.Authenticate(strings.TrimSpace(token))
-
 	// if the token is invalid or expired
 	if ok == false {
+		loadEnrollData(c, u, "")
+		return
+	}
+
+	completeEnroll(c, u, MFA_METHOD_TOTP)
+}
+
+// completeEnroll marks the user's second factor as set and displays their recovery codes
+func completeEnroll(c *gin.Context, u *User, method string) {
+
+	u.MfaSet = true
+	err := u.Update()
+	if err != nil {
+		log.Printf("Error updating user for enroll verification: %v\n", err)
+		goToErrorPage(c, "Unable perform enroll")
+		return
+	}
+
+	session, _ := sessionStore.Get(c.Request, APP_NAME)
+	session.Values["mfa_set"] = u.MfaSet
+	// The second factor was just used, so there is no need to verify again
+	session.Values["mfa_verified"] = true
+	err = session.Save(c.Request, c.Writer)
+	if err != nil {
+		log.Printf("Error saving user session (enroll): %v\n", err)
+		goToErrorPage(c, "Unable perform enroll")
+		return
+	}
 
-		qr, err := generateQr(u.MfaSecret)
-		if err != nil {
-			goToErrorPage(c, "Unable to perform login")
-			return
-		}
-
-		c.HTML(http.StatusOK, "enroll", gin.H{"qr": qr, "code": ""})
-	} else {
-		u.MfaSet = true
-		err = u.Update()
-		if err != nil {
-			log.Printf("Error updating user for enroll verification: %v\n", err)
-			goToErrorPage(c, "Unable perform enroll")
-			return
-		}
-
-		session, _ := sessionStore.Get(c.Request, APP_NAME)
-		session.Values["mfa_set"] = u.MfaSet
-		err = session.Save(c.Request, c.Writer)
-		if err != nil {
-			log.Printf("Error saving user session (enroll): %v\n", err)
-			goToErrorPage(c, "Unable perform enroll")
-			return
-		}
-
-		c.Redirect(http.StatusFound, "/alerts")
+	codes, err := generateRecoveryCodes(u.ID)
+	if err != nil {
+		log.Printf("Error generating recovery codes (enroll): %v\n", err)
+		goToErrorPage(c, "Unable perform enroll")
+		return
 	}
+
+	writeAuditFor(c, u.ID, u.Username, AUDIT_MFA_ENROLL, AUDIT_TARGET_USER, convertInt64ToString(u.ID), method)
+
+	renderRecoveryCodes(c, codes, "/alerts")
 }
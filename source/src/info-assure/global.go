@@ -3,6 +3,7 @@ package main
 const ALERT_YELLOW string = `<div class="alert alert-warning" role="alert">%v</div>`
 const ALERT_RED string = `<div class="alert alert-danger" role="alert">%v</div>`
 const ALERT_GREEN string = `<div class="alert alert-success" role="alert">%v</div>`
+const ALERT_BLUE string = `<div class="alert alert-info" role="alert">%v</div>`
 
 type AccountType int16
 
@@ -22,6 +23,69 @@ func (at AccountType) String() string {
 	return names[at]
 }
 
+const (
+	AUTH_PROVIDER_LOCAL = "local"
+	AUTH_PROVIDER_OIDC  = "oidc"
+	AUTH_PROVIDER_LDAP  = "ldap"
+)
+
+const AUTH_BACKEND_DATABASE = "database"
+
+const PASSWORD_MAX_LENGTH = 50
+
+// bcrypt ignores anything after the first 72 bytes of a password
+const PASSWORD_MAX_BYTES = 72
+
+// Loaded into the common_passwords table when the table is empty
+const COMMON_PASSWORDS_FILE = "./common-passwords.txt"
+
+type TokenScope int16
+
+const (
+	TOKEN_SCOPE_READ     TokenScope = 0
+	TOKEN_SCOPE_CLASSIFY TokenScope = 1
+)
+
+func (ts TokenScope) String() string {
+
+	names := [...]string{"Read Only", "Classify"}
+
+	if ts < TOKEN_SCOPE_READ || ts > TOKEN_SCOPE_CLASSIFY {
+		return "Unknown"
+	}
+
+	return names[ts]
+}
+
+type AlertState int16
+
+// Alerts are open while new or being investigated, and are classified once a
+// disposition (benign, malicious or false positive) has been set
+const (
+	ALERT_STATE_NEW            AlertState = 0
+	ALERT_STATE_INVESTIGATING  AlertState = 1
+	ALERT_STATE_BENIGN         AlertState = 2
+	ALERT_STATE_MALICIOUS      AlertState = 3
+	ALERT_STATE_FALSE_POSITIVE AlertState = 4
+)
+
+func (as AlertState) String() string {
+
+	names := [...]string{"New", "Investigating", "Benign", "Malicious", "False Positive"}
+
+	if as < ALERT_STATE_NEW || as > ALERT_STATE_FALSE_POSITIVE {
+		return "Unknown"
+	}
+
+	return names[as]
+}
+
+// IsDisposition returns true if the state closes (classifies) the alert
+func (as AlertState) IsDisposition() bool {
+
+	return as >= ALERT_STATE_BENIGN && as <= ALERT_STATE_FALSE_POSITIVE
+}
+
 const (
 	EXPORT_TYPE_SHA256 = 1
 	EXPORT_TYPE_MD5    = 2
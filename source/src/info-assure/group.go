@@ -0,0 +1,582 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+const GROUP_NAME_MAX_LENGTH int = 100
+
+// ##### Structs ##############################################################
+
+// Represents a "host_group" record. The static member hosts are stored within "host_group_member". Hosts
+// whose domain and name match the patterns (* and ? wildcards, case insensitive) are also members
+type HostGroup struct {
+	ID                        int64      `db:"id" json:"id"`
+	Name                      string     `db:"name" json:"name"`
+	Description               string     `db:"description" json:"description"`
+	DomainPattern             string     `db:"domain_pattern" json:"domain_pattern"`
+	HostPattern               string     `db:"host_pattern" json:"host_pattern"`
+	BaselineInstance          *int64     `db:"baseline_instance" json:"baseline_instance"`
+	BaselineDomain            string     `db:"baseline_domain" json:"baseline_domain"`
+	BaselineHost              string     `db:"baseline_host" json:"baseline_host"`
+	BaselineInstanceTimestamp *time.Time `db:"baseline_instance_timestamp" json:"baseline_instance_timestamp"`
+	BaselineUsername          string     `db:"baseline_username" json:"baseline_username"`
+	TimestampBaseline         *time.Time `db:"timestamp_baseline" json:"timestamp_baseline"`
+	UserID                    *int64     `db:"user_id" json:"user_id"`
+	Username                  string     `db:"username" json:"username"`
+	TimestampCreated          time.Time  `db:"timestamp_created" json:"timestamp_created"`
+	TimestampUpdated          time.Time  `db:"timestamp_updated" json:"timestamp_updated"`
+	MemberCount               int64      `db:"member_count" json:"member_count"`
+	Hosts                     []string   `db:"-" json:"hosts,omitempty"`
+	HostsString               string     `db:"-" json:"-"`
+	UpdatedString             string     `db:"-" json:"-"`
+	BaselineString            string     `db:"-" json:"-"`
+	PatternString             string     `db:"-" json:"-"`
+}
+
+// ##### Methods ##############################################################
+
+// NewHostGroupByID returns the group, including its member hosts
+func NewHostGroupByID(id int64) (*HostGroup, error) {
+
+	g := new(HostGroup)
+	err := db.
+		Select("*").
+		From("host_group").
+		Where("id = $1", id).
+		QueryStruct(g)
+
+	if err == sql.ErrNoRows {
+		return g, errors.New("Group does not exist")
+	}
+	if err != nil {
+		return g, err
+	}
+
+	err = db.
+		Select("host").
+		From("host_group_member").
+		Where("group_id = $1", id).
+		OrderBy("host").
+		QuerySlice(&g.Hosts)
+	if err != nil {
+		return g, err
+	}
+
+	g.MemberCount = int64(len(g.Hosts))
+	g.Beautify()
+
+	return g, nil
+}
+
+// newHostGroupFromForm returns a group populated from the HTML form fields. The member hosts
+// are separated by whitespace or commas, and duplicates (case insensitive) are removed
+func newHostGroupFromForm(c *gin.Context) *HostGroup {
+
+	g := new(HostGroup)
+	g.Name = strings.TrimSpace(c.PostForm("name"))
+	g.Description = strings.TrimSpace(c.PostForm("description"))
+	g.DomainPattern = strings.TrimSpace(c.PostForm("domain_pattern"))
+	g.HostPattern = strings.TrimSpace(c.PostForm("host_pattern"))
+
+	seen := make(map[string]bool)
+	for _, h := range strings.FieldsFunc(c.PostForm("hosts"), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}) {
+		if seen[strings.ToLower(h)] == true {
+			continue
+		}
+
+		seen[strings.ToLower(h)] = true
+		g.Hosts = append(g.Hosts, h)
+	}
+
+	sort.Strings(g.Hosts)
+	g.MemberCount = int64(len(g.Hosts))
+	g.Beautify()
+
+	return g
+}
+
+// Validate ensures that the group has a unique name
+func (g *HostGroup) Validate() error {
+
+	if len(g.Name) == 0 {
+		return errors.New("Name must be supplied")
+	}
+
+	if len(g.Name) > GROUP_NAME_MAX_LENGTH {
+		return fmt.Errorf("Name must not exceed %d characters", GROUP_NAME_MAX_LENGTH)
+	}
+
+	var count int64
+	err := db.SQL("SELECT COUNT(*) FROM host_group WHERE LOWER(name) = LOWER($1) AND id <> $2", g.Name, g.ID).QueryScalar(&count)
+	if err != nil {
+		return errors.New("Unable to validate the name")
+	}
+
+	if count > 0 {
+		return errors.New("A group with the name already exists")
+	}
+
+	return nil
+}
+
+// Add inserts the group and its member hosts, recording the user that created it
+func (g *HostGroup) Add(userID int64, username string) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.AutoRollback()
+
+	now := time.Now().UTC()
+	err = tx.
+		InsertInto("host_group").
+		Columns("name", "description", "domain_pattern", "host_pattern", "user_id", "username", "timestamp_created", "timestamp_updated").
+		Values(g.Name, g.Description, g.DomainPattern, g.HostPattern, userID, username, now, now).
+		Returning("id").
+		QueryScalar(&g.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range g.Hosts {
+		_, err = tx.InsertInto("host_group_member").Columns("group_id", "host").Values(g.ID, h).Exec()
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Update saves the group and replaces its member hosts, recording the user that last changed it. The baseline is unchanged
+func (g *HostGroup) Update(userID int64, username string) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.AutoRollback()
+
+	_, err = tx.
+		Update("host_group").
+		Set("name", g.Name).
+		Set("description", g.Description).
+		Set("domain_pattern", g.DomainPattern).
+		Set("host_pattern", g.HostPattern).
+		Set("user_id", userID).
+		Set("username", username).
+		Set("timestamp_updated", time.Now().UTC()).
+		Where("id = $1", g.ID).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.DeleteFrom("host_group_member").Where("group_id = $1", g.ID).Exec()
+	if err != nil {
+		return err
+	}
+
+	for _, h := range g.Hosts {
+		_, err = tx.InsertInto("host_group_member").Columns("group_id", "host").Values(g.ID, h).Exec()
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SetBaseline sets the instance (collection) of a host that the group's hosts are compared to. The
+// instance's autoruns are copied, since the analysis server may later remove the instance
+func (g *HostGroup) SetBaseline(i *Instance, username string) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.AutoRollback()
+
+	_, err = tx.
+		Update("host_group").
+		Set("baseline_instance", i.Id).
+		Set("baseline_domain", i.Domain).
+		Set("baseline_host", i.Host).
+		Set("baseline_instance_timestamp", i.Timestamp).
+		Set("baseline_username", username).
+		Set("timestamp_baseline", time.Now().UTC()).
+		Where("id = $1", g.ID).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.
+		DeleteFrom("host_group_baseline_autorun").
+		Where("group_id = $1", g.ID).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.SQL(`INSERT INTO host_group_baseline_autorun (group_id, `+SQL_AUTORUN_COLUMNS+`)
+		SELECT $1, h.* FROM `+SQL_AUTORUN_HISTORY+` AS h WHERE h.instance = $2`, g.ID, i.Id).Exec()
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes the group and its member hosts
+func (g *HostGroup) Delete() error {
+
+	_, err := db.
+		DeleteFrom("host_group").
+		Where("id = $1", g.ID).
+		Exec()
+
+	return err
+}
+
+//
+func (g *HostGroup) Beautify() {
+
+	g.UpdatedString = g.TimestampUpdated.Format("15:04:05 02/01/2006")
+	g.HostsString = strings.Join(g.Hosts, "\n")
+
+	if g.BaselineInstance != nil {
+		g.BaselineString = fmt.Sprintf("%s (Instance %d)", g.BaselineHost, *g.BaselineInstance)
+	}
+
+	var patterns []string
+	if len(g.DomainPattern) > 0 {
+		patterns = append(patterns, "Domain: "+g.DomainPattern)
+	}
+	if len(g.HostPattern) > 0 {
+		patterns = append(patterns, "Host: "+g.HostPattern)
+	}
+	g.PatternString = strings.Join(patterns, ", ")
+}
+
+// String returns the group's name and members, which is used for the audit records
+func (g *HostGroup) String() string {
+
+	g.Beautify()
+	if len(g.PatternString) > 0 {
+		return fmt.Sprintf("%s (%d hosts; %s)", g.Name, len(g.Hosts), g.PatternString)
+	}
+
+	return fmt.Sprintf("%s (%d hosts)", g.Name, len(g.Hosts))
+}
+
+// hasPatterns returns true if the group's members include the hosts matching its patterns
+func (g *HostGroup) hasPatterns() bool {
+
+	return len(g.DomainPattern) > 0 || len(g.HostPattern) > 0
+}
+
+// buildPatternWhere returns the SQL condition that matches the domain and host columns to the group's patterns
+func (g *HostGroup) buildPatternWhere(domainColumn string, hostColumn string, args []interface{}) (string, []interface{}) {
+
+	var where []string
+
+	if len(g.DomainPattern) > 0 {
+		args = append(args, convertGlobToLike(g.DomainPattern))
+		where = append(where, fmt.Sprintf("%s ILIKE $%d", domainColumn, len(args)))
+	}
+
+	if len(g.HostPattern) > 0 {
+		args = append(args, convertGlobToLike(g.HostPattern))
+		where = append(where, fmt.Sprintf("%s ILIKE $%d", hostColumn, len(args)))
+	}
+
+	return strings.Join(where, " AND "), args
+}
+
+// buildWhere returns the SQL condition that restricts the domain and host columns to the group's members
+func (g *HostGroup) buildWhere(domainColumn string, hostColumn string, args []interface{}) (string, []interface{}) {
+
+	args = append(args, g.ID)
+	where := fmt.Sprintf("LOWER(%s) IN (SELECT LOWER(m.host) FROM host_group_member m WHERE m.group_id = $%d)", hostColumn, len(args))
+
+	if g.hasPatterns() == false {
+		return where, args
+	}
+
+	patterns, args := g.buildPatternWhere(domainColumn, hostColumn, args)
+
+	return fmt.Sprintf("(%s OR (%s))", where, patterns), args
+}
+
+// getMemberHosts returns the group's static members, and the hosts that have reported whose domain
+// and name match the group's patterns. The most recent name of a host is used
+func (g *HostGroup) getMemberHosts() ([]string, error) {
+
+	hosts := append([]string{}, g.Hosts...)
+
+	if g.hasPatterns() == true {
+		where, args := g.buildPatternWhere("i.domain", "i.host", nil)
+
+		var matched []string
+		err := db.SQL("SELECT (array_agg(i.host ORDER BY i.timestamp DESC))[1] FROM instance i WHERE "+where+" GROUP BY LOWER(i.host)",
+			args...).QuerySlice(&matched)
+		if err != nil {
+			return hosts, err
+		}
+
+		seen := make(map[string]bool)
+		for _, h := range hosts {
+			seen[strings.ToLower(h)] = true
+		}
+
+		for _, h := range matched {
+			if seen[strings.ToLower(h)] == false {
+				seen[strings.ToLower(h)] = true
+				hosts = append(hosts, h)
+			}
+		}
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return strings.ToLower(hosts[i]) < strings.ToLower(hosts[j])
+	})
+
+	return hosts, nil
+}
+
+// ***** Routing Methods ******************************************************
+
+//
+func routeGroupNewGet(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	c.HTML(http.StatusOK, "group", getTemplateData(c, gin.H{"endpoint": "new", "title": "New Group", "g": &HostGroup{}}))
+}
+
+//
+func routeGroupNewPost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	g := newHostGroupFromForm(c)
+	if processGroupForm(c, g, "new", "New Group") == false {
+		return
+	}
+
+	userID, username := getAuditActor(c)
+	err := g.Add(userID, username)
+	if err != nil {
+		log.Printf("Error adding group: %v\n", err)
+		goToErrorPage(c, "Unable to add group")
+		return
+	}
+
+	writeAudit(c, AUDIT_GROUP_CREATE, AUDIT_TARGET_GROUP, convertInt64ToString(g.ID), g.String())
+
+	loadGroupsData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Group added")))
+}
+
+//
+func routeGroupEditGet(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	g, successful := loadGroupForAction(c, c.Param("id"))
+	if successful == false {
+		return
+	}
+
+	c.HTML(http.StatusOK, "group", getTemplateData(c, gin.H{"endpoint": "edit/" + convertInt64ToString(g.ID), "title": "Edit Group", "g": g}))
+}
+
+//
+func routeGroupEditPost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	existing, successful := loadGroupForAction(c, c.Param("id"))
+	if successful == false {
+		return
+	}
+
+	g := newHostGroupFromForm(c)
+	g.ID = existing.ID
+	if processGroupForm(c, g, "edit/"+convertInt64ToString(g.ID), "Edit Group") == false {
+		return
+	}
+
+	userID, username := getAuditActor(c)
+	err := g.Update(userID, username)
+	if err != nil {
+		log.Printf("Error updating group: %v\n", err)
+		loadGroupsData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to update group")))
+		return
+	}
+
+	writeAudit(c, AUDIT_GROUP_EDIT, AUDIT_TARGET_GROUP, convertInt64ToString(g.ID), g.String())
+
+	loadGroupsData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Group updated")))
+}
+
+// processGroupForm validates the submitted group, re-rendering the form with a message if it is invalid.
+// Returns true if the group should be saved
+func processGroupForm(c *gin.Context, g *HostGroup, endpoint string, title string) bool {
+
+	err := g.Validate()
+	if err != nil {
+		c.HTML(http.StatusOK, "group", getTemplateData(c, gin.H{"endpoint": endpoint, "title": title, "g": g,
+			"message": template.HTML(fmt.Sprintf(ALERT_YELLOW, err.Error()))}))
+		return false
+	}
+
+	return true
+}
+
+//
+func routeGroupDeletePost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	g, successful := loadGroupForAction(c, c.Param("id"))
+	if successful == false {
+		return
+	}
+
+	err := g.Delete()
+	if err != nil {
+		log.Printf("Error deleting group: %v (%s)\n", err, g.Name)
+		loadGroupsData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to delete group")))
+		return
+	}
+
+	writeAudit(c, AUDIT_GROUP_DELETE, AUDIT_TARGET_GROUP, convertInt64ToString(g.ID), g.String())
+
+	loadGroupsData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Group deleted")))
+}
+
+// routeGroupBaselineGet displays the groups that the instance can be set as the baseline of
+func routeGroupBaselineGet(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	i, successful := loadBaselineInstance(c)
+	if successful == false {
+		return
+	}
+
+	groups, err := getHostGroups()
+	if err != nil {
+		log.Printf("Error loading groups: %v\n", err)
+		goToErrorPage(c, "Unable to load groups")
+		return
+	}
+
+	if len(groups) == 0 {
+		loadGroupsData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Add a group before setting a baseline")))
+		return
+	}
+
+	c.HTML(http.StatusOK, "group_baseline", getTemplateData(c, gin.H{
+		"instance":      i,
+		"instance_time": i.Timestamp.Format("15:04:05 02/01/2006"),
+		"groups":        groups,
+	}))
+}
+
+// routeGroupBaselinePost sets the instance as the baseline of the selected group
+func routeGroupBaselinePost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	i, successful := loadBaselineInstance(c)
+	if successful == false {
+		return
+	}
+
+	g, successful := loadGroupForAction(c, c.PostForm("group_id"))
+	if successful == false {
+		return
+	}
+
+	_, username := getAuditActor(c)
+	err := g.SetBaseline(i, username)
+	if err != nil {
+		log.Printf("Error setting group baseline: %v (%s)\n", err, g.Name)
+		loadGroupsData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to set baseline")))
+		return
+	}
+
+	writeAudit(c, AUDIT_GROUP_BASELINE, AUDIT_TARGET_GROUP, convertInt64ToString(g.ID),
+		fmt.Sprintf("%s: %s (Instance %d)", g.Name, i.Host, i.Id))
+
+	loadGroupsData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Baseline set")))
+}
+
+// loadBaselineInstance returns the instance referenced by the instance parameter, rendering the groups page with a message on failure
+func loadBaselineInstance(c *gin.Context) (*Instance, bool) {
+
+	id, successful := processInt64Parameter(c.Query("instance"))
+	if successful == false {
+		id, successful = processInt64Parameter(c.PostForm("instance"))
+	}
+
+	if successful == false {
+		loadGroupsData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid instance")))
+		return nil, false
+	}
+
+	i, err := getInstance(id)
+	if err != nil {
+		log.Printf("Error loading baseline instance: %v (%d)\n", err, id)
+		loadGroupsData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Instance does not exist")))
+		return nil, false
+	}
+
+	return i, true
+}
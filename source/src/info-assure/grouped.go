@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+// The artefact is the SHA256, or the launch string if the file could not be hashed
+const SQL_ALERT_ARTEFACT string = `CASE WHEN alert.sha256 <> '' THEN alert.sha256 ELSE alert.launch_string END`
+
+// Identifies the alerts for the same artefact across hosts
+const SQL_ALERT_GROUP_KEY string = `md5(alert.location || chr(31) || alert.item_name || chr(31) || ` + SQL_ALERT_ARTEFACT + `)`
+
+const SQL_ALERTS_GROUPED string = `SELECT ` + SQL_ALERT_GROUP_KEY + ` AS group_key, alert.location, alert.item_name,
+			` + SQL_ALERT_ARTEFACT + ` AS artefact, COUNT(DISTINCT alert.host) AS host_count, COUNT(*) AS alert_count,
+			MIN(alert.timestamp) AS first_seen, MAX(alert.timestamp) AS last_seen,
+			array_to_string((array_agg(DISTINCT alert.host ORDER BY alert.host))[1:5], ', ') AS sample_hosts
+	   FROM alert
+  LEFT JOIN classification ON (classification.alert_id = alert.id)
+  LEFT JOIN alert_state ON (alert_state.alert_id = alert.id)
+      WHERE %s
+   GROUP BY 1, 2, 3, 4
+   ORDER BY host_count DESC, last_seen DESC
+      LIMIT $1
+	 OFFSET $2`
+
+// The maximum number of alerts shown when a group is expanded
+const GROUP_ALERTS_MAX int = 500
+
+// ##### Structs ##############################################################
+
+// Represents the open alerts for the same artefact across hosts
+type AlertGroup struct {
+	Key          string        `db:"group_key" json:"group_key"`
+	Location     string        `db:"location" json:"location"`
+	LocationStr  template.HTML `db:"-" json:"-"`
+	ItemName     string        `db:"item_name" json:"item_name"`
+	Artefact     string        `db:"artefact" json:"artefact"`
+	HostCount    int64         `db:"host_count" json:"host_count"`
+	AlertCount   int64         `db:"alert_count" json:"alert_count"`
+	FirstSeen    time.Time     `db:"first_seen" json:"first_seen"`
+	FirstSeenStr string        `db:"-" json:"-"`
+	LastSeen     time.Time     `db:"last_seen" json:"last_seen"`
+	LastSeenStr  string        `db:"-" json:"-"`
+	SampleHosts  string        `db:"sample_hosts" json:"sample_hosts"`
+}
+
+// ##### Methods ##############################################################
+
+// processGroupKeys validates the comma separated group keys (MD5 hashes)
+func processGroupKeys(data string) ([]string, bool) {
+
+	keys := strings.Split(data, ",")
+	for _, k := range keys {
+		_, err := hex.DecodeString(k)
+		if err != nil || len(k) != 32 {
+			return nil, false
+		}
+	}
+
+	return keys, true
+}
+
+//
+func routeGrouped(c *gin.Context) {
+
+	numRecsPerPage, successful := processIntParameter(c.PostForm("num_recs_per_page"))
+	if successful == false {
+		numRecsPerPage = 10
+	}
+
+	filter := processAlertFilter(c.PostForm("verified"), "", "")
+
+	mode, hasMode := c.GetPostForm("mode")
+
+	// Appears to be the first request to send the initial set of data
+	if (mode != "first" &&
+		mode != "next" &&
+		mode != "previous" &&
+		mode != "classify") || hasMode == false {
+
+		loadGroupedData(c, 0, numRecsPerPage, filter, "")
+		return
+	}
+
+	currentPageNumber := processCurrentPageNumber(c.PostForm("current_page_num"), mode)
+
+	message := ""
+	if mode == "classify" {
+		// Ensure that we have some groups to classify
+		ids, idsExist := c.GetPostForm("ids")
+		if idsExist == false || len(ids) == 0 {
+
+			loadGroupedData(c, currentPageNumber, numRecsPerPage, filter, "No group's supplied for classification")
+			return
+		}
+
+		keys, successful := processGroupKeys(ids)
+		if successful == false {
+			loadGroupedData(c, currentPageNumber, numRecsPerPage, filter, "Invalid groups")
+			return
+		}
+
+		disposition := AlertState(convertStringToInt16(c.PostForm("disposition")))
+		if disposition.IsDisposition() == false {
+			loadGroupedData(c, currentPageNumber, numRecsPerPage, filter, "Invalid disposition")
+			return
+		}
+
+		// The number of alerts within the selected groups, which must not have changed
+		expected, successful := processInt64Parameter(c.PostForm("count"))
+		if successful == false {
+			loadGroupedData(c, currentPageNumber, numRecsPerPage, filter, "Invalid number of alerts")
+			return
+		}
+
+		userID := getCookieInt64Value(c, "user_id")
+		if userID == -1 {
+			log.Println("Error retrieving user: invalid user ID")
+			goToErrorPage(c, "Unable to perform classification")
+			return
+		}
+
+		filter.GroupKeys = keys
+		_, message = performBulkClassification(c, userID, filter, disposition, strings.TrimSpace(c.PostForm("reason")), expected)
+		filter.GroupKeys = nil
+	}
+
+	loadGroupedData(c, currentPageNumber, numRecsPerPage, filter, message)
+}
+
+//
+func loadGroupedData(
+	c *gin.Context,
+	currentPageNumber int,
+	numRecsPerPage int,
+	filter *AlertFilter, error string) {
+
+	errored, noMoreRecords, data := getAlertGroups(numRecsPerPage, currentPageNumber, filter)
+	if errored == true {
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	c.HTML(http.StatusOK, "grouped", getTemplateData(c, gin.H{
+		"current_page_num":  currentPageNumber,
+		"num_recs_per_page": numRecsPerPage,
+		"no_more_records":   noMoreRecords,
+		"verified":          filter.Verified,
+		"data":              data,
+		"error":             error,
+	}))
+}
+
+//
+func getAlertGroups(numRecsPerPage int, currentPageNumber int, filter *AlertFilter) (bool, bool, []*AlertGroup) {
+
+	var data []*AlertGroup
+
+	where, args := filter.buildWhere([]interface{}{numRecsPerPage + 1, numRecsPerPage * currentPageNumber})
+	err := db.SQL(fmt.Sprintf(SQL_ALERTS_GROUPED, where), args...).QueryStructs(&data)
+
+	if err != nil {
+		logger.Errorf("Error querying for alert groups: %v", err)
+		return true, false, data
+	}
+
+	// Perform some cleaning of the data, so that it displays better in the HTML
+	for _, v := range data {
+		v.LocationStr = template.HTML("<td class=\"poppy\" data-variation=\"basic\" data-content=\"" + template.HTMLEscapeString(v.Location) + "\">" + template.HTMLEscapeString(splitRegKey(v.Location)) + "</td>")
+		v.FirstSeenStr = v.FirstSeen.Format("15:04:05 02/01/2006")
+		v.LastSeenStr = v.LastSeen.Format("15:04:05 02/01/2006")
+	}
+
+	noMoreRecords := false
+	if len(data) < numRecsPerPage+1 {
+		noMoreRecords = true
+	} else {
+		// Remove the last item in the slice/array
+		data = data[:len(data)-1]
+	}
+
+	return false, noMoreRecords, data
+}
+
+// routeGroupedAlerts returns the HTML table of the group's individual alerts, which is shown when a group is expanded
+func routeGroupedAlerts(c *gin.Context) {
+
+	keys, successful := processGroupKeys(c.Param("key"))
+	if successful == false || len(keys) != 1 {
+		c.String(http.StatusBadRequest, "Invalid group")
+		return
+	}
+
+	filter := processAlertFilter(c.Query("verified"), "", "")
+	filter.GroupKeys = keys
+
+	paging := &Paging{Mode: "first", Size: GROUP_ALERTS_MAX}
+	errored, data := getAlerts(paging, filter)
+	if errored == true {
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	c.HTML(http.StatusOK, "grouped_alerts", gin.H{"data": data, "no_more_records": paging.HasNext == false, "max": GROUP_ALERTS_MAX})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+const SQL_GROUPS string = `SELECT host_group.*,
+			(SELECT COUNT(*) FROM host_group_member WHERE host_group_member.group_id = host_group.id) AS member_count
+	   FROM host_group
+   ORDER BY host_group.name ASC`
+
+// ##### Methods ##############################################################
+
+// getHostGroups returns the groups, without their member hosts
+func getHostGroups() ([]*HostGroup, error) {
+
+	var data []*HostGroup
+
+	err := db.SQL(SQL_GROUPS).QueryStructs(&data)
+
+	for _, g := range data {
+		g.Beautify()
+	}
+
+	return data, err
+}
+
+// ***** Routing Methods ******************************************************
+
+// routeGroupsGet lists the host groups. Any user can view the groups and their baseline
+// deviations, whereas only an administrator can change the groups
+func routeGroupsGet(c *gin.Context) {
+
+	loadGroupsData(c, "")
+}
+
+// loadGroupsData renders the groups page with an optional message
+func loadGroupsData(c *gin.Context, message template.HTML) {
+
+	data, err := getHostGroups()
+	if err != nil {
+		log.Printf("Error loading groups: %v\n", err)
+		goToErrorPage(c, "Unable to load groups")
+		return
+	}
+
+	c.HTML(http.StatusOK, "groups", getTemplateData(c, gin.H{"groups": data, "admin": getAccountType(c) == ADMIN, "message": message}))
+}
+
+// loadGroupForAction returns the group referenced by the ID, rendering the groups page with a message on failure
+func loadGroupForAction(c *gin.Context, value string) (*HostGroup, bool) {
+
+	id, successful := processInt64Parameter(value)
+	if successful == false {
+		loadGroupsData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid group")))
+		return nil, false
+	}
+
+	g, err := NewHostGroupByID(id)
+	if err != nil {
+		log.Printf("Error loading group: %v\n", err)
+		loadGroupsData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Group does not exist")))
+		return nil, false
+	}
+
+	return g, true
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+)
+
+// ##### Constants ############################################################
+
+// The columns shared by the current and previous autoruns tables
+const SQL_AUTORUN_COLUMNS string = `id, instance, location, item_name, enabled, profile, launch_string, description, company, signer,
+			version_number, file_path, file_name, file_directory, time, sha256, md5, text`
+
+// The autoruns for every instance of every host. The analysis server moves a host's
+// autoruns from current_autoruns to previous_autoruns when a new instance is received
+const SQL_AUTORUN_HISTORY string = `(SELECT ` + SQL_AUTORUN_COLUMNS + ` FROM current_autoruns
+	  UNION ALL
+	 SELECT ` + SQL_AUTORUN_COLUMNS + ` FROM previous_autoruns)`
+
+// The same autorun (location, name and user profile) on the host, from the newest instance before the instance specified
+const SQL_AUTORUN_PREVIOUS string = `SELECT h.*
+	   FROM ` + SQL_AUTORUN_HISTORY + ` AS h
+	   JOIN instance i ON (i.id = h.instance)
+	  WHERE LOWER(i.host) = LOWER($1)
+	    AND h.location = $2
+	    AND h.item_name = $3
+	    AND h.profile = $4
+	    AND i.timestamp < (SELECT timestamp FROM instance WHERE id = $5)
+   ORDER BY i.timestamp DESC, h.id DESC
+      LIMIT 1`
+
+const SQL_AUTORUN_OTHER_HOSTS string = `SELECT i.domain, i.host, d.launch_string, d.sha256
+	   FROM current_autoruns d
+	   JOIN instance i ON (i.id = d.instance)
+	  WHERE d.location = $1
+	    AND d.item_name = $2
+	    AND LOWER(i.host) <> LOWER($3)
+   ORDER BY i.host ASC
+      LIMIT $4`
+
+// The maximum number of other hosts shown for an autorun
+const OTHER_HOSTS_MAX int = 100
+
+// ##### Structs ##############################################################
+
+// Represents a field that may differ between two versions of an autorun
+type AutorunChange struct {
+	Field    string `json:"field"`
+	Previous string `json:"previous"`
+	Current  string `json:"current"`
+	Changed  bool   `json:"changed"`
+}
+
+// Represents another host that has the same autorun (location and name)
+type AutorunHost struct {
+	Domain       string `db:"domain" json:"domain"`
+	Host         string `db:"host" json:"host"`
+	LaunchString string `db:"launch_string" json:"launch_string"`
+	Sha256       string `db:"sha256" json:"sha256"`
+	Same         bool   `db:"-" json:"same"` // Same launch string and SHA256 as the autorun being compared
+}
+
+// ##### Methods ##############################################################
+
+// Autorun returns the autorun record that the alert was raised for
+func (a *Alert) Autorun() *Autorun {
+
+	return &Autorun{
+		Id:            a.AutorunId,
+		Instance:      a.Instance,
+		FilePath:      a.FilePath,
+		FileName:      a.FileName,
+		FileDirectory: a.FileDirectory,
+		Location:      a.Location,
+		ItemName:      a.ItemName,
+		Enabled:       a.Enabled,
+		Profile:       a.Profile,
+		LaunchString:  a.LaunchString,
+		Description:   a.Description,
+		Company:       a.Company,
+		Signer:        a.Signer,
+		VersionNumber: a.VersionNumber,
+		Time:          a.Time,
+		Sha256:        a.Sha256,
+		Md5:           a.Md5,
+		Text:          a.Text,
+	}
+}
+
+// getInstance returns the instance (collection) specified
+func getInstance(id int64) (*Instance, error) {
+
+	var i Instance
+	err := db.
+		Select(`id, domain, host, timestamp`).
+		From("instance").
+		Where("id = $1", id).
+		QueryStruct(&i)
+
+	return &i, err
+}
+
+// getPreviousAutorun returns the version of the autorun from the host's previous instance,
+// or nil if the autorun did not exist before the instance e.g. a new autorun
+func getPreviousAutorun(host string, location string, itemName string, profile string, instance int64) (*Autorun, error) {
+
+	var a Autorun
+	err := db.SQL(SQL_AUTORUN_PREVIOUS, host, location, itemName, profile, instance).QueryStruct(&a)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a.TimeStr = a.Time.Format("15:04:05 02/01/2006")
+
+	return &a, nil
+}
+
+// getAutorunOtherHosts returns the other hosts whose current autoruns include the same location and name
+func getAutorunOtherHosts(a *Autorun, host string) ([]*AutorunHost, error) {
+
+	var data []*AutorunHost
+	err := db.SQL(SQL_AUTORUN_OTHER_HOSTS, a.Location, a.ItemName, host, OTHER_HOSTS_MAX).QueryStructs(&data)
+
+	for _, h := range data {
+		h.Same = h.LaunchString == a.LaunchString && h.Sha256 == a.Sha256
+	}
+
+	return data, err
+}
+
+// diffAutoruns compares the identifying fields of two versions of an autorun
+func diffAutoruns(previous *Autorun, current *Autorun) []*AutorunChange {
+
+	fields := []struct {
+		name     string
+		previous string
+		current  string
+	}{
+		{"Launch String", previous.LaunchString, current.LaunchString},
+		{"File Path", previous.FilePath, current.FilePath},
+		{"SHA256", previous.Sha256, current.Sha256},
+		{"MD5", previous.Md5, current.Md5},
+		{"Signer", previous.Signer, current.Signer},
+		{"Version", previous.VersionNumber, current.VersionNumber},
+		{"Enabled", strconv.FormatBool(previous.Enabled), strconv.FormatBool(current.Enabled)},
+	}
+
+	changes := make([]*AutorunChange, 0, len(fields))
+	for _, f := range fields {
+		changes = append(changes, &AutorunChange{
+			Field:    f.name,
+			Previous: f.previous,
+			Current:  f.current,
+			Changed:  f.previous != f.current,
+		})
+	}
+
+	return changes
+}
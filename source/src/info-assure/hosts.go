@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+// One record per host (case insensitive), using the domain and host name of the newest instance. The
+// autoruns are those of the newest instance, and the alerts are the open (unclassified) alerts
+const SQL_HOSTS string = `(SELECT i.host_key, i.domain, i.host, i.first_seen, i.last_seen, i.instance_count,
+			COALESCE(d.autorun_count, 0) AS autorun_count, COALESCE(a.alert_count, 0) AS alert_count
+	   FROM (SELECT LOWER(host) AS host_key, (array_agg(domain ORDER BY timestamp DESC))[1] AS domain,
+				(array_agg(host ORDER BY timestamp DESC))[1] AS host, (array_agg(id ORDER BY timestamp DESC))[1] AS last_instance,
+				MIN(timestamp) AS first_seen, MAX(timestamp) AS last_seen, COUNT(*) AS instance_count
+		   FROM instance
+	   GROUP BY LOWER(host)) AS i
+  LEFT JOIN (SELECT instance, COUNT(*) AS autorun_count FROM current_autoruns GROUP BY instance) AS d ON (d.instance = i.last_instance)
+  LEFT JOIN (SELECT LOWER(alert.host) AS host_key, COUNT(*) AS alert_count FROM alert
+  LEFT JOIN classification ON (classification.alert_id = alert.id)
+	  WHERE classification.id IS NULL
+   GROUP BY LOWER(alert.host)) AS a ON (a.host_key = i.host_key))`
+
+// The staleness filters of the host inventory
+const HOST_STATUS_ALL int = 0
+const HOST_STATUS_STALE int = 1
+const HOST_STATUS_REPORTING int = 2
+
+// ##### Variables ############################################################
+
+// The columns that the hosts can be sorted by
+var HOST_SORT_COLUMNS = map[string]string{
+	"host":      "h.host_key",
+	"domain":    "h.domain",
+	"first":     "h.first_seen",
+	"last":      "h.last_seen",
+	"instances": "h.instance_count",
+	"autoruns":  "h.autorun_count",
+	"alerts":    "h.alert_count",
+}
+
+// ##### Structs ##############################################################
+
+// Represents a host within the inventory
+type HostSummary struct {
+	Domain        string    `db:"domain" json:"domain"`
+	Host          string    `db:"host" json:"host"`
+	FirstSeen     time.Time `db:"first_seen" json:"first_seen"`
+	FirstSeenStr  string    `db:"-" json:"-"`
+	LastSeen      time.Time `db:"last_seen" json:"last_seen"`
+	LastSeenStr   string    `db:"-" json:"-"`
+	InstanceCount int64     `db:"instance_count" json:"instance_count"`
+	AutorunCount  int64     `db:"autorun_count" json:"autorun_count"`
+	AlertCount    int64     `db:"alert_count" json:"alert_count"`
+	Stale         bool      `db:"stale" json:"stale"`
+	TagsString    string    `db:"tags" json:"-"`
+	Tags          []string  `db:"-" json:"tags"`
+	SortKey       string    `db:"sort_key" json:"-"`
+}
+
+// HostFilter contains the filters and sort order for the host inventory
+type HostFilter struct {
+	HostLike   string // Substring match, which can include * and ? wildcards
+	Domain     string
+	Status     int
+	Scope      *HostScope
+	Sort       string // One of HOST_SORT_COLUMNS, defaults to the host
+	Descending bool
+}
+
+// ##### Methods ##############################################################
+
+// processHostFilter returns the filter and sort order for the host inventory, along with the values so that
+// they can be redisplayed. An error is returned if the host scope is invalid
+func processHostFilter(param func(string) string) (*HostFilter, gin.H, error) {
+
+	scope, scopeErr := processHostScope(param)
+
+	f := &HostFilter{
+		HostLike: strings.TrimSpace(param("host")),
+		Domain:   strings.TrimSpace(param("domain")),
+		Status:   HOST_STATUS_ALL,
+		Scope:    scope,
+		Sort:     "host",
+	}
+
+	status, successful := processIntParameter(param("status"))
+	if successful == true && status >= HOST_STATUS_ALL && status <= HOST_STATUS_REPORTING {
+		f.Status = status
+	}
+
+	_, exists := HOST_SORT_COLUMNS[param("sort")]
+	if exists == true {
+		f.Sort = param("sort")
+	}
+	f.Descending = param("dir") == "desc"
+
+	direction := "asc"
+	if f.Descending == true {
+		direction = "desc"
+	}
+
+	values := gin.H{
+		"host":   f.HostLike,
+		"domain": f.Domain,
+		"status": f.Status,
+		"sort":   f.Sort,
+		"dir":    direction,
+	}
+
+	return f, values, scopeErr
+}
+
+// staleThreshold returns the time before which a host is considered stale i.e. no longer reporting
+func staleThreshold() time.Time {
+
+	return time.Now().UTC().Add(-time.Duration(config.HostStaleHours) * time.Hour)
+}
+
+// buildWhere returns the SQL WHERE clause for the filter. The args are the parameters already used by the query
+func (f *HostFilter) buildWhere(args []interface{}) (string, []interface{}) {
+
+	where := []string{"TRUE"}
+
+	if len(f.HostLike) > 0 {
+		args = append(args, "%"+convertGlobToLike(f.HostLike)+"%")
+		where = append(where, fmt.Sprintf("h.host ILIKE $%d", len(args)))
+	}
+
+	if len(f.Domain) > 0 {
+		args = append(args, f.Domain)
+		where = append(where, fmt.Sprintf("LOWER(h.domain) = LOWER($%d)", len(args)))
+	}
+
+	switch f.Status {
+	case HOST_STATUS_STALE:
+		args = append(args, staleThreshold())
+		where = append(where, fmt.Sprintf("h.last_seen < $%d", len(args)))
+	case HOST_STATUS_REPORTING:
+		args = append(args, staleThreshold())
+		where = append(where, fmt.Sprintf("h.last_seen >= $%d", len(args)))
+	}
+
+	if f.Scope.IsSet() == true {
+		var scope string
+		scope, args = f.Scope.buildWhere("h.domain", "h.host", args)
+		where = append(where, scope)
+	}
+
+	return strings.Join(where, " AND "), args
+}
+
+// keyset returns the sort order of the filter. The host ensures that the order is stable across pages
+func (f *HostFilter) keyset() *Keyset {
+
+	column, exists := HOST_SORT_COLUMNS[f.Sort]
+	if exists == false {
+		column = HOST_SORT_COLUMNS["host"]
+	}
+
+	columns := []string{column}
+	if column != HOST_SORT_COLUMNS["host"] {
+		columns = append(columns, HOST_SORT_COLUMNS["host"])
+	}
+
+	return &Keyset{Columns: columns, Descending: f.Descending}
+}
+
+// getHostInventory returns a page of the hosts that match the filter, and sets the total and cursors of the page
+func getHostInventory(paging *Paging, filter *HostFilter) (bool, []*HostSummary) {
+
+	var data []*HostSummary
+
+	where, args := filter.buildWhere(nil)
+
+	total, exact, err := countRecords("SELECT 1 FROM "+SQL_HOSTS+" AS h WHERE "+where, args)
+	if err != nil {
+		logger.Errorf("Error counting hosts: %v", err)
+		return true, data
+	}
+	paging.setTotal(total, exact)
+
+	keyset := filter.keyset()
+	cursor, orderBy, limit, args, err := keyset.page(paging, args)
+	if err != nil {
+		logger.Errorf("Error reading hosts cursor: %v", err)
+		return true, data
+	}
+
+	args = append(args, staleThreshold())
+	err = db.SQL(fmt.Sprintf(`SELECT h.domain, h.host, h.first_seen, h.last_seen, h.instance_count, h.autorun_count,
+			h.alert_count, h.last_seen < $%d AS stale,
+			COALESCE((SELECT string_agg(t.tag, ',' ORDER BY LOWER(t.tag)) FROM host_tag t WHERE LOWER(t.host) = h.host_key), '') AS tags, %s
+	   FROM %s AS h
+	  WHERE %s AND %s
+   ORDER BY %s
+	  %s`, len(args), keyset.selectKey(), SQL_HOSTS, where, cursor, orderBy, limit), args...).QueryStructs(&data)
+
+	if err != nil {
+		logger.Errorf("Error querying for hosts: %v", err)
+		return true, data
+	}
+
+	data = data[:paging.trim(data, func(i int) string { return data[i].SortKey })]
+
+	for _, h := range data {
+		h.FirstSeenStr = h.FirstSeen.Format("15:04:05 02/01/2006")
+		h.LastSeenStr = h.LastSeen.Format("15:04:05 02/01/2006")
+
+		// Tags cannot contain commas
+		if len(h.TagsString) > 0 {
+			h.Tags = strings.Split(h.TagsString, ",")
+		}
+	}
+
+	return false, data
+}
+
+// ***** Routing Methods ******************************************************
+
+// routeHosts displays the host inventory. The filters and paging are sent using GET so that the views can be bookmarked
+func routeHosts(c *gin.Context) {
+
+	filter, values, err := processHostFilter(c.Query)
+	paging := processPaging(c.Query)
+
+	if err != nil {
+		values["message"] = template.HTML(fmt.Sprintf(ALERT_YELLOW, err.Error()))
+	}
+
+	errored, data := getHostInventory(paging, filter)
+	if errored == true {
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	values["current_page_num"] = paging.Number
+	values["num_recs_per_page"] = paging.Size
+	values["paging"] = paging
+	values["stale_hours"] = config.HostStaleHours
+	values["data"] = data
+
+	err = filter.Scope.setTemplateValues(values)
+	if err != nil {
+		logger.Errorf("Error querying for host groups and tags: %v", err)
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	c.HTML(http.StatusOK, "hosts", getTemplateData(c, values))
+}
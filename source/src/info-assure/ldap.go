@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ##### Constants ############################################################
+
+// BER tags for the subset of the LDAPv3 protocol (RFC 4511) that we use
+const (
+	BER_BOOLEAN     byte = 0x01
+	BER_INTEGER     byte = 0x02
+	BER_OCTETSTRING byte = 0x04
+	BER_ENUMERATED  byte = 0x0a
+	BER_SEQUENCE    byte = 0x30
+	BER_SET         byte = 0x31
+
+	LDAP_BIND_REQUEST         byte = 0x60
+	LDAP_BIND_RESPONSE        byte = 0x61
+	LDAP_UNBIND_REQUEST       byte = 0x42
+	LDAP_SEARCH_REQUEST       byte = 0x63
+	LDAP_SEARCH_RESULT_ENTRY  byte = 0x64
+	LDAP_SEARCH_RESULT_DONE   byte = 0x65
+	LDAP_SEARCH_RESULT_REF    byte = 0x73
+	LDAP_EXTENDED_REQUEST     byte = 0x77
+	LDAP_EXTENDED_RESPONSE    byte = 0x78
+	LDAP_AUTH_SIMPLE          byte = 0x80
+	LDAP_EXTENDED_REQUEST_OID byte = 0x80
+	LDAP_FILTER_AND           byte = 0xa0
+	LDAP_FILTER_EQUALITY      byte = 0xa3
+)
+
+const (
+	LDAP_RESULT_SUCCESS             = 0
+	LDAP_RESULT_INVALID_CREDENTIALS = 49
+)
+
+const LDAP_OID_STARTTLS string = "1.3.6.1.4.1.1466.20037"
+
+// ##### Structs ##############################################################
+
+// Represents a decoded BER element. Constructed elements have their children parsed
+type BerPacket struct {
+	Tag      byte
+	Value    []byte
+	Children []*BerPacket
+}
+
+// Represents an entry returned from a search
+type LdapEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// LdapConn is a minimal LDAPv3 client, supporting simple binds and searches
+type LdapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int64
+	timeout   time.Duration
+}
+
+// LdapAuthBackend authenticates users by binding to an LDAP directory e.g. Active Directory
+type LdapAuthBackend struct {
+	config LdapConfig
+}
+
+// ##### BER Methods ##########################################################
+
+// berEncode returns a BER element with the definite length encoding
+func berEncode(tag byte, content []byte) []byte {
+
+	length := len(content)
+	var header []byte
+	if length < 0x80 {
+		header = []byte{tag, byte(length)}
+	} else {
+		var lengthBytes []byte
+		for l := length; l > 0; l >>= 8 {
+			lengthBytes = append([]byte{byte(l)}, lengthBytes...)
+		}
+		header = append([]byte{tag, 0x80 | byte(len(lengthBytes))}, lengthBytes...)
+	}
+
+	return append(header, content...)
+}
+
+// berInteger returns a BER encoded two's complement integer
+func berInteger(tag byte, value int64) []byte {
+
+	// Stop once the remaining bits only repeat the sign bit of the leading byte
+	content := []byte{byte(value)}
+	for v := value >> 8; ; v >>= 8 {
+		if (v == 0 && content[0]&0x80 == 0) || (v == -1 && content[0]&0x80 != 0) {
+			break
+		}
+		content = append([]byte{byte(v)}, content...)
+	}
+
+	return berEncode(tag, content)
+}
+
+// berString returns a BER encoded octet string
+func berString(tag byte, value string) []byte {
+
+	return berEncode(tag, []byte(value))
+}
+
+// berConstructed returns a BER element containing the already encoded children
+func berConstructed(tag byte, children ...[]byte) []byte {
+
+	var content []byte
+	for _, c := range children {
+		content = append(content, c...)
+	}
+
+	return berEncode(tag, content)
+}
+
+// readBerPacket reads a single BER element from the reader
+func readBerPacket(r io.Reader) (*BerPacket, error) {
+
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		numBytes := length & 0x7f
+		if numBytes == 0 || numBytes > 4 {
+			return nil, errors.New("Unsupported BER length")
+		}
+
+		lengthBytes := make([]byte, numBytes)
+		_, err = io.ReadFull(r, lengthBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+
+	if length > 16*1024*1024 {
+		return nil, errors.New("BER element too large")
+	}
+
+	content := make([]byte, length)
+	_, err = io.ReadFull(r, content)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBerPacket(header[0], content)
+}
+
+// parseBerPacket decodes the children of constructed elements
+func parseBerPacket(tag byte, content []byte) (*BerPacket, error) {
+
+	p := &BerPacket{Tag: tag, Value: content}
+
+	// Bit 6 is set for constructed elements
+	if tag&0x20 == 0 {
+		return p, nil
+	}
+
+	reader := strings.NewReader(string(content))
+	for reader.Len() > 0 {
+		child, err := readBerPacket(reader)
+		if err != nil {
+			return nil, err
+		}
+		p.Children = append(p.Children, child)
+	}
+
+	return p, nil
+}
+
+// Int returns the value of an INTEGER or ENUMERATED element
+func (p *BerPacket) Int() int64 {
+
+	var value int64
+	for i, b := range p.Value {
+		if i == 0 && b&0x80 != 0 {
+			value = -1
+		}
+		value = value<<8 | int64(b)
+	}
+
+	return value
+}
+
+// ##### LDAP Client Methods ##################################################
+
+// DialLdap connects to an ldap:// or ldaps:// URL
+func DialLdap(ldapUrl string, tlsConfig *tls.Config, timeout time.Duration) (*LdapConn, error) {
+
+	u, err := url.Parse(ldapUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	switch strings.ToLower(u.Scheme) {
+	case "ldap":
+		if len(u.Port()) == 0 {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		if len(u.Port()) == 0 {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	default:
+		return nil, fmt.Errorf("Unsupported LDAP URL scheme: %s", u.Scheme)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LdapConn{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// Close sends an unbind request and closes the connection
+func (l *LdapConn) Close() {
+
+	l.messageID++
+	l.conn.SetDeadline(time.Now().Add(l.timeout))
+	l.conn.Write(berConstructed(BER_SEQUENCE, berInteger(BER_INTEGER, l.messageID), berEncode(LDAP_UNBIND_REQUEST, nil)))
+	l.conn.Close()
+}
+
+// request sends a protocol operation and returns the responses for the message ID.
+// Searches return multiple responses, so reading stops at the final response tag
+func (l *LdapConn) request(op []byte, finalTag byte) ([]*BerPacket, error) {
+
+	l.messageID++
+	l.conn.SetDeadline(time.Now().Add(l.timeout))
+
+	_, err := l.conn.Write(berConstructed(BER_SEQUENCE, berInteger(BER_INTEGER, l.messageID), op))
+	if err != nil {
+		return nil, err
+	}
+
+	var responses []*BerPacket
+	for {
+		packet, err := readBerPacket(l.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		if packet.Tag != BER_SEQUENCE || len(packet.Children) < 2 {
+			return nil, errors.New("Malformed LDAP message")
+		}
+
+		if packet.Children[0].Int() != l.messageID {
+			continue
+		}
+
+		response := packet.Children[1]
+		responses = append(responses, response)
+
+		if response.Tag == finalTag {
+			return responses, nil
+		}
+	}
+}
+
+// checkLdapResult returns an error for an unsuccessful LDAPResult
+func checkLdapResult(p *BerPacket) (int64, error) {
+
+	if len(p.Children) < 3 {
+		return -1, errors.New("Malformed LDAP result")
+	}
+
+	code := p.Children[0].Int()
+	if code != LDAP_RESULT_SUCCESS {
+		return code, fmt.Errorf("LDAP result code %d: %s", code, string(p.Children[2].Value))
+	}
+
+	return code, nil
+}
+
+// StartTLS upgrades a plain connection to TLS
+func (l *LdapConn) StartTLS(tlsConfig *tls.Config) error {
+
+	responses, err := l.request(berConstructed(LDAP_EXTENDED_REQUEST, berString(LDAP_EXTENDED_REQUEST_OID, LDAP_OID_STARTTLS)), LDAP_EXTENDED_RESPONSE)
+	if err != nil {
+		return err
+	}
+
+	_, err = checkLdapResult(responses[len(responses)-1])
+	if err != nil {
+		return err
+	}
+
+	tlsConn := tls.Client(l.conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(l.timeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+
+	l.conn = tlsConn
+	l.reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
+// Bind performs a simple bind, returning ErrInvalidCredentials for a bad DN/password
+func (l *LdapConn) Bind(dn string, password string) error {
+
+	responses, err := l.request(berConstructed(LDAP_BIND_REQUEST,
+		berInteger(BER_INTEGER, 3),
+		berString(BER_OCTETSTRING, dn),
+		berString(LDAP_AUTH_SIMPLE, password)), LDAP_BIND_RESPONSE)
+	if err != nil {
+		return err
+	}
+
+	code, err := checkLdapResult(responses[len(responses)-1])
+	if code == LDAP_RESULT_INVALID_CREDENTIALS {
+		return ErrInvalidCredentials
+	}
+
+	return err
+}
+
+// SearchEquals performs a subtree search for entries where every attribute equals the
+// value supplied. The values are encoded directly, so they do not require escaping
+func (l *LdapConn) SearchEquals(baseDN string, equals [][2]string, attributes []string, sizeLimit int64) ([]*LdapEntry, error) {
+
+	var filters [][]byte
+	for _, e := range equals {
+		filters = append(filters, berConstructed(LDAP_FILTER_EQUALITY, berString(BER_OCTETSTRING, e[0]), berString(BER_OCTETSTRING, e[1])))
+	}
+
+	var attrs [][]byte
+	for _, a := range attributes {
+		attrs = append(attrs, berString(BER_OCTETSTRING, a))
+	}
+
+	responses, err := l.request(berConstructed(LDAP_SEARCH_REQUEST,
+		berString(BER_OCTETSTRING, baseDN),
+		berInteger(BER_ENUMERATED, 2), // Whole subtree
+		berInteger(BER_ENUMERATED, 0), // Never dereference aliases
+		berInteger(BER_INTEGER, sizeLimit),
+		berInteger(BER_INTEGER, int64(l.timeout.Seconds())),
+		berEncode(BER_BOOLEAN, []byte{0x00}),
+		berConstructed(LDAP_FILTER_AND, filters...),
+		berConstructed(BER_SEQUENCE, attrs...)), LDAP_SEARCH_RESULT_DONE)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = checkLdapResult(responses[len(responses)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*LdapEntry
+	for _, r := range responses {
+		if r.Tag != LDAP_SEARCH_RESULT_ENTRY || len(r.Children) < 2 {
+			continue
+		}
+
+		e := &LdapEntry{DN: string(r.Children[0].Value), Attributes: make(map[string][]string)}
+		for _, attribute := range r.Children[1].Children {
+			if len(attribute.Children) < 2 {
+				continue
+			}
+
+			name := strings.ToLower(string(attribute.Children[0].Value))
+			for _, v := range attribute.Children[1].Children {
+				e.Attributes[name] = append(e.Attributes[name], string(v.Value))
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// Get returns the first value of an attribute
+func (e *LdapEntry) Get(name string) string {
+
+	values := e.Attributes[strings.ToLower(name)]
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// ##### Backend Methods ######################################################
+
+// NewLdapAuthBackend validates the LDAP configuration and applies the defaults
+func NewLdapAuthBackend(c LdapConfig) *LdapAuthBackend {
+
+	if len(c.Url) == 0 {
+		logger.Fatal("LDAP URL not set in config file")
+	}
+
+	if len(c.BaseDn) == 0 {
+		logger.Fatal("LDAP base DN not set in config file")
+	}
+
+	if len(c.UserAttribute) == 0 {
+		c.UserAttribute = "sAMAccountName"
+	}
+
+	if len(c.UserObjectClass) == 0 {
+		c.UserObjectClass = "user"
+	}
+
+	if len(c.NameAttribute) == 0 {
+		c.NameAttribute = "displayName"
+	}
+
+	if len(c.GroupAttribute) == 0 {
+		c.GroupAttribute = "memberOf"
+	}
+
+	if c.TimeoutSeconds == 0 {
+		c.TimeoutSeconds = 10
+	}
+
+	return &LdapAuthBackend{config: c}
+}
+
+//
+func (b *LdapAuthBackend) Name() string {
+
+	return AUTH_PROVIDER_LDAP
+}
+
+// Authenticate locates the user's entry using the service account, then binds as the
+// user to verify the password. Group membership is read from the user's entry
+func (b *LdapAuthBackend) Authenticate(username string, password string) (*AuthResult, error) {
+
+	// An empty password would be treated as an unauthenticated bind, which always succeeds
+	if len(password) == 0 {
+		return nil, ErrInvalidCredentials
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: b.config.TlsInsecureSkipVerify}
+	if u, err := url.Parse(b.config.Url); err == nil {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	timeout := time.Duration(b.config.TimeoutSeconds) * time.Second
+	conn, err := DialLdap(b.config.Url, tlsConfig, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to LDAP server: %v", err)
+	}
+	defer conn.Close()
+
+	if b.config.StartTls == true {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to start LDAP TLS: %v", err)
+		}
+	}
+
+	if len(b.config.BindDn) > 0 {
+		err = conn.Bind(b.config.BindDn, b.config.BindPassword)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to bind LDAP service account: %v", err)
+		}
+	}
+
+	entries, err := conn.SearchEquals(b.config.BaseDn,
+		[][2]string{{"objectClass", b.config.UserObjectClass}, {b.config.UserAttribute, username}},
+		[]string{b.config.NameAttribute, b.config.GroupAttribute}, 2)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to search LDAP directory: %v", err)
+	}
+
+	if len(entries) == 0 {
+		return nil, ErrInvalidCredentials
+	}
+
+	if len(entries) > 1 {
+		return nil, fmt.Errorf("Multiple LDAP entries for user: %s", username)
+	}
+
+	err = conn.Bind(entries[0].DN, password)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := entries[0].Attributes[strings.ToLower(b.config.GroupAttribute)]
+
+	// Groups can be configured as either the full DN or the CN
+	names := make([]string, 0, len(groups)*2)
+	for _, g := range groups {
+		names = append(names, g)
+		if strings.HasPrefix(strings.ToLower(g), "cn=") {
+			names = append(names, strings.SplitN(g[3:], ",", 2)[0])
+		}
+	}
+
+	accountType, allowed := mapGroupsToAccountType(names, b.config.AdminGroups, b.config.UserGroups)
+	if allowed == false {
+		return nil, ErrNotPermitted
+	}
+
+	return &AuthResult{
+		ExternalID:  strings.ToLower(username),
+		Name:        entries[0].Get(b.config.NameAttribute),
+		AccountType: accountType,
+	}, nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ##### BER Tests ############################################################
+
+func TestBerInteger(t *testing.T) {
+
+	tests := []struct {
+		value    int64
+		expected []byte
+	}{
+		{0, []byte{0x02, 0x01, 0x00}},
+		{1, []byte{0x02, 0x01, 0x01}},
+		{127, []byte{0x02, 0x01, 0x7f}},
+		{128, []byte{0x02, 0x02, 0x00, 0x80}},
+		{256, []byte{0x02, 0x02, 0x01, 0x00}},
+		{65535, []byte{0x02, 0x03, 0x00, 0xff, 0xff}},
+		{-1, []byte{0x02, 0x01, 0xff}},
+		{-128, []byte{0x02, 0x01, 0x80}},
+		{-129, []byte{0x02, 0x02, 0xff, 0x7f}},
+	}
+
+	for _, test := range tests {
+		encoded := berInteger(BER_INTEGER, test.value)
+		if bytes.Equal(encoded, test.expected) == false {
+			t.Errorf("berInteger(%d) = % x, expected % x", test.value, encoded, test.expected)
+			continue
+		}
+
+		p, err := readBerPacket(bytes.NewReader(encoded))
+		if err != nil {
+			t.Errorf("Error reading integer %d: %v", test.value, err)
+			continue
+		}
+
+		if p.Int() != test.value {
+			t.Errorf("Int() = %d, expected %d", p.Int(), test.value)
+		}
+	}
+}
+
+func TestBerEncodeLength(t *testing.T) {
+
+	tests := []struct {
+		length int
+		header []byte
+	}{
+		{0, []byte{BER_OCTETSTRING, 0x00}},
+		{127, []byte{BER_OCTETSTRING, 0x7f}},
+		{128, []byte{BER_OCTETSTRING, 0x81, 0x80}},
+		{200, []byte{BER_OCTETSTRING, 0x81, 0xc8}},
+		{300, []byte{BER_OCTETSTRING, 0x82, 0x01, 0x2c}},
+		{70000, []byte{BER_OCTETSTRING, 0x83, 0x01, 0x11, 0x70}},
+	}
+
+	for _, test := range tests {
+		value := strings.Repeat("a", test.length)
+		encoded := berString(BER_OCTETSTRING, value)
+
+		if bytes.Equal(encoded[:len(test.header)], test.header) == false {
+			t.Errorf("Length %d header = % x, expected % x", test.length, encoded[:len(test.header)], test.header)
+			continue
+		}
+
+		p, err := readBerPacket(bytes.NewReader(encoded))
+		if err != nil {
+			t.Errorf("Error reading length %d: %v", test.length, err)
+			continue
+		}
+
+		if string(p.Value) != value {
+			t.Errorf("Length %d value not read back", test.length)
+		}
+	}
+}
+
+func TestBerConstructed(t *testing.T) {
+
+	encoded := berConstructed(BER_SEQUENCE,
+		berInteger(BER_INTEGER, 5),
+		berConstructed(BER_SET, berString(BER_OCTETSTRING, "a"), berString(BER_OCTETSTRING, "bc")))
+
+	expected := []byte{0x30, 0x0c, 0x02, 0x01, 0x05, 0x31, 0x07, 0x04, 0x01, 'a', 0x04, 0x02, 'b', 'c'}
+	if bytes.Equal(encoded, expected) == false {
+		t.Fatalf("Encoded % x, expected % x", encoded, expected)
+	}
+
+	p, err := readBerPacket(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("Error reading sequence: %v", err)
+	}
+
+	if len(p.Children) != 2 || p.Children[0].Int() != 5 || len(p.Children[1].Children) != 2 {
+		t.Fatalf("Unexpected children: %+v", p.Children)
+	}
+
+	if string(p.Children[1].Children[1].Value) != "bc" {
+		t.Errorf("Nested value = %q, expected \"bc\"", p.Children[1].Children[1].Value)
+	}
+}
+
+func TestReadBerPacketInvalid(t *testing.T) {
+
+	tests := map[string][]byte{
+		"empty":                {},
+		"no length":            {0x04},
+		"truncated content":    {0x04, 0x05, 'a', 'b'},
+		"indefinite length":    {0x30, 0x80, 0x00, 0x00},
+		"length too long":      {0x04, 0x85, 0x01, 0x00, 0x00, 0x00, 0x00},
+		"truncated length":     {0x04, 0x82, 0x01},
+		"element too large":    {0x04, 0x84, 0x7f, 0xff, 0xff, 0xff},
+		"truncated child":      {0x30, 0x03, 0x04, 0x05, 'a'},
+		"child exceeds parent": {0x30, 0x02, 0x04, 0x01},
+	}
+
+	for name, data := range tests {
+		_, err := readBerPacket(bytes.NewReader(data))
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// ##### LDAP Tests ###########################################################
+
+const (
+	TEST_LDAP_BASE_DN          = "DC=example,DC=com"
+	TEST_LDAP_SERVICE_DN       = "CN=svc-arl,OU=Service,DC=example,DC=com"
+	TEST_LDAP_SERVICE_PASSWORD = "service-password"
+	TEST_LDAP_USER_PASSWORD    = "user-password"
+)
+
+// Represents a directory user of the mock LDAP server
+type testLdapUser struct {
+	dn     string
+	name   string
+	groups []string
+}
+
+// testLdapServer is a minimal directory, which supports simple binds and the searches sent by LdapConn
+type testLdapServer struct {
+	listener net.Listener
+	users    map[string]*testLdapUser // Keyed by the lower case sAMAccountName
+	searches []string                 // The sAMAccountName of each search
+	mutex    sync.Mutex
+}
+
+func newTestLdapServer(t *testing.T) *testLdapServer {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+
+	s := &testLdapServer{
+		listener: listener,
+		users: map[string]*testLdapUser{
+			"alice": {dn: "CN=Alice,OU=Users,DC=example,DC=com", name: "Alice Smith", groups: []string{"CN=ARL Admins,OU=Groups,DC=example,DC=com"}},
+			"bob":   {dn: "CN=Bob,OU=Users,DC=example,DC=com", name: "Bob Jones", groups: []string{"CN=ARL Users,OU=Groups,DC=example,DC=com"}},
+			"carol": {dn: "CN=Carol,OU=Users,DC=example,DC=com", name: "Carol White", groups: []string{"CN=Finance,OU=Groups,DC=example,DC=com"}},
+		},
+	}
+
+	go s.serve()
+
+	return s
+}
+
+func (s *testLdapServer) url() string {
+
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *testLdapServer) serve() {
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *testLdapServer) handle(conn net.Conn) {
+
+	defer conn.Close()
+
+	for {
+		packet, err := readBerPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		messageID := packet.Children[0].Int()
+		op := packet.Children[1]
+
+		respond := func(response []byte) {
+			conn.Write(berConstructed(BER_SEQUENCE, berInteger(BER_INTEGER, messageID), response))
+		}
+
+		switch op.Tag {
+		case LDAP_BIND_REQUEST:
+			respond(testLdapResult(LDAP_BIND_RESPONSE, s.bind(string(op.Children[1].Value), string(op.Children[2].Value))))
+		case LDAP_SEARCH_REQUEST:
+			for _, entry := range s.search(op) {
+				respond(entry)
+			}
+			respond(testLdapResult(LDAP_SEARCH_RESULT_DONE, LDAP_RESULT_SUCCESS))
+		case LDAP_UNBIND_REQUEST:
+			return
+		}
+	}
+}
+
+func (s *testLdapServer) bind(dn string, password string) int64 {
+
+	if dn == TEST_LDAP_SERVICE_DN && password == TEST_LDAP_SERVICE_PASSWORD {
+		return LDAP_RESULT_SUCCESS
+	}
+
+	for _, u := range s.users {
+		if dn == u.dn && password == TEST_LDAP_USER_PASSWORD {
+			return LDAP_RESULT_SUCCESS
+		}
+	}
+
+	return LDAP_RESULT_INVALID_CREDENTIALS
+}
+
+// search returns the entries for the sAMAccountName within the AND filter. Like Active Directory,
+// the attribute value is matched without regard to case
+func (s *testLdapServer) search(op *BerPacket) [][]byte {
+
+	if string(op.Children[0].Value) != TEST_LDAP_BASE_DN {
+		return nil
+	}
+
+	var username string
+	for _, f := range op.Children[6].Children {
+		if f.Tag == LDAP_FILTER_EQUALITY && strings.EqualFold(string(f.Children[0].Value), "sAMAccountName") {
+			username = string(f.Children[1].Value)
+		}
+	}
+	s.mutex.Lock()
+	s.searches = append(s.searches, username)
+	s.mutex.Unlock()
+
+	u, exists := s.users[strings.ToLower(username)]
+	if exists == false {
+		return nil
+	}
+
+	var groups [][]byte
+	for _, g := range u.groups {
+		groups = append(groups, berString(BER_OCTETSTRING, g))
+	}
+
+	return [][]byte{berConstructed(LDAP_SEARCH_RESULT_ENTRY,
+		berString(BER_OCTETSTRING, u.dn),
+		berConstructed(BER_SEQUENCE,
+			berConstructed(BER_SEQUENCE, berString(BER_OCTETSTRING, "displayName"), berConstructed(BER_SET, berString(BER_OCTETSTRING, u.name))),
+			berConstructed(BER_SEQUENCE, berString(BER_OCTETSTRING, "memberOf"), berConstructed(BER_SET, groups...))))}
+}
+
+func testLdapResult(tag byte, code int64) []byte {
+
+	return berConstructed(tag, berInteger(BER_ENUMERATED, code), berString(BER_OCTETSTRING, ""), berString(BER_OCTETSTRING, fmt.Sprintf("code %d", code)))
+}
+
+func newTestLdapBackend(s *testLdapServer) *LdapAuthBackend {
+
+	return NewLdapAuthBackend(LdapConfig{
+		Url:          s.url(),
+		BindDn:       TEST_LDAP_SERVICE_DN,
+		BindPassword: TEST_LDAP_SERVICE_PASSWORD,
+		BaseDn:       TEST_LDAP_BASE_DN,
+		AdminGroups:  []string{"ARL Admins"},
+		UserGroups:   []string{"CN=ARL Users,OU=Groups,DC=example,DC=com"},
+	})
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+
+	s := newTestLdapServer(t)
+	defer s.listener.Close()
+
+	b := newTestLdapBackend(s)
+
+	result, err := b.Authenticate("Alice", TEST_LDAP_USER_PASSWORD)
+	if err != nil {
+		t.Fatalf("Error authenticating admin: %v", err)
+	}
+
+	if result.ExternalID != "alice" || result.Name != "Alice Smith" || result.AccountType != ADMIN {
+		t.Errorf("Unexpected admin result: %+v", result)
+	}
+
+	result, err = b.Authenticate("bob", TEST_LDAP_USER_PASSWORD)
+	if err != nil {
+		t.Fatalf("Error authenticating user: %v", err)
+	}
+
+	if result.ExternalID != "bob" || result.AccountType != USER {
+		t.Errorf("Unexpected user result: %+v", result)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.searches) != 2 || s.searches[0] != "Alice" || s.searches[1] != "bob" {
+		t.Errorf("Unexpected searches: %v", s.searches)
+	}
+}
+
+func TestLdapAuthenticateFailures(t *testing.T) {
+
+	s := newTestLdapServer(t)
+	defer s.listener.Close()
+
+	b := newTestLdapBackend(s)
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		expected error
+	}{
+		{"wrong password", "alice", "wrong", ErrInvalidCredentials},
+		{"empty password", "alice", "", ErrInvalidCredentials},
+		{"unknown user", "mallory", TEST_LDAP_USER_PASSWORD, ErrInvalidCredentials},
+		{"not in a group", "carol", TEST_LDAP_USER_PASSWORD, ErrNotPermitted},
+	}
+
+	for _, test := range tests {
+		_, err := b.Authenticate(test.username, test.password)
+		if err != test.expected {
+			t.Errorf("%s: error = %v, expected %v", test.name, err, test.expected)
+		}
+	}
+}
+
+func TestLdapAuthenticateServiceAccount(t *testing.T) {
+
+	s := newTestLdapServer(t)
+	defer s.listener.Close()
+
+	b := newTestLdapBackend(s)
+	b.config.BindPassword = "wrong"
+
+	// A misconfigured service account is an error, rather than the user's password being incorrect
+	_, err := b.Authenticate("alice", TEST_LDAP_USER_PASSWORD)
+	if err == nil || err == ErrInvalidCredentials {
+		t.Errorf("Error = %v, expected a service account bind error", err)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"time"
 
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/contrib/renders/multitemplate"
 	"github.com/gin-gonic/gin"
 	"github.com/op/go-logging"
@@ -70,6 +69,13 @@ func main() {
 	loadConfig(opt.ConfigFile)
 
 	initialiseDatabase()
+	initialiseSchema()
+	initialiseCommonPasswords()
+	initialiseOidc()
+	initialiseAuthBackend()
+	initialiseWebauthn()
+	initialiseClassificationRules()
+	initialisePrevalence()
 	setupHttpServer()
 }
 
@@ -87,7 +93,7 @@ func setupHttpServer() {
 		router.Use(gin.Recovery())
 	}
 
-	sessionStore = cookie.NewStore([]byte("secret"))
+	sessionStore = NewPostgresStore(getSessionSecret(), time.Duration(config.InactiveSessionTimeoutSeconds)*time.Second)
 	router.Use(sessions.Sessions(APP_NAME, sessionStore))
 	router.HTMLRender = loadTemplates("./templates")
 	router.Static("/static", "./static")
@@ -95,30 +101,96 @@ func setupHttpServer() {
 	router.GET("/", routeLogonGet)
 	router.POST("/", routeLogonPost)
 	router.GET("/logout", routeLogout)
+	router.GET("/oidc/login", routeOidcLogin)
+	router.GET("/oidc/callback", routeOidcCallback)
 
 	authorized := router.Group("/")
-	authorized.Use(AuthorizeMiddleware())
+	authorized.Use(AuthorizeMiddleware(), CsrfMiddleware())
 	{
 		authorized.GET("/enroll", routeEnrollGet)
 		authorized.POST("/enroll", routeEnrollPost)
 		authorized.GET("/verify", routeVerifyGet)
 		authorized.POST("/verify", routeVerifyPost)
+		authorized.POST("/enroll/webauthn/begin", routeEnrollWebauthnBegin)
+		authorized.POST("/enroll/webauthn", routeEnrollWebauthnPost)
+		authorized.POST("/verify/webauthn/begin", routeVerifyWebauthnBegin)
+		authorized.POST("/verify/webauthn", routeVerifyWebauthnPost)
 		authorized.GET("/alerts", routeAlerts)
 		authorized.POST("/alerts", routeAlerts)
+		authorized.GET("/alerts/:id", routeAlertGet)
+		authorized.POST("/alerts/:id/state", routeAlertStatePost)
+		authorized.POST("/alerts/:id/assign", routeAlertAssignPost)
+		authorized.POST("/alerts/:id/comments", routeAlertCommentPost)
+		authorized.GET("/grouped", routeGrouped)
+		authorized.POST("/grouped", routeGrouped)
+		authorized.GET("/grouped/:key", routeGroupedAlerts)
+		authorized.GET("/bulk", routeBulkGet)
+		authorized.POST("/bulk", routeBulkPost)
 		authorized.GET("/classified", routeClassified)
 		authorized.POST("/classified", routeClassified)
 		authorized.GET("/singlehost", routeSingleHost)
 		authorized.POST("/singlehost", routeSingleHost)
+		authorized.GET("/hosts", routeHosts)
+		authorized.GET("/hosts/tags", routeHostTagsGet)
+		authorized.POST("/hosts/tags", routeHostTagsPost)
+		authorized.GET("/timeline", routeTimeline)
+		authorized.GET("/compare", routeCompare)
+		authorized.GET("/groups", routeGroupsGet)
+		authorized.GET("/groups/new", routeGroupNewGet)
+		authorized.POST("/groups/new", routeGroupNewPost)
+		authorized.GET("/groups/edit/:id", routeGroupEditGet)
+		authorized.POST("/groups/edit/:id", routeGroupEditPost)
+		authorized.POST("/groups/delete/:id", routeGroupDeletePost)
+		authorized.GET("/groups/baseline", routeGroupBaselineGet)
+		authorized.POST("/groups/baseline", routeGroupBaselinePost)
+		authorized.GET("/baseline/:id", routeBaseline)
 		authorized.GET("/search", routeSearch)
 		authorized.POST("/search", routeSearch)
+		authorized.GET("/stacking", routeStacking)
+		authorized.POST("/stacking", routeStacking)
 		authorized.GET("/export", routeExport)
 		authorized.POST("/export", routeExport)
-		authorized.GET("/export/:id", routeExportData) // Download
 		authorized.GET("/users", routeUsersGet)
-		authorized.GET("/users/new", routeUserNewGet)
-		authorized.POST("/users/new", routeUserNewPost)
+		authorized.GET("/users/:id", routeUserGet)
+		authorized.POST("/users/:id", routeUserPost)
+		authorized.POST("/users/:id/lock", routeUserLockPost)
+		authorized.POST("/users/:id/unlock", routeUserUnlockPost)
+		authorized.POST("/users/:id/delete", routeUserDeletePost)
+		authorized.POST("/users/:id/reset", routeUserResetPost)
+		authorized.POST("/users/:id/mfareset", routeUserMfaResetPost)
+		authorized.POST("/users/:id/logout", routeUserLogoutPost)
+		authorized.GET("/rules", routeRulesGet)
+		authorized.GET("/rules/new", routeRuleNewGet)
+		authorized.POST("/rules/new", routeRuleNewPost)
+		authorized.GET("/rules/edit/:id", routeRuleEditGet)
+		authorized.POST("/rules/edit/:id", routeRuleEditPost)
+		authorized.POST("/rules/delete/:id", routeRuleDeletePost)
+		authorized.POST("/rules/run/:id", routeRuleRunPost)
+		authorized.POST("/rules/run", routeRulesRunPost)
+		authorized.GET("/audit", routeAuditGet)
+		authorized.GET("/audit/download", routeAuditDownload)
+		authorized.GET("/account", routeAccountGet)
+		authorized.GET("/account/password", routeAccountPasswordGet)
+		authorized.POST("/account/password", routeAccountPasswordPost)
+		authorized.GET("/account/sessions", routeAccountSessionsGet)
+		authorized.POST("/account/sessions/revoke/:id", routeAccountSessionRevokePost)
+		authorized.POST("/account/tokens/new", routeAccountTokenNewPost)
+		authorized.POST("/account/tokens/revoke/:id", routeAccountTokenRevokePost)
+		authorized.POST("/account/recovery", routeAccountRecoveryPost)
+		authorized.POST("/account/webauthn/begin", routeAccountWebauthnBegin)
+		authorized.POST("/account/webauthn/new", routeAccountWebauthnNewPost)
+		authorized.POST("/account/webauthn/delete/:id", routeAccountWebauthnDeletePost)
 	}
 
+	// Downloads can also be authorized using an API token
+	download := router.Group("/")
+	download.Use(DownloadAuthorizeMiddleware())
+	{
+		download.GET("/export/:id", routeExportData)
+	}
+
+	setupApiRoutes(router)
+
 	router.Run(config.HttpIp + ":" + fmt.Sprintf("%d", config.HttpPort))
 }
 
@@ -158,6 +230,9 @@ func initialiseDatabase() {
 func loadConfig(configPath string) {
 
 	config = new(Config)
+	// Defaults for values that are not required in the config file
+	config.PasswordPolicy = PasswordPolicyConfig{MinLength: 12, CheckCommonPasswords: true, HistoryCount: 5}
+
 	data, err := util.ReadTextFromFile(configPath)
 	if err != nil {
 		logger.Fatalf("Error reading the config file: %v", err)
@@ -203,6 +278,30 @@ func loadConfig(configPath string) {
 	if len(config.ExportDir) == 0 {
 		logger.Fatal("Export dir not set in config file")
 	}
+
+	if config.InactiveSessionTimeoutSeconds <= 0 {
+		config.InactiveSessionTimeoutSeconds = 3600
+	}
+
+	if config.RuleIntervalMinutes <= 0 {
+		config.RuleIntervalMinutes = 15
+	}
+
+	if config.PrevalenceIntervalMinutes <= 0 {
+		config.PrevalenceIntervalMinutes = 60
+	}
+
+	if config.HostStaleHours <= 0 {
+		config.HostStaleHours = 24
+	}
+
+	if config.PasswordPolicy.MinLength < 8 || config.PasswordPolicy.MinLength > PASSWORD_MAX_LENGTH {
+		logger.Fatalf("Password policy minimum length must be between 8 and %d", PASSWORD_MAX_LENGTH)
+	}
+
+	if config.PasswordPolicy.HistoryCount < 0 {
+		logger.Fatal("Password policy history count cannot be negative")
+	}
 }
 
 // Sets up the logging infrastructure e.g. Stdout and /var/log
@@ -241,26 +340,72 @@ func loadTemplates(templatesDir string) multitemplate.Render {
 		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "index.html"))
 	r.AddFromFiles("logon",
 		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "logon.html"))
+	r.AddFromFiles("forbidden",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "forbidden.html"))
 	r.AddFromFiles("enroll",
 		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "enroll.html"))
 	r.AddFromFiles("verify",
 		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "verify.html"))
+	r.AddFromFiles("password",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "password.html"))
+	r.AddFromFiles("sessions",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "sessions.html"))
+	r.AddFromFiles("recovery",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "recovery.html"))
 	r.AddFromFiles("users",
 		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "users.html"))
 	r.AddFromFiles("user",
 		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "user.html"))
+	r.AddFromFiles("rules",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "rules.html"))
+	r.AddFromFiles("rule",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "rule.html"))
+	r.AddFromFiles("audit",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "audit.html"))
+	r.AddFromFiles("account",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "account.html"))
 	r.AddFromFiles("alerts",
 		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "alerts.html"),
 		filepath.Join(templatesDir, "buttons.html"))
+	r.AddFromFiles("alert",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "alert.html"))
+	r.AddFromFiles("grouped",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "grouped.html"),
+		filepath.Join(templatesDir, "buttons.html"))
+	r.AddFromFiles("grouped_alerts",
+		filepath.Join(templatesDir, "grouped_alerts.html"))
+	r.AddFromFiles("bulk",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "bulk.html"))
 	r.AddFromFiles("classified",
 		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "classified.html"),
 		filepath.Join(templatesDir, "buttons.html"))
 	r.AddFromFiles("single_host",
 		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "single_host.html"),
 		filepath.Join(templatesDir, "buttons.html"))
+	r.AddFromFiles("hosts",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "hosts.html"),
+		filepath.Join(templatesDir, "buttons.html"))
+	r.AddFromFiles("host_tags",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "host_tags.html"))
+	r.AddFromFiles("timeline",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "timeline.html"),
+		filepath.Join(templatesDir, "buttons.html"))
+	r.AddFromFiles("compare",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "compare.html"))
+	r.AddFromFiles("groups",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "groups.html"))
+	r.AddFromFiles("group",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "group.html"))
+	r.AddFromFiles("group_baseline",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "group_baseline.html"))
+	r.AddFromFiles("baseline",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "baseline.html"))
 	r.AddFromFiles("single_host_data",
 		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "single_host_data.html"),
 		filepath.Join(templatesDir, "buttons.html"))
+	r.AddFromFiles("stacking",
+		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "stacking.html"),
+		filepath.Join(templatesDir, "buttons.html"))
 	r.AddFromFiles("export",
 		filepath.Join(templatesDir, "base.html"), filepath.Join(templatesDir, "export.html"))
 	r.AddFromFiles("search",
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+// Allowed difference between our clock and the IdP's when checking ID token times
+const OIDC_CLOCK_SKEW time.Duration = 2 * time.Minute
+
+// How long the IdP's signing keys are cached before being refreshed
+const OIDC_KEY_CACHE_DURATION time.Duration = 1 * time.Hour
+
+// ##### Structs ##############################################################
+
+// Represents the subset of the IdP's discovery document that we use
+type OidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// Represents a single key from the IdP's JSON Web Key Set
+type OidcJwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Represents the response from the IdP's token endpoint
+type OidcTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IdToken          string `json:"id_token"`
+	TokenType        string `json:"token_type"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// OidcProvider holds the discovered IdP end-points and the cached signing keys
+type OidcProvider struct {
+	sync.Mutex
+	client      *http.Client
+	discovery   *OidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// ##### Variables ############################################################
+
+var oidcProvider *OidcProvider
+
+// ##### Methods ##############################################################
+
+// initialiseOidc validates the OpenID Connect configuration and creates the provider.
+// Discovery is performed on first use so that an unavailable IdP does not stop the server starting
+func initialiseOidc() {
+
+	if config.Oidc.Enabled == false {
+		return
+	}
+
+	if len(config.Oidc.Issuer) == 0 {
+		logger.Fatal("OIDC issuer not set in config file")
+	}
+
+	if len(config.Oidc.ClientID) == 0 {
+		logger.Fatal("OIDC client ID not set in config file")
+	}
+
+	if len(config.Oidc.RedirectUrl) == 0 {
+		logger.Fatal("OIDC redirect URL not set in config file")
+	}
+
+	if len(config.Oidc.Scopes) == 0 {
+		config.Oidc.Scopes = []string{"openid", "profile", "email"}
+	}
+
+	if len(config.Oidc.UsernameClaim) == 0 {
+		config.Oidc.UsernameClaim = "preferred_username"
+	}
+
+	if len(config.Oidc.GroupClaim) == 0 {
+		config.Oidc.GroupClaim = "groups"
+	}
+
+	oidcProvider = &OidcProvider{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: config.Oidc.TlsInsecureSkipVerify},
+			},
+		},
+	}
+}
+
+// getJson performs a GET request and unmarshals the JSON response
+func (p *OidcProvider) getJson(url string, v interface{}) error {
+
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status code: %d (%s)", resp.StatusCode, url)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Discovery returns the IdP's discovery document, retrieving it on first use
+func (p *OidcProvider) Discovery() (*OidcDiscovery, error) {
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	d := new(OidcDiscovery)
+	err := p.getJson(strings.TrimSuffix(config.Oidc.Issuer, "/")+"/.well-known/openid-configuration", d)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Issuer != config.Oidc.Issuer {
+		return nil, fmt.Errorf("Discovered issuer does not match configuration: %s", d.Issuer)
+	}
+
+	if len(d.AuthorizationEndpoint) == 0 || len(d.TokenEndpoint) == 0 || len(d.JwksUri) == 0 {
+		return nil, errors.New("Discovery document is missing required end-points")
+	}
+
+	p.discovery = d
+	return d, nil
+}
+
+// Key returns the signing key for the key ID. The key set is refreshed when it
+// is stale or does not contain the key ID, to support the IdP rotating keys
+func (p *OidcProvider) Key(kid string) (crypto.PublicKey, error) {
+
+	d, err := p.Discovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	key, exists := p.keys[kid]
+	if exists == true && time.Since(p.keysFetched) < OIDC_KEY_CACHE_DURATION {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []OidcJwk `json:"keys"`
+	}
+
+	err = p.getJson(d.JwksUri, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+
+		publicKey, err := parseJwk(k)
+		if err != nil {
+			log.Printf("Error parsing OIDC signing key: %v (%s)\n", err, k.Kid)
+			continue
+		}
+
+		keys[k.Kid] = publicKey
+	}
+
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	key, exists = p.keys[kid]
+	if exists == false {
+		return nil, fmt.Errorf("Unknown signing key: %s", kid)
+	}
+
+	return key, nil
+}
+
+// parseJwk converts a JSON Web Key to an RSA or ECDSA public key
+func parseJwk(k OidcJwk) (crypto.PublicKey, error) {
+
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve: %s", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported key type: %s", k.Kty)
+}
+
+// verifyJwtSignature checks the signature of a JWT, returning the decoded claims
+func (p *OidcProvider) verifyJwtSignature(token string) (map[string]interface{}, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("Malformed token header")
+	}
+
+	err = json.Unmarshal(data, &header)
+	if err != nil {
+		return nil, errors.New("Malformed token header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Malformed token signature")
+	}
+
+	var h hash.Hash
+	var cryptoHash crypto.Hash
+	switch header.Alg {
+	case "RS256", "ES256":
+		h, cryptoHash = sha256.New(), crypto.SHA256
+	case "RS384", "ES384":
+		h, cryptoHash = sha512.New384(), crypto.SHA384
+	case "RS512", "ES512":
+		h, cryptoHash = sha512.New(), crypto.SHA512
+	default:
+		// Explicitly rejects "none" and the symmetric algorithms
+		return nil, fmt.Errorf("Unsupported token algorithm: %s", header.Alg)
+	}
+
+	key, err := p.Key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(header.Alg, "RS") == false {
+			return nil, errors.New("Token algorithm does not match key")
+		}
+
+		err = rsa.VerifyPKCS1v15(k, cryptoHash, digest, signature)
+		if err != nil {
+			return nil, errors.New("Invalid token signature")
+		}
+
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(header.Alg, "ES") == false {
+			return nil, errors.New("Token algorithm does not match key")
+		}
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return nil, errors.New("Invalid token signature")
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if ecdsa.Verify(k, digest, r, s) == false {
+			return nil, errors.New("Invalid token signature")
+		}
+
+	default:
+		return nil, errors.New("Unsupported key type")
+	}
+
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("Malformed token claims")
+	}
+
+	claims := make(map[string]interface{})
+	err = json.Unmarshal(data, &claims)
+	if err != nil {
+		return nil, errors.New("Malformed token claims")
+	}
+
+	return claims, nil
+}
+
+// VerifyIdToken validates the ID token signature and the standard claims
+func (p *OidcProvider) VerifyIdToken(token string, nonce string) (map[string]interface{}, error) {
+
+	claims, err := p.verifyJwtSignature(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if getClaimString(claims, "iss") != config.Oidc.Issuer {
+		return nil, errors.New("Invalid token issuer")
+	}
+
+	audiences := getClaimStrings(claims, "aud")
+	validAudience := false
+	for _, a := range audiences {
+		if a == config.Oidc.ClientID {
+			validAudience = true
+		}
+	}
+
+	if validAudience == false {
+		return nil, errors.New("Invalid token audience")
+	}
+
+	if len(audiences) > 1 && getClaimString(claims, "azp") != config.Oidc.ClientID {
+		return nil, errors.New("Invalid token authorized party")
+	}
+
+	now := time.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if ok == false || now.After(time.Unix(int64(exp), 0).Add(OIDC_CLOCK_SKEW)) {
+		return nil, errors.New("Token expired")
+	}
+
+	iat, ok := claims["iat"].(float64)
+	if ok == false || now.Add(OIDC_CLOCK_SKEW).Before(time.Unix(int64(iat), 0)) {
+		return nil, errors.New("Token issued in the future")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(getClaimString(claims, "nonce")), []byte(nonce)) != 1 {
+		return nil, errors.New("Invalid token nonce")
+	}
+
+	if len(getClaimString(claims, "sub")) == 0 {
+		return nil, errors.New("Token has no subject")
+	}
+
+	return claims, nil
+}
+
+// ExchangeCode swaps the authorization code for the IdP's tokens
+func (p *OidcProvider) ExchangeCode(code string, verifier string) (*OidcTokenResponse, error) {
+
+	d, err := p.Discovery()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", config.Oidc.RedirectUrl)
+	form.Set("client_id", config.Oidc.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if len(config.Oidc.ClientSecret) > 0 {
+		req.SetBasicAuth(url.QueryEscape(config.Oidc.ClientID), url.QueryEscape(config.Oidc.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	t := new(OidcTokenResponse)
+	err = json.Unmarshal(body, t)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid token response: %v (Status: %d)", err, resp.StatusCode)
+	}
+
+	if resp.StatusCode != http.StatusOK || len(t.Error) > 0 {
+		return nil, fmt.Errorf("Token request failed: %s %s (Status: %d)", t.Error, t.ErrorDescription, resp.StatusCode)
+	}
+
+	if len(t.IdToken) == 0 {
+		return nil, errors.New("Token response has no ID token")
+	}
+
+	return t, nil
+}
+
+// getClaimString returns a string claim, or an empty string if it is missing
+func getClaimString(claims map[string]interface{}, name string) string {
+
+	value, _ := claims[name].(string)
+	return value
+}
+
+// getClaimStrings returns a claim that may be either a single string or an array of strings
+func getClaimStrings(claims map[string]interface{}, name string) []string {
+
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, i := range v {
+			if s, ok := i.(string); ok == true {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
+
+// mapGroupsToAccountType returns the account type for a set of groups. Users that are in
+// none of the configured groups are denied access, unless no user groups are configured
+func mapGroupsToAccountType(groups []string, adminGroups []string, userGroups []string) (AccountType, bool) {
+
+	for _, g := range groups {
+		for _, a := range adminGroups {
+			if strings.EqualFold(g, a) {
+				return ADMIN, true
+			}
+		}
+	}
+
+	if len(userGroups) == 0 {
+		return USER, true
+	}
+
+	for _, g := range groups {
+		for _, u := range userGroups {
+			if strings.EqualFold(g, u) {
+				return USER, true
+			}
+		}
+	}
+
+	return USER, false
+}
+
+// provisionExternalUser returns the local user record for an externally authenticated
+// user, creating it on first logon and keeping the name and account type in sync
+func provisionExternalUser(provider string, externalID string, username string, name string, accountType AccountType) (*User, error) {
+
+	u, err := NewUserByExternalID(provider, externalID)
+	if err == nil {
+		u.Name = name
+		u.AccountType = int16(accountType)
+		err = u.Update()
+		return u, err
+	}
+
+	// Ensure an existing account (e.g. a local one) cannot be taken over
+	u = new(User)
+	u.Username = username
+	exists, err := u.Exists()
+	if err != nil {
+		return u, err
+	}
+
+	if exists == true {
+		return u, errors.New("Username already exists for a different account")
+	}
+
+	u.Name = name
+	u.AccountType = int16(accountType)
+	u.AuthProvider = provider
+	u.ExternalID = externalID
+	// The password is never used, it just ensures that a local logon is not possible
+	u.Password = generateRandomString(32)
+
+	err = u.Validate(true)
+	if err != nil {
+		return u, err
+	}
+
+	err = u.Add()
+	if err != nil {
+		return u, err
+	}
+
+	return NewUserByExternalID(provider, externalID)
+}
+
+// generateRandomUrlString returns a random base64url string, used for the state, nonce and PKCE verifier
+func generateRandomUrlString() string {
+
+	return base64.RawURLEncoding.EncodeToString([]byte(generateRandomString(32)))
+}
+
+// ***** Routing Methods ******************************************************
+
+// routeOidcLogin starts the authorization code flow, by storing the state, nonce and
+// PKCE verifier within the session and redirecting the user to the IdP
+func routeOidcLogin(c *gin.Context) {
+
+	if oidcProvider == nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	d, err := oidcProvider.Discovery()
+	if err != nil {
+		log.Printf("Error performing OIDC discovery: %v\n", err)
+		renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Single sign-on is unavailable")))
+		return
+	}
+
+	state := generateRandomUrlString()
+	nonce := generateRandomUrlString()
+	verifier := generateRandomUrlString() + generateRandomUrlString()
+	challenge := sha256.Sum256([]byte(verifier))
+
+	session, _ := sessionStore.Get(c.Request, APP_NAME)
+	session.Values["oidc_state"] = state
+	session.Values["oidc_nonce"] = nonce
+	session.Values["oidc_verifier"] = verifier
+	err = session.Save(c.Request, c.Writer)
+	if err != nil {
+		log.Printf("Error saving user session (OIDC): %v\n", err)
+		goToErrorPage(c, "Unable to perform login")
+		return
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", config.Oidc.ClientID)
+	params.Set("redirect_uri", config.Oidc.RedirectUrl)
+	params.Set("scope", strings.Join(config.Oidc.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	c.Redirect(http.StatusFound, d.AuthorizationEndpoint+separator+params.Encode())
+}
+
+// routeOidcCallback completes the authorization code flow, validating the ID token
+// and then logging the user on, provisioning them if required
+func routeOidcCallback(c *gin.Context) {
+
+	if oidcProvider == nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	session, err := sessionStore.Get(c.Request, APP_NAME)
+	if err != nil {
+		goToErrorPage(c, "Unable to perform login")
+		return
+	}
+
+	state, _ := session.Values["oidc_state"].(string)
+	nonce, _ := session.Values["oidc_nonce"].(string)
+	verifier, _ := session.Values["oidc_verifier"].(string)
+
+	// The state, nonce and verifier are single use
+	delete(session.Values, "oidc_state")
+	delete(session.Values, "oidc_nonce")
+	delete(session.Values, "oidc_verifier")
+	err = session.Save(c.Request, c.Writer)
+	if err != nil {
+		log.Printf("Error saving user session (OIDC): %v\n", err)
+		goToErrorPage(c, "Unable to perform login")
+		return
+	}
+
+	if len(state) == 0 || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		log.Println("Error validating OIDC state")
+		renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Single sign-on failed")))
+		return
+	}
+
+	if len(c.Query("error")) > 0 {
+		log.Printf("Error returned from OIDC IdP: %s (%s)\n", c.Query("error"), c.Query("error_description"))
+		renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Single sign-on failed")))
+		return
+	}
+
+	tokens, err := oidcProvider.ExchangeCode(c.Query("code"), verifier)
+	if err != nil {
+		log.Printf("Error exchanging OIDC code: %v\n", err)
+		renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Single sign-on failed")))
+		return
+	}
+
+	claims, err := oidcProvider.VerifyIdToken(tokens.IdToken, nonce)
+	if err != nil {
+		log.Printf("Error validating OIDC ID token: %v\n", err)
+		renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Single sign-on failed")))
+		return
+	}
+
+	subject := getClaimString(claims, "sub")
+	username := getClaimString(claims, config.Oidc.UsernameClaim)
+	if len(username) == 0 {
+		username = subject
+	}
+
+	accountType, allowed := mapGroupsToAccountType(
+		getClaimStrings(claims, config.Oidc.GroupClaim), config.Oidc.AdminGroups, config.Oidc.UserGroups)
+	if allowed == false {
+		log.Printf("Error OIDC user not in an allowed group: %v\n", username)
+		writeAuditFor(c, -1, username, AUDIT_LOGON_FAILURE, AUDIT_TARGET_NONE, "", "Not permitted ("+AUTH_PROVIDER_OIDC+")")
+		renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Account not permitted")))
+		return
+	}
+
+	u, err := provisionExternalUser(AUTH_PROVIDER_OIDC, subject, username, getClaimString(claims, "name"), accountType)
+	if err != nil {
+		log.Printf("Error provisioning OIDC user: %v (%s)\n", err, username)
+		renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Unable to provision account")))
+		return
+	}
+
+	if u.Locked == true {
+		log.Printf("Error user locked: %v\n", u.Username)
+		writeAuditFor(c, u.ID, u.Username, AUDIT_LOGON_FAILURE, AUDIT_TARGET_USER, convertInt64ToString(u.ID), "Account locked")
+		renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Account locked")))
+		return
+	}
+
+	// The second factor is the responsibility of the IdP
+	err = startUserSession(c, u, true, true)
+	if err != nil {
+		log.Printf("Error saving user session (OIDC): %v\n", err)
+		goToErrorPage(c, "Unable to perform login")
+		return
+	}
+
+	writeAuditFor(c, u.ID, u.Username, AUDIT_LOGON_SUCCESS, AUDIT_TARGET_USER, convertInt64ToString(u.ID), AUTH_PROVIDER_OIDC)
+
+	c.Redirect(http.StatusFound, "/alerts")
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Mock IdP #############################################################
+
+const (
+	TEST_OIDC_CLIENT_ID    = "arl"
+	TEST_OIDC_REDIRECT_URL = "https://arl.example.com/oidc/callback"
+	TEST_OIDC_NONCE        = "test-nonce"
+)
+
+// testIdp serves the discovery document, JSON Web Key Set and token end-point of an
+// OpenID Connect provider. The token end-point returns the ID token that has been set
+type testIdp struct {
+	server        *httptest.Server
+	ecKey         *ecdsa.PrivateKey
+	rsaKey        *rsa.PrivateKey
+	mutex         sync.Mutex
+	idToken       string
+	tokenRequests []url.Values
+	jwksRequests  int
+}
+
+// newTestIdp starts the IdP and configures the OIDC provider to use it
+func newTestIdp(t *testing.T) *testIdp {
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating EC key: %v", err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating RSA key: %v", err)
+	}
+
+	idp := &testIdp{ecKey: ecKey, rsaKey: rsaKey}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.routeDiscovery)
+	mux.HandleFunc("/jwks", idp.routeJwks)
+	mux.HandleFunc("/token", idp.routeToken)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	config = &Config{Oidc: OidcConfig{
+		Enabled:     true,
+		Issuer:      idp.server.URL,
+		ClientID:    TEST_OIDC_CLIENT_ID,
+		RedirectUrl: TEST_OIDC_REDIRECT_URL,
+	}}
+	initialiseOidc()
+	t.Cleanup(func() { oidcProvider = nil })
+
+	return idp
+}
+
+func (idp *testIdp) routeDiscovery(w http.ResponseWriter, r *http.Request) {
+
+	json.NewEncoder(w).Encode(OidcDiscovery{
+		Issuer:                idp.server.URL,
+		AuthorizationEndpoint: idp.server.URL + "/authorize",
+		TokenEndpoint:         idp.server.URL + "/token",
+		JwksUri:               idp.server.URL + "/jwks",
+	})
+}
+
+func (idp *testIdp) routeJwks(w http.ResponseWriter, r *http.Request) {
+
+	idp.mutex.Lock()
+	idp.jwksRequests++
+	idp.mutex.Unlock()
+
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	idp.ecKey.X.FillBytes(x)
+	idp.ecKey.Y.FillBytes(y)
+
+	json.NewEncoder(w).Encode(map[string][]OidcJwk{"keys": {
+		{Kid: "ec1", Kty: "EC", Use: "sig", Crv: "P-256", X: base64.RawURLEncoding.EncodeToString(x), Y: base64.RawURLEncoding.EncodeToString(y)},
+		{Kid: "rsa1", Kty: "RSA", Use: "sig", N: base64.RawURLEncoding.EncodeToString(idp.rsaKey.N.Bytes()), E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.rsaKey.E)).Bytes())},
+		{Kid: "enc1", Kty: "RSA", Use: "enc", N: "AQAB", E: "AQAB"},
+	}})
+}
+
+func (idp *testIdp) routeToken(w http.ResponseWriter, r *http.Request) {
+
+	r.ParseForm()
+
+	idp.mutex.Lock()
+	idp.tokenRequests = append(idp.tokenRequests, r.PostForm)
+	idToken := idp.idToken
+	idp.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(OidcTokenResponse{AccessToken: "access", TokenType: "Bearer", IdToken: idToken})
+}
+
+// claims returns valid ID token claims, which the tests then alter
+func (idp *testIdp) claims() map[string]interface{} {
+
+	now := time.Now().Unix()
+	return map[string]interface{}{
+		"iss":                idp.server.URL,
+		"aud":                TEST_OIDC_CLIENT_ID,
+		"sub":                "00u1",
+		"preferred_username": "alice",
+		"nonce":              TEST_OIDC_NONCE,
+		"iat":                now,
+		"exp":                now + 300,
+	}
+}
+
+// sign returns a JWT signed with the EC (ES256) or RSA (RS256) key
+func (idp *testIdp) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+
+	return signTestJwt(t, alg, kid, claims, idp.ecKey, idp.rsaKey)
+}
+
+func signTestJwt(t *testing.T, alg string, kid string, claims map[string]interface{}, ecKey *ecdsa.PrivateKey, rsaKey *rsa.PrivateKey) string {
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatalf("Error signing token: %v", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("Error signing token: %v", err)
+		}
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// ##### ID Token Tests #######################################################
+
+func TestOidcVerifyIdToken(t *testing.T) {
+
+	idp := newTestIdp(t)
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	tests := []struct {
+		name     string
+		token    func() string
+		expected string
+	}{
+		{"valid ES256", func() string { return idp.sign(t, "ES256", "ec1", idp.claims()) }, ""},
+		{"valid RS256", func() string { return idp.sign(t, "RS256", "rsa1", idp.claims()) }, ""},
+		{"bad signature", func() string {
+			return signTestJwt(t, "ES256", "ec1", idp.claims(), otherKey, nil)
+		}, "Invalid token signature"},
+		{"altered claims", func() string {
+			parts := strings.Split(idp.sign(t, "ES256", "ec1", idp.claims()), ".")
+			claims := idp.claims()
+			claims["sub"] = "admin"
+			payload, _ := json.Marshal(claims)
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+		}, "Invalid token signature"},
+		{"unknown kid", func() string { return idp.sign(t, "ES256", "ec2", idp.claims()) }, "Unknown signing key"},
+		{"encryption key", func() string { return idp.sign(t, "RS256", "enc1", idp.claims()) }, "Unknown signing key"},
+		{"algorithm none", func() string {
+			parts := strings.Split(idp.sign(t, "ES256", "ec1", idp.claims()), ".")
+			header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "ec1"})
+			return base64.RawURLEncoding.EncodeToString(header) + "." + parts[1] + "."
+		}, "Unsupported token algorithm"},
+		{"algorithm does not match key", func() string { return idp.sign(t, "RS256", "ec1", idp.claims()) }, "does not match key"},
+		{"wrong issuer", func() string {
+			claims := idp.claims()
+			claims["iss"] = "https://evil.example.com"
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, "Invalid token issuer"},
+		{"wrong audience", func() string {
+			claims := idp.claims()
+			claims["aud"] = "other-client"
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, "Invalid token audience"},
+		{"multiple audiences without azp", func() string {
+			claims := idp.claims()
+			claims["aud"] = []string{"other-client", TEST_OIDC_CLIENT_ID}
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, "Invalid token authorized party"},
+		{"multiple audiences with azp", func() string {
+			claims := idp.claims()
+			claims["aud"] = []string{"other-client", TEST_OIDC_CLIENT_ID}
+			claims["azp"] = TEST_OIDC_CLIENT_ID
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, ""},
+		{"expired", func() string {
+			claims := idp.claims()
+			claims["exp"] = time.Now().Add(-OIDC_CLOCK_SKEW - time.Minute).Unix()
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, "Token expired"},
+		{"expired within clock skew", func() string {
+			claims := idp.claims()
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, ""},
+		{"missing expiry", func() string {
+			claims := idp.claims()
+			delete(claims, "exp")
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, "Token expired"},
+		{"issued in the future", func() string {
+			claims := idp.claims()
+			claims["iat"] = time.Now().Add(OIDC_CLOCK_SKEW + time.Minute).Unix()
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, "Token issued in the future"},
+		{"nonce mismatch", func() string {
+			claims := idp.claims()
+			claims["nonce"] = "other-nonce"
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, "Invalid token nonce"},
+		{"missing nonce", func() string {
+			claims := idp.claims()
+			delete(claims, "nonce")
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, "Invalid token nonce"},
+		{"missing subject", func() string {
+			claims := idp.claims()
+			delete(claims, "sub")
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, "Token has no subject"},
+		{"malformed", func() string { return "not.a-token" }, "Malformed token"},
+	}
+
+	for _, test := range tests {
+		_, err := oidcProvider.VerifyIdToken(test.token(), TEST_OIDC_NONCE)
+
+		if len(test.expected) == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+
+		if err == nil || strings.Contains(err.Error(), test.expected) == false {
+			t.Errorf("%s: error = %v, expected %q", test.name, err, test.expected)
+		}
+	}
+}
+
+func TestOidcKeyCache(t *testing.T) {
+
+	idp := newTestIdp(t)
+
+	for i := 0; i < 2; i++ {
+		_, err := oidcProvider.VerifyIdToken(idp.sign(t, "ES256", "ec1", idp.claims()), TEST_OIDC_NONCE)
+		if err != nil {
+			t.Fatalf("Error verifying token: %v", err)
+		}
+	}
+
+	if idp.jwksRequests != 1 {
+		t.Errorf("JWKS requests = %d, expected the keys to be cached", idp.jwksRequests)
+	}
+
+	// An unknown key ID refreshes the key set, in case the IdP has rotated its keys
+	oidcProvider.VerifyIdToken(idp.sign(t, "ES256", "ec2", idp.claims()), TEST_OIDC_NONCE)
+	if idp.jwksRequests != 2 {
+		t.Errorf("JWKS requests = %d, expected a refresh for an unknown key", idp.jwksRequests)
+	}
+}
+
+// ##### Callback Tests #######################################################
+
+// newTestOidcRouter returns a router for the login and callback end-points, using a cookie session store
+func newTestOidcRouter() *gin.Engine {
+
+	gin.SetMode(gin.TestMode)
+	sessionStore = cookie.NewStore([]byte("0123456789abcdef0123456789abcdef"))
+
+	router := gin.New()
+	router.HTMLRender = loadTemplates("templates")
+	router.GET("/oidc/login", routeOidcLogin)
+	router.GET("/oidc/callback", routeOidcCallback)
+
+	return router
+}
+
+// startTestOidcLogin starts the flow, returning the session cookies and the authorization request parameters
+func startTestOidcLogin(t *testing.T, router *gin.Engine, idp *testIdp) ([]*http.Cookie, url.Values) {
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oidc/login", nil))
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("Login status = %d, expected a redirect", w.Code)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || strings.HasPrefix(location.String(), idp.server.URL+"/authorize?") == false {
+		t.Fatalf("Unexpected authorization redirect: %s", w.Header().Get("Location"))
+	}
+
+	return w.Result().Cookies(), location.Query()
+}
+
+func callTestOidcCallback(router *gin.Engine, cookies []*http.Cookie, query url.Values) *httptest.ResponseRecorder {
+
+	r := httptest.NewRequest(http.MethodGet, "/oidc/callback?"+query.Encode(), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestOidcLogin(t *testing.T) {
+
+	idp := newTestIdp(t)
+	router := newTestOidcRouter()
+
+	_, params := startTestOidcLogin(t, router, idp)
+
+	expected := map[string]string{
+		"response_type":         "code",
+		"client_id":             TEST_OIDC_CLIENT_ID,
+		"redirect_uri":          TEST_OIDC_REDIRECT_URL,
+		"code_challenge_method": "S256",
+	}
+
+	for name, value := range expected {
+		if params.Get(name) != value {
+			t.Errorf("Parameter %s = %q, expected %q", name, params.Get(name), value)
+		}
+	}
+
+	for _, name := range []string{"state", "nonce", "code_challenge"} {
+		if len(params.Get(name)) < 32 {
+			t.Errorf("Parameter %s = %q, expected a random value", name, params.Get(name))
+		}
+	}
+}
+
+func TestOidcCallbackFailures(t *testing.T) {
+
+	idp := newTestIdp(t)
+	router := newTestOidcRouter()
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	tests := []struct {
+		name     string
+		token    func(nonce string) string
+		query    func(params url.Values) url.Values
+		exchange bool // Whether the code should be exchanged for tokens
+	}{
+		{"state mismatch", nil, func(params url.Values) url.Values {
+			return url.Values{"state": {"other-state"}, "code": {"code"}}
+		}, false},
+		{"missing state", nil, func(params url.Values) url.Values {
+			return url.Values{"code": {"code"}}
+		}, false},
+		{"IdP error", nil, func(params url.Values) url.Values {
+			return url.Values{"state": {params.Get("state")}, "error": {"access_denied"}}
+		}, false},
+		{"bad signature", func(nonce string) string {
+			claims := idp.claims()
+			claims["nonce"] = nonce
+			return signTestJwt(t, "ES256", "ec1", claims, otherKey, nil)
+		}, nil, true},
+		{"unknown kid", func(nonce string) string {
+			claims := idp.claims()
+			claims["nonce"] = nonce
+			return idp.sign(t, "ES256", "unknown", claims)
+		}, nil, true},
+		{"wrong issuer", func(nonce string) string {
+			claims := idp.claims()
+			claims["nonce"] = nonce
+			claims["iss"] = "https://evil.example.com"
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, nil, true},
+		{"wrong audience", func(nonce string) string {
+			claims := idp.claims()
+			claims["nonce"] = nonce
+			claims["aud"] = "other-client"
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, nil, true},
+		{"expired", func(nonce string) string {
+			claims := idp.claims()
+			claims["nonce"] = nonce
+			claims["exp"] = time.Now().Add(-time.Hour).Unix()
+			return idp.sign(t, "ES256", "ec1", claims)
+		}, nil, true},
+		{"nonce mismatch", func(nonce string) string {
+			return idp.sign(t, "ES256", "ec1", idp.claims())
+		}, nil, true},
+	}
+
+	for _, test := range tests {
+		cookies, params := startTestOidcLogin(t, router, idp)
+
+		if test.token != nil {
+			idp.idToken = test.token(params.Get("nonce"))
+		}
+
+		query := url.Values{"state": {params.Get("state")}, "code": {"code"}}
+		if test.query != nil {
+			query = test.query(params)
+		}
+
+		// Without the session cookies there is no state to match
+		if test.name == "missing state" {
+			cookies = nil
+		}
+
+		requests := len(idp.tokenRequests)
+		w := callTestOidcCallback(router, cookies, query)
+
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Single sign-on failed") == false {
+			t.Errorf("%s: status = %d, expected the logon page with an error", test.name, w.Code)
+		}
+
+		exchanged := len(idp.tokenRequests) > requests
+		if exchanged != test.exchange {
+			t.Errorf("%s: code exchanged = %v, expected %v", test.name, exchanged, test.exchange)
+		}
+	}
+}
+
+func TestOidcCallbackPkce(t *testing.T) {
+
+	idp := newTestIdp(t)
+	router := newTestOidcRouter()
+
+	cookies, params := startTestOidcLogin(t, router, idp)
+
+	// The token is rejected, so that the flow ends before the user is provisioned
+	claims := idp.claims()
+	claims["nonce"] = "other-nonce"
+	idp.idToken = idp.sign(t, "ES256", "ec1", claims)
+
+	callTestOidcCallback(router, cookies, url.Values{"state": {params.Get("state")}, "code": {"auth-code"}})
+
+	if len(idp.tokenRequests) != 1 {
+		t.Fatalf("Token requests = %d, expected 1", len(idp.tokenRequests))
+	}
+
+	form := idp.tokenRequests[0]
+	expected := map[string]string{
+		"grant_type":   "authorization_code",
+		"code":         "auth-code",
+		"redirect_uri": TEST_OIDC_REDIRECT_URL,
+		"client_id":    TEST_OIDC_CLIENT_ID,
+	}
+
+	for name, value := range expected {
+		if form.Get(name) != value {
+			t.Errorf("Token request %s = %q, expected %q", name, form.Get(name), value)
+		}
+	}
+
+	// The verifier stored in the session must be the one the challenge was derived from
+	verifier := form.Get("code_verifier")
+	challenge := sha256.Sum256([]byte(verifier))
+	if len(verifier) < 43 || base64.RawURLEncoding.EncodeToString(challenge[:]) != params.Get("code_challenge") {
+		t.Errorf("Code verifier %q does not match the code challenge %q", verifier, params.Get("code_challenge"))
+	}
+
+	// A second login uses a new verifier
+	cookies, params2 := startTestOidcLogin(t, router, idp)
+	callTestOidcCallback(router, cookies, url.Values{"state": {params2.Get("state")}, "code": {"auth-code"}})
+
+	if len(idp.tokenRequests) != 2 || idp.tokenRequests[1].Get("code_verifier") == verifier {
+		t.Error("Expected a different code verifier for each login")
+	}
+}
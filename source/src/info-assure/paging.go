@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ##### Constants ############################################################
+
+// Results with an estimated number of records up to this value are counted exactly
+const PAGING_EXACT_COUNT_MAX int64 = 100000
+
+// The maximum page number that can be jumped to, since jumping uses an offset
+const PAGING_JUMP_MAX int = 10000
+
+// ##### Structs ##############################################################
+
+// Paging contains the keyset (cursor) paging parameters and results for a view. The next and
+// previous pages are read relative to the cursors of the records at the edges of the current
+// page, so their cost does not depend upon the page number. Jumping to a page uses an offset
+type Paging struct {
+	Mode        string // first, next, previous, last, page or current
+	Number      int    // Zero based
+	Size        int
+	Cursor      string // The cursor that the next or previous page is read relative to
+	FirstCursor string // The cursors of the first and last records of the page
+	LastCursor  string
+	HasPrevious bool
+	HasNext     bool
+	Total       int64
+	TotalExact  bool
+}
+
+// Keyset contains the ORDER BY expressions of a view. The expressions are all sorted in the
+// same direction, and must end with a unique column (e.g. the ID) so that the order is stable
+type Keyset struct {
+	Columns    []string
+	Descending bool
+}
+
+// ##### Methods ##############################################################
+
+// processPaging returns the paging parameters. The parameters are read using the
+// supplied function e.g. from the query string or POST form
+func processPaging(param func(string) string) *Paging {
+
+	p := &Paging{Mode: "first", Size: 10}
+
+	size, successful := processIntParameter(param("num_recs_per_page"))
+	if successful == true && size > 0 && size <= 1000 {
+		p.Size = size
+	}
+
+	current, successful := processIntParameter(param("current_page_num"))
+	if successful == false || current < 0 {
+		current = 0
+	}
+
+	switch param("mode") {
+	case "next":
+		if len(param("last_key")) > 0 {
+			p.Mode = "next"
+			p.Cursor = param("last_key")
+			p.Number = current + 1
+		}
+	case "previous":
+		if len(param("first_key")) > 0 && current > 0 {
+			p.Mode = "previous"
+			p.Cursor = param("first_key")
+			p.Number = current - 1
+		}
+	case "last":
+		p.Mode = "last"
+	case "page":
+		page, successful := processIntParameter(param("page_num"))
+		if successful == true && page > 1 && page <= PAGING_JUMP_MAX {
+			p.Mode = "page"
+			p.Number = page - 1
+		}
+	case "", "first":
+	default:
+		// Any other action e.g. classification redisplays the current page
+		if len(param("first_key")) > 0 {
+			p.Mode = "current"
+			p.Cursor = param("first_key")
+			p.Number = current
+		}
+	}
+
+	return p
+}
+
+// reversed returns true if the page is read backwards i.e. the previous page, or the last page
+// when the total is an estimate
+func (p *Paging) reversed() bool {
+
+	return p.Mode == "previous" || p.Mode == "last"
+}
+
+// Pages returns the number of pages, which is approximate if the total is
+func (p *Paging) Pages() int64 {
+
+	if p.Total == 0 {
+		return 1
+	}
+
+	return (p.Total + int64(p.Size) - 1) / int64(p.Size)
+}
+
+// Page returns the one based page number for display
+func (p *Paging) Page() int {
+
+	return p.Number + 1
+}
+
+// setTotal sets the total number of records, and the number of the last page. When the total is
+// exact the last page is read from its offset, so that it contains the same records as jumping to
+// that page number, and the previous pages line up with the page numbers. An estimated total cannot
+// be used as an offset, so the last records are read backwards instead
+func (p *Paging) setTotal(total int64, exact bool) {
+
+	p.Total = total
+	p.TotalExact = exact
+
+	if p.Mode == "last" {
+		p.Number = int(p.Pages() - 1)
+
+		if exact == true {
+			p.Mode = "page"
+		}
+	}
+}
+
+// setResults sets the page's cursors and whether there are previous and next pages. The number of
+// records read includes the extra record that is read to determine whether there are more records
+func (p *Paging) setResults(read int, firstKey string, lastKey string) {
+
+	more := read > p.Size
+
+	if p.reversed() == true {
+		p.HasPrevious = more
+		p.HasNext = p.Mode == "previous"
+
+		// The start has been reached, regardless of the page number that was expected
+		if more == false {
+			p.Number = 0
+		}
+	} else {
+		p.HasNext = more
+		p.HasPrevious = p.Number > 0
+	}
+
+	if len(firstKey) > 0 {
+		p.FirstCursor = base64.RawURLEncoding.EncodeToString([]byte(firstKey))
+	}
+
+	if len(lastKey) > 0 {
+		p.LastCursor = base64.RawURLEncoding.EncodeToString([]byte(lastKey))
+	}
+}
+
+// trim removes the extra record that was read to determine whether there are more records,
+// restores the display order of a page that was read backwards, and sets the page's cursors.
+// The data is a slice of the records, and sortKey returns the sort key of the record at an
+// index. It returns the number of records on the page, which the slice should be cut to
+func (p *Paging) trim(data interface{}, sortKey func(i int) string) int {
+
+	read := reflect.ValueOf(data).Len()
+	count := read
+	if count > p.Size {
+		count = p.Size
+	}
+
+	if p.reversed() == true {
+		swap := reflect.Swapper(data)
+		for i, j := 0, count-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+
+	firstKey := ""
+	lastKey := ""
+	if count > 0 {
+		firstKey = sortKey(0)
+		lastKey = sortKey(count - 1)
+	}
+
+	p.setResults(read, firstKey, lastKey)
+
+	return count
+}
+
+// selectKey returns the SELECT expression of the record's sort key, which is a JSON array of the keyset values
+func (k *Keyset) selectKey() string {
+
+	return fmt.Sprintf("json_build_array(%s)::text AS sort_key", strings.Join(k.Columns, ", "))
+}
+
+// orderBy returns the ORDER BY clause, which is reversed when reading backwards
+func (k *Keyset) orderBy(reverse bool) string {
+
+	direction := "ASC"
+	if k.Descending != reverse {
+		direction = "DESC"
+	}
+
+	columns := make([]string, 0, len(k.Columns))
+	for _, c := range k.Columns {
+		columns = append(columns, c+" "+direction)
+	}
+
+	return strings.Join(columns, ", ")
+}
+
+// page returns the WHERE condition that restricts the records to those after (or before) the
+// cursor, the ORDER BY clause, and the LIMIT and OFFSET clause. The args are the parameters
+// already used by the query e.g. the filters
+func (k *Keyset) page(p *Paging, args []interface{}) (string, string, string, []interface{}, error) {
+
+	reverse := p.reversed()
+	where := "TRUE"
+
+	if p.Mode == "next" || p.Mode == "previous" || p.Mode == "current" {
+		values, err := decodeCursor(p.Cursor, len(k.Columns))
+		if err != nil {
+			return "", "", "", nil, err
+		}
+
+		placeholders := make([]string, 0, len(values))
+		for _, v := range values {
+			args = append(args, v)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+
+		operator := ">"
+		if k.Descending != reverse {
+			operator = "<"
+		}
+
+		// The current page includes the record at the cursor
+		if p.Mode == "current" {
+			operator += "="
+		}
+
+		where = fmt.Sprintf("(%s) %s (%s)", strings.Join(k.Columns, ", "), operator, strings.Join(placeholders, ", "))
+	}
+
+	offset := 0
+	if p.Mode == "page" {
+		offset = p.Number * p.Size
+	}
+
+	args = append(args, p.Size+1, offset)
+	limit := fmt.Sprintf("LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	return where, k.orderBy(reverse), limit, args, nil
+}
+
+// decodeCursor returns the keyset values from the cursor, as strings so that the database converts them to the column types
+func decodeCursor(cursor string, count int) ([]interface{}, error) {
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&values)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) != count {
+		return nil, errors.New("Invalid number of cursor values")
+	}
+
+	ret := make([]interface{}, 0, count)
+	for _, v := range values {
+		switch t := v.(type) {
+		case string:
+			ret = append(ret, t)
+		case json.Number:
+			ret = append(ret, t.String())
+		default:
+			return nil, errors.New("Invalid cursor value")
+		}
+	}
+
+	return ret, nil
+}
+
+// countRecords returns the number of records that the query returns, and whether the count is exact. The
+// planner's estimate is used when it is too large to count the records quickly
+func countRecords(query string, args []interface{}) (int64, bool, error) {
+
+	var plan string
+	err := db.SQL("EXPLAIN (FORMAT JSON) "+query, args...).QueryScalar(&plan)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var plans []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+
+	err = json.Unmarshal([]byte(plan), &plans)
+	if err != nil || len(plans) == 0 {
+		return 0, false, fmt.Errorf("Invalid query plan: %v", err)
+	}
+
+	estimate := int64(plans[0].Plan.Rows)
+	if estimate > PAGING_EXACT_COUNT_MAX {
+		return estimate, false, nil
+	}
+
+	var count int64
+	err = db.SQL("SELECT COUNT(*) FROM ("+query+") AS records", args...).QueryScalar(&count)
+
+	return count, true, err
+}
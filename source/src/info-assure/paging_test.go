@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ##### Helpers ##############################################################
+
+// encodeCursor returns the cursor of a sort key, as set by Paging.setResults
+func encodeCursor(sortKey string) string {
+
+	return base64.RawURLEncoding.EncodeToString([]byte(sortKey))
+}
+
+// testPagingParams returns a parameter function for processPaging that reads from the map
+func testPagingParams(params map[string]string) func(string) string {
+
+	return func(name string) string {
+		return params[name]
+	}
+}
+
+// ##### Cursor Tests #########################################################
+
+func TestDecodeCursor(t *testing.T) {
+
+	values, err := decodeCursor(encodeCursor(`["2019-05-01T10:00:00", 12345678901234567890, 1.5, "a,b"]`), 4)
+	if err != nil {
+		t.Fatalf("Error decoding cursor: %v", err)
+	}
+
+	// Numbers are kept as their text so that large values are not rounded
+	expected := []interface{}{"2019-05-01T10:00:00", "12345678901234567890", "1.5", "a,b"}
+	if reflect.DeepEqual(values, expected) == false {
+		t.Errorf("Decoded %#v, expected %#v", values, expected)
+	}
+
+	_, err = decodeCursor(encodeCursor(`[-3, "x"]`), 2)
+	if err != nil {
+		t.Errorf("Error decoding negative value: %v", err)
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+
+	tests := map[string]string{
+		"not base64":     "!!!",
+		"padded base64":  base64.URLEncoding.EncodeToString([]byte(`[1,2]`)),
+		"not json":       encodeCursor(`[1, 2`),
+		"not an array":   encodeCursor(`{"a": 1}`),
+		"too few values": encodeCursor(`[1]`),
+		"too many":       encodeCursor(`[1, 2, 3]`),
+		"null value":     encodeCursor(`[null, 2]`),
+		"boolean value":  encodeCursor(`[true, 2]`),
+		"nested array":   encodeCursor(`[[1], 2]`),
+		"object value":   encodeCursor(`[{"a": 1}, 2]`),
+		"empty":          "",
+	}
+
+	for name, cursor := range tests {
+		_, err := decodeCursor(cursor, 2)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// ##### Keyset Tests #########################################################
+
+func TestKeysetPage(t *testing.T) {
+
+	cursor := encodeCursor(`["2019-05-01", 7]`)
+
+	tests := []struct {
+		name       string
+		paging     *Paging
+		descending bool
+		where      string
+		orderBy    string
+		args       []interface{}
+	}{
+		{"first", &Paging{Mode: "first", Size: 10}, false,
+			"TRUE", "a.time ASC, a.id ASC", []interface{}{"x", 11, 0}},
+		{"next", &Paging{Mode: "next", Size: 10, Number: 1, Cursor: cursor}, false,
+			"(a.time, a.id) > ($2, $3)", "a.time ASC, a.id ASC", []interface{}{"x", "2019-05-01", "7", 11, 0}},
+		{"next descending", &Paging{Mode: "next", Size: 10, Number: 1, Cursor: cursor}, true,
+			"(a.time, a.id) < ($2, $3)", "a.time DESC, a.id DESC", []interface{}{"x", "2019-05-01", "7", 11, 0}},
+		{"previous", &Paging{Mode: "previous", Size: 10, Cursor: cursor}, false,
+			"(a.time, a.id) < ($2, $3)", "a.time DESC, a.id DESC", []interface{}{"x", "2019-05-01", "7", 11, 0}},
+		{"previous descending", &Paging{Mode: "previous", Size: 10, Cursor: cursor}, true,
+			"(a.time, a.id) > ($2, $3)", "a.time ASC, a.id ASC", []interface{}{"x", "2019-05-01", "7", 11, 0}},
+		{"current", &Paging{Mode: "current", Size: 10, Number: 2, Cursor: cursor}, false,
+			"(a.time, a.id) >= ($2, $3)", "a.time ASC, a.id ASC", []interface{}{"x", "2019-05-01", "7", 11, 0}},
+		{"page", &Paging{Mode: "page", Size: 10, Number: 3}, false,
+			"TRUE", "a.time ASC, a.id ASC", []interface{}{"x", 11, 30}},
+		{"last", &Paging{Mode: "last", Size: 10, Number: 4}, false,
+			"TRUE", "a.time DESC, a.id DESC", []interface{}{"x", 11, 0}},
+	}
+
+	for _, test := range tests {
+		k := &Keyset{Columns: []string{"a.time", "a.id"}, Descending: test.descending}
+
+		where, orderBy, limit, args, err := k.page(test.paging, []interface{}{"x"})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if where != test.where {
+			t.Errorf("%s: where %q, expected %q", test.name, where, test.where)
+		}
+
+		if orderBy != test.orderBy {
+			t.Errorf("%s: order by %q, expected %q", test.name, orderBy, test.orderBy)
+		}
+
+		expectedLimit := "LIMIT $2 OFFSET $3"
+		if len(test.args) == 5 {
+			expectedLimit = "LIMIT $4 OFFSET $5"
+		}
+		if limit != expectedLimit {
+			t.Errorf("%s: limit %q, expected %q", test.name, limit, expectedLimit)
+		}
+
+		if reflect.DeepEqual(args, test.args) == false {
+			t.Errorf("%s: args %#v, expected %#v", test.name, args, test.args)
+		}
+	}
+}
+
+func TestKeysetPageInvalidCursor(t *testing.T) {
+
+	k := &Keyset{Columns: []string{"a.time", "a.id"}}
+
+	for _, cursor := range []string{"", "!!!", encodeCursor(`[1]`), encodeCursor(`["a", 1, 2]`)} {
+		_, _, _, _, err := k.page(&Paging{Mode: "next", Size: 10, Cursor: cursor}, nil)
+		if err == nil {
+			t.Errorf("Expected an error for cursor %q", cursor)
+		}
+	}
+}
+
+func TestKeysetSelectKey(t *testing.T) {
+
+	k := &Keyset{Columns: []string{"-" + SQL_PREVALENCE_SORT, "d.id"}}
+
+	key := k.selectKey()
+	if strings.HasPrefix(key, "json_build_array(-COALESCE(") == false || strings.HasSuffix(key, ", d.id)::text AS sort_key") == false {
+		t.Errorf("Unexpected sort key %q", key)
+	}
+}
+
+// ##### Paging Tests #########################################################
+
+func TestProcessPaging(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		params map[string]string
+		mode   string
+		number int
+		size   int
+	}{
+		{"defaults", map[string]string{}, "first", 0, 10},
+		{"size", map[string]string{"num_recs_per_page": "50"}, "first", 0, 50},
+		{"invalid size", map[string]string{"num_recs_per_page": "5000"}, "first", 0, 10},
+		{"next", map[string]string{"mode": "next", "last_key": "abc", "current_page_num": "2"}, "next", 3, 10},
+		{"next without cursor", map[string]string{"mode": "next", "current_page_num": "2"}, "first", 0, 10},
+		{"previous", map[string]string{"mode": "previous", "first_key": "abc", "current_page_num": "2"}, "previous", 1, 10},
+		{"previous from first page", map[string]string{"mode": "previous", "first_key": "abc", "current_page_num": "0"}, "first", 0, 10},
+		{"page", map[string]string{"mode": "page", "page_num": "5"}, "page", 4, 10},
+		{"page too large", map[string]string{"mode": "page", "page_num": "10001"}, "first", 0, 10},
+		{"last", map[string]string{"mode": "last"}, "last", 0, 10},
+		{"other action", map[string]string{"mode": "classify", "first_key": "abc", "current_page_num": "3"}, "current", 3, 10},
+	}
+
+	for _, test := range tests {
+		p := processPaging(testPagingParams(test.params))
+
+		if p.Mode != test.mode || p.Number != test.number || p.Size != test.size {
+			t.Errorf("%s: mode %s, number %d, size %d, expected %s, %d, %d", test.name, p.Mode, p.Number, p.Size, test.mode, test.number, test.size)
+		}
+	}
+}
+
+func TestPagingLast(t *testing.T) {
+
+	// An exact total reads the last page from its offset, so it lines up with the page numbers
+	p := &Paging{Mode: "last", Size: 10}
+	p.setTotal(95, true)
+
+	if p.Mode != "page" || p.Number != 9 || p.reversed() == true {
+		t.Errorf("Exact total: mode %s, number %d, expected page, 9", p.Mode, p.Number)
+	}
+
+	k := &Keyset{Columns: []string{"a.id"}}
+	_, orderBy, _, args, err := k.page(p, nil)
+	if err != nil {
+		t.Fatalf("Error paging: %v", err)
+	}
+
+	if orderBy != "a.id ASC" || reflect.DeepEqual(args, []interface{}{11, 90}) == false {
+		t.Errorf("Exact total: order by %q, args %v, expected a.id ASC, [11 90]", orderBy, args)
+	}
+
+	// An estimated total reads the last records backwards
+	p = &Paging{Mode: "last", Size: 10}
+	p.setTotal(200000, false)
+
+	if p.Mode != "last" || p.Number != 19999 || p.reversed() == false {
+		t.Errorf("Estimated total: mode %s, number %d, expected last, 19999", p.Mode, p.Number)
+	}
+
+	// No records is a single empty page
+	p = &Paging{Mode: "last", Size: 10}
+	p.setTotal(0, true)
+
+	if p.Number != 0 || p.Pages() != 1 {
+		t.Errorf("No records: number %d, pages %d, expected 0, 1", p.Number, p.Pages())
+	}
+}
+
+func TestPagingTrim(t *testing.T) {
+
+	type record struct {
+		SortKey string
+	}
+
+	records := func(keys ...string) []*record {
+		data := make([]*record, 0, len(keys))
+		for _, k := range keys {
+			data = append(data, &record{SortKey: k})
+		}
+		return data
+	}
+
+	keys := func(data []*record) string {
+		values := make([]string, 0, len(data))
+		for _, r := range data {
+			values = append(values, r.SortKey)
+		}
+		return strings.Join(values, ",")
+	}
+
+	tests := []struct {
+		name        string
+		paging      *Paging
+		data        []*record
+		expected    string
+		hasPrevious bool
+		hasNext     bool
+		number      int
+	}{
+		{"first with more", &Paging{Mode: "first", Size: 3}, records("1", "2", "3", "4"), "1,2,3", false, true, 0},
+		{"first without more", &Paging{Mode: "first", Size: 3}, records("1", "2"), "1,2", false, false, 0},
+		{"next", &Paging{Mode: "next", Size: 3, Number: 1}, records("4", "5", "6", "7"), "4,5,6", true, true, 1},
+		{"next to end", &Paging{Mode: "next", Size: 3, Number: 2}, records("7"), "7", true, false, 2},
+		{"previous with more", &Paging{Mode: "previous", Size: 3, Number: 1}, records("6", "5", "4", "3"), "4,5,6", true, true, 1},
+		{"previous to start", &Paging{Mode: "previous", Size: 3, Number: 3}, records("3", "2", "1"), "1,2,3", false, true, 0},
+		{"last estimated", &Paging{Mode: "last", Size: 3, Number: 5}, records("9", "8", "7", "6"), "7,8,9", true, false, 5},
+		{"empty", &Paging{Mode: "first", Size: 3}, records(), "", false, false, 0},
+	}
+
+	for _, test := range tests {
+		data := test.data
+		data = data[:test.paging.trim(data, func(i int) string { return data[i].SortKey })]
+
+		if keys(data) != test.expected {
+			t.Errorf("%s: records %s, expected %s", test.name, keys(data), test.expected)
+		}
+
+		p := test.paging
+		if p.HasPrevious != test.hasPrevious || p.HasNext != test.hasNext || p.Number != test.number {
+			t.Errorf("%s: previous %v, next %v, number %d, expected %v, %v, %d",
+				test.name, p.HasPrevious, p.HasNext, p.Number, test.hasPrevious, test.hasNext, test.number)
+		}
+
+		expectedFirst, expectedLast := "", ""
+		if len(data) > 0 {
+			expectedFirst = encodeCursor(data[0].SortKey)
+			expectedLast = encodeCursor(data[len(data)-1].SortKey)
+		}
+
+		if p.FirstCursor != expectedFirst || p.LastCursor != expectedLast {
+			t.Errorf("%s: cursors %s %s, expected %s %s", test.name, p.FirstCursor, p.LastCursor, expectedFirst, expectedLast)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Methods ##############################################################
+
+// generateOneTimePassword returns a random password for new users and password
+// resets, which meets the minimum length of the password policy
+func generateOneTimePassword() string {
+
+	if config.PasswordPolicy.MinLength > 16 {
+		return generateRandomString(config.PasswordPolicy.MinLength)
+	}
+
+	return generateRandomString(16)
+}
+
+// ***** Routing Methods ******************************************************
+
+//
+func routeAccountPasswordGet(c *gin.Context) {
+
+	loadPasswordData(c, "")
+}
+
+// loadPasswordData renders the change password page with an optional message
+func loadPasswordData(c *gin.Context, message template.HTML) {
+
+	session, _ := sessionStore.Get(c.Request, APP_NAME)
+	mustChange, _ := session.Values["must_change_password"].(bool)
+
+	if mustChange == true && len(message) == 0 {
+		message = template.HTML(fmt.Sprintf(ALERT_YELLOW, "Your password must be changed before continuing"))
+	}
+
+	c.HTML(http.StatusOK, "password", getTemplateData(c, gin.H{"message": message, "must_change": mustChange}))
+}
+
+//
+func routeAccountPasswordPost(c *gin.Context) {
+
+	userID := getCookieInt64Value(c, "user_id")
+	if userID == -1 {
+		log.Println("Error checking session: invalid user ID")
+		goToErrorPage(c, "Unable to change password")
+		return
+	}
+
+	u, err := NewUserByID(userID)
+	if err != nil {
+		log.Printf("Error loading user details for password change: %v\n", err)
+		goToErrorPage(c, "Unable to change password")
+		return
+	}
+
+	if u.AuthProvider != AUTH_PROVIDER_LOCAL {
+		loadPasswordData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Password is managed by an external provider")))
+		return
+	}
+
+	// The current password is required, so that an unattended session cannot be used to take over the account
+	current := User{Username: u.Username, Password: c.PostForm("current_password")}
+	err = current.CheckPassword()
+	if err != nil {
+		log.Printf("Error checking current password: %v (%s)\n", err, u.Username)
+
+		auditFailedAttempt(c, u, AUDIT_PASSWORD_CHANGE_FAILURE, "Current password is incorrect")
+		if u.Locked == true {
+			endLockedSession(c)
+			return
+		}
+
+		loadPasswordData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Current password is incorrect")))
+		return
+	}
+
+	u.Password = c.PostForm("password")
+	u.PasswordVerify = c.PostForm("password_verify")
+
+	if u.Password == current.Password {
+		loadPasswordData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "New password must be different to the current password")))
+		return
+	}
+
+	err = u.ValidatePassword()
+	if err != nil {
+		loadPasswordData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, err)))
+		return
+	}
+
+	if u.SetPassword(u.Password) == false || u.SetMustChangePassword(false) == false {
+		loadPasswordData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to change password")))
+		return
+	}
+
+	u.ResetLoginAttempts()
+	writeAudit(c, AUDIT_PASSWORD_CHANGE, AUDIT_TARGET_USER, convertInt64ToString(u.ID), "")
+
+	err = deleteOtherUserSessions(c, u.ID)
+	if err != nil {
+		log.Printf("Error deleting other user sessions after password change: %v\n", err)
+	}
+
+	session, _ := sessionStore.Get(c.Request, APP_NAME)
+	session.Values["must_change_password"] = false
+	err = session.Save(c.Request, c.Writer)
+	if err != nil {
+		log.Printf("Error saving user session (password): %v\n", err)
+		goToErrorPage(c, "Unable to change password")
+		return
+	}
+
+	loadAccountData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Password changed")), "")
+}
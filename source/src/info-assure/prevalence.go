@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+// The orderings of the alerts, single host and search views
+const ORDER_DEFAULT int = 0
+const ORDER_PREVALENCE int = 1 // Least common first
+
+// The types of artefact that can be stacked
+const STACK_TYPE_SHA256 int = 1
+const STACK_TYPE_LAUNCH_STRING int = 2
+const STACK_TYPE_ITEM int = 3
+
+// Joins the prevalence views to a table with the autorun columns. The table's alias is substituted
+const SQL_PREVALENCE_JOINS string = `LEFT JOIN prevalence_sha256 AS prev_sha256 ON (prev_sha256.sha256 = LOWER(%[1]s.sha256))
+  LEFT JOIN prevalence_launch_string AS prev_launch ON (prev_launch.launch_string_hash = md5(%[1]s.launch_string))
+  LEFT JOIN prevalence_item AS prev_item ON (prev_item.item_hash = md5(%[1]s.location || chr(31) || %[1]s.item_name))`
+
+// The rarity score is the number of hosts for the least common of the artefacts. It is NULL if
+// none of the artefacts have been counted yet i.e. the autorun is newer than the last refresh
+const SQL_PREVALENCE string = `LEAST(prev_sha256.host_count, prev_launch.host_count, prev_item.host_count)`
+
+// The rarity score used for sorting, so that the autoruns that have not been counted are last
+// when sorting by the least common (ascending) or most common (descending) first
+const SQL_PREVALENCE_SORT string = `COALESCE(` + SQL_PREVALENCE + `, 2147483647)`
+const SQL_PREVALENCE_SORT_DESC string = `COALESCE(` + SQL_PREVALENCE + `, -1)`
+
+const SQL_PREVALENCE_COLUMNS string = SQL_PREVALENCE + ` AS prevalence,
+			COALESCE(prev_sha256.host_count, 0) AS prevalence_sha256,
+			COALESCE(prev_launch.host_count, 0) AS prevalence_launch_string,
+			COALESCE(prev_item.host_count, 0) AS prevalence_item`
+
+const SQL_STACKING_SHA256 string = `SELECT sha256 AS value, location, item_name, file_path, host_count, sample_hosts
+	   FROM prevalence_sha256
+   ORDER BY host_count ASC, sha256 ASC
+      LIMIT $1
+	 OFFSET $2`
+
+const SQL_STACKING_LAUNCH_STRING string = `SELECT launch_string AS value, location, item_name, '' AS file_path, host_count, sample_hosts
+	   FROM prevalence_launch_string
+   ORDER BY host_count ASC, launch_string ASC
+      LIMIT $1
+	 OFFSET $2`
+
+const SQL_STACKING_ITEM string = `SELECT '' AS value, location, item_name, '' AS file_path, host_count, sample_hosts
+	   FROM prevalence_item
+   ORDER BY host_count ASC, location ASC, item_name ASC
+      LIMIT $1
+	 OFFSET $2`
+
+// ##### Variables ############################################################
+
+var prevalenceViews = []string{"prevalence_sha256", "prevalence_launch_string", "prevalence_item"}
+
+// ##### Structs ##############################################################
+
+// Represents an artefact and the number of hosts that it is present on
+type StackEntry struct {
+	Value       string        `db:"value" json:"value"`
+	Location    string        `db:"location" json:"location"`
+	LocationStr template.HTML `db:"-" json:"-"`
+	ItemName    string        `db:"item_name" json:"item_name"`
+	FilePath    string        `db:"file_path" json:"file_path"`
+	HostCount   int64         `db:"host_count" json:"host_count"`
+	SampleHosts string        `db:"sample_hosts" json:"sample_hosts"`
+}
+
+// ##### Methods ##############################################################
+
+// processOrderParameter validates the ordering, using the default for invalid values
+func processOrderParameter(data string) int {
+
+	order, successful := processIntParameter(data)
+	if successful == false || order != ORDER_PREVALENCE {
+		return ORDER_DEFAULT
+	}
+
+	return order
+}
+
+// prevalenceJoins returns the prevalence joins for the table alias
+func prevalenceJoins(alias string) string {
+
+	return fmt.Sprintf(SQL_PREVALENCE_JOINS, alias)
+}
+
+// refreshPrevalence recalculates the prevalence views from the current autoruns
+func refreshPrevalence() error {
+
+	for _, v := range prevalenceViews {
+		_, err := db.DB.Exec("REFRESH MATERIALIZED VIEW CONCURRENTLY " + v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", v, err)
+		}
+	}
+
+	return nil
+}
+
+// initialisePrevalence starts the scheduled refresh of the prevalence views. The views
+// are refreshed at startup, since they may be out of date after the server has been stopped
+func initialisePrevalence() {
+
+	interval := time.Duration(config.PrevalenceIntervalMinutes) * time.Minute
+	logger.Infof("Prevalence refreshed every %v", interval)
+
+	go func() {
+		for {
+			err := refreshPrevalence()
+			if err != nil {
+				log.Printf("Error refreshing prevalence: %v\n", err)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// ***** Routing Methods ******************************************************
+
+//
+func routeStacking(c *gin.Context) {
+
+	numRecsPerPage, successful := processIntParameter(c.PostForm("num_recs_per_page"))
+	if successful == false {
+		numRecsPerPage = 10
+	}
+
+	stackType, successful := processIntParameter(c.PostForm("stack_type"))
+	if successful == false || stackType < STACK_TYPE_SHA256 || stackType > STACK_TYPE_ITEM {
+		stackType = STACK_TYPE_SHA256
+	}
+
+	mode, hasMode := c.GetPostForm("mode")
+
+	// Appears to be the first request to send the initial set of data
+	if (mode != "first" &&
+		mode != "next" &&
+		mode != "previous") || hasMode == false {
+
+		loadStackingData(c, stackType, 0, numRecsPerPage)
+		return
+	}
+
+	currentPageNumber := processCurrentPageNumber(c.PostForm("current_page_num"), mode)
+
+	loadStackingData(c, stackType, currentPageNumber, numRecsPerPage)
+}
+
+//
+func loadStackingData(c *gin.Context, stackType int, currentPageNumber int, numRecsPerPage int) {
+
+	errored, noMoreRecords, data := getStackEntries(stackType, numRecsPerPage, currentPageNumber)
+	if errored == true {
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	c.HTML(http.StatusOK, "stacking", getTemplateData(c, gin.H{
+		"current_page_num":  currentPageNumber,
+		"num_recs_per_page": numRecsPerPage,
+		"no_more_records":   noMoreRecords,
+		"stack_type":        stackType,
+		"interval":          config.PrevalenceIntervalMinutes,
+		"data":              data,
+	}))
+}
+
+// getStackEntries returns a page of the artefacts, ordered by the least common first
+func getStackEntries(stackType int, numRecsPerPage int, currentPageNumber int) (bool, bool, []*StackEntry) {
+
+	var data []*StackEntry
+
+	sql := SQL_STACKING_SHA256
+	switch stackType {
+	case STACK_TYPE_LAUNCH_STRING:
+		sql = SQL_STACKING_LAUNCH_STRING
+	case STACK_TYPE_ITEM:
+		sql = SQL_STACKING_ITEM
+	}
+
+	err := db.SQL(sql, numRecsPerPage+1, numRecsPerPage*currentPageNumber).QueryStructs(&data)
+	if err != nil {
+		logger.Errorf("Error querying for stacking: %v", err)
+		return true, false, data
+	}
+
+	// Perform some cleaning of the data, so that it displays better in the HTML
+	for _, v := range data {
+		v.LocationStr = template.HTML("<td class=\"poppy\" data-variation=\"basic\" data-content=\"" + template.HTMLEscapeString(v.Location) + "\">" + template.HTMLEscapeString(splitRegKey(v.Location)) + "</td>")
+	}
+
+	noMoreRecords := false
+	if len(data) < numRecsPerPage+1 {
+		noMoreRecords = true
+	} else {
+		// Remove the last item in the slice/array
+		data = data[:len(data)-1]
+	}
+
+	return false, noMoreRecords, data
+}
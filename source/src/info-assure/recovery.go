@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+const MFA_RECOVERY_CODE_COUNT int = 10
+
+// ##### Methods ##############################################################
+
+// normaliseRecoveryCode removes the formatting from a recovery code, so that
+// codes can be entered with or without the separators
+func normaliseRecoveryCode(code string) string {
+
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
+
+// hashRecoveryCode returns the hex encoded SHA256 hash of a recovery code. The
+// codes contain 80 bits of randomness, so a fast unsalted hash is sufficient
+func hashRecoveryCode(code string) string {
+
+	hash := sha256.Sum256([]byte(normaliseRecoveryCode(code)))
+	return hex.EncodeToString(hash[:])
+}
+
+// generateRecoveryCode returns a random code in the format xxxx-xxxx-xxxx-xxxx
+func generateRecoveryCode() (string, error) {
+
+	data := make([]byte, 10)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(data))
+	return code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16], nil
+}
+
+// generateRecoveryCodes replaces a user's recovery codes, returning the plain text
+// codes, which is the only time that they are available
+func generateRecoveryCodes(userID int64) ([]string, error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.AutoRollback()
+
+	_, err = tx.
+		DeleteFrom("mfa_recovery_code").
+		Where("user_id = $1", userID).
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, MFA_RECOVERY_CODE_COUNT)
+	for i := 0; i < MFA_RECOVERY_CODE_COUNT; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.
+			InsertInto("mfa_recovery_code").
+			Columns("user_id", "code_hash", "timestamp_created").
+			Values(userID, hashRecoveryCode(code), time.Now().UTC()).
+			Exec()
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// getUnusedRecoveryCodeCount returns the number of recovery codes that a user has remaining
+func getUnusedRecoveryCodeCount(userID int64) (int64, error) {
+
+	var count int64
+	err := db.
+		Select("COUNT(*)").
+		From("mfa_recovery_code").
+		Where("user_id = $1 AND timestamp_used IS NULL", userID).
+		QueryScalar(&count)
+
+	return count, err
+}
+
+// useRecoveryCode marks a recovery code as used, returning false if the code does
+// not exist or has already been used. The update is conditional so that a code
+// cannot be used twice by concurrent requests
+func useRecoveryCode(userID int64, code string) (bool, error) {
+
+	res, err := db.
+		Update("mfa_recovery_code").
+		Set("timestamp_used", time.Now().UTC()).
+		Where("user_id = $1 AND code_hash = $2 AND timestamp_used IS NULL", userID, hashRecoveryCode(code)).
+		Exec()
+	if err != nil {
+		return false, err
+	}
+
+	return res.RowsAffected == 1, nil
+}
+
+// deleteRecoveryCodes removes all of a user's recovery codes
+func deleteRecoveryCodes(userID int64) error {
+
+	_, err := db.
+		DeleteFrom("mfa_recovery_code").
+		Where("user_id = $1", userID).
+		Exec()
+
+	return err
+}
+
+// renderRecoveryCodes displays newly generated recovery codes, with a link to continue to the next page
+func renderRecoveryCodes(c *gin.Context, codes []string, next string) {
+
+	c.HTML(http.StatusOK, "recovery", getTemplateData(c, gin.H{
+		"codes":   codes,
+		"next":    next,
+		"message": template.HTML(fmt.Sprintf(ALERT_GREEN, "Store the recovery codes somewhere safe. They will not be shown again")),
+	}))
+}
+
+// ***** Routing Methods ******************************************************
+
+//
+func routeAccountRecoveryPost(c *gin.Context) {
+
+	userID := getCookieInt64Value(c, "user_id")
+	if userID == -1 {
+		log.Println("Error checking session: invalid user ID")
+		goToErrorPage(c, "Unable to generate recovery codes")
+		return
+	}
+
+	codes, err := generateRecoveryCodes(userID)
+	if err != nil {
+		log.Printf("Error generating recovery codes: %v\n", err)
+		goToErrorPage(c, "Unable to generate recovery codes")
+		return
+	}
+
+	writeAudit(c, AUDIT_MFA_RECOVERY_GENERATE, AUDIT_TARGET_USER, convertInt64ToString(userID), "")
+
+	renderRecoveryCodes(c, codes, "/account")
+}
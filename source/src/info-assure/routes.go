@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -11,6 +13,21 @@ import (
 	util "github.com/woanware/goutil"
 )
 
+// The column of each export type, and its file name, when the export is restricted to a group or tag
+var EXPORT_SCOPED_COLUMNS = map[int]string{
+	EXPORT_TYPE_SHA256: "LOWER(d.sha256)",
+	EXPORT_TYPE_MD5:    "LOWER(d.md5)",
+	EXPORT_TYPE_DOMAIN: "i.domain",
+	EXPORT_TYPE_HOST:   "i.host",
+}
+
+var EXPORT_SCOPED_NAMES = map[int]string{
+	EXPORT_TYPE_SHA256: "sha256",
+	EXPORT_TYPE_MD5:    "md5",
+	EXPORT_TYPE_DOMAIN: "domains",
+	EXPORT_TYPE_HOST:   "hosts",
+}
+
 //
 func routeIndex(c *gin.Context) {
 	c.HTML(http.StatusOK, "index", gin.H{})
@@ -19,11 +36,11 @@ func routeIndex(c *gin.Context) {
 //
 func routeSearch(c *gin.Context) {
 
-	currentPageNumber := 0
-
-	numRecsPerPage, successful := processIntParameter(c.PostForm("num_recs_per_page"))
-	if successful == false {
-		numRecsPerPage = 10
+	paging := processPaging(c.PostForm)
+	scope, err := processHostScope(c.PostForm)
+	if err != nil {
+		loadSearchData(c, 0, 0, "", paging, ORDER_DEFAULT, scope, template.HTML(fmt.Sprintf(ALERT_YELLOW, err.Error())))
+		return
 	}
 
 	mode, hasMode := c.GetPostForm("mode")
@@ -31,9 +48,11 @@ func routeSearch(c *gin.Context) {
 	// Appears to be the first request to send the initial set of data
 	if (mode != "first" &&
 		mode != "next" &&
-		mode != "previous") || hasMode == false {
+		mode != "previous" &&
+		mode != "last" &&
+		mode != "page") || hasMode == false {
 
-		loadSearchData(c, 0, 0, "", currentPageNumber, numRecsPerPage)
+		loadSearchData(c, 0, 0, "", paging, ORDER_DEFAULT, scope, "")
 		return
 	}
 
@@ -55,9 +74,14 @@ func routeSearch(c *gin.Context) {
 		return
 	}
 
-	currentPageNumber = processCurrentPageNumber(c.PostForm("current_page_num"), mode)
+	order := processOrderParameter(c.PostForm("order"))
+
+	// Only the initial search is audited, rather than each page of its results
+	if mode == "first" {
+		writeAudit(c, AUDIT_SEARCH, AUDIT_TARGET_NONE, "", formatSearchAudit(dataType, searchType, searchValue, paging.Number, scope))
+	}
 
-	loadSearchData(c, dataType, searchType, searchValue, currentPageNumber, numRecsPerPage)
+	loadSearchData(c, dataType, searchType, searchValue, paging, order, scope, "")
 }
 
 //
@@ -66,24 +90,37 @@ func loadSearchData(
 	dataType int,
 	searchType int,
 	searchValue string,
-	currentPageNumber int,
-	numRecsPerPage int) {
+	paging *Paging,
+	order int,
+	scope *HostScope,
+	message template.HTML) {
 
 	if len(searchValue) == 0 || (searchType < 1 || searchType > 10) || (dataType < 1 || dataType > 2) {
-		c.HTML(http.StatusOK, "search", gin.H{
-			"current_page_num":  currentPageNumber,
-			"num_recs_per_page": numRecsPerPage,
+		values := gin.H{
+			"current_page_num":  0,
+			"num_recs_per_page": paging.Size,
 			"no_more_records":   true,
 			"data":              nil,
 			"has_data":          false,
 			"data_type":         0,
 			"search_type":       0,
 			"search_value":      searchValue,
-		})
+			"order":             order,
+			"message":           message,
+		}
+
+		err := scope.setTemplateValues(values)
+		if err != nil {
+			logger.Errorf("Error querying for search groups and tags: %v", err)
+			c.String(http.StatusInternalServerError, "")
+			return
+		}
+
+		c.HTML(http.StatusOK, "search", getTemplateData(c, values))
 		return
 	}
 
-	errored, noMoreRecords, data := getSearch(dataType, searchType, searchValue, numRecsPerPage, currentPageNumber)
+	errored, data := getSearch(dataType, searchType, searchValue, paging, order, scope)
 	if errored == true {
 		c.String(http.StatusInternalServerError, "")
 		return
@@ -94,24 +131,37 @@ func loadSearchData(
 		hasData = false
 	}
 
-	c.HTML(http.StatusOK, "search", gin.H{
-		"current_page_num":  currentPageNumber,
-		"num_recs_per_page": numRecsPerPage,
-		"no_more_records":   noMoreRecords,
+	values := gin.H{
+		"current_page_num":  paging.Number,
+		"num_recs_per_page": paging.Size,
+		"paging":            paging,
 		"data":              data,
 		"has_data":          hasData,
 		"data_type":         dataType,
 		"search_type":       searchType,
 		"search_value":      searchValue,
-	})
+		"order":             order,
+		"message":           message,
+	}
+
+	err := scope.setTemplateValues(values)
+	if err != nil {
+		logger.Errorf("Error querying for search groups and tags: %v", err)
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	c.HTML(http.StatusOK, "search", getTemplateData(c, values))
 }
 
+// getSearch returns a page of the alerts or current autoruns that contain the search value, and sets the total and cursors of the page
 func getSearch(
 	dataType int,
 	searchType int,
 	searchValue string,
-	numRecsPerPage int,
-	currentPageNumber int) (bool, bool, []*Alert) {
+	paging *Paging,
+	order int,
+	scope *HostScope) (bool, []*Alert) {
 
 	where := ""
 	switch searchType {
@@ -142,30 +192,55 @@ func getSearch(
 
 	selectSql := `i.domain, i.host, d.id, d.location, d.item_name, d.enabled,
 		d.profile, d.launch_string, d.description, d.company, d.signer, d.version_number, d.file_path,
-		d.file_name, d.file_directory, d.time, d.sha256, d.md5`
+		d.file_name, d.file_directory, d.time, d.sha256, d.md5, ` + SQL_PREVALENCE_COLUMNS
 	fromSql := `current_autoruns d JOIN instance i on (d.instance = i.id)`
+	domainColumn, hostColumn := "i.domain", "i.host"
 
 	if dataType == DATA_TYPE_ALERTS {
 		selectSql = `d.domain, d.host, d.id, d.location, d.item_name, d.enabled,
 			d.profile, d.launch_string, d.description, d.company, d.signer, d.version_number, d.file_path,
-			d.file_name, d.file_directory, d.time, d.sha256, d.md5`
+			d.file_name, d.file_directory, d.time, d.sha256, d.md5, ` + SQL_PREVALENCE_COLUMNS
 		fromSql = `alert d`
+		domainColumn, hostColumn = "d.domain", "d.host"
 	}
 
-	err := db.
-		Select(selectSql).
-		From(fromSql).
-		OrderBy("d.time DESC").
-		Offset(uint64(numRecsPerPage*currentPageNumber)).
-		Limit(uint64(numRecsPerPage+1)).
-		Where(where, "%"+strings.ToLower(searchValue)+"%").
-		QueryStructs(&data)
+	args := []interface{}{"%" + strings.ToLower(searchValue) + "%"}
+
+	if scope.IsSet() == true {
+		var condition string
+		condition, args = scope.buildWhere(domainColumn, hostColumn, args)
+		where += " AND " + condition
+	}
+
+	total, exact, err := countRecords("SELECT 1 FROM "+fromSql+" WHERE "+where, args)
+	if err != nil {
+		logger.Errorf("Error counting search results: %v", err)
+		return true, data
+	}
+	paging.setTotal(total, exact)
+
+	// The least common are first, so the prevalence is negated to sort in the same direction as the time
+	keyset := &Keyset{Columns: []string{"d.time", "d.id"}, Descending: true}
+	if order == ORDER_PREVALENCE {
+		keyset.Columns = append([]string{"-" + SQL_PREVALENCE_SORT}, keyset.Columns...)
+	}
+
+	cursor, orderBy, limit, args, err := keyset.page(paging, args)
+	if err != nil {
+		logger.Errorf("Error reading search cursor: %v", err)
+		return true, data
+	}
+
+	err = db.SQL(fmt.Sprintf("SELECT %s, %s FROM %s %s WHERE %s AND %s ORDER BY %s %s",
+		selectSql, keyset.selectKey(), fromSql, prevalenceJoins("d"), where, cursor, orderBy, limit), args...).QueryStructs(&data)
 
 	if err != nil {
 		logger.Errorf("Error querying for search: %v", err)
-		return true, false, data
+		return true, data
 	}
 
+	data = data[:paging.trim(data, func(i int) string { return data[i].SortKey })]
+
 	// Perform some cleaning of the data, so that it displays better in the HTML
 	for _, v := range data {
 		v.UtcTimeStr = v.Time.Format("15:04:05 02/01/2006")
@@ -183,35 +258,64 @@ func getSearch(
 			v.FilePath, v.LaunchString, v.Enabled, v.Description, v.Company, v.Signer, v.VersionNumber, v.Time, v.Sha256, v.Md5))
 	}
 
-	noMoreRecords := false
-	if len(data) < numRecsPerPage+1 {
-		noMoreRecords = true
-	} else {
-		// Remove the last item in the slice/array
-		data = data[:len(data)-1]
-	}
-
-	return false, noMoreRecords, data
+	return false, data
 }
 
 //
 func routeExport(c *gin.Context) {
 
+	// The scoped export is downloaded via a GET, whereas the export type is selected via the form
+	param := c.PostForm
+	if c.Request.Method == http.MethodGet {
+		param = c.Query
+	}
+
 	exportType := 0
 
-	temp := c.PostForm("export_type")
+	temp := param("export_type")
 	if len(temp) > 0 {
 		if util.IsNumber(temp) == true {
 			exportType = util.ConvertStringToInt(temp)
 		}
 	}
 
+	scope, scopeErr := processHostScope(param)
+
+	values := gin.H{
+		"has_data":    false,
+		"export_type": 0,
+		"data":        nil,
+		"scoped":      false,
+	}
+
+	err := scope.setTemplateValues(values)
+	if err != nil {
+		logger.Errorf("Error querying for groups and tags: %v", err)
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	if scopeErr != nil {
+		values["message"] = template.HTML(fmt.Sprintf(ALERT_YELLOW, scopeErr.Error()))
+		c.HTML(http.StatusOK, "export", getTemplateData(c, values))
+		return
+	}
+
 	if exportType == 0 {
-		c.HTML(http.StatusOK, "export", gin.H{
-			"has_data":    false,
-			"export_type": 0,
-			"data":        nil,
-		})
+		c.HTML(http.StatusOK, "export", getTemplateData(c, values))
+		return
+	}
+
+	// The pre-generated exports cover all hosts, so the values for a group or tag are generated on demand
+	if scope.IsSet() == true {
+		if param("format") == "csv" {
+			routeExportScoped(c, exportType, scope)
+			return
+		}
+
+		values["export_type"] = exportType
+		values["scoped"] = true
+		c.HTML(http.StatusOK, "export", getTemplateData(c, values))
 		return
 	}
 
@@ -226,11 +330,50 @@ func routeExport(c *gin.Context) {
 		hasData = false
 	}
 
-	c.HTML(http.StatusOK, "export", gin.H{
-		"has_data":    hasData,
-		"export_type": exportType,
-		"data":        data,
-	})
+	values["has_data"] = hasData
+	values["export_type"] = exportType
+	values["data"] = data
+
+	c.HTML(http.StatusOK, "export", getTemplateData(c, values))
+}
+
+// routeExportScoped downloads the distinct values of the export type from the current autoruns of the
+// hosts within the scope
+func routeExportScoped(c *gin.Context, exportType int, scope *HostScope) {
+
+	column, exists := EXPORT_SCOPED_COLUMNS[exportType]
+	if exists == false {
+		c.String(http.StatusBadRequest, "")
+		return
+	}
+
+	where, args := scope.buildWhere("i.domain", "i.host", []interface{}{})
+
+	var data []string
+	err := db.SQL(fmt.Sprintf(`SELECT DISTINCT %s
+		   FROM current_autoruns d
+	 INNER JOIN instance i ON (d.instance = i.id)
+		  WHERE %s <> '' AND %s
+	   ORDER BY 1 ASC`, column, column, where), args...).QuerySlice(&data)
+
+	if err != nil {
+		logger.Errorf("Error querying for scoped export: %v (%d, %s)", err, exportType, scope.String())
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	buffer := new(bytes.Buffer)
+	cw := csv.NewWriter(buffer)
+	for _, v := range data {
+		cw.Write([]string{v})
+	}
+	cw.Flush()
+
+	fileName := fmt.Sprintf("%s-scoped.csv", EXPORT_SCOPED_NAMES[exportType])
+	writeAudit(c, AUDIT_EXPORT_DOWNLOAD, AUDIT_TARGET_EXPORT, "", fileName+" ("+scope.String()+")")
+
+	c.Header("Content-Disposition", "attachment; filename="+fileName)
+	c.Data(http.StatusOK, "text/csv", buffer.Bytes())
 }
 
 //
@@ -295,6 +438,8 @@ func routeExportData(c *gin.Context) {
 		return
 	}
 
+	writeAudit(c, AUDIT_EXPORT_DOWNLOAD, AUDIT_TARGET_EXPORT, convertInt64ToString(id), export.FileName)
+
 	c.Header("Content-Disposition", "attachment; filename=\""+export.FileName)
 	c.Data(http.StatusOK, "text/csv", []byte(data))
 }
@@ -317,49 +462,3 @@ func getExport(id int64) (bool, Export) {
 
 	return false, e
 }
-
-// //
-// func routeLogon(c *gin.Context) {
-
-// 	// domain := "woanware.eu.auth0.com"
-// 	// aud := ""
-
-// 	// conf := &oauth2.Config{
-// 	// 	ClientID:     "hhJm3c170y6rfmbzbstS0Q46Eriza5CY",
-// 	// 	ClientSecret: "eBBD4h2mU_JKQqpWdgG1uCz587-wfTON-r9UWarjFZPBgvYHWYXdqxdPYUAUIAVz",
-// 	// 	RedirectURL:  "http://0.0.0.0:8080/callback",
-// 	// 	Scopes:       []string{"openid", "profile"},
-// 	// 	Endpoint: oauth2.Endpoint{
-// 	// 		AuthURL:  "https://" + domain + "/authorize",
-// 	// 		TokenURL: "https://" + domain + "/oauth/token",
-// 	// 	},
-// 	// }
-
-// 	// if aud == "" {
-// 	// 	aud = "https://" + domain + "/userinfo"
-// 	// }
-
-// 	// // Generate random state
-// 	// b := make([]byte, 32)
-// 	// rand.Read(b)
-// 	// state := base64.StdEncoding.EncodeToString(b)
-
-// 	// session, err := sessionStore.Get(c.Request, "state")
-// 	// if err != nil {
-// 	// 	log.Printf("Error getting user session: %v\n", err)
-// 	// 	goToErrorPage(c, "Unable to perform login")
-// 	// 	return
-// 	// }
-// 	// session.Values["state"] = state
-// 	// err = session.Save(c.Request, c.Writer)
-// 	// if err != nil {
-// 	// 	log.Printf("Error saving session state: %v\n", err)
-// 	// 	goToErrorPage(c, "Unable to perform login")
-// 	// 	return
-// 	// }
-
-// 	// audience := oauth2.SetAuthURLParam("audience", aud)
-// 	// url := conf.AuthCodeURL(state, audience)
-
-// 	// c.Redirect(http.StatusTemporaryRedirect, url)
-// }
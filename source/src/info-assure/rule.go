@@ -0,0 +1,480 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+// The rule's criteria are appended to the WHERE clause. Alerts that have been
+// triaged by an analyst (e.g. unclassified) are never classified by a rule
+const SQL_RULE_MATCH string = `FROM alert
+  LEFT JOIN classification ON (classification.alert_id = alert.id)
+  LEFT JOIN alert_state ON (alert_state.alert_id = alert.id)
+      WHERE classification.id IS NULL AND alert_state.alert_id IS NULL AND %s`
+
+const SQL_RULE_APPLY string = `INSERT INTO classification (alert_id, user_id, timestamp, disposition, reason, rule_id)
+	 SELECT alert.id, NULL, $1, $2, $3, $4 ` + SQL_RULE_MATCH + `
+  RETURNING alert_id`
+
+const RULE_NAME_MAX_LENGTH int = 100
+
+// ##### Structs ##############################################################
+
+// Represents a "classification_rule" record. Each non-empty criterion must match
+// for an alert to be classified with the rule's disposition
+type ClassificationRule struct {
+	ID                int64      `db:"id" json:"id"`
+	Name              string     `db:"name" json:"name"`
+	Enabled           bool       `db:"enabled" json:"enabled"`
+	Signer            string     `db:"signer" json:"signer"`
+	Company           string     `db:"company" json:"company"`
+	Location          string     `db:"location" json:"location"`
+	FilePath          string     `db:"file_path" json:"file_path"`
+	LaunchString      string     `db:"launch_string" json:"launch_string"`
+	Sha256            string     `db:"sha256" json:"sha256"`
+	Domain            string     `db:"domain" json:"domain"`
+	Host              string     `db:"host" json:"host"`
+	Disposition       int16      `db:"disposition" json:"disposition"`
+	Reason            string     `db:"reason" json:"reason"`
+	UserID            *int64     `db:"user_id" json:"user_id"`
+	Username          string     `db:"username" json:"username"`
+	TimestampCreated  time.Time  `db:"timestamp_created" json:"timestamp_created"`
+	TimestampUpdated  time.Time  `db:"timestamp_updated" json:"timestamp_updated"`
+	TimestampLastRun  *time.Time `db:"timestamp_last_run" json:"timestamp_last_run"`
+	LastRunCount      int64      `db:"last_run_count" json:"last_run_count"`
+	ClassifiedCount   int64      `db:"classified_count" json:"classified_count"`
+	DispositionString string     `db:"-" json:"-"`
+	CriteriaString    string     `db:"-" json:"-"`
+	UpdatedString     string     `db:"-" json:"-"`
+	LastRunString     string     `db:"-" json:"-"`
+}
+
+// ##### Methods ##############################################################
+
+//
+func NewClassificationRuleByID(id int64) (*ClassificationRule, error) {
+
+	r := new(ClassificationRule)
+	err := db.
+		Select("*").
+		From("classification_rule").
+		Where("id = $1", id).
+		QueryStruct(r)
+
+	if err == sql.ErrNoRows {
+		return r, errors.New("Rule does not exist")
+	}
+	if err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// newClassificationRuleFromForm returns a rule populated from the HTML form fields
+func newClassificationRuleFromForm(c *gin.Context) *ClassificationRule {
+
+	r := new(ClassificationRule)
+	r.Name = strings.TrimSpace(c.PostForm("name"))
+	r.Enabled = c.PostForm("enabled") == "true"
+	r.Signer = strings.TrimSpace(c.PostForm("signer"))
+	r.Company = strings.TrimSpace(c.PostForm("company"))
+	r.Location = strings.TrimSpace(c.PostForm("location"))
+	r.FilePath = strings.TrimSpace(c.PostForm("file_path"))
+	r.LaunchString = strings.TrimSpace(c.PostForm("launch_string"))
+	r.Sha256 = strings.ToLower(strings.TrimSpace(c.PostForm("sha256")))
+	r.Domain = strings.TrimSpace(c.PostForm("domain"))
+	r.Host = strings.TrimSpace(c.PostForm("host"))
+	r.Disposition = convertStringToInt16(c.PostForm("disposition"))
+	r.Reason = strings.TrimSpace(c.PostForm("reason"))
+
+	return r
+}
+
+// Validate ensures that the rule has a name, a disposition and at least one valid criterion
+func (r *ClassificationRule) Validate() error {
+
+	if len(r.Name) == 0 {
+		return errors.New("Name must be supplied")
+	}
+
+	if len(r.Name) > RULE_NAME_MAX_LENGTH {
+		return fmt.Errorf("Name must not exceed %d characters", RULE_NAME_MAX_LENGTH)
+	}
+
+	if AlertState(r.Disposition).IsDisposition() == false {
+		return errors.New("Invalid disposition")
+	}
+
+	if len(r.Signer) == 0 && len(r.Company) == 0 && len(r.Location) == 0 && len(r.FilePath) == 0 &&
+		len(r.LaunchString) == 0 && len(r.Sha256) == 0 && len(r.Domain) == 0 && len(r.Host) == 0 {
+		return errors.New("At least one criterion must be supplied")
+	}
+
+	if len(r.Sha256) > 0 {
+		_, err := hex.DecodeString(r.Sha256)
+		if err != nil || len(r.Sha256) != 64 {
+			return errors.New("SHA256 must be 64 hexadecimal characters")
+		}
+	}
+
+	// The regular expression is evaluated by PostgreSQL, so it is also validated there
+	if len(r.LaunchString) > 0 {
+		var matched bool
+		err := db.SQL("SELECT '' ~ $1", r.LaunchString).QueryScalar(&matched)
+		if err != nil {
+			return errors.New("Invalid launch string regular expression")
+		}
+	}
+
+	return nil
+}
+
+// buildWhere returns the SQL WHERE clause for the rule's criteria. The text fields are case insensitive
+func (r *ClassificationRule) buildWhere(args []interface{}) (string, []interface{}) {
+
+	var where []string
+
+	equals := []struct {
+		column string
+		value  string
+	}{
+		{"alert.signer", r.Signer},
+		{"alert.company", r.Company},
+		{"alert.location", r.Location},
+		{"alert.sha256", r.Sha256},
+		{"alert.domain", r.Domain},
+		{"alert.host", r.Host},
+	}
+
+	for _, e := range equals {
+		if len(e.value) == 0 {
+			continue
+		}
+
+		args = append(args, e.value)
+		where = append(where, fmt.Sprintf("LOWER(%s) = LOWER($%d)", e.column, len(args)))
+	}
+
+	if len(r.FilePath) > 0 {
+		args = append(args, convertGlobToLike(r.FilePath))
+		where = append(where, fmt.Sprintf("alert.file_path ILIKE $%d", len(args)))
+	}
+
+	if len(r.LaunchString) > 0 {
+		args = append(args, r.LaunchString)
+		where = append(where, fmt.Sprintf("alert.launch_string ~ $%d", len(args)))
+	}
+
+	return strings.Join(where, " AND "), args
+}
+
+// Preview returns the number of unclassified alerts that the rule would classify
+func (r *ClassificationRule) Preview() (int64, error) {
+
+	where, args := r.buildWhere(nil)
+
+	var count int64
+	err := db.SQL(fmt.Sprintf("SELECT COUNT(*) "+SQL_RULE_MATCH, where), args...).QueryScalar(&count)
+
+	return count, err
+}
+
+// Apply classifies the unclassified alerts that match the rule, returning the
+// number of alerts classified. The context is nil for scheduled runs
+func (r *ClassificationRule) Apply(c *gin.Context) (int64, error) {
+
+	ruleMutex.Lock()
+	defer ruleMutex.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.AutoRollback()
+
+	now := time.Now().UTC()
+	where, args := r.buildWhere([]interface{}{now, r.Disposition, r.Reason, r.ID})
+
+	var ids []int64
+	err = tx.SQL(fmt.Sprintf(SQL_RULE_APPLY, where), args...).QuerySlice(&ids)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.
+		Update("classification_rule").
+		Set("timestamp_last_run", now).
+		Set("last_run_count", len(ids)).
+		Where("id = $1", r.ID).
+		Exec()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(ids) > 0 {
+		userID, username := int64(-1), RULE_SCHEDULER_USERNAME
+		if c != nil {
+			userID, username = getAuditActor(c)
+		}
+
+		targets := make([]string, 0, len(ids))
+		for _, id := range ids {
+			targets = append(targets, convertInt64ToString(id))
+		}
+
+		err = insertAuditEntry(tx, c, userID, username, AUDIT_RULE_APPLY, AUDIT_TARGET_ALERT, strings.Join(targets, ","),
+			fmt.Sprintf("Rule %d: %s (%s)", r.ID, r.Name, AlertState(r.Disposition)))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(ids)), nil
+}
+
+// Add inserts the rule, recording the user that created it
+func (r *ClassificationRule) Add(userID int64, username string) error {
+
+	now := time.Now().UTC()
+	return db.
+		InsertInto("classification_rule").
+		Columns("name", "enabled", "signer", "company", "location", "file_path", "launch_string", "sha256", "domain", "host",
+			"disposition", "reason", "user_id", "username", "timestamp_created", "timestamp_updated").
+		Values(r.Name, r.Enabled, r.Signer, r.Company, r.Location, r.FilePath, r.LaunchString, r.Sha256, r.Domain, r.Host,
+			r.Disposition, r.Reason, userID, username, now, now).
+		Returning("*").
+		QueryStruct(r)
+}
+
+// Update saves the rule, recording the user that last changed it
+func (r *ClassificationRule) Update(userID int64, username string) error {
+
+	_, err := db.
+		Update("classification_rule").
+		Set("name", r.Name).
+		Set("enabled", r.Enabled).
+		Set("signer", r.Signer).
+		Set("company", r.Company).
+		Set("location", r.Location).
+		Set("file_path", r.FilePath).
+		Set("launch_string", r.LaunchString).
+		Set("sha256", r.Sha256).
+		Set("domain", r.Domain).
+		Set("host", r.Host).
+		Set("disposition", r.Disposition).
+		Set("reason", r.Reason).
+		Set("user_id", userID).
+		Set("username", username).
+		Set("timestamp_updated", time.Now().UTC()).
+		Where("id = $1", r.ID).
+		Exec()
+
+	return err
+}
+
+// Delete removes the rule. The alerts it classified remain classified
+func (r *ClassificationRule) Delete() error {
+
+	_, err := db.
+		DeleteFrom("classification_rule").
+		Where("id = $1", r.ID).
+		Exec()
+
+	return err
+}
+
+//
+func (r *ClassificationRule) Beautify() {
+
+	r.DispositionString = AlertState(r.Disposition).String()
+	r.UpdatedString = r.TimestampUpdated.Format("15:04:05 02/01/2006")
+	if r.TimestampLastRun != nil {
+		r.LastRunString = r.TimestampLastRun.Format("15:04:05 02/01/2006")
+	}
+
+	var criteria []string
+	for _, v := range []struct {
+		name  string
+		value string
+	}{
+		{"Signer", r.Signer},
+		{"Company", r.Company},
+		{"Location", r.Location},
+		{"File Path", r.FilePath},
+		{"Launch String", r.LaunchString},
+		{"SHA256", r.Sha256},
+		{"Domain", r.Domain},
+		{"Host", r.Host},
+	} {
+		if len(v.value) > 0 {
+			criteria = append(criteria, v.name+": "+v.value)
+		}
+	}
+
+	r.CriteriaString = strings.Join(criteria, ", ")
+}
+
+// String returns the rule's name and criteria, which is used for the audit records
+func (r *ClassificationRule) String() string {
+
+	r.Beautify()
+	return fmt.Sprintf("%s (%s; %s)", r.Name, r.CriteriaString, r.DispositionString)
+}
+
+// convertGlobToLike converts a file path glob (* and ?) to a LIKE pattern, escaping the LIKE wildcards
+func convertGlobToLike(glob string) string {
+
+	var b strings.Builder
+	for _, ch := range glob {
+		switch ch {
+		case '*':
+			b.WriteRune('%')
+		case '?':
+			b.WriteRune('_')
+		case '%', '_', '\\':
+			b.WriteRune('\\')
+			b.WriteRune(ch)
+		default:
+			b.WriteRune(ch)
+		}
+	}
+
+	return b.String()
+}
+
+// ***** Routing Methods ******************************************************
+
+//
+func routeRuleNewGet(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	r := &ClassificationRule{Enabled: true, Disposition: int16(ALERT_STATE_BENIGN)}
+	c.HTML(http.StatusOK, "rule", getTemplateData(c, gin.H{"endpoint": "new", "title": "New Rule", "r": r}))
+}
+
+//
+func routeRuleNewPost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	r := newClassificationRuleFromForm(c)
+	if processRuleForm(c, r, "new", "New Rule") == false {
+		return
+	}
+
+	userID, username := getAuditActor(c)
+	err := r.Add(userID, username)
+	if err != nil {
+		log.Printf("Error adding rule: %v\n", err)
+		goToErrorPage(c, "Unable to add rule")
+		return
+	}
+
+	writeAudit(c, AUDIT_RULE_CREATE, AUDIT_TARGET_RULE, convertInt64ToString(r.ID), r.String())
+
+	loadRulesData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Rule added")))
+}
+
+//
+func routeRuleEditGet(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	r, successful := loadRuleForAction(c)
+	if successful == false {
+		return
+	}
+
+	c.HTML(http.StatusOK, "rule", getTemplateData(c, gin.H{"endpoint": "edit/" + convertInt64ToString(r.ID), "title": "Edit Rule", "r": r}))
+}
+
+//
+func routeRuleEditPost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	existing, successful := loadRuleForAction(c)
+	if successful == false {
+		return
+	}
+
+	r := newClassificationRuleFromForm(c)
+	r.ID = existing.ID
+	if processRuleForm(c, r, "edit/"+convertInt64ToString(r.ID), "Edit Rule") == false {
+		return
+	}
+
+	userID, username := getAuditActor(c)
+	err := r.Update(userID, username)
+	if err != nil {
+		log.Printf("Error updating rule: %v\n", err)
+		loadRulesData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to update rule")))
+		return
+	}
+
+	writeAudit(c, AUDIT_RULE_EDIT, AUDIT_TARGET_RULE, convertInt64ToString(r.ID), r.String())
+
+	loadRulesData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Rule updated")))
+}
+
+// processRuleForm validates the submitted rule, re-rendering the form with a message if it is invalid or
+// if a preview was requested. Returns true if the rule should be saved
+func processRuleForm(c *gin.Context, r *ClassificationRule, endpoint string, title string) bool {
+
+	err := r.Validate()
+	if err != nil {
+		c.HTML(http.StatusOK, "rule", getTemplateData(c, gin.H{"endpoint": endpoint, "title": title, "r": r,
+			"message": template.HTML(fmt.Sprintf(ALERT_YELLOW, err.Error()))}))
+		return false
+	}
+
+	if c.PostForm("mode") != "preview" {
+		return true
+	}
+
+	count, err := r.Preview()
+	if err != nil {
+		log.Printf("Error previewing rule: %v\n", err)
+		c.HTML(http.StatusOK, "rule", getTemplateData(c, gin.H{"endpoint": endpoint, "title": title, "r": r,
+			"message": template.HTML(fmt.Sprintf(ALERT_RED, "Unable to preview rule"))}))
+		return false
+	}
+
+	c.HTML(http.StatusOK, "rule", getTemplateData(c, gin.H{"endpoint": endpoint, "title": title, "r": r,
+		"message": template.HTML(fmt.Sprintf(ALERT_BLUE, fmt.Sprintf("Would match %d unclassified alerts", count)))}))
+	return false
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+// Username recorded in the audit log for the scheduled rule runs
+const RULE_SCHEDULER_USERNAME string = "scheduler"
+
+const SQL_RULES string = `SELECT classification_rule.*,
+			(SELECT COUNT(*) FROM classification WHERE classification.rule_id = classification_rule.id) AS classified_count
+	   FROM classification_rule
+   ORDER BY classification_rule.name ASC`
+
+// ##### Variables ############################################################
+
+// Ensures that the scheduled and on demand runs do not classify the same alerts concurrently
+var ruleMutex sync.Mutex
+
+// ##### Methods ##############################################################
+
+//
+func getClassificationRules() ([]*ClassificationRule, error) {
+
+	var data []*ClassificationRule
+
+	err := db.SQL(SQL_RULES).QueryStructs(&data)
+
+	for _, r := range data {
+		r.Beautify()
+	}
+
+	return data, err
+}
+
+// applyClassificationRules applies each enabled rule, returning the total number of alerts classified.
+// A failing rule is logged and does not prevent the other rules from being applied
+func applyClassificationRules(c *gin.Context) (int64, error) {
+
+	rules, err := getClassificationRules()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	var lastErr error
+	for _, r := range rules {
+		if r.Enabled == false {
+			continue
+		}
+
+		count, err := r.Apply(c)
+		if err != nil {
+			log.Printf("Error applying rule: %v (%d: %s)\n", err, r.ID, r.Name)
+			lastErr = err
+			continue
+		}
+
+		total += count
+	}
+
+	return total, lastErr
+}
+
+// initialiseClassificationRules starts the scheduled application of the rules
+func initialiseClassificationRules() {
+
+	interval := time.Duration(config.RuleIntervalMinutes) * time.Minute
+	logger.Infof("Classification rules applied every %v", interval)
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			count, err := applyClassificationRules(nil)
+			if err != nil {
+				log.Printf("Error applying classification rules: %v\n", err)
+			}
+
+			if count > 0 {
+				log.Printf("Classification rules classified %d alerts\n", count)
+			}
+		}
+	}()
+}
+
+// ***** Routing Methods ******************************************************
+
+//
+func routeRulesGet(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	loadRulesData(c, "")
+}
+
+// loadRulesData renders the rules page with an optional message
+func loadRulesData(c *gin.Context, message template.HTML) {
+
+	data, err := getClassificationRules()
+	if err != nil {
+		log.Printf("Error loading rules: %v\n", err)
+		goToErrorPage(c, "Unable to load rules")
+		return
+	}
+
+	c.HTML(http.StatusOK, "rules", getTemplateData(c, gin.H{"rules": data, "interval": config.RuleIntervalMinutes, "message": message}))
+}
+
+// loadRuleForAction returns the rule referenced by the ID parameter, rendering the rules page with a message on failure
+func loadRuleForAction(c *gin.Context) (*ClassificationRule, bool) {
+
+	id, successful := processInt64Parameter(c.Param("id"))
+	if successful == false {
+		loadRulesData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid rule")))
+		return nil, false
+	}
+
+	r, err := NewClassificationRuleByID(id)
+	if err != nil {
+		log.Printf("Error loading rule: %v\n", err)
+		loadRulesData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Rule does not exist")))
+		return nil, false
+	}
+
+	return r, true
+}
+
+//
+func routeRuleDeletePost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	r, successful := loadRuleForAction(c)
+	if successful == false {
+		return
+	}
+
+	err := r.Delete()
+	if err != nil {
+		log.Printf("Error deleting rule: %v (%s)\n", err, r.Name)
+		loadRulesData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to delete rule")))
+		return
+	}
+
+	writeAudit(c, AUDIT_RULE_DELETE, AUDIT_TARGET_RULE, convertInt64ToString(r.ID), r.String())
+
+	loadRulesData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Rule deleted")))
+}
+
+//
+func routeRuleRunPost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	r, successful := loadRuleForAction(c)
+	if successful == false {
+		return
+	}
+
+	count, err := r.Apply(c)
+	if err != nil {
+		log.Printf("Error applying rule: %v (%s)\n", err, r.Name)
+		loadRulesData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to apply rule")))
+		return
+	}
+
+	loadRulesData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, fmt.Sprintf("Rule classified %d alerts", count))))
+}
+
+//
+func routeRulesRunPost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	count, err := applyClassificationRules(c)
+	if err != nil {
+		loadRulesData(c, template.HTML(fmt.Sprintf(ALERT_RED, fmt.Sprintf("Unable to apply all of the rules (%d alerts classified)", count))))
+		return
+	}
+
+	loadRulesData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, fmt.Sprintf("Rules classified %d alerts", count))))
+}
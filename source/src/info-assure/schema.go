@@ -0,0 +1,227 @@
+package main
+
+// ##### Constants ############################################################
+
+// SQL_SCHEMA contains the statements that create the tables owned by the UI
+// server. The statements must be safe to run repeatedly, since they are
+// executed each time the server starts
+var SQL_SCHEMA = []string{
+	`CREATE TABLE IF NOT EXISTS api_token (
+		id                  BIGSERIAL PRIMARY KEY,
+		user_id             BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name                TEXT NOT NULL,
+		token_hash          TEXT NOT NULL UNIQUE,
+		token_prefix        TEXT NOT NULL,
+		scope               SMALLINT NOT NULL DEFAULT 0,
+		timestamp_created   TIMESTAMP NOT NULL,
+		timestamp_expires   TIMESTAMP NULL,
+		timestamp_last_used TIMESTAMP NULL)`,
+	`CREATE INDEX IF NOT EXISTS api_token_user_id_idx ON api_token (user_id)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS auth_provider TEXT NOT NULL DEFAULT 'local'`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS external_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS mfa_last_counter BIGINT NOT NULL DEFAULT 0`,
+	`CREATE TABLE IF NOT EXISTS mfa_recovery_code (
+		id                BIGSERIAL PRIMARY KEY,
+		user_id           BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		code_hash         TEXT NOT NULL,
+		timestamp_created TIMESTAMP NOT NULL,
+		timestamp_used    TIMESTAMP NULL)`,
+	`CREATE INDEX IF NOT EXISTS mfa_recovery_code_user_id_idx ON mfa_recovery_code (user_id)`,
+	`CREATE TABLE IF NOT EXISTS webauthn_credential (
+		id                  BIGSERIAL PRIMARY KEY,
+		user_id             BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name                TEXT NOT NULL,
+		credential_id       TEXT NOT NULL UNIQUE,
+		public_key          TEXT NOT NULL,
+		sign_count          BIGINT NOT NULL DEFAULT 0,
+		timestamp_created   TIMESTAMP NOT NULL,
+		timestamp_last_used TIMESTAMP NULL)`,
+	`CREATE INDEX IF NOT EXISTS webauthn_credential_user_id_idx ON webauthn_credential (user_id)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS must_change_password BOOLEAN NOT NULL DEFAULT false`,
+	`CREATE TABLE IF NOT EXISTS common_passwords (
+		password TEXT PRIMARY KEY)`,
+	`CREATE TABLE IF NOT EXISTS password_history (
+		id                BIGSERIAL PRIMARY KEY,
+		user_id           BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		password_hash     TEXT NOT NULL,
+		timestamp_created TIMESTAMP NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS password_history_user_id_idx ON password_history (user_id)`,
+	`CREATE TABLE IF NOT EXISTS user_session (
+		id                  BIGSERIAL PRIMARY KEY,
+		token_hash          TEXT NOT NULL UNIQUE,
+		user_id             BIGINT NULL REFERENCES users(id) ON DELETE CASCADE,
+		data                TEXT NOT NULL,
+		ip_address          TEXT NOT NULL,
+		user_agent          TEXT NOT NULL,
+		timestamp_created   TIMESTAMP NOT NULL,
+		timestamp_last_seen TIMESTAMP NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS user_session_user_id_idx ON user_session (user_id)`,
+	`CREATE INDEX IF NOT EXISTS user_session_last_seen_idx ON user_session (timestamp_last_seen)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id          BIGSERIAL PRIMARY KEY,
+		timestamp   TIMESTAMP NOT NULL,
+		user_id     BIGINT NULL,
+		username    TEXT NOT NULL,
+		ip_address  TEXT NOT NULL,
+		action      TEXT NOT NULL,
+		target_type TEXT NOT NULL,
+		target_ids  TEXT NOT NULL,
+		details     TEXT NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_timestamp_idx ON audit_log (timestamp)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_username_idx ON audit_log (LOWER(username))`,
+	`CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action)`,
+	// The audit log is append only, so updates, deletes and truncation are rejected
+	`CREATE OR REPLACE FUNCTION audit_log_immutable() RETURNS TRIGGER AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_log is append only';
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS audit_log_immutable ON audit_log`,
+	`CREATE TRIGGER audit_log_immutable BEFORE UPDATE OR DELETE ON audit_log
+		FOR EACH ROW EXECUTE PROCEDURE audit_log_immutable()`,
+	`DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log`,
+	`CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+		FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_immutable()`,
+	// Classifications that pre-date the triage workflow are treated as benign
+	`ALTER TABLE classification ADD COLUMN IF NOT EXISTS disposition SMALLINT NOT NULL DEFAULT 2`,
+	`ALTER TABLE classification ADD COLUMN IF NOT EXISTS reason TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS alert_state (
+		alert_id          BIGINT PRIMARY KEY,
+		state             SMALLINT NOT NULL DEFAULT 0,
+		assigned_user_id  BIGINT NULL REFERENCES users(id) ON DELETE SET NULL,
+		user_id           BIGINT NULL REFERENCES users(id) ON DELETE SET NULL,
+		timestamp_updated TIMESTAMP NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS alert_state_assigned_user_id_idx ON alert_state (assigned_user_id)`,
+	`CREATE TABLE IF NOT EXISTS alert_comment (
+		id                BIGSERIAL PRIMARY KEY,
+		alert_id          BIGINT NOT NULL,
+		parent_id         BIGINT NULL REFERENCES alert_comment(id) ON DELETE CASCADE,
+		user_id           BIGINT NULL REFERENCES users(id) ON DELETE SET NULL,
+		username          TEXT NOT NULL,
+		comment           TEXT NOT NULL,
+		timestamp_created TIMESTAMP NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS alert_comment_alert_id_idx ON alert_comment (alert_id)`,
+	`CREATE TABLE IF NOT EXISTS classification_rule (
+		id                 BIGSERIAL PRIMARY KEY,
+		name               TEXT NOT NULL,
+		enabled            BOOLEAN NOT NULL DEFAULT TRUE,
+		signer             TEXT NOT NULL DEFAULT '',
+		company            TEXT NOT NULL DEFAULT '',
+		location           TEXT NOT NULL DEFAULT '',
+		file_path          TEXT NOT NULL DEFAULT '',
+		launch_string      TEXT NOT NULL DEFAULT '',
+		sha256             TEXT NOT NULL DEFAULT '',
+		domain             TEXT NOT NULL DEFAULT '',
+		host               TEXT NOT NULL DEFAULT '',
+		disposition        SMALLINT NOT NULL DEFAULT 2,
+		reason             TEXT NOT NULL DEFAULT '',
+		user_id            BIGINT NULL REFERENCES users(id) ON DELETE SET NULL,
+		username           TEXT NOT NULL,
+		timestamp_created  TIMESTAMP NOT NULL,
+		timestamp_updated  TIMESTAMP NOT NULL,
+		timestamp_last_run TIMESTAMP NULL,
+		last_run_count     BIGINT NOT NULL DEFAULT 0)`,
+	// Classifications made by a rule have no user, and record the rule instead
+	`ALTER TABLE classification ALTER COLUMN user_id DROP NOT NULL`,
+	`ALTER TABLE classification ADD COLUMN IF NOT EXISTS rule_id BIGINT NULL REFERENCES classification_rule(id) ON DELETE SET NULL`,
+	`CREATE INDEX IF NOT EXISTS classification_rule_id_idx ON classification (rule_id)`,
+	// The prevalence views count the hosts that share each artefact within the current autoruns. The
+	// long text values are keyed by their MD5 so that the unique indexes allow concurrent refreshes
+	`CREATE MATERIALIZED VIEW IF NOT EXISTS prevalence_sha256 AS
+		SELECT LOWER(d.sha256) AS sha256, COUNT(DISTINCT i.host) AS host_count,
+			   MIN(d.location) AS location, MIN(d.item_name) AS item_name, MIN(d.file_path) AS file_path,
+			   array_to_string((array_agg(DISTINCT i.host ORDER BY i.host))[1:5], ', ') AS sample_hosts
+		  FROM current_autoruns d JOIN instance i ON (d.instance = i.id)
+		 WHERE d.sha256 <> ''
+	  GROUP BY LOWER(d.sha256)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS prevalence_sha256_idx ON prevalence_sha256 (sha256)`,
+	`CREATE INDEX IF NOT EXISTS prevalence_sha256_host_count_idx ON prevalence_sha256 (host_count)`,
+	`CREATE MATERIALIZED VIEW IF NOT EXISTS prevalence_launch_string AS
+		SELECT md5(d.launch_string) AS launch_string_hash, MIN(d.launch_string) AS launch_string,
+			   COUNT(DISTINCT i.host) AS host_count, MIN(d.location) AS location, MIN(d.item_name) AS item_name,
+			   array_to_string((array_agg(DISTINCT i.host ORDER BY i.host))[1:5], ', ') AS sample_hosts
+		  FROM current_autoruns d JOIN instance i ON (d.instance = i.id)
+		 WHERE d.launch_string <> ''
+	  GROUP BY md5(d.launch_string)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS prevalence_launch_string_idx ON prevalence_launch_string (launch_string_hash)`,
+	`CREATE INDEX IF NOT EXISTS prevalence_launch_string_host_count_idx ON prevalence_launch_string (host_count)`,
+	`CREATE MATERIALIZED VIEW IF NOT EXISTS prevalence_item AS
+		SELECT md5(d.location || chr(31) || d.item_name) AS item_hash, MIN(d.location) AS location,
+			   MIN(d.item_name) AS item_name, COUNT(DISTINCT i.host) AS host_count,
+			   array_to_string((array_agg(DISTINCT i.host ORDER BY i.host))[1:5], ', ') AS sample_hosts
+		  FROM current_autoruns d JOIN instance i ON (d.instance = i.id)
+	  GROUP BY md5(d.location || chr(31) || d.item_name)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS prevalence_item_idx ON prevalence_item (item_hash)`,
+	`CREATE INDEX IF NOT EXISTS prevalence_item_host_count_idx ON prevalence_item (host_count)`,
+	// The baseline is an instance of a host (e.g. built from a gold image) that the group's hosts are compared to
+	`CREATE TABLE IF NOT EXISTS host_group (
+		id                 BIGSERIAL PRIMARY KEY,
+		name               TEXT NOT NULL UNIQUE,
+		description        TEXT NOT NULL DEFAULT '',
+		baseline_instance  BIGINT NULL,
+		baseline_host      TEXT NOT NULL DEFAULT '',
+		baseline_username  TEXT NOT NULL DEFAULT '',
+		timestamp_baseline TIMESTAMP NULL,
+		user_id            BIGINT NULL REFERENCES users(id) ON DELETE SET NULL,
+		username           TEXT NOT NULL,
+		timestamp_created  TIMESTAMP NOT NULL,
+		timestamp_updated  TIMESTAMP NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS host_group_member (
+		group_id BIGINT NOT NULL REFERENCES host_group(id) ON DELETE CASCADE,
+		host     TEXT NOT NULL,
+		PRIMARY KEY (group_id, host))`,
+	`CREATE INDEX IF NOT EXISTS host_group_member_host_idx ON host_group_member (LOWER(host))`,
+	// Hosts whose domain and name match a group's patterns are also members of the group
+	`ALTER TABLE host_group ADD COLUMN IF NOT EXISTS domain_pattern TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE host_group ADD COLUMN IF NOT EXISTS host_pattern TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS host_tag (
+		host              TEXT NOT NULL,
+		tag               TEXT NOT NULL,
+		username          TEXT NOT NULL,
+		timestamp_created TIMESTAMP NOT NULL)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS host_tag_host_tag_idx ON host_tag (LOWER(host), LOWER(tag))`,
+	`CREATE INDEX IF NOT EXISTS host_tag_tag_idx ON host_tag (LOWER(tag))`,
+	// The baseline's autoruns are copied when it is set, so that the comparison does not depend upon
+	// the analysis server retaining the instance. Existing baselines are copied if still available
+	`ALTER TABLE host_group ADD COLUMN IF NOT EXISTS baseline_domain TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE host_group ADD COLUMN IF NOT EXISTS baseline_instance_timestamp TIMESTAMP NULL`,
+	`UPDATE host_group SET baseline_domain = i.domain, baseline_instance_timestamp = i.timestamp
+		FROM instance i WHERE i.id = host_group.baseline_instance AND host_group.baseline_instance_timestamp IS NULL`,
+	`CREATE TABLE IF NOT EXISTS host_group_baseline_autorun (
+		group_id       BIGINT NOT NULL REFERENCES host_group(id) ON DELETE CASCADE,
+		id             BIGINT,
+		instance       BIGINT,
+		location       TEXT,
+		item_name      TEXT,
+		enabled        BOOLEAN,
+		profile        TEXT,
+		launch_string  TEXT,
+		description    TEXT,
+		company        TEXT,
+		signer         TEXT,
+		version_number TEXT,
+		file_path      TEXT,
+		file_name      TEXT,
+		file_directory TEXT,
+		time           TIMESTAMP,
+		sha256         TEXT,
+		md5            TEXT,
+		text           TEXT)`,
+	`CREATE INDEX IF NOT EXISTS host_group_baseline_autorun_group_id_idx ON host_group_baseline_autorun (group_id)`,
+	`INSERT INTO host_group_baseline_autorun (group_id, ` + SQL_AUTORUN_COLUMNS + `)
+		SELECT g.id, h.* FROM host_group g JOIN ` + SQL_AUTORUN_HISTORY + ` AS h ON (h.instance = g.baseline_instance)
+		 WHERE NOT EXISTS (SELECT 1 FROM host_group_baseline_autorun b WHERE b.group_id = g.id)`,
+}
+
+// ##### Methods ##############################################################
+
+// initialiseSchema ensures that the tables used by the UI server exist
+func initialiseSchema() {
+
+	for _, s := range SQL_SCHEMA {
+		_, err := db.DB.Exec(s)
+		if err != nil {
+			logger.Fatalf("Unable to initialise database schema: %v", err)
+		}
+	}
+}
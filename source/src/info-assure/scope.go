@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Structs ##############################################################
+
+// HostScope restricts a view to the hosts of a group and/or the hosts with a tag. Either can be empty
+type HostScope struct {
+	Group   *HostGroup
+	Tag     string
+	invalid bool // The group does not exist, so no hosts are within the scope
+}
+
+// ##### Methods ##############################################################
+
+// processHostScope returns the scope from the group (ID) and tag parameters. An error is returned
+// if the group is invalid or does not exist, in which case the scope does not match any hosts
+func processHostScope(param func(string) string) (*HostScope, error) {
+
+	s := &HostScope{Tag: strings.TrimSpace(param("tag"))}
+
+	group := param("group")
+	if len(group) == 0 || group == "0" {
+		return s, nil
+	}
+
+	id, successful := processInt64Parameter(group)
+	if successful == false || id <= 0 {
+		s.invalid = true
+		return s, errors.New("Invalid group")
+	}
+
+	g, err := NewHostGroupByID(id)
+	if err != nil {
+		logger.Errorf("Error querying for scope group: %v (%d)", err, id)
+		s.invalid = true
+		return s, errors.New("Invalid group")
+	}
+
+	s.Group = g
+	return s, nil
+}
+
+// IsSet returns true if the scope restricts the hosts
+func (s *HostScope) IsSet() bool {
+
+	return s.Group != nil || len(s.Tag) > 0 || s.invalid == true
+}
+
+// String returns the group and tag, which is used for the audit records
+func (s *HostScope) String() string {
+
+	var scope []string
+	if s.Group != nil {
+		scope = append(scope, "Group: "+s.Group.Name)
+	}
+
+	if s.invalid == true {
+		scope = append(scope, "Group: Invalid")
+	}
+
+	if len(s.Tag) > 0 {
+		scope = append(scope, "Tag: "+s.Tag)
+	}
+
+	return strings.Join(scope, ", ")
+}
+
+// buildWhere returns the SQL condition that restricts the domain and host columns to the scope, or an
+// empty string if the scope is not set. The args are the parameters already used by the query
+func (s *HostScope) buildWhere(domainColumn string, hostColumn string, args []interface{}) (string, []interface{}) {
+
+	var where []string
+
+	if s.invalid == true {
+		where = append(where, "FALSE")
+	}
+
+	if s.Group != nil {
+		var condition string
+		condition, args = s.Group.buildWhere(domainColumn, hostColumn, args)
+		where = append(where, condition)
+	}
+
+	if len(s.Tag) > 0 {
+		args = append(args, s.Tag)
+		where = append(where, fmt.Sprintf("LOWER(%s) IN (SELECT LOWER(t.host) FROM host_tag t WHERE LOWER(t.tag) = LOWER($%d))", hostColumn, len(args)))
+	}
+
+	return strings.Join(where, " AND "), args
+}
+
+// setTemplateValues adds the selected group and tag, and the groups and tags that can be selected, to the template data
+func (s *HostScope) setTemplateValues(values gin.H) error {
+
+	groupID := int64(0)
+	if s.Group != nil {
+		groupID = s.Group.ID
+	}
+
+	values["group"] = groupID
+	values["tag"] = s.Tag
+
+	groups, err := getHostGroups()
+	if err != nil {
+		return err
+	}
+
+	tags, err := getTags()
+	if err != nil {
+		return err
+	}
+
+	values["groups"] = groups
+	values["tags"] = tags
+
+	return nil
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
+	gorilla "github.com/gorilla/sessions"
+)
+
+// ##### Constants ############################################################
+
+const SESSION_SECRET_ENV string = "ARL_SESSION_SECRET"
+
+// The last seen timestamp is only updated periodically, to reduce database writes
+const SESSION_LAST_SEEN_INTERVAL time.Duration = 30 * time.Second
+const SESSION_CLEANUP_INTERVAL time.Duration = 5 * time.Minute
+
+// Sessions that have not been authenticated (e.g. those holding the OIDC login state) are
+// removed after a short period of inactivity, so that unauthenticated requests cannot fill the table
+const SESSION_ANONYMOUS_TIMEOUT time.Duration = 15 * time.Minute
+
+// ##### Structs ##############################################################
+
+// Represents a "user_session" record. The session ID within the cookie is
+// random, and only its SHA256 hash is stored
+type UserSession struct {
+	ID                int64     `db:"id"`
+	TokenHash         string    `db:"token_hash"`
+	UserID            *int64    `db:"user_id"`
+	Data              string    `db:"data"`
+	IpAddress         string    `db:"ip_address"`
+	UserAgent         string    `db:"user_agent"`
+	TimestampCreated  time.Time `db:"timestamp_created"`
+	TimestampLastSeen time.Time `db:"timestamp_last_seen"`
+	CreatedString     string    `db:"-"`
+	LastSeenString    string    `db:"-"`
+	Current           bool      `db:"-"`
+}
+
+// PostgresStore is a gorilla session store that keeps the session values within the
+// "user_session" table. The cookie only contains the signed session ID, so sessions
+// can be revoked, and the inactivity timeout is enforced by the server
+type PostgresStore struct {
+	codecs  []securecookie.Codec
+	options *gorilla.Options
+	timeout time.Duration
+}
+
+// ##### Methods ##############################################################
+
+// NewPostgresStore returns a store that signs the session cookies using the secret
+func NewPostgresStore(secret []byte, timeout time.Duration) *PostgresStore {
+
+	s := &PostgresStore{
+		codecs:  securecookie.CodecsFromPairs(secret),
+		options: &gorilla.Options{Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode},
+		timeout: timeout,
+	}
+
+	go s.cleanup()
+	return s
+}
+
+// getSessionSecret returns the secret used to sign session cookies, which is read
+// from the environment or config file. A random secret is used if neither is set
+func getSessionSecret() []byte {
+
+	secret := os.Getenv(SESSION_SECRET_ENV)
+	if len(secret) == 0 {
+		secret = config.SessionSecret
+	}
+
+	if len(secret) == 0 {
+		logger.Warning("Session secret not set, using a random secret. Users will be logged out when the server restarts")
+		return securecookie.GenerateRandomKey(32)
+	}
+
+	if len(secret) < 32 {
+		logger.Fatal("Session secret must be at least 32 characters")
+	}
+
+	return []byte(secret)
+}
+
+// hashSessionToken returns the hex encoded SHA256 hash of a session ID
+func hashSessionToken(token string) string {
+
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Options sets the default options for new sessions
+func (s *PostgresStore) Options(options sessions.Options) {
+
+	s.options = &gorilla.Options{
+		Path:     options.Path,
+		Domain:   options.Domain,
+		MaxAge:   options.MaxAge,
+		Secure:   options.Secure,
+		HttpOnly: options.HttpOnly,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Get returns the session cached for the request, loading it on first use
+func (s *PostgresStore) Get(r *http.Request, name string) (*gorilla.Session, error) {
+
+	return gorilla.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session referenced by the cookie. A new, empty session is returned if
+// the cookie is invalid, or the session has been revoked or has been inactive for too long
+func (s *PostgresStore) New(r *http.Request, name string) (*gorilla.Session, error) {
+
+	session := gorilla.NewSession(s, name)
+	options := *s.options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var token string
+	err = securecookie.DecodeMulti(name, cookie.Value, &token, s.codecs...)
+	if err != nil {
+		return session, nil
+	}
+
+	us := new(UserSession)
+	err = db.
+		Select("*").
+		From("user_session").
+		Where("token_hash = $1", hashSessionToken(token)).
+		QueryStruct(us)
+
+	if err == sql.ErrNoRows {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+
+	timeout := s.timeout
+	if us.UserID == nil && timeout > SESSION_ANONYMOUS_TIMEOUT {
+		timeout = SESSION_ANONYMOUS_TIMEOUT
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(us.TimestampLastSeen) > timeout {
+		deleteSessionByToken(token)
+		return session, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(us.Data)
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values)
+	}
+	if err != nil {
+		log.Printf("Error decoding session data: %v\n", err)
+		return session, nil
+	}
+
+	if now.Sub(us.TimestampLastSeen) > SESSION_LAST_SEEN_INTERVAL {
+		_, err = db.
+			Update("user_session").
+			Set("timestamp_last_seen", now).
+			Set("ip_address", getRequestIp(r)).
+			Where("id = $1", us.ID).
+			Exec()
+		if err != nil {
+			log.Printf("Error updating session last seen: %v\n", err)
+		}
+	}
+
+	session.ID = token
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the session values and sets the cookie. Sessions with a negative
+// MaxAge are deleted, which is how logouts are performed
+func (s *PostgresStore) Save(r *http.Request, w http.ResponseWriter, session *gorilla.Session) error {
+
+	if session.Options.MaxAge < 0 {
+		if len(session.ID) > 0 {
+			deleteSessionByToken(session.ID)
+		}
+		http.SetCookie(w, gorilla.NewCookie(session.Name(), "", &gorilla.Options{Path: s.options.Path, MaxAge: -1}))
+		return nil
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(session.Values)
+	if err != nil {
+		return err
+	}
+	data := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	var userID *int64
+	if id, ok := session.Values["user_id"].(int64); ok == true {
+		userID = &id
+	}
+
+	now := time.Now().UTC()
+	if len(session.ID) == 0 {
+		token, err := generateSessionToken()
+		if err != nil {
+			return err
+		}
+
+		_, err = db.
+			InsertInto("user_session").
+			Columns("token_hash", "user_id", "data", "ip_address", "user_agent", "timestamp_created", "timestamp_last_seen").
+			Values(hashSessionToken(token), userID, data, getRequestIp(r), r.UserAgent(), now, now).
+			Exec()
+		if err != nil {
+			return err
+		}
+
+		session.ID = token
+	} else {
+		res, err := db.
+			Update("user_session").
+			Set("data", data).
+			Set("user_id", userID).
+			Set("timestamp_last_seen", now).
+			Where("token_hash = $1", hashSessionToken(session.ID)).
+			Exec()
+		if err != nil {
+			return err
+		}
+
+		// The session was revoked during the request, so it must not be recreated
+		if res.RowsAffected == 0 {
+			http.SetCookie(w, gorilla.NewCookie(session.Name(), "", &gorilla.Options{Path: s.options.Path, MaxAge: -1}))
+			return errors.New("Session has been revoked")
+		}
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, gorilla.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// cleanup periodically removes the sessions that have exceeded the inactivity timeout,
+// and the unauthenticated sessions that have exceeded the anonymous timeout
+func (s *PostgresStore) cleanup() {
+
+	for {
+		now := time.Now().UTC()
+		_, err := db.
+			DeleteFrom("user_session").
+			Where("timestamp_last_seen < $1 OR (user_id IS NULL AND timestamp_last_seen < $2)", now.Add(-s.timeout), now.Add(-SESSION_ANONYMOUS_TIMEOUT)).
+			Exec()
+		if err != nil {
+			log.Printf("Error removing expired sessions: %v\n", err)
+		}
+
+		time.Sleep(SESSION_CLEANUP_INTERVAL)
+	}
+}
+
+// generateSessionToken returns a random base64url encoded session ID
+func generateSessionToken() (string, error) {
+
+	data := make([]byte, 32)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// getRequestIp returns the IP address of the connection. Forwarding headers are not
+// used, since they can be set by the client
+func getRequestIp(r *http.Request) string {
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
+
+// regenerateSession removes the stored session so that a new session ID is issued
+// when the session is saved. This prevents session fixation at logon
+func regenerateSession(session *gorilla.Session) {
+
+	if len(session.ID) > 0 {
+		deleteSessionByToken(session.ID)
+		session.ID = ""
+	}
+}
+
+// deleteSessionByToken removes the session with the session ID
+func deleteSessionByToken(token string) {
+
+	_, err := db.
+		DeleteFrom("user_session").
+		Where("token_hash = $1", hashSessionToken(token)).
+		Exec()
+	if err != nil {
+		log.Printf("Error deleting session: %v\n", err)
+	}
+}
+
+// deleteUserSessions removes (logs out) all of a user's sessions
+func deleteUserSessions(userID int64) error {
+
+	_, err := db.
+		DeleteFrom("user_session").
+		Where("user_id = $1", userID).
+		Exec()
+
+	return err
+}
+
+// deleteOtherUserSessions removes all of a user's sessions, except for the current session
+func deleteOtherUserSessions(c *gin.Context, userID int64) error {
+
+	session, err := sessionStore.Get(c.Request, APP_NAME)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.
+		DeleteFrom("user_session").
+		Where("user_id = $1 AND token_hash <> $2", userID, hashSessionToken(session.ID)).
+		Exec()
+
+	return err
+}
+
+// getUserSessions returns a user's sessions, marking the session used by the request
+func getUserSessions(c *gin.Context, userID int64) ([]*UserSession, error) {
+
+	var data []*UserSession
+
+	err := db.
+		Select("*").
+		From("user_session").
+		Where("user_id = $1", userID).
+		OrderBy("timestamp_last_seen DESC").
+		QueryStructs(&data)
+
+	currentHash := ""
+	session, err2 := sessionStore.Get(c.Request, APP_NAME)
+	if err2 == nil && len(session.ID) > 0 {
+		currentHash = hashSessionToken(session.ID)
+	}
+
+	for _, s := range data {
+		s.Beautify()
+		s.Current = s.TokenHash == currentHash
+	}
+
+	return data, err
+}
+
+//
+func (s *UserSession) Beautify() {
+
+	s.CreatedString = s.TimestampCreated.Format("15:04:05 02/01/2006")
+	s.LastSeenString = s.TimestampLastSeen.Format("15:04:05 02/01/2006")
+}
+
+// ***** Routing Methods ******************************************************
+
+//
+func routeAccountSessionsGet(c *gin.Context) {
+
+	loadSessionsData(c, "")
+}
+
+// loadSessionsData renders the active sessions page with an optional message
+func loadSessionsData(c *gin.Context, message template.HTML) {
+
+	data, err := getUserSessions(c, getCookieInt64Value(c, "user_id"))
+	if err != nil {
+		log.Printf("Error loading user sessions: %v\n", err)
+		goToErrorPage(c, "Unable to load sessions")
+		return
+	}
+
+	c.HTML(http.StatusOK, "sessions", getTemplateData(c, gin.H{"sessions": data, "message": message}))
+}
+
+//
+func routeAccountSessionRevokePost(c *gin.Context) {
+
+	id, successful := processInt64Parameter(c.Param("id"))
+	if successful == false {
+		loadSessionsData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid session")))
+		return
+	}
+
+	res, err := db.
+		DeleteFrom("user_session").
+		Where("id = $1 AND user_id = $2", id, getCookieInt64Value(c, "user_id")).
+		Exec()
+	if err != nil || res.RowsAffected == 0 {
+		log.Printf("Error revoking session: %v\n", err)
+		loadSessionsData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Unable to revoke session")))
+		return
+	}
+
+	writeAudit(c, AUDIT_SESSION_REVOKE, AUDIT_TARGET_SESSION, convertInt64ToString(id), "")
+
+	loadSessionsData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Session revoked")))
+}
+
+//
+func routeUserLogoutPost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	u, successful := loadUserForAction(c)
+	if successful == false {
+		return
+	}
+
+	err := deleteUserSessions(u.ID)
+	if err != nil {
+		log.Printf("Error logging out user sessions: %v\n", err)
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to log out user")))
+		return
+	}
+
+	log.Printf("All sessions logged out for user: %s\n", u.Username)
+	writeAudit(c, AUDIT_USER_LOGOUT, AUDIT_TARGET_USER, convertInt64ToString(u.ID), u.Username)
+	loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "User logged out of all sessions")))
+}
@@ -20,12 +20,21 @@ func routeSingleHost(c *gin.Context) {
 	host := c.PostForm("host")
 	instance := c.PostForm("instance")
 
+	// Other pages link to a host's autoruns, optionally at a previous instance
+	if len(host) == 0 {
+		host = c.Query("host")
+	}
+
+	if len(instance) == 0 {
+		instance = c.Query("instance")
+	}
+
 	if len(searchHost) == 0 && len(host) == 0 && len(instance) == 0 {
-		c.HTML(http.StatusOK, "single_host", gin.H{
+		c.HTML(http.StatusOK, "single_host", getTemplateData(c, gin.H{
 			"search_host": "",
 			"data":        nil,
 			"hosts":       nil,
-		})
+		}))
 		return
 	}
 
@@ -38,12 +47,22 @@ func routeSingleHost(c *gin.Context) {
 			return
 		}
 
+		if len(hosts) == 0 {
+			c.HTML(http.StatusOK, "single_host", getTemplateData(c, gin.H{
+				"data":        nil,
+				"search_host": searchHost,
+				"hosts":       nil,
+				"error":       "No hosts match " + searchHost,
+			}))
+			return
+		}
+
 		if len(hosts) > 1 {
-			c.HTML(http.StatusOK, "single_host", gin.H{
+			c.HTML(http.StatusOK, "single_host", getTemplateData(c, gin.H{
 				"data":        nil,
 				"search_host": "",
 				"hosts":       hosts,
-			})
+			}))
 			return
 		}
 
@@ -62,29 +81,13 @@ func routeSingleHost(c *gin.Context) {
 			instanceID = util.ConvertStringToInt64(instance)
 		}
 
-		fmt.Println(host)
-		fmt.Println(instanceID)
-
 		if instanceID == -1 {
 			c.String(http.StatusInternalServerError, "")
 			return
 		}
 
 		mode, hasMode := c.GetPostForm("mode")
-		numRecsPerPage, successful := processIntParameter(c.PostForm("num_recs_per_page"))
-		if successful == false {
-			numRecsPerPage = 10
-		}
-
-		// Appears to be the first request to send the initial set of data
-		if (mode != "first" &&
-			mode != "next" &&
-			mode != "previous" &&
-			mode != "export") || hasMode == false {
-
-			loadSingleHostAutorunsData(c, host, instanceID, 0, numRecsPerPage)
-			return
-		}
+		order := processOrderParameter(c.PostForm("order"))
 
 		// Export single host's autorun data
 		if hasMode == true && mode == "export" {
@@ -92,18 +95,16 @@ func routeSingleHost(c *gin.Context) {
 			return
 		}
 
-		currentPageNumber := processCurrentPageNumber(c.PostForm("current_page_num"), mode)
-
-		loadSingleHostAutorunsData(c, host, instanceID, currentPageNumber, numRecsPerPage)
+		loadSingleHostAutorunsData(c, host, instanceID, processPaging(c.PostForm), order)
 		return
 	}
 
 	// Default action
-	c.HTML(http.StatusOK, "single_host", gin.H{
+	c.HTML(http.StatusOK, "single_host", getTemplateData(c, gin.H{
 		"search_host": searchHost,
 		"data":        nil,
 		"hosts":       nil,
-	})
+	}))
 }
 
 // loadSingleHostAutorunsData performs the data retrieval and processing for a single hosts autoruns data
@@ -111,25 +112,33 @@ func loadSingleHostAutorunsData(
 	c *gin.Context,
 	host string,
 	instance int64,
-	currentPageNumber int,
-	numRecsPerPage int) {
+	paging *Paging,
+	order int) {
 
-	errored, noMoreRecords, data := getPagedSingleHostAutoruns(instance, currentPageNumber, numRecsPerPage)
+	errored, data := getPagedSingleHostAutoruns(instance, paging, order)
 	if errored == true {
 		c.String(http.StatusInternalServerError, "")
 		return
 	}
 
-	fmt.Printf("Data: %v", data)
+	i, err := getInstance(instance)
+	if err != nil {
+		logger.Errorf("Error querying for single host instance: %v (Instance: %d)", err, instance)
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
 
-	c.HTML(http.StatusOK, "single_host_data", gin.H{
-		"search_host":       host,
+	c.HTML(http.StatusOK, "single_host_data", getTemplateData(c, gin.H{
+		"search_host":       i.Host,
 		"instance":          instance,
+		"instance_time":     i.Timestamp.Format("15:04:05 02/01/2006"),
+		"current":           instance == getInstanceFromHost(i.Host),
 		"data":              data,
-		"current_page_num":  currentPageNumber,
-		"num_recs_per_page": numRecsPerPage,
-		"no_more_records":   noMoreRecords,
-	})
+		"current_page_num":  paging.Number,
+		"num_recs_per_page": paging.Size,
+		"paging":            paging,
+		"order":             order,
+	}))
 }
 
 // getInstanceFromHost returns the ID of an instance that relates to the host specified
@@ -152,33 +161,55 @@ func getInstanceFromHost(host string) int64 {
 	return i.Id
 }
 
-// getPagedSingleHostAutoruns returns a paged set of autoruns, specific to a host
-func getPagedSingleHostAutoruns(instance int64, currentPageNumber int, numRecsPerPage int) (errored bool, noMoreRecords bool, data []*Autorun) {
+// getPagedSingleHostAutoruns returns a paged set of autoruns, specific to a host's instance, and sets the total and cursors
+// of the page. The autoruns of a previous instance are read from the history, so that they are shown as they were at the time
+func getPagedSingleHostAutoruns(instance int64, paging *Paging, order int) (errored bool, data []*Autorun) {
 
 	errored = false
 
-	err := db.
-		Select(`id, location, item_name, enabled, profile, launch_string, description, company, signer, version_number, file_path, file_name, file_directory, time, sha256, md5, text`).
-		From("current_autoruns").
-		Where("instance = $1", instance).
-		Limit(uint64(numRecsPerPage) + 1).
-		Offset(uint64(numRecsPerPage) * uint64(currentPageNumber)).
-		OrderBy("location, item_name").
-		QueryStructs(&data)
+	args := []interface{}{instance}
+
+	total, exact, err := countRecords("SELECT 1 FROM "+SQL_AUTORUN_HISTORY+" AS d WHERE d.instance = $1", args)
+	if err != nil {
+		errored = true
+		logger.Errorf("Error counting single host data: %v (Instance: %d)", err, instance)
+		return
+	}
+	paging.setTotal(total, exact)
+
+	keyset := &Keyset{Columns: []string{"d.location", "d.item_name", "d.id"}}
+	if order == ORDER_PREVALENCE {
+		keyset.Columns = append([]string{SQL_PREVALENCE_SORT}, keyset.Columns...)
+	}
+
+	cursor, orderBy, limit, args, err := keyset.page(paging, args)
+	if err != nil {
+		errored = true
+		logger.Errorf("Error reading single host cursor: %v (Instance: %d)", err, instance)
+		return
+	}
+
+	err = db.SQL(fmt.Sprintf(`SELECT d.id, d.location, d.item_name, d.enabled, d.profile, d.launch_string, d.description, d.company, d.signer,
+			d.version_number, d.file_path, d.file_name, d.file_directory, d.time, d.sha256, d.md5, d.text, %s, %s
+	   FROM %s AS d %s
+	  WHERE d.instance = $1 AND %s
+   ORDER BY %s
+	  %s`, SQL_PREVALENCE_COLUMNS, keyset.selectKey(), SQL_AUTORUN_HISTORY, prevalenceJoins("d"), cursor, orderBy, limit), args...).QueryStructs(&data)
 
 	if err != nil {
 		if strings.Contains(err.Error(), "no rows in result set") == true {
-			noMoreRecords = true
+			paging.setResults(0, "", "")
 			return
 		}
 
 		errored = true
-		noMoreRecords = true
 
 		logger.Errorf("Error querying for single host data: %v (Instance: %d)", err, instance)
 		return
 	}
 
+	data = data[:paging.trim(data, func(i int) string { return data[i].SortKey })]
+
 	// Perform some cleaning of the data, so that it displays better in the HTML
 	for _, d := range data {
 		d.LocationStr = template.HTML("<td class=\"poppy\" data-variation=\"basic\" data-content=\"" + d.Location + "\">" + splitRegKey(d.Location) + "</td>")
@@ -186,24 +217,17 @@ func getPagedSingleHostAutoruns(instance int64, currentPageNumber int, numRecsPe
 		d.TimeStr = d.Time.Format("15:04:05 02/01/2006")
 	}
 
-	if len(data) < numRecsPerPage+1 {
-		noMoreRecords = true
-	} else {
-		// Remove the last item in the slice/array
-		data = data[:len(data)-1]
-	}
-
 	return
 }
 
-// getSingleHostAutoruns returns a set of autoruns, specific to a host
+// getSingleHostAutoruns returns a set of autoruns, specific to a host's instance
 func getSingleHostAutoruns(instance int64) (data []*Autorun, errored bool) {
 
 	errored = false
 
 	err := db.
 		Select(`id, location, item_name, enabled, profile, launch_string, description, company, signer, version_number, file_path, file_name, file_directory, time, sha256, md5`).
-		From("current_autoruns").
+		From(SQL_AUTORUN_HISTORY+" AS h").
 		Where("instance = $1", instance).
 		OrderBy("location, item_name").
 		QueryStructs(&data)
@@ -240,34 +264,47 @@ func exportSingleHostAutoruns(c *gin.Context, instance int64, host string) {
 
 	buffer := generateSingleHostAutorunsCsv(host, data)
 
+	writeAudit(c, AUDIT_SINGLE_HOST_DOWNLOAD, AUDIT_TARGET_INSTANCE, convertInt64ToString(instance), host)
+
 	c.Header("Content-Type", "application/octet-stream")
 	c.Header("Content-Disposition", "attachment; filename="+host+".csv")
 	c.Data(http.StatusOK, "application/octet-stream", buffer)
 }
 
+// The CSV columns of an autorun, which are shared by the single host and baseline exports
+var AUTORUN_CSV_HEADER = []string{"LOCATION", "NAME", "ENABLED", "PROFILE", "LAUNCH_STRING", "DESCRIPTION", "COMPANY", "SIGNER", "VERSION", "PATH", "TIMESTAMP", "SHA256", "MD5"}
+
 // generateSingleHostAutorunsCsv returns the CSV content as a byte slice
 func generateSingleHostAutorunsCsv(host string, autoruns []*Autorun) []byte {
 
 	buffer := new(bytes.Buffer)
 	cw := csv.NewWriter(buffer)
-	cw.Write([]string{"LOCATION", "NAME", "ENABLED", "PROFILE", "LAUNCH_STRING", "DESCRIPTION", "COMPANY", "SIGNER", "VERSION", "PATH", "TIMESTAMP", "SHA256", "MD5"})
+	cw.Write(AUTORUN_CSV_HEADER)
 
 	for _, a := range autoruns {
-		cw.Write([]string{
-			a.Location,
-			a.ItemName,
-			strconv.FormatBool(a.Enabled),
-			a.Profile,
-			a.LaunchString,
-			a.Description,
-			a.Company,
-			a.Signer,
-			a.VersionNumber,
-			a.FilePath,
-			a.Time.String(),
-			a.Sha256,
-			a.Md5})
+		cw.Write(autorunCsvRecord(a))
 	}
 
+	cw.Flush()
+
 	return buffer.Bytes()
 }
+
+// autorunCsvRecord returns the CSV columns of an autorun, in the order of AUTORUN_CSV_HEADER
+func autorunCsvRecord(a *Autorun) []string {
+
+	return []string{
+		a.Location,
+		a.ItemName,
+		strconv.FormatBool(a.Enabled),
+		a.Profile,
+		a.LaunchString,
+		a.Description,
+		a.Company,
+		a.Signer,
+		a.VersionNumber,
+		a.FilePath,
+		a.Time.String(),
+		a.Sha256,
+		a.Md5}
+}
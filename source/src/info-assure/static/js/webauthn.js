@@ -0,0 +1,83 @@
+// Helpers for the WebAuthn (security key) ceremonies. The options are requested
+// from the server as JSON, then the authenticator's response is placed into the
+// hidden inputs of the HTML form, which is submitted as normal
+
+function webauthnDecode(value) {
+    var data = atob(value.replace(/-/g, "+").replace(/_/g, "/"));
+    var bytes = new Uint8Array(data.length);
+    for (var i = 0; i < data.length; i++) {
+        bytes[i] = data.charCodeAt(i);
+    }
+    return bytes.buffer;
+}
+
+function webauthnEncode(buffer) {
+    var bytes = new Uint8Array(buffer);
+    var data = "";
+    for (var i = 0; i < bytes.length; i++) {
+        data += String.fromCharCode(bytes[i]);
+    }
+    return btoa(data).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function webauthnError(xhr) {
+    if (xhr && xhr.responseJSON && xhr.responseJSON.error) {
+        alert(xhr.responseJSON.error.message);
+    } else {
+        alert("Unable to contact the server");
+    }
+}
+
+// Registers a new security key using the options returned from beginUrl
+function webauthnRegister(beginUrl, $form) {
+
+    if (!window.PublicKeyCredential) {
+        alert("Security keys are not supported by this browser");
+        return;
+    }
+
+    $.post(beginUrl, function (options) {
+
+        options.publicKey.challenge = webauthnDecode(options.publicKey.challenge);
+        options.publicKey.user.id = webauthnDecode(options.publicKey.user.id);
+        $.each(options.publicKey.excludeCredentials, function (i, c) {
+            c.id = webauthnDecode(c.id);
+        });
+
+        navigator.credentials.create(options).then(function (credential) {
+            $form.find("input[name=credential_id]").val(webauthnEncode(credential.rawId));
+            $form.find("input[name=client_data]").val(webauthnEncode(credential.response.clientDataJSON));
+            $form.find("input[name=attestation_object]").val(webauthnEncode(credential.response.attestationObject));
+            $form.submit();
+        }).catch(function (err) {
+            alert("Security key registration failed: " + err.message);
+        });
+    }, "json").fail(webauthnError);
+}
+
+// Verifies a registered security key using the options returned from beginUrl
+function webauthnAuthenticate(beginUrl, $form) {
+
+    if (!window.PublicKeyCredential) {
+        alert("Security keys are not supported by this browser");
+        return;
+    }
+
+    $.post(beginUrl, function (options) {
+
+        options.publicKey.challenge = webauthnDecode(options.publicKey.challenge);
+        $.each(options.publicKey.allowCredentials, function (i, c) {
+            c.id = webauthnDecode(c.id);
+        });
+
+        navigator.credentials.get(options).then(function (credential) {
+            $form.find("input[name=credential_id]").val(webauthnEncode(credential.rawId));
+            $form.find("input[name=client_data]").val(webauthnEncode(credential.response.clientDataJSON));
+            $form.find("input[name=authenticator_data]").val(webauthnEncode(credential.response.authenticatorData));
+            $form.find("input[name=signature]").val(webauthnEncode(credential.response.signature));
+            $form.submit();
+        }).catch(function (err) {
+            alert("Security key verification failed: " + err.message);
+        });
+    }, "json").fail(webauthnError);
+}
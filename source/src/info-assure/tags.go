@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+const TAG_MAX_LENGTH int = 50
+
+// Each tag once, using the earliest spelling of the tag
+const SQL_TAGS string = `SELECT MIN(tag)
+	   FROM host_tag
+   GROUP BY LOWER(tag)
+   ORDER BY LOWER(MIN(tag)) ASC`
+
+// ##### Methods ##############################################################
+
+// getTags returns the tags that have been applied to any host
+func getTags() ([]string, error) {
+
+	var data []string
+	err := db.SQL(SQL_TAGS).QuerySlice(&data)
+
+	return data, err
+}
+
+// getHostTags returns the tags of the host
+func getHostTags(host string) ([]string, error) {
+
+	var data []string
+	err := db.
+		Select("tag").
+		From("host_tag").
+		Where("LOWER(host) = LOWER($1)", host).
+		OrderBy("LOWER(tag)").
+		QuerySlice(&data)
+
+	return data, err
+}
+
+// processTags returns the tags from a comma separated list, removing duplicates (case insensitive)
+func processTags(data string) ([]string, error) {
+
+	var tags []string
+	seen := make(map[string]bool)
+
+	for _, t := range strings.Split(data, ",") {
+		t = strings.TrimSpace(t)
+		if len(t) == 0 || seen[strings.ToLower(t)] == true {
+			continue
+		}
+
+		if len(t) > TAG_MAX_LENGTH {
+			return nil, fmt.Errorf("Tags must not exceed %d characters", TAG_MAX_LENGTH)
+		}
+
+		seen[strings.ToLower(t)] = true
+		tags = append(tags, t)
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		return strings.ToLower(tags[i]) < strings.ToLower(tags[j])
+	})
+
+	return tags, nil
+}
+
+// setHostTags replaces the tags of the host
+func setHostTags(host string, tags []string, username string) error {
+
+	if len(host) == 0 {
+		return errors.New("Host must be supplied")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.AutoRollback()
+
+	_, err = tx.DeleteFrom("host_tag").Where("LOWER(host) = LOWER($1)", host).Exec()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, t := range tags {
+		_, err = tx.
+			InsertInto("host_tag").
+			Columns("host", "tag", "username", "timestamp_created").
+			Values(host, t, username, now).
+			Exec()
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ***** Routing Methods ******************************************************
+
+// routeHostTagsGet displays the tags of a host so that they can be edited
+func routeHostTagsGet(c *gin.Context) {
+
+	host := strings.TrimSpace(c.Query("host"))
+	if len(host) == 0 {
+		c.Redirect(http.StatusFound, "/hosts")
+		return
+	}
+
+	tags, err := getHostTags(host)
+	if err != nil {
+		log.Printf("Error loading host tags: %v (%s)\n", err, host)
+		goToErrorPage(c, "Unable to load tags")
+		return
+	}
+
+	loadHostTagsData(c, host, strings.Join(tags, ", "), "")
+}
+
+// routeHostTagsPost replaces the tags of a host. Any user can tag hosts
+func routeHostTagsPost(c *gin.Context) {
+
+	host := strings.TrimSpace(c.PostForm("host"))
+	if len(host) == 0 {
+		c.Redirect(http.StatusFound, "/hosts")
+		return
+	}
+
+	tags, err := processTags(c.PostForm("tags"))
+	if err != nil {
+		loadHostTagsData(c, host, c.PostForm("tags"), template.HTML(fmt.Sprintf(ALERT_YELLOW, err.Error())))
+		return
+	}
+
+	_, username := getAuditActor(c)
+	err = setHostTags(host, tags, username)
+	if err != nil {
+		log.Printf("Error setting host tags: %v (%s)\n", err, host)
+		loadHostTagsData(c, host, c.PostForm("tags"), template.HTML(fmt.Sprintf(ALERT_RED, "Unable to save tags")))
+		return
+	}
+
+	writeAudit(c, AUDIT_HOST_TAG, AUDIT_TARGET_HOST, host, strings.Join(tags, ", "))
+
+	c.Redirect(http.StatusFound, "/hosts?host="+url.QueryEscape(host))
+}
+
+// loadHostTagsData renders the host tags form with an optional message
+func loadHostTagsData(c *gin.Context, host string, tags string, message template.HTML) {
+
+	all, err := getTags()
+	if err != nil {
+		log.Printf("Error loading tags: %v\n", err)
+		goToErrorPage(c, "Unable to load tags")
+		return
+	}
+
+	c.HTML(http.StatusOK, "host_tags", getTemplateData(c, gin.H{"host": host, "tags": tags, "all_tags": all, "message": message}))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+// The instances (collections) of a host. The autoruns of the previous instances are only
+// available whilst the analysis server retains them within previous_autoruns
+const SQL_HOST_INSTANCES string = `SELECT i.id, i.domain, i.host, i.timestamp,
+			(SELECT COUNT(*) FROM current_autoruns WHERE instance = i.id) +
+			(SELECT COUNT(*) FROM previous_autoruns WHERE instance = i.id) AS autorun_count,
+			(SELECT COUNT(*) FROM alert WHERE alert.instance = i.id) AS alert_count,
+			i.id = (SELECT id FROM instance WHERE LOWER(host) = LOWER($1) ORDER BY timestamp DESC, id DESC LIMIT 1) AS current,
+			%s
+	   FROM instance i
+	  WHERE LOWER(i.host) = LOWER($1) AND %s
+   ORDER BY %s
+	  %s`
+
+// ##### Structs ##############################################################
+
+// Represents an instance (collection) within a host's timeline
+type HostInstance struct {
+	Id           int64     `db:"id" json:"id"`
+	Domain       string    `db:"domain" json:"domain"`
+	Host         string    `db:"host" json:"host"`
+	Timestamp    time.Time `db:"timestamp" json:"timestamp"`
+	TimestampStr string    `db:"-" json:"-"`
+	AutorunCount int64     `db:"autorun_count" json:"autorun_count"`
+	AlertCount   int64     `db:"alert_count" json:"alert_count"`
+	Current      bool      `db:"current" json:"current"` // The newest instance, whose autoruns are the current autoruns
+	SortKey      string    `db:"sort_key" json:"-"`
+}
+
+// ##### Methods ##############################################################
+
+// getHostInstances returns a page of the host's instances, newest first, and sets the total and cursors of the page
+func getHostInstances(host string, paging *Paging) (bool, []*HostInstance) {
+
+	var data []*HostInstance
+
+	args := []interface{}{host}
+
+	total, exact, err := countRecords("SELECT 1 FROM instance i WHERE LOWER(i.host) = LOWER($1)", args)
+	if err != nil {
+		logger.Errorf("Error counting host instances: %v (%s)", err, host)
+		return true, data
+	}
+	paging.setTotal(total, exact)
+
+	keyset := &Keyset{Columns: []string{"i.timestamp", "i.id"}, Descending: true}
+	cursor, orderBy, limit, args, err := keyset.page(paging, args)
+	if err != nil {
+		logger.Errorf("Error reading host instances cursor: %v (%s)", err, host)
+		return true, data
+	}
+
+	err = db.SQL(fmt.Sprintf(SQL_HOST_INSTANCES, keyset.selectKey(), cursor, orderBy, limit), args...).QueryStructs(&data)
+	if err != nil {
+		logger.Errorf("Error querying for host instances: %v (%s)", err, host)
+		return true, data
+	}
+
+	data = data[:paging.trim(data, func(i int) string { return data[i].SortKey })]
+
+	for _, i := range data {
+		i.TimestampStr = i.Timestamp.Format("15:04:05 02/01/2006")
+	}
+
+	return false, data
+}
+
+// ***** Routing Methods ******************************************************
+
+// routeTimeline lists the instances (collections) of a host, so that its autoruns can be viewed as they were at any instance
+func routeTimeline(c *gin.Context) {
+
+	host := c.Query("host")
+	if len(host) == 0 {
+		c.Redirect(http.StatusFound, "/hosts")
+		return
+	}
+
+	paging := processPaging(c.Query)
+
+	errored, data := getHostInstances(host, paging)
+	if errored == true {
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+
+	c.HTML(http.StatusOK, "timeline", getTemplateData(c, gin.H{
+		"host":              host,
+		"current_page_num":  paging.Number,
+		"num_recs_per_page": paging.Size,
+		"paging":            paging,
+		"data":              data,
+	}))
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+const API_TOKEN_PREFIX string = "arl_"
+const API_TOKEN_LENGTH int = 40
+
+// ##### Structs ##############################################################
+
+// Represents an "api_token" record. Only the SHA256 hash of the token is stored
+type ApiToken struct {
+	ID                int64      `db:"id"`
+	UserID            int64      `db:"user_id"`
+	Name              string     `db:"name"`
+	TokenHash         string     `db:"token_hash"`
+	TokenPrefix       string     `db:"token_prefix"`
+	Scope             int16      `db:"scope"`
+	ScopeString       string     `db:"-"`
+	TimestampCreated  time.Time  `db:"timestamp_created"`
+	TimestampExpires  *time.Time `db:"timestamp_expires"`
+	TimestampLastUsed *time.Time `db:"timestamp_last_used"`
+	CreatedString     string     `db:"-"`
+	ExpiresString     string     `db:"-"`
+	LastUsedString    string     `db:"-"`
+	Expired           bool       `db:"-"`
+}
+
+// ##### Methods ##############################################################
+
+// hashApiToken returns the hex encoded SHA256 hash of an API token. The tokens
+// are long and random, so a fast unsalted hash is sufficient
+func hashApiToken(token string) string {
+
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// NewApiTokenByToken returns the stored record matching the plain text token
+func NewApiTokenByToken(token string) (*ApiToken, error) {
+
+	t := new(ApiToken)
+	err := db.
+		Select("*").
+		From("api_token").
+		Where("token_hash = $1", hashApiToken(token)).
+		QueryStruct(t)
+
+	if err == sql.ErrNoRows {
+		return t, errors.New("Token does not exist")
+	}
+	if err != nil {
+		return t, err
+	}
+
+	return t, nil
+}
+
+// getApiTokens returns all of the tokens owned by a user
+func getApiTokens(userID int64) ([]*ApiToken, error) {
+
+	var data []*ApiToken
+
+	err := db.
+		Select("*").
+		From("api_token").
+		Where("user_id = $1", userID).
+		OrderBy("timestamp_created DESC").
+		QueryStructs(&data)
+
+	for _, t := range data {
+		t.Beautify()
+	}
+
+	return data, err
+}
+
+// Add generates a new random token, stores its hash and returns the plain
+// text token, which is the only time that it is available
+func (t *ApiToken) Add() (string, error) {
+
+	token := API_TOKEN_PREFIX + generateRandomString(API_TOKEN_LENGTH)
+
+	t.TokenHash = hashApiToken(token)
+	t.TokenPrefix = token[:len(API_TOKEN_PREFIX)+6]
+
+	err := db.
+		InsertInto("api_token").
+		Columns("user_id", "name", "token_hash", "token_prefix", "scope", "timestamp_created", "timestamp_expires").
+		Values(t.UserID, t.Name, t.TokenHash, t.TokenPrefix, t.Scope, time.Now().UTC(), t.TimestampExpires).
+		Returning("*").
+		QueryStruct(t)
+
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Delete removes (revokes) a token. The user ID is included so that users can only revoke their own tokens
+func (t *ApiToken) Delete() error {
+
+	res, err := db.
+		DeleteFrom("api_token").
+		Where("id = $1 AND user_id = $2", t.ID, t.UserID).
+		Exec()
+
+	if err != nil {
+		return err
+	}
+
+	if res.RowsAffected == 0 {
+		return errors.New("Token does not exist")
+	}
+
+	return nil
+}
+
+// IsExpired returns true if the token has an expiry that has passed
+func (t *ApiToken) IsExpired() bool {
+
+	if t.TimestampExpires == nil {
+		return false
+	}
+
+	return time.Now().UTC().After(*t.TimestampExpires)
+}
+
+// UpdateLastUsed records when the token was last used
+func (t *ApiToken) UpdateLastUsed() {
+
+	_, err := db.
+		Update("api_token").
+		Set("timestamp_last_used", time.Now().UTC()).
+		Where("id = $1", t.ID).
+		Exec()
+
+	if err != nil {
+		log.Printf("Error updating token last used: %v\n", err)
+	}
+}
+
+//
+func (t *ApiToken) Beautify() {
+
+	t.ScopeString = TokenScope(t.Scope).String()
+	t.CreatedString = t.TimestampCreated.Format("15:04:05 02/01/2006")
+	t.ExpiresString = "Never"
+	if t.TimestampExpires != nil {
+		t.ExpiresString = t.TimestampExpires.Format("15:04:05 02/01/2006")
+	}
+	t.LastUsedString = "Never"
+	if t.TimestampLastUsed != nil {
+		t.LastUsedString = t.TimestampLastUsed.Format("15:04:05 02/01/2006")
+	}
+	t.Expired = t.IsExpired()
+}
+
+// getBearerToken returns the token from the "Authorization: Bearer" header, if present
+func getBearerToken(c *gin.Context) (string, bool) {
+
+	header := c.GetHeader("Authorization")
+	if len(header) < 7 || strings.EqualFold(header[:7], "Bearer ") == false {
+		return "", false
+	}
+
+	return strings.TrimSpace(header[7:]), true
+}
+
+// authorizeBearerToken validates the API token supplied with the request and
+// sets the user details into the context. The request is aborted on failure
+func authorizeBearerToken(c *gin.Context, token string) bool {
+
+	t, err := NewApiTokenByToken(token)
+	if err != nil {
+		abortApiRequest(c, http.StatusUnauthorized, "Invalid API token")
+		return false
+	}
+
+	if t.IsExpired() == true {
+		abortApiRequest(c, http.StatusUnauthorized, "API token expired")
+		return false
+	}
+
+	u, err := NewUserByID(t.UserID)
+	if err != nil {
+		log.Printf("Error loading user for API token: %v\n", err)
+		abortApiRequest(c, http.StatusUnauthorized, "Invalid API token")
+		return false
+	}
+
+	if u.Locked == true {
+		abortApiRequest(c, http.StatusUnauthorized, "Account locked")
+		return false
+	}
+
+	t.UpdateLastUsed()
+
+	c.Set("user_id", u.ID)
+	c.Set("username", u.Username)
+	c.Set("account_type", AccountType(u.AccountType).String())
+	c.Set("token_scope", TokenScope(t.Scope))
+	return true
+}
+
+// requireApiScope ensures that token authenticated requests have the scope
+// required for the end-point. Session authenticated requests are not restricted
+func requireApiScope(scope TokenScope) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		value, exists := c.Get("token_scope")
+		if exists == false {
+			c.Next()
+			return
+		}
+
+		if value.(TokenScope) < scope {
+			abortApiRequest(c, http.StatusForbidden, "API token does not have the "+scope.String()+" scope")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// DownloadAuthorizeMiddleware allows file downloads to be authorized with either
+// an API token or the normal session cookie
+func DownloadAuthorizeMiddleware() gin.HandlerFunc {
+
+	sessionMiddleware := AuthorizeMiddleware()
+
+	return func(c *gin.Context) {
+
+		token, exists := getBearerToken(c)
+		if exists == false {
+			sessionMiddleware(c)
+			return
+		}
+
+		if authorizeBearerToken(c, token) == false {
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ***** Routing Methods ******************************************************
+
+//
+func routeAccountGet(c *gin.Context) {
+
+	loadAccountData(c, "", "")
+}
+
+// loadAccountData renders the account page, with an optional message and newly created token
+func loadAccountData(c *gin.Context, message template.HTML, token string) {
+
+	userID := getCookieInt64Value(c, "user_id")
+	if userID == -1 {
+		log.Println("Error checking session: invalid user ID")
+		goToErrorPage(c, "Unable to load account")
+		return
+	}
+
+	u, err := NewUserByID(userID)
+	if err != nil {
+		log.Printf("Error loading user details: %v\n", err)
+		goToErrorPage(c, "Unable to load account")
+		return
+	}
+	u.Beautify()
+
+	tokens, err := getApiTokens(userID)
+	if err != nil {
+		log.Printf("Error loading API tokens: %v\n", err)
+		goToErrorPage(c, "Unable to load account")
+		return
+	}
+
+	recoveryCodes, err := getUnusedRecoveryCodeCount(userID)
+	if err != nil {
+		log.Printf("Error loading recovery code count: %v\n", err)
+		goToErrorPage(c, "Unable to load account")
+		return
+	}
+
+	keys, err := getWebauthnCredentials(userID)
+	if err != nil {
+		log.Printf("Error loading webauthn credentials: %v\n", err)
+		goToErrorPage(c, "Unable to load account")
+		return
+	}
+
+	c.HTML(http.StatusOK, "account", getTemplateData(c, gin.H{
+		"u":              u,
+		"tokens":         tokens,
+		"token":          token,
+		"recovery_codes": recoveryCodes,
+		"webauthn":       webauthnRP != nil,
+		"keys":           keys,
+		"message":        message,
+	}))
+}
+
+//
+func routeAccountTokenNewPost(c *gin.Context) {
+
+	userID := getCookieInt64Value(c, "user_id")
+	if userID == -1 {
+		log.Println("Error checking session: invalid user ID")
+		goToErrorPage(c, "Unable to create token")
+		return
+	}
+
+	t := new(ApiToken)
+	t.UserID = userID
+	t.Name = strings.TrimSpace(c.PostForm("name"))
+	t.Scope = convertStringToInt16(c.PostForm("scope"))
+
+	if len(t.Name) == 0 || len(t.Name) > 50 {
+		loadAccountData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Token name must be between 1 and 50 characters")), "")
+		return
+	}
+
+	if TokenScope(t.Scope) != TOKEN_SCOPE_READ && TokenScope(t.Scope) != TOKEN_SCOPE_CLASSIFY {
+		loadAccountData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid token scope")), "")
+		return
+	}
+
+	expiryDays, successful := processIntParameter(c.PostForm("expiry_days"))
+	if successful == true && expiryDays > 0 {
+		expires := time.Now().UTC().AddDate(0, 0, expiryDays)
+		t.TimestampExpires = &expires
+	}
+
+	token, err := t.Add()
+	if err != nil {
+		log.Printf("Error adding API token: %v\n", err)
+		goToErrorPage(c, "Unable to create token")
+		return
+	}
+
+	writeAudit(c, AUDIT_API_TOKEN_CREATE, AUDIT_TARGET_API_TOKEN, convertInt64ToString(t.ID), fmt.Sprintf("%s (Scope: %s)", t.Name, TokenScope(t.Scope)))
+
+	loadAccountData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Token created. Copy the token now, it will not be shown again")), token)
+}
+
+//
+func routeAccountTokenRevokePost(c *gin.Context) {
+
+	userID := getCookieInt64Value(c, "user_id")
+	if userID == -1 {
+		log.Println("Error checking session: invalid user ID")
+		goToErrorPage(c, "Unable to revoke token")
+		return
+	}
+
+	id, successful := processInt64Parameter(c.Param("id"))
+	if successful == false {
+		loadAccountData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid token")), "")
+		return
+	}
+
+	t := &ApiToken{ID: id, UserID: userID}
+	err := t.Delete()
+	if err != nil {
+		log.Printf("Error revoking API token: %v\n", err)
+		loadAccountData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Unable to revoke token")), "")
+		return
+	}
+
+	writeAudit(c, AUDIT_API_TOKEN_REVOKE, AUDIT_TARGET_API_TOKEN, convertInt64ToString(id), "")
+
+	loadAccountData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Token revoked")), "")
+}
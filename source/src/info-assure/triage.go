@@ -0,0 +1,467 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/mgutz/dat.v1/sqlx-runner"
+)
+
+// ##### Constants ############################################################
+
+const SQL_ALERT string = `SELECT alert.*, COALESCE(alert_state.state, 0) AS state, COALESCE(assignee.username, '') AS assigned_to,
+			COALESCE(alert_state.assigned_user_id, 0) AS assigned_user_id
+	   FROM alert
+  LEFT JOIN alert_state ON (alert_state.alert_id = alert.id)
+  LEFT JOIN users AS assignee ON (assignee.id = alert_state.assigned_user_id)
+      WHERE alert.id = $1`
+
+const SQL_ALERT_CLASSIFICATION string = `SELECT COALESCE(users.username, 'Rule: ' || classification_rule.name, '') AS classified_by,
+			classification.timestamp AS classified, classification.disposition, classification.reason
+	   FROM classification
+  LEFT JOIN users ON (users.id = classification.user_id)
+  LEFT JOIN classification_rule ON (classification_rule.id = classification.rule_id)
+      WHERE classification.alert_id = $1`
+
+const SQL_ALERT_STATE_UPSERT string = `INSERT INTO alert_state (alert_id, state, user_id, timestamp_updated)
+	 VALUES ($1, $2, $3, $4)
+ON CONFLICT (alert_id) DO UPDATE
+		SET state = EXCLUDED.state, user_id = EXCLUDED.user_id, timestamp_updated = EXCLUDED.timestamp_updated`
+
+const SQL_ALERT_ASSIGN_UPSERT string = `INSERT INTO alert_state (alert_id, state, assigned_user_id, user_id, timestamp_updated)
+	 VALUES ($1, 0, $2, $3, $4)
+ON CONFLICT (alert_id) DO UPDATE
+		SET assigned_user_id = EXCLUDED.assigned_user_id, user_id = EXCLUDED.user_id, timestamp_updated = EXCLUDED.timestamp_updated`
+
+const ALERT_COMMENT_MAX_LENGTH int = 4000
+
+// ##### Structs ##############################################################
+
+// Represents the "classification" of a single alert
+type AlertClassification struct {
+	ClassifiedBy      string    `db:"classified_by" json:"classified_by"`
+	Classified        time.Time `db:"classified" json:"classified"`
+	ClassifiedString  string    `db:"-" json:"-"`
+	Disposition       int16     `db:"disposition" json:"disposition"`
+	DispositionString string    `db:"-" json:"-"`
+	Reason            string    `db:"reason" json:"reason"`
+}
+
+// Represents an "alert_comment" record. Comments are threaded using the parent ID
+type AlertComment struct {
+	ID               int64           `db:"id" json:"id"`
+	AlertID          int64           `db:"alert_id" json:"alert_id"`
+	ParentID         *int64          `db:"parent_id" json:"parent_id"`
+	UserID           *int64          `db:"user_id" json:"user_id"`
+	Username         string          `db:"username" json:"username"`
+	Comment          string          `db:"comment" json:"comment"`
+	TimestampCreated time.Time       `db:"timestamp_created" json:"timestamp_created"`
+	CreatedString    string          `db:"-" json:"-"`
+	Replies          []*AlertComment `db:"-" json:"replies"`
+}
+
+// ##### Methods ##############################################################
+
+// getAlert returns a single alert, including its triage state and assignee
+func getAlert(id int64) (*Alert, error) {
+
+	a := new(Alert)
+	err := db.SQL(SQL_ALERT, id).QueryStruct(a)
+	if err != nil {
+		return nil, err
+	}
+
+	a.UtcTimeStr = a.UtcTime.Format("15:04:05 02/01/2006")
+	a.TimeStr = a.Time.Format("15:04:05 02/01/2006")
+	a.TextStr = template.HTML(a.Text)
+	a.LinkedStr = template.HTML(a.Linked)
+	a.StateString = AlertState(a.State).String()
+
+	return a, nil
+}
+
+// getAlertClassification returns the alert's classification, or nil if the alert is still open
+func getAlertClassification(id int64) (*AlertClassification, error) {
+
+	ac := new(AlertClassification)
+	err := db.SQL(SQL_ALERT_CLASSIFICATION, id).QueryStruct(ac)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ac.ClassifiedString = ac.Classified.Format("15:04:05 02/01/2006")
+	ac.DispositionString = AlertState(ac.Disposition).String()
+
+	return ac, nil
+}
+
+// getAlertComments returns the alert's comments as a tree, with the replies beneath their parent
+func getAlertComments(id int64) ([]*AlertComment, error) {
+
+	var data []*AlertComment
+
+	err := db.
+		Select("*").
+		From("alert_comment").
+		Where("alert_id = $1", id).
+		OrderBy("timestamp_created ASC, id ASC").
+		QueryStructs(&data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	comments := make(map[int64]*AlertComment)
+	for _, ac := range data {
+		ac.CreatedString = ac.TimestampCreated.Format("15:04:05 02/01/2006")
+		comments[ac.ID] = ac
+	}
+
+	var roots []*AlertComment
+	for _, ac := range data {
+		if ac.ParentID != nil {
+			if parent, exists := comments[*ac.ParentID]; exists == true {
+				parent.Replies = append(parent.Replies, ac)
+				continue
+			}
+		}
+
+		roots = append(roots, ac)
+	}
+
+	return roots, nil
+}
+
+// setAlertState records the open (new or investigating) state of an alert
+func setAlertState(conn runner.Connection, alertID int64, state AlertState, userID int64) error {
+
+	_, err := conn.SQL(SQL_ALERT_STATE_UPSERT, alertID, int16(state), userID, time.Now().UTC()).Exec()
+	return err
+}
+
+// setAlertAssignee assigns an alert to a user, or unassigns it when the assignee is nil
+func setAlertAssignee(conn runner.Connection, alertID int64, assignee *int64, userID int64) error {
+
+	_, err := conn.SQL(SQL_ALERT_ASSIGN_UPSERT, alertID, assignee, userID, time.Now().UTC()).Exec()
+	return err
+}
+
+// reopenAlert removes any classification from the alert and sets its open state. The
+// audit record is written within the same transaction as the change
+func reopenAlert(c *gin.Context, userID int64, alertID int64, state AlertState) error {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.AutoRollback()
+
+	_, err = tx.
+		DeleteFrom("classification").
+		Where("alert_id = $1", alertID).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	err = setAlertState(tx, alertID, state, userID)
+	if err != nil {
+		return err
+	}
+
+	_, username := getAuditActor(c)
+	err = insertAuditEntry(tx, c, userID, username, AUDIT_ALERT_STATE, AUDIT_TARGET_ALERT, convertInt64ToString(alertID), state.String())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// alertCommentExists returns true if the comment exists and belongs to the alert
+func alertCommentExists(alertID int64, commentID int64) (bool, error) {
+
+	var count int64
+	err := db.
+		Select("COUNT(*)").
+		From("alert_comment").
+		Where("id = $1 AND alert_id = $2", commentID, alertID).
+		QueryScalar(&count)
+
+	return count > 0, err
+}
+
+// ***** Routing Methods ******************************************************
+
+//
+func routeAlertGet(c *gin.Context) {
+
+	id, successful := processInt64Parameter(c.Param("id"))
+	if successful == false {
+		goToErrorPage(c, "Invalid alert")
+		return
+	}
+
+	loadAlertPage(c, id, "")
+}
+
+// loadAlertPage renders the alert's details, triage state and comments with an optional message
+func loadAlertPage(c *gin.Context, id int64, message template.HTML) {
+
+	a, err := getAlert(id)
+	if err == sql.ErrNoRows {
+		goToErrorPage(c, "Alert does not exist")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading alert: %v (%d)\n", err, id)
+		goToErrorPage(c, "Unable to load alert")
+		return
+	}
+
+	classification, err := getAlertClassification(id)
+	if err != nil {
+		log.Printf("Error loading alert classification: %v (%d)\n", err, id)
+		goToErrorPage(c, "Unable to load alert")
+		return
+	}
+
+	// A classified alert is closed, so its disposition is the current state
+	state := AlertState(a.State)
+	if classification != nil {
+		state = AlertState(classification.Disposition)
+	}
+
+	comments, err := getAlertComments(id)
+	if err != nil {
+		log.Printf("Error loading alert comments: %v (%d)\n", err, id)
+		goToErrorPage(c, "Unable to load alert")
+		return
+	}
+
+	users, err := getUsers()
+	if err != nil {
+		log.Printf("Error loading users for alert: %v\n", err)
+		goToErrorPage(c, "Unable to load alert")
+		return
+	}
+
+	// The autorun's history is shown if available, but is not required to triage the alert
+	current := a.Autorun()
+	historyErrored := false
+
+	var changes []*AutorunChange
+	var previousInstance *Instance
+	previous, err := getPreviousAutorun(a.Host, a.Location, a.ItemName, a.Profile, a.Instance)
+	if err != nil {
+		log.Printf("Error loading previous autorun for alert: %v (%d)\n", err, id)
+		historyErrored = true
+	} else if previous != nil {
+		changes = diffAutoruns(previous, current)
+
+		previousInstance, err = getInstance(previous.Instance)
+		if err != nil {
+			log.Printf("Error loading previous instance for alert: %v (%d)\n", err, id)
+			historyErrored = true
+		}
+	}
+
+	otherHosts, err := getAutorunOtherHosts(current, a.Host)
+	if err != nil {
+		log.Printf("Error loading other hosts for alert: %v (%d)\n", err, id)
+		historyErrored = true
+	}
+
+	c.HTML(http.StatusOK, "alert", getTemplateData(c, gin.H{
+		"alert":             a,
+		"state":             int16(state),
+		"state_string":      state.String(),
+		"classification":    classification,
+		"comments":          comments,
+		"users":             users,
+		"previous":          previous,
+		"previous_instance": previousInstance,
+		"changes":           changes,
+		"other_hosts":       otherHosts,
+		"other_hosts_max":   OTHER_HOSTS_MAX,
+		"history_errored":   historyErrored,
+		"message":           message,
+	}))
+}
+
+// loadAlertForAction returns the ID of the alert referenced by the ID parameter, ensuring that it exists
+func loadAlertForAction(c *gin.Context) (int64, bool) {
+
+	id, successful := processInt64Parameter(c.Param("id"))
+	if successful == false {
+		goToErrorPage(c, "Invalid alert")
+		return 0, false
+	}
+
+	_, err := getAlert(id)
+	if err == sql.ErrNoRows {
+		goToErrorPage(c, "Alert does not exist")
+		return 0, false
+	}
+	if err != nil {
+		log.Printf("Error loading alert: %v (%d)\n", err, id)
+		goToErrorPage(c, "Unable to load alert")
+		return 0, false
+	}
+
+	return id, true
+}
+
+//
+func routeAlertStatePost(c *gin.Context) {
+
+	id, successful := loadAlertForAction(c)
+	if successful == false {
+		return
+	}
+
+	userID := getCookieInt64Value(c, "user_id")
+	if userID == -1 {
+		log.Println("Error retrieving user: invalid user ID")
+		goToErrorPage(c, "Unable to change alert state")
+		return
+	}
+
+	st, successful := processIntParameter(c.PostForm("state"))
+	if successful == false || st < int(ALERT_STATE_NEW) || st > int(ALERT_STATE_FALSE_POSITIVE) {
+		loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid state")))
+		return
+	}
+
+	state := AlertState(st)
+	reason := strings.TrimSpace(c.PostForm("reason"))
+
+	// Dispositions close the alert by classifying it, whereas the open states reopen it
+	if state.IsDisposition() == true {
+		message := performAlertClassification(c, userID, convertInt64ToString(id), false, state, reason)
+		if len(message) > 0 {
+			loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_RED, message)))
+			return
+		}
+
+		loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_GREEN, "Alert classified as "+state.String())))
+		return
+	}
+
+	err := reopenAlert(c, userID, id, state)
+	if err != nil {
+		log.Printf("Error changing alert state: %v (%d)\n", err, id)
+		loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to change alert state")))
+		return
+	}
+
+	loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_GREEN, "Alert state changed to "+state.String())))
+}
+
+//
+func routeAlertAssignPost(c *gin.Context) {
+
+	id, successful := loadAlertForAction(c)
+	if successful == false {
+		return
+	}
+
+	assigneeID, successful := processInt64Parameter(c.PostForm("user_id"))
+	if successful == false || assigneeID < ALERT_ASSIGNEE_NONE {
+		loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid user")))
+		return
+	}
+
+	var assignee *int64
+	details := "Unassigned"
+	if assigneeID != ALERT_ASSIGNEE_NONE {
+		u, err := NewUserByID(assigneeID)
+		if err != nil {
+			log.Printf("Error loading user for alert assignment: %v\n", err)
+			loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_YELLOW, "User does not exist")))
+			return
+		}
+
+		assignee = &u.ID
+		details = u.Username
+	}
+
+	err := setAlertAssignee(db, id, assignee, getCookieInt64Value(c, "user_id"))
+	if err != nil {
+		log.Printf("Error assigning alert: %v (%d)\n", err, id)
+		loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to assign alert")))
+		return
+	}
+
+	writeAudit(c, AUDIT_ALERT_ASSIGN, AUDIT_TARGET_ALERT, convertInt64ToString(id), details)
+
+	loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_GREEN, "Alert assignment updated")))
+}
+
+//
+func routeAlertCommentPost(c *gin.Context) {
+
+	id, successful := loadAlertForAction(c)
+	if successful == false {
+		return
+	}
+
+	comment := strings.TrimSpace(c.PostForm("comment"))
+	if len(comment) == 0 {
+		loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Comment must be supplied")))
+		return
+	}
+
+	if len(comment) > ALERT_COMMENT_MAX_LENGTH {
+		loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_YELLOW, fmt.Sprintf("Comment must not exceed %d characters", ALERT_COMMENT_MAX_LENGTH))))
+		return
+	}
+
+	// Replies must be to a comment on the same alert
+	var parentID *int64
+	if len(c.PostForm("parent_id")) > 0 {
+		pid, successful := processInt64Parameter(c.PostForm("parent_id"))
+		if successful == false {
+			loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid comment")))
+			return
+		}
+
+		exists, err := alertCommentExists(id, pid)
+		if err != nil || exists == false {
+			log.Printf("Error validating parent comment: %v (%d)\n", err, pid)
+			loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Comment does not exist")))
+			return
+		}
+
+		parentID = &pid
+	}
+
+	userID, username := getAuditActor(c)
+
+	var commentID int64
+	err := db.
+		InsertInto("alert_comment").
+		Columns("alert_id", "parent_id", "user_id", "username", "comment", "timestamp_created").
+		Values(id, parentID, userID, username, comment, time.Now().UTC()).
+		Returning("id").
+		QueryScalar(&commentID)
+
+	if err != nil {
+		log.Printf("Error inserting alert comment: %v (%d)\n", err, id)
+		loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to add comment")))
+		return
+	}
+
+	writeAudit(c, AUDIT_ALERT_COMMENT, AUDIT_TARGET_ALERT, convertInt64ToString(id), "Comment: "+convertInt64ToString(commentID))
+
+	loadAlertPage(c, id, template.HTML(fmt.Sprintf(ALERT_GREEN, "Comment added")))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base32"
 	"errors"
@@ -8,10 +9,14 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/dgryski/dgoogauth"
 	"github.com/gin-gonic/gin"
+	util "github.com/woanware/goutil"
 )
 
 //
@@ -30,6 +35,10 @@ type User struct {
 	Locked                 bool      `db:"is_locked"`
 	MfaSecret              string    `db:"mfa_secret"`
 	MfaSet                 bool      `db:"is_mfa_set"`
+	AuthProvider           string    `db:"auth_provider"`
+	ExternalID             string    `db:"external_id"`
+	MfaLastCounter         int64     `db:"mfa_last_counter"`
+	MustChangePassword     bool      `db:"must_change_password"`
 }
 
 //
@@ -72,6 +81,26 @@ func NewUserByID(id int64) (*User, error) {
 	return u, nil
 }
 
+//
+func NewUserByExternalID(provider string, externalID string) (*User, error) {
+
+	u := new(User)
+	err := db.
+		Select("*").
+		From("users").
+		Where("auth_provider = $1 AND external_id = $2", provider, externalID).
+		QueryStruct(u)
+
+	if err == sql.ErrNoRows {
+		return u, errors.New("User does not exist")
+	}
+	if err != nil {
+		return u, err
+	}
+
+	return u, nil
+}
+
 //
 func (u *User) Add() error {
 
@@ -81,17 +110,18 @@ func (u *User) Add() error {
 		return err
 	}
 
-	// Generate random string for Google 2FA
-	random := generateRandomString(16)
-	// For Google Authenticator purpose: https://github.com/google/google-authenticator/wiki/Key-Uri-Format
-	secret := base32.StdEncoding.EncodeToString([]byte(random))
+	secret := generateMfaSecret()
 
 	u.PasswordHash = hash
 
+	if len(u.AuthProvider) == 0 {
+		u.AuthProvider = AUTH_PROVIDER_LOCAL
+	}
+
 	err = db.
 		InsertInto("users").
-		Columns("username", "name", "password_hash", "account_type", "timestamp_created", "login_attempts", "is_locked", "mfa_secret", "is_mfa_set").
-		Values(u.Username, u.Name, u.PasswordHash, u.AccountType, time.Now(), 0, false, secret, false).
+		Columns("username", "name", "password_hash", "account_type", "timestamp_created", "login_attempts", "is_locked", "mfa_secret", "is_mfa_set", "auth_provider", "external_id").
+		Values(u.Username, u.Name, u.PasswordHash, u.AccountType, time.Now(), 0, false, secret, false, u.AuthProvider, u.ExternalID).
 		Returning("*").
 		QueryStruct(u)
 
@@ -150,13 +180,64 @@ func (u *User) Delete() error {
 	return nil
 }
 
+// ResetMfa generates a new MFA secret and removes the recovery codes and security
+// keys, which forces the user to enroll again on their next logon
+func (u *User) ResetMfa() error {
+
+	secret := generateMfaSecret()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.AutoRollback()
+
+	_, err = tx.
+		Update("users").
+		Set("mfa_secret", secret).
+		Set("is_mfa_set", false).
+		Set("mfa_last_counter", 0).
+		Where("id = $1", u.ID).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.
+		DeleteFrom("mfa_recovery_code").
+		Where("user_id = $1", u.ID).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.
+		DeleteFrom("webauthn_credential").
+		Where("user_id = $1", u.ID).
+		Exec()
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	u.MfaSecret = secret
+	u.MfaSet = false
+	u.MfaLastCounter = 0
+	return deleteUserSessions(u.ID)
+}
+
 //
 func (u *User) Beautify() {
 
 	u.AccountTypeString = AccountType(u.AccountType).String()
 }
 
-//
+// SetPassword replaces the user's password, retaining the previous hash within
+// the password history so that recent passwords cannot be reused
 func (u *User) SetPassword(password string) bool {
 
 	hash, err := getPasswordHash(password)
@@ -165,17 +246,50 @@ func (u *User) SetPassword(password string) bool {
 		return false
 	}
 
-	_, err = db.
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error reseting user password: %v\n", err)
+		return false
+	}
+	defer tx.AutoRollback()
+
+	// The history holds the previous passwords, the current one making up the history count
+	retained := config.PasswordPolicy.HistoryCount - 1
+	if retained < 0 {
+		retained = 0
+	}
+
+	if retained > 0 {
+		_, err = tx.SQL(`INSERT INTO password_history (user_id, password_hash, timestamp_created)
+			SELECT id, password_hash, $2 FROM users WHERE id = $1 AND password_hash <> ''`, u.ID, time.Now().UTC()).Exec()
+		if err != nil {
+			log.Printf("Error updating password history: %v\n", err)
+			return false
+		}
+	}
+
+	_, err = tx.SQL(`DELETE FROM password_history WHERE user_id = $1 AND id NOT IN
+		(SELECT id FROM password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2)`, u.ID, retained).Exec()
+	if err != nil {
+		log.Printf("Error updating password history: %v\n", err)
+		return false
+	}
+
+	_, err = tx.
 		Update("users").
 		Set("password_hash", hash).
 		Where("id = $1", u.ID).
 		Exec()
 
 	if err != nil {
-		if strings.Contains(err.Error(), "no rows in result set") {
-			return true
+		if strings.Contains(err.Error(), "no rows in result set") == false {
+			log.Printf("Error reseting user password: %v\n", err)
+			return false
 		}
+	}
 
+	err = tx.Commit()
+	if err != nil {
 		log.Printf("Error reseting user password: %v\n", err)
 		return false
 	}
@@ -183,6 +297,31 @@ func (u *User) SetPassword(password string) bool {
 	return true
 }
 
+// IsPasswordReused returns true if the password matches one of the last HistoryCount passwords,
+// being the current password and the most recent passwords within the password history
+func (u *User) IsPasswordReused(password string) (bool, error) {
+
+	if config.PasswordPolicy.HistoryCount <= 0 {
+		return false, nil
+	}
+
+	var hashes []string
+	err := db.SQL(`SELECT password_hash FROM users WHERE id = $1
+		UNION ALL (SELECT password_hash FROM password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2)`,
+		u.ID, config.PasswordPolicy.HistoryCount-1).QuerySlice(&hashes)
+	if err != nil {
+		return false, err
+	}
+
+	for _, h := range hashes {
+		if checkPasswordHash(password, h) == nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 //
 func (u *User) Exists() (bool, error) {
 
@@ -221,8 +360,12 @@ func (u *User) Validate(ignoreCreds bool) error {
 			return errors.New("New password does not match verify password")
 		}
 
-		if len(u.Password) > 50 {
-			return errors.New("Password too long (Maximum 50)")
+		if utf8.RuneCountInString(u.Password) > PASSWORD_MAX_LENGTH {
+			return fmt.Errorf("Password too long (Maximum %d)", PASSWORD_MAX_LENGTH)
+		}
+
+		if len(u.Password) > PASSWORD_MAX_BYTES {
+			return fmt.Errorf("Password too long (Maximum %d bytes)", PASSWORD_MAX_BYTES)
 		}
 
 		// found, err := checkCommonPasswords(u.Password)
@@ -237,7 +380,7 @@ func (u *User) Validate(ignoreCreds bool) error {
 	return nil
 }
 
-//
+// ValidatePassword checks a new password against the configured password policy
 func (u *User) ValidatePassword() error {
 
 	// Ensure we have matching passwords
@@ -245,16 +388,36 @@ func (u *User) ValidatePassword() error {
 		return errors.New("New password does not match verify password")
 	}
 
-	if len(u.Password) > 50 {
-		return errors.New("Password too long (Maximum 50)")
+	if utf8.RuneCountInString(u.Password) < config.PasswordPolicy.MinLength {
+		return fmt.Errorf("Password too short (Minimum %d)", config.PasswordPolicy.MinLength)
 	}
 
-	found, err := checkCommonPasswords(u.Password)
+	if utf8.RuneCountInString(u.Password) > PASSWORD_MAX_LENGTH {
+		return fmt.Errorf("Password too long (Maximum %d)", PASSWORD_MAX_LENGTH)
+	}
+
+	if len(u.Password) > PASSWORD_MAX_BYTES {
+		return fmt.Errorf("Password too long (Maximum %d bytes)", PASSWORD_MAX_BYTES)
+	}
+
+	if config.PasswordPolicy.CheckCommonPasswords == true {
+		found, err := checkCommonPasswords(u.Password)
+		if err != nil {
+			log.Printf("Error checking common passwords: %v\n", err)
+			return errors.New("Unable to check password")
+		}
+		if found == true {
+			return errors.New("Password too common")
+		}
+	}
+
+	reused, err := u.IsPasswordReused(u.Password)
 	if err != nil {
+		log.Printf("Error checking password history: %v\n", err)
 		return errors.New("Unable to check password")
 	}
-	if found == true {
-		return errors.New("Password too common")
+	if reused == true {
+		return errors.New("Password has been used recently")
 	}
 
 	return nil
@@ -263,7 +426,7 @@ func (u *User) ValidatePassword() error {
 //
 func checkCommonPasswords(password string) (bool, error) {
 
-	row := db.DB.QueryRow("SELECT count(1) from common_passwords where password = $1", password)
+	row := db.DB.QueryRow("SELECT count(1) from common_passwords where password = $1 or password = lower($1)", password)
 	var count int
 	err := row.Scan(&count)
 
@@ -281,6 +444,56 @@ func checkCommonPasswords(password string) (bool, error) {
 	return false, nil
 }
 
+// initialiseCommonPasswords loads the list of common passwords (one per line) when the
+// common_passwords table is empty, so that the password policy has passwords to check
+// against. A table that has already been populated e.g. with a larger list, is left as is
+func initialiseCommonPasswords() {
+
+	if config.PasswordPolicy.CheckCommonPasswords == false {
+		return
+	}
+
+	var count int64
+	err := db.SQL("SELECT COUNT(*) FROM common_passwords").QueryScalar(&count)
+	if err != nil {
+		logger.Fatalf("Error counting common passwords: %v", err)
+	}
+
+	if count > 0 {
+		return
+	}
+
+	data, err := util.ReadTextFromFile(COMMON_PASSWORDS_FILE)
+	if err != nil {
+		logger.Fatalf("Error reading the common passwords file: %v", err)
+	}
+
+	// Passwords are checked against their lower case value, and duplicates would break the primary key
+	passwords := make(map[string]bool)
+	for _, line := range strings.Split(data, "\n") {
+		password := strings.ToLower(strings.TrimSpace(line))
+		if len(password) > 0 {
+			passwords[password] = true
+		}
+	}
+
+	if len(passwords) == 0 {
+		logger.Fatalf("No common passwords within the common passwords file: %s", COMMON_PASSWORDS_FILE)
+	}
+
+	b := db.InsertInto("common_passwords").Columns("password")
+	for password := range passwords {
+		b.Values(password)
+	}
+
+	_, err = b.Exec()
+	if err != nil {
+		logger.Fatalf("Error inserting common passwords: %v", err)
+	}
+
+	logger.Infof("Loaded %d common passwords", len(passwords))
+}
+
 //
 func (u User) CheckPassword() error {
 
@@ -363,6 +576,12 @@ func (u *User) Lock() bool {
 		return false
 	}
 
+	// Locked users must not be able to continue using an existing session
+	err = deleteUserSessions(u.ID)
+	if err != nil {
+		log.Printf("Error deleting locked user sessions: %v\n", err)
+	}
+
 	u.Locked = true
 	return true
 }
@@ -386,6 +605,99 @@ func (u *User) Unlock() bool {
 	return true
 }
 
+// SetMustChangePassword sets whether the user must change their password on their next logon
+func (u *User) SetMustChangePassword(value bool) bool {
+
+	_, err := db.
+		Update("users").
+		Set("must_change_password", value).
+		Where("id = $1", u.ID).
+		Exec()
+
+	if err != nil {
+		log.Printf("Error setting user must change password: %v\n", err)
+		return false
+	}
+
+	u.MustChangePassword = value
+	return true
+}
+
+// IsLastAdmin returns true if the user is the only unlocked admin, in which case
+// they cannot be deleted, locked or changed to a standard user
+func (u *User) IsLastAdmin() (bool, error) {
+
+	if AccountType(u.AccountType) != ADMIN || u.Locked == true {
+		return false, nil
+	}
+
+	var count int64
+	err := db.
+		Select("COUNT(*)").
+		From("users").
+		Where("account_type = $1 AND is_locked = false AND id <> $2", int16(ADMIN), u.ID).
+		QueryScalar(&count)
+
+	if err != nil {
+		return false, err
+	}
+
+	return count == 0, nil
+}
+
+// generateMfaSecret returns a new base32 encoded secret for Google Authenticator
+func generateMfaSecret() string {
+
+	// For Google Authenticator purpose: https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+	return base32.StdEncoding.EncodeToString([]byte(generateRandomString(16)))
+}
+
+// VerifyMfaCode checks a TOTP code, allowing for one time step of clock drift either
+// side. The time step of an accepted code is recorded, so that a code cannot be
+// reused (including by a concurrent request) within its validity window
+func (u *User) VerifyMfaCode(code string) (bool, error) {
+
+	code = strings.TrimSpace(code)
+	if len(code) != 6 {
+		return false, nil
+	}
+
+	value, err := strconv.Atoi(code)
+	if err != nil {
+		return false, nil
+	}
+
+	secret := strings.TrimSpace(u.MfaSecret)
+	t0 := time.Now().Unix() / 30
+	for counter := t0 - 1; counter <= t0+1; counter++ {
+		if counter <= u.MfaLastCounter {
+			continue
+		}
+
+		if subtle.ConstantTimeEq(int32(dgoogauth.ComputeCode(secret, counter)), int32(value)) == 0 {
+			continue
+		}
+
+		res, err := db.
+			Update("users").
+			Set("mfa_last_counter", counter).
+			Where("id = $1 AND mfa_last_counter < $2", u.ID, counter).
+			Exec()
+		if err != nil {
+			return false, err
+		}
+
+		if res.RowsAffected == 0 {
+			return false, nil
+		}
+
+		u.MfaLastCounter = counter
+		return true, nil
+	}
+
+	return false, nil
+}
+
 // ***** Routing Methods ******************************************************
 
 //
@@ -397,7 +709,7 @@ func routeUserNewGet(c *gin.Context) {
 		return
 	}
 
-	c.HTML(http.StatusOK, "user", gin.H{"endpoint": "new", "title": "New User", "u": new(User)})
+	c.HTML(http.StatusOK, "user", getTemplateData(c, gin.H{"endpoint": "new", "title": "New User", "u": new(User)}))
 }
 
 //
@@ -423,15 +735,15 @@ func routeUserNewPost(c *gin.Context) {
 	}
 
 	if exists == true {
-		c.HTML(http.StatusOK, "user", gin.H{"endpoint": "new", "u": u,
-			"message": template.HTML(fmt.Sprintf(ALERT_YELLOW, "User already exists"))})
+		c.HTML(http.StatusOK, "user", getTemplateData(c, gin.H{"endpoint": "new", "u": u,
+			"message": template.HTML(fmt.Sprintf(ALERT_YELLOW, "User already exists"))}))
 		return
 	}
 
 	err = u.Validate(true)
 	if err != nil {
-		c.HTML(http.StatusOK, "user", gin.H{"endpoint": "new", "u": u,
-			"message": template.HTML(fmt.Sprintf(ALERT_YELLOW, err.Error()))})
+		c.HTML(http.StatusOK, "user", getTemplateData(c, gin.H{"endpoint": "new", "u": u,
+			"message": template.HTML(fmt.Sprintf(ALERT_YELLOW, err.Error()))}))
 		return
 	}
 
@@ -442,7 +754,7 @@ func routeUserNewPost(c *gin.Context) {
 		return
 	}
 
-	password := generateRandomString(8)
+	password := generateOneTimePassword()
 
 	if u.SetPassword(password) == false {
 		log.Printf("Error setting new user password: %v\n", err)
@@ -450,7 +762,14 @@ func routeUserNewPost(c *gin.Context) {
 		return
 	}
 
+	if u.SetMustChangePassword(true) == false {
+		goToErrorPage(c, "Unable to set user password")
+		return
+	}
+
+	writeAudit(c, AUDIT_USER_CREATE, AUDIT_TARGET_USER, convertInt64ToString(u.ID), fmt.Sprintf("%s (Name: %s, Account Type: %s)", u.Username, u.Name, AccountType(u.AccountType)))
+
 	u = new(User)
-	c.HTML(http.StatusOK, "user", gin.H{"endpoint": "new", "title": "New User", "u": u,
-		"message": template.HTML(fmt.Sprintf(ALERT_GREEN, "User added (Password: "+password+")"))})
+	c.HTML(http.StatusOK, "user", getTemplateData(c, gin.H{"endpoint": "new", "title": "New User", "u": u,
+		"message": template.HTML(fmt.Sprintf(ALERT_GREEN, "User added (Password: "+password+")"))}))
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePasswordLength(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		password string
+		valid    bool
+	}{
+		{"maximum characters", strings.Repeat("a", PASSWORD_MAX_LENGTH), true},
+		{"too many characters", strings.Repeat("a", PASSWORD_MAX_LENGTH+1), false},
+		{"multi-byte characters", strings.Repeat("é", PASSWORD_MAX_BYTES/2), true},
+		{"too many bytes", strings.Repeat("€", PASSWORD_MAX_BYTES/3+1), false},
+	}
+
+	for _, test := range tests {
+		u := &User{Username: TEST_USER_NAME, Password: test.password, PasswordVerify: test.password}
+
+		err := u.Validate(false)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: error %v, expected valid %v", test.name, err, test.valid)
+		}
+	}
+}
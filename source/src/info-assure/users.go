@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"html/template"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,6 +19,12 @@ func routeUsersGet(c *gin.Context) {
 		return
 	}
 
+	loadUsersData(c, "")
+}
+
+// loadUsersData renders the users page with an optional message
+func loadUsersData(c *gin.Context, message template.HTML) {
+
 	data, err := getUsers()
 	if err != nil {
 		log.Printf("Error loading users: %v\n", err)
@@ -23,5 +32,293 @@ func routeUsersGet(c *gin.Context) {
 		return
 	}
 
-	c.HTML(http.StatusOK, "users", gin.H{"users": data})
+	c.HTML(http.StatusOK, "users", getTemplateData(c, gin.H{"users": data, "message": message}))
+}
+
+//
+func routeUserMfaResetPost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	id, successful := processInt64Parameter(c.Param("id"))
+	if successful == false {
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid user")))
+		return
+	}
+
+	u, err := NewUserByID(id)
+	if err != nil {
+		log.Printf("Error loading user for MFA reset: %v\n", err)
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "User does not exist")))
+		return
+	}
+
+	err = u.ResetMfa()
+	if err != nil {
+		log.Printf("Error resetting user MFA: %v (%s)\n", err, u.Username)
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to reset MFA")))
+		return
+	}
+
+	log.Printf("MFA reset for user: %s\n", u.Username)
+	writeAudit(c, AUDIT_MFA_RESET, AUDIT_TARGET_USER, convertInt64ToString(u.ID), u.Username)
+	loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "MFA reset. The user will be required to enroll on their next logon")))
+}
+
+// loadUserForAction returns the user referenced by the ID parameter, rendering the users page with a message on failure
+func loadUserForAction(c *gin.Context) (*User, bool) {
+
+	id, successful := processInt64Parameter(c.Param("id"))
+	if successful == false {
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid user")))
+		return nil, false
+	}
+
+	u, err := NewUserByID(id)
+	if err != nil {
+		log.Printf("Error loading user: %v\n", err)
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "User does not exist")))
+		return nil, false
+	}
+
+	return u, true
+}
+
+// checkLastAdmin renders the users page with a message if the user is the last admin
+func checkLastAdmin(c *gin.Context, u *User, message string) bool {
+
+	lastAdmin, err := u.IsLastAdmin()
+	if err != nil {
+		log.Printf("Error checking last admin: %v\n", err)
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to check admin users")))
+		return true
+	}
+
+	if lastAdmin == true {
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, message)))
+		return true
+	}
+
+	return false
+}
+
+// routeUserGet displays the new user page or the page of an existing user. The router does not
+// allow /users/new alongside /users/:id, so both are routed here
+func routeUserGet(c *gin.Context) {
+
+	if c.Param("id") == "new" {
+		routeUserNewGet(c)
+		return
+	}
+
+	routeUserEditGet(c)
+}
+
+// routeUserPost creates a new user or updates an existing one
+func routeUserPost(c *gin.Context) {
+
+	if c.Param("id") == "new" {
+		routeUserNewPost(c)
+		return
+	}
+
+	routeUserEditPost(c)
+}
+
+//
+func routeUserEditGet(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	u, successful := loadUserForAction(c)
+	if successful == false {
+		return
+	}
+
+	c.HTML(http.StatusOK, "user", getTemplateData(c, gin.H{"endpoint": convertInt64ToString(u.ID), "title": "Edit User", "edit": true, "u": u}))
+}
+
+//
+func routeUserEditPost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	u, successful := loadUserForAction(c)
+	if successful == false {
+		return
+	}
+
+	newAccountType := AccountType(convertStringToInt16(strings.TrimSpace(c.PostForm("account_type"))))
+	if newAccountType != USER && newAccountType != ADMIN {
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid account type")))
+		return
+	}
+
+	if newAccountType != ADMIN && checkLastAdmin(c, u, "The last admin cannot be changed to a user") == true {
+		return
+	}
+
+	accountTypeChanged := u.AccountType != int16(newAccountType)
+
+	u.Name = strings.TrimSpace(c.PostForm("name"))
+	u.AccountType = int16(newAccountType)
+
+	err := u.Update()
+	if err != nil {
+		log.Printf("Error updating user: %v\n", err)
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to update user")))
+		return
+	}
+
+	// The account type is held in the session, so end the user's sessions for the change to apply
+	if accountTypeChanged == true {
+		err = deleteUserSessions(u.ID)
+		if err != nil {
+			log.Printf("Error deleting user sessions after account type change: %v\n", err)
+		}
+	}
+
+	writeAudit(c, AUDIT_USER_EDIT, AUDIT_TARGET_USER, convertInt64ToString(u.ID), fmt.Sprintf("%s (Name: %s, Account Type: %s)", u.Username, u.Name, newAccountType))
+
+	loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "User updated")))
+}
+
+//
+func routeUserLockPost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	u, successful := loadUserForAction(c)
+	if successful == false {
+		return
+	}
+
+	if u.ID == getCookieInt64Value(c, "user_id") {
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "You cannot lock your own account")))
+		return
+	}
+
+	if checkLastAdmin(c, u, "The last admin cannot be locked") == true {
+		return
+	}
+
+	if u.Lock() == false {
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to lock user")))
+		return
+	}
+
+	writeAudit(c, AUDIT_USER_LOCK, AUDIT_TARGET_USER, convertInt64ToString(u.ID), u.Username)
+
+	loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "User locked")))
+}
+
+//
+func routeUserUnlockPost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	u, successful := loadUserForAction(c)
+	if successful == false {
+		return
+	}
+
+	if u.Unlock() == false {
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to unlock user")))
+		return
+	}
+
+	writeAudit(c, AUDIT_USER_UNLOCK, AUDIT_TARGET_USER, convertInt64ToString(u.ID), u.Username)
+
+	loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "User unlocked")))
+}
+
+//
+func routeUserDeletePost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	u, successful := loadUserForAction(c)
+	if successful == false {
+		return
+	}
+
+	if u.ID == getCookieInt64Value(c, "user_id") {
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "You cannot delete your own account")))
+		return
+	}
+
+	if checkLastAdmin(c, u, "The last admin cannot be deleted") == true {
+		return
+	}
+
+	err := u.Delete()
+	if err != nil {
+		log.Printf("Error deleting user: %v\n", err)
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to delete user")))
+		return
+	}
+
+	writeAudit(c, AUDIT_USER_DELETE, AUDIT_TARGET_USER, convertInt64ToString(u.ID), u.Username)
+
+	loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "User deleted")))
+}
+
+// routeUserResetPost sets a one-time password, which the user must change on their next logon
+func routeUserResetPost(c *gin.Context) {
+
+	accountType := getAccountType(c)
+	if accountType != ADMIN {
+		c.Redirect(http.StatusTemporaryRedirect, "/logout")
+		return
+	}
+
+	u, successful := loadUserForAction(c)
+	if successful == false {
+		return
+	}
+
+	if u.AuthProvider != AUTH_PROVIDER_LOCAL {
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "The password of an externally authenticated user cannot be reset")))
+		return
+	}
+
+	password := generateOneTimePassword()
+
+	if u.SetPassword(password) == false || u.SetMustChangePassword(true) == false {
+		loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_RED, "Unable to reset password")))
+		return
+	}
+
+	err := deleteUserSessions(u.ID)
+	if err != nil {
+		log.Printf("Error deleting user sessions after password reset: %v\n", err)
+	}
+
+	log.Printf("Password reset for user: %s\n", u.Username)
+	writeAudit(c, AUDIT_USER_PASSWORD_RESET, AUDIT_TARGET_USER, convertInt64ToString(u.ID), u.Username)
+	loadUsersData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Password reset for "+template.HTMLEscapeString(u.Username)+" (One-time password: "+password+")")))
 }
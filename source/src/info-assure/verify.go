@@ -1,18 +1,42 @@
 package main
 
 import (
+	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"strings"
 
-	"github.com/dgryski/dgoogauth"
 	"github.com/gin-gonic/gin"
+	gorilla "github.com/gorilla/sessions"
 )
 
 //
 func routeVerifyGet(c *gin.Context) {
 
-	c.HTML(http.StatusOK, "verify", gin.H{"code": ""})
+	u, err := NewUserByID(getCookieInt64Value(c, "user_id"))
+	if err != nil {
+		log.Printf("Error loading user details for verify: %v\n", err)
+		goToErrorPage(c, "Unable perform verify")
+		return
+	}
+
+	loadVerifyData(c, u, "")
+}
+
+// loadVerifyData renders the verify page, offering security keys if the user has registered any
+func loadVerifyData(c *gin.Context, u *User, message template.HTML) {
+
+	hasKeys := false
+	if webauthnRP != nil {
+		creds, err := getWebauthnCredentials(u.ID)
+		if err != nil {
+			log.Printf("Error loading webauthn credentials: %v\n", err)
+		}
+		hasKeys = len(creds) > 0
+	}
+
+	c.HTML(http.StatusOK, "verify", getTemplateData(c, gin.H{"code": "", "webauthn": hasKeys, "message": message}))
 }
 
 //
@@ -32,25 +56,79 @@ func routeVerifyPost(c *gin.Context) {
 		return
 	}
 
-	token := c.Request.FormValue("code")
-
-	// setup the one-time-password configuration.
-	otpConfig := &dgoogauth.OTPConfig{
-		Secret:      strings.TrimSpace(u.MfaSecret),
-		WindowSize:  3,
-		HotpCounter: 0,
+	if u.Locked == true {
+		log.Printf("Error user locked: %v\n", u.Username)
+		endLockedSession(c)
+		return
 	}
 
-	// Validate token
-	ok, err := otpConfig.Authenticate(strings.TrimSpace(token))
-	log.Println(token)
-	log.Println(ok)
-	log.Println(err)
+	// Verification codes are always 6 digits, so anything longer is a recovery code
+	code := strings.TrimSpace(c.Request.FormValue("code"))
+	method := MFA_METHOD_TOTP
+	var ok bool
+	if len(code) > 6 {
+		method = MFA_METHOD_RECOVERY_CODE
+		ok, err = useRecoveryCode(u.ID, code)
+		if ok == true {
+			log.Printf("Recovery code used: %v\n", u.Username)
+		}
+	} else {
+		ok, err = u.VerifyMfaCode(code)
+	}
+	if err != nil {
+		log.Printf("Error verifying MFA code: %v\n", err)
+		goToErrorPage(c, "Unable perform verify")
+		return
+	}
 
-	// if the token is invalid or expired
+	// Failed codes count towards the account lockout, the same as failed passwords
 	if ok == false {
-		c.HTML(http.StatusOK, "verify", gin.H{"code": ""})
-	} else {
-		c.Redirect(http.StatusFound, "/alerts")
+		log.Printf("Error invalid MFA code: %v\n", u.Username)
+
+		auditFailedAttempt(c, u, AUDIT_MFA_VERIFY_FAILURE, method)
+		if u.Locked == true {
+			endLockedSession(c)
+			return
+		}
+
+		loadVerifyData(c, u, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid verification code")))
+		return
 	}
+
+	completeVerify(c, u, method)
+}
+
+// completeVerify marks the session as having passed the second factor
+func completeVerify(c *gin.Context, u *User, method string) {
+
+	u.ResetLoginAttempts()
+	writeAuditFor(c, u.ID, u.Username, AUDIT_MFA_VERIFY_SUCCESS, AUDIT_TARGET_USER, convertInt64ToString(u.ID), method)
+
+	session, _ := sessionStore.Get(c.Request, APP_NAME)
+	session.Values["mfa_verified"] = true
+	err := session.Save(c.Request, c.Writer)
+	if err != nil {
+		log.Printf("Error saving user session (verify): %v\n", err)
+		goToErrorPage(c, "Unable perform verify")
+		return
+	}
+
+	c.Redirect(http.StatusFound, "/alerts")
+}
+
+// endLockedSession removes the partially authenticated session once the account is locked
+func endLockedSession(c *gin.Context) {
+
+	session, err := sessionStore.Get(c.Request, APP_NAME)
+	if err == nil {
+		session.Options = &gorilla.Options{MaxAge: -1}
+		session.Values["authed"] = false
+		session.Values["mfa_verified"] = false
+		err = session.Save(c.Request, c.Writer)
+		if err != nil {
+			log.Printf("Error ending locked session: %v\n", err)
+		}
+	}
+
+	renderLogon(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Account locked")))
 }
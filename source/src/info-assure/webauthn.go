@@ -0,0 +1,818 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ##### Constants ############################################################
+
+const WEBAUTHN_CHALLENGE_LENGTH int = 32
+const WEBAUTHN_TIMEOUT_MS int = 60000
+
+// COSE algorithm identifiers (RFC 8152)
+const (
+	COSE_ALG_ES256 int64 = -7
+	COSE_ALG_EDDSA int64 = -8
+	COSE_ALG_RS256 int64 = -257
+)
+
+// COSE key parameters
+const (
+	COSE_KEY_KTY   int64 = 1
+	COSE_KEY_ALG   int64 = 3
+	COSE_KEY_CRV   int64 = -1
+	COSE_KEY_X     int64 = -2
+	COSE_KEY_Y     int64 = -3
+	COSE_KTY_OKP   int64 = 1
+	COSE_KTY_EC2   int64 = 2
+	COSE_KTY_RSA   int64 = 3
+	COSE_CRV_P256  int64 = 1
+	COSE_CRV_ED255 int64 = 6
+)
+
+// Authenticator data flags
+const (
+	WEBAUTHN_FLAG_USER_PRESENT  byte = 0x01
+	WEBAUTHN_FLAG_USER_VERIFIED byte = 0x04
+	WEBAUTHN_FLAG_ATTESTED_DATA byte = 0x40
+	WEBAUTHN_FLAG_EXTENSIONS    byte = 0x80
+)
+
+// ##### Structs ##############################################################
+
+// Represents a "webauthn_credential" record i.e. a registered security key
+type WebauthnCredential struct {
+	ID                int64      `db:"id"`
+	UserID            int64      `db:"user_id"`
+	Name              string     `db:"name"`
+	CredentialID      string     `db:"credential_id"`
+	PublicKey         string     `db:"public_key"`
+	SignCount         int64      `db:"sign_count"`
+	TimestampCreated  time.Time  `db:"timestamp_created"`
+	TimestampLastUsed *time.Time `db:"timestamp_last_used"`
+	CreatedString     string     `db:"-"`
+	LastUsedString    string     `db:"-"`
+}
+
+// WebauthnRelyingParty verifies the registration and assertion ceremonies. The
+// methods operate on the raw ceremony data, so that they can be driven by a
+// software authenticator
+type WebauthnRelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+// Represents the client data collected by the browser
+type WebauthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// Represents the parsed authenticator data
+type WebauthnAuthenticatorData struct {
+	RpIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// ##### Variables ############################################################
+
+// webauthnRP is nil if security keys have not been configured
+var webauthnRP *WebauthnRelyingParty
+
+// ##### Methods ##############################################################
+
+// initialiseWebauthn enables security keys if a relying party ID has been configured
+func initialiseWebauthn() {
+
+	if len(config.Webauthn.RpID) == 0 {
+		return
+	}
+
+	webauthnRP = &WebauthnRelyingParty{
+		ID:      config.Webauthn.RpID,
+		Name:    config.Webauthn.RpName,
+		Origins: config.Webauthn.Origins,
+	}
+
+	if len(webauthnRP.Name) == 0 {
+		webauthnRP.Name = "AutoRun Logger"
+	}
+
+	if len(webauthnRP.Origins) == 0 {
+		webauthnRP.Origins = []string{"https://" + webauthnRP.ID}
+	}
+}
+
+// generateWebauthnChallenge returns a base64url encoded random challenge
+func generateWebauthnChallenge() (string, error) {
+
+	data := make([]byte, WEBAUTHN_CHALLENGE_LENGTH)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeBase64Url decodes base64url data, with or without padding
+func decodeBase64Url(data string) ([]byte, error) {
+
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+// verifyClientData checks the ceremony type, challenge and origin of the client data
+func (rp *WebauthnRelyingParty) verifyClientData(clientDataJSON []byte, ceremonyType string, challenge string) error {
+
+	var clientData WebauthnClientData
+	err := json.Unmarshal(clientDataJSON, &clientData)
+	if err != nil {
+		return errors.New("Malformed client data")
+	}
+
+	if clientData.Type != ceremonyType {
+		return fmt.Errorf("Invalid client data type: %s", clientData.Type)
+	}
+
+	if len(challenge) == 0 || subtle.ConstantTimeCompare([]byte(strings.TrimRight(clientData.Challenge, "=")), []byte(challenge)) != 1 {
+		return errors.New("Invalid challenge")
+	}
+
+	for _, o := range rp.Origins {
+		if clientData.Origin == o {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Invalid origin: %s", clientData.Origin)
+}
+
+// parseAuthenticatorData parses the authenticator data, including the attested
+// credential data if present, and checks that it is bound to the relying party
+func (rp *WebauthnRelyingParty) parseAuthenticatorData(data []byte) (*WebauthnAuthenticatorData, error) {
+
+	if len(data) < 37 {
+		return nil, errors.New("Authenticator data too short")
+	}
+
+	a := &WebauthnAuthenticatorData{
+		RpIDHash:  data[0:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(a.RpIDHash, rpIDHash[:]) != 1 {
+		return nil, errors.New("Invalid relying party ID hash")
+	}
+
+	if a.Flags&WEBAUTHN_FLAG_USER_PRESENT == 0 {
+		return nil, errors.New("User presence not confirmed")
+	}
+
+	rest := data[37:]
+	if a.Flags&WEBAUTHN_FLAG_ATTESTED_DATA != 0 {
+		// AAGUID (16 bytes), credential ID length (2 bytes), credential ID, COSE public key
+		if len(rest) < 18 {
+			return nil, errors.New("Attested credential data too short")
+		}
+
+		length := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if length == 0 || length > 1023 || len(rest) < length {
+			return nil, errors.New("Invalid credential ID length")
+		}
+
+		a.CredentialID = rest[:length]
+		rest = rest[length:]
+
+		_, remaining, err := decodeCbor(rest)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed credential public key: %v", err)
+		}
+
+		a.PublicKey = rest[:len(rest)-len(remaining)]
+		rest = remaining
+	}
+
+	if a.Flags&WEBAUTHN_FLAG_EXTENSIONS != 0 {
+		_, remaining, err := decodeCbor(rest)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed extensions: %v", err)
+		}
+		rest = remaining
+	}
+
+	if len(rest) != 0 {
+		return nil, errors.New("Unexpected data after authenticator data")
+	}
+
+	return a, nil
+}
+
+// VerifyRegistration verifies the response of a registration (create) ceremony and
+// returns the new credential. Attestation statements are not verified, as "none"
+// attestation is requested i.e. the key is trusted on first use
+func (rp *WebauthnRelyingParty) VerifyRegistration(challenge string, credentialID []byte, clientDataJSON []byte, attestationObject []byte) (*WebauthnCredential, error) {
+
+	err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, rest, err := decodeCbor(attestationObject)
+	if err != nil || len(rest) != 0 {
+		return nil, errors.New("Malformed attestation object")
+	}
+
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if ok == false {
+		return nil, errors.New("Malformed attestation object")
+	}
+
+	authData, ok := attestation["authData"].([]byte)
+	if ok == false {
+		return nil, errors.New("Attestation object missing authenticator data")
+	}
+
+	a, err := rp.parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.CredentialID == nil {
+		return nil, errors.New("Attested credential data not present")
+	}
+
+	if bytes.Equal(a.CredentialID, credentialID) == false {
+		return nil, errors.New("Credential ID mismatch")
+	}
+
+	_, _, err = parseCosePublicKey(a.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebauthnCredential{
+		CredentialID: base64.RawURLEncoding.EncodeToString(a.CredentialID),
+		PublicKey:    base64.RawURLEncoding.EncodeToString(a.PublicKey),
+		SignCount:    int64(a.SignCount),
+	}, nil
+}
+
+// VerifyAssertion verifies the response of an authentication (get) ceremony for a
+// stored credential, returning the new signature counter
+func (rp *WebauthnRelyingParty) VerifyAssertion(cred *WebauthnCredential, challenge string, clientDataJSON []byte, authenticatorData []byte, signature []byte) (int64, error) {
+
+	err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+
+	a, err := rp.parseAuthenticatorData(authenticatorData)
+	if err != nil {
+		return 0, err
+	}
+
+	publicKey, err := decodeBase64Url(cred.PublicKey)
+	if err != nil {
+		return 0, errors.New("Malformed stored public key")
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	message := append(append([]byte{}, authenticatorData...), clientDataHash[:]...)
+
+	err = verifyCoseSignature(publicKey, message, signature)
+	if err != nil {
+		return 0, err
+	}
+
+	// Authenticators that support counters must always increase them, otherwise
+	// the key may have been cloned
+	signCount := int64(a.SignCount)
+	if (signCount != 0 || cred.SignCount != 0) && signCount <= cred.SignCount {
+		return 0, errors.New("Signature counter did not increase")
+	}
+
+	return signCount, nil
+}
+
+// parseCosePublicKey returns the algorithm and public key from a COSE encoded key
+func parseCosePublicKey(data []byte) (int64, crypto.PublicKey, error) {
+
+	decoded, rest, err := decodeCbor(data)
+	if err != nil || len(rest) != 0 {
+		return 0, nil, errors.New("Malformed COSE key")
+	}
+
+	key, ok := decoded.(map[interface{}]interface{})
+	if ok == false {
+		return 0, nil, errors.New("Malformed COSE key")
+	}
+
+	kty, _ := key[COSE_KEY_KTY].(int64)
+	alg, _ := key[COSE_KEY_ALG].(int64)
+	crv, _ := key[COSE_KEY_CRV].(int64)
+
+	switch {
+	case kty == COSE_KTY_EC2 && alg == COSE_ALG_ES256 && crv == COSE_CRV_P256:
+		x, _ := key[COSE_KEY_X].([]byte)
+		y, _ := key[COSE_KEY_Y].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return 0, nil, errors.New("Invalid EC2 key")
+		}
+
+		// Validates that the point is on the curve
+		_, err = ecdh.P256().NewPublicKey(append(append([]byte{0x04}, x...), y...))
+		if err != nil {
+			return 0, nil, errors.New("Invalid EC2 key")
+		}
+
+		return alg, &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+
+	case kty == COSE_KTY_OKP && alg == COSE_ALG_EDDSA && crv == COSE_CRV_ED255:
+		x, _ := key[COSE_KEY_X].([]byte)
+		if len(x) != ed25519.PublicKeySize {
+			return 0, nil, errors.New("Invalid OKP key")
+		}
+
+		return alg, ed25519.PublicKey(x), nil
+
+	case kty == COSE_KTY_RSA && alg == COSE_ALG_RS256:
+		// For RSA keys, -1 and -2 are the modulus and exponent
+		n, _ := key[COSE_KEY_CRV].([]byte)
+		e, _ := key[COSE_KEY_X].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, errors.New("Invalid RSA key")
+		}
+
+		return alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+
+	return 0, nil, fmt.Errorf("Unsupported COSE key type/algorithm: %d/%d", kty, alg)
+}
+
+// verifyCoseSignature checks a signature using a COSE encoded public key
+func verifyCoseSignature(coseKey []byte, message []byte, signature []byte) error {
+
+	alg, publicKey, err := parseCosePublicKey(coseKey)
+	if err != nil {
+		return err
+	}
+
+	valid := false
+	switch alg {
+	case COSE_ALG_ES256:
+		digest := sha256.Sum256(message)
+		valid = ecdsa.VerifyASN1(publicKey.(*ecdsa.PublicKey), digest[:], signature)
+	case COSE_ALG_EDDSA:
+		valid = ed25519.Verify(publicKey.(ed25519.PublicKey), message, signature)
+	case COSE_ALG_RS256:
+		digest := sha256.Sum256(message)
+		valid = rsa.VerifyPKCS1v15(publicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	}
+
+	if valid == false {
+		return errors.New("Invalid signature")
+	}
+
+	return nil
+}
+
+// NewWebauthnCredential returns the user's stored credential matching the base64url credential ID
+func NewWebauthnCredential(userID int64, credentialID string) (*WebauthnCredential, error) {
+
+	w := new(WebauthnCredential)
+	err := db.
+		Select("*").
+		From("webauthn_credential").
+		Where("user_id = $1 AND credential_id = $2", userID, strings.TrimRight(credentialID, "=")).
+		QueryStruct(w)
+
+	if err == sql.ErrNoRows {
+		return w, errors.New("Credential does not exist")
+	}
+	if err != nil {
+		return w, err
+	}
+
+	return w, nil
+}
+
+// getWebauthnCredentials returns all of the security keys registered by a user
+func getWebauthnCredentials(userID int64) ([]*WebauthnCredential, error) {
+
+	var data []*WebauthnCredential
+
+	err := db.
+		Select("*").
+		From("webauthn_credential").
+		Where("user_id = $1", userID).
+		OrderBy("timestamp_created ASC").
+		QueryStructs(&data)
+
+	for _, w := range data {
+		w.Beautify()
+	}
+
+	return data, err
+}
+
+//
+func (w *WebauthnCredential) Add() error {
+
+	return db.
+		InsertInto("webauthn_credential").
+		Columns("user_id", "name", "credential_id", "public_key", "sign_count", "timestamp_created").
+		Values(w.UserID, w.Name, w.CredentialID, w.PublicKey, w.SignCount, time.Now().UTC()).
+		Returning("*").
+		QueryStruct(w)
+}
+
+// Delete removes a security key. The user ID is included so that users can only remove their own keys
+func (w *WebauthnCredential) Delete() error {
+
+	res, err := db.
+		DeleteFrom("webauthn_credential").
+		Where("id = $1 AND user_id = $2", w.ID, w.UserID).
+		Exec()
+
+	if err != nil {
+		return err
+	}
+
+	if res.RowsAffected == 0 {
+		return errors.New("Credential does not exist")
+	}
+
+	return nil
+}
+
+// UpdateSignCount records the new signature counter. The update is conditional on the
+// previous counter, so that the same assertion cannot be accepted by concurrent requests
+func (w *WebauthnCredential) UpdateSignCount(signCount int64) error {
+
+	res, err := db.
+		Update("webauthn_credential").
+		Set("sign_count", signCount).
+		Set("timestamp_last_used", time.Now().UTC()).
+		Where("id = $1 AND sign_count = $2", w.ID, w.SignCount).
+		Exec()
+
+	if err != nil {
+		return err
+	}
+
+	if res.RowsAffected == 0 {
+		return errors.New("Signature counter changed")
+	}
+
+	w.SignCount = signCount
+	return nil
+}
+
+//
+func (w *WebauthnCredential) Beautify() {
+
+	w.CreatedString = w.TimestampCreated.Format("15:04:05 02/01/2006")
+	w.LastUsedString = "Never"
+	if w.TimestampLastUsed != nil {
+		w.LastUsedString = w.TimestampLastUsed.Format("15:04:05 02/01/2006")
+	}
+}
+
+// startWebauthnCeremony stores a new challenge within the session
+func startWebauthnCeremony(c *gin.Context) (string, error) {
+
+	challenge, err := generateWebauthnChallenge()
+	if err != nil {
+		return "", err
+	}
+
+	session, _ := sessionStore.Get(c.Request, APP_NAME)
+	session.Values["webauthn_challenge"] = challenge
+	return challenge, session.Save(c.Request, c.Writer)
+}
+
+// finishWebauthnCeremony returns the challenge from the session, removing it so that it can only be used once
+func finishWebauthnCeremony(c *gin.Context) string {
+
+	session, _ := sessionStore.Get(c.Request, APP_NAME)
+	challenge, _ := session.Values["webauthn_challenge"].(string)
+	delete(session.Values, "webauthn_challenge")
+	err := session.Save(c.Request, c.Writer)
+	if err != nil {
+		log.Printf("Error saving user session (webauthn): %v\n", err)
+		return ""
+	}
+
+	return challenge
+}
+
+// webauthnRegistrationBegin returns the options for navigator.credentials.create
+func webauthnRegistrationBegin(c *gin.Context) {
+
+	if webauthnRP == nil {
+		abortApiRequest(c, http.StatusNotFound, "Security keys are not enabled")
+		return
+	}
+
+	u, err := NewUserByID(getCookieInt64Value(c, "user_id"))
+	if err != nil {
+		log.Printf("Error loading user details (webauthn): %v\n", err)
+		abortApiRequest(c, http.StatusInternalServerError, "Unable to load user")
+		return
+	}
+
+	creds, err := getWebauthnCredentials(u.ID)
+	if err != nil {
+		log.Printf("Error loading webauthn credentials: %v\n", err)
+		abortApiRequest(c, http.StatusInternalServerError, "Unable to load security keys")
+		return
+	}
+
+	// Prevents the same key being registered twice
+	exclude := make([]gin.H, 0, len(creds))
+	for _, w := range creds {
+		exclude = append(exclude, gin.H{"type": "public-key", "id": w.CredentialID})
+	}
+
+	challenge, err := startWebauthnCeremony(c)
+	if err != nil {
+		log.Printf("Error starting webauthn registration: %v\n", err)
+		abortApiRequest(c, http.StatusInternalServerError, "Unable to start registration")
+		return
+	}
+
+	userHandle := make([]byte, 8)
+	binary.BigEndian.PutUint64(userHandle, uint64(u.ID))
+
+	c.JSON(http.StatusOK, gin.H{"publicKey": gin.H{
+		"rp":        gin.H{"id": webauthnRP.ID, "name": webauthnRP.Name},
+		"user":      gin.H{"id": base64.RawURLEncoding.EncodeToString(userHandle), "name": u.Username, "displayName": u.Name},
+		"challenge": challenge,
+		"pubKeyCredParams": []gin.H{
+			{"type": "public-key", "alg": COSE_ALG_ES256},
+			{"type": "public-key", "alg": COSE_ALG_EDDSA},
+			{"type": "public-key", "alg": COSE_ALG_RS256},
+		},
+		"timeout":                WEBAUTHN_TIMEOUT_MS,
+		"attestation":            "none",
+		"excludeCredentials":     exclude,
+		"authenticatorSelection": gin.H{"userVerification": "discouraged"},
+	}})
+}
+
+// webauthnRegistrationFinish verifies the registration form and stores the new security key
+func webauthnRegistrationFinish(c *gin.Context, userID int64) (*WebauthnCredential, error) {
+
+	challenge := finishWebauthnCeremony(c)
+
+	if webauthnRP == nil {
+		return nil, errors.New("Security keys are not enabled")
+	}
+
+	name := strings.TrimSpace(c.PostForm("name"))
+	if len(name) == 0 || len(name) > 50 {
+		return nil, errors.New("Key name must be between 1 and 50 characters")
+	}
+
+	credentialID, err := decodeBase64Url(c.PostForm("credential_id"))
+	if err != nil {
+		return nil, errors.New("Invalid credential ID")
+	}
+
+	clientData, err := decodeBase64Url(c.PostForm("client_data"))
+	if err != nil {
+		return nil, errors.New("Invalid client data")
+	}
+
+	attestationObject, err := decodeBase64Url(c.PostForm("attestation_object"))
+	if err != nil {
+		return nil, errors.New("Invalid attestation object")
+	}
+
+	w, err := webauthnRP.VerifyRegistration(challenge, credentialID, clientData, attestationObject)
+	if err != nil {
+		log.Printf("Error verifying webauthn registration: %v\n", err)
+		return nil, errors.New("Unable to verify security key")
+	}
+
+	w.UserID = userID
+	w.Name = name
+	err = w.Add()
+	if err != nil {
+		log.Printf("Error adding webauthn credential: %v\n", err)
+		return nil, errors.New("Unable to store security key")
+	}
+
+	return w, nil
+}
+
+// ***** Routing Methods ******************************************************
+
+//
+func routeEnrollWebauthnBegin(c *gin.Context) {
+
+	webauthnRegistrationBegin(c)
+}
+
+//
+func routeEnrollWebauthnPost(c *gin.Context) {
+
+	u, err := NewUserByID(getCookieInt64Value(c, "user_id"))
+	if err != nil {
+		log.Printf("Error loading user details for enroll: %v\n", err)
+		goToErrorPage(c, "Unable perform enroll")
+		return
+	}
+
+	_, err = webauthnRegistrationFinish(c, u.ID)
+	if err != nil {
+		loadEnrollData(c, u, template.HTML(fmt.Sprintf(ALERT_YELLOW, err)))
+		return
+	}
+
+	completeEnroll(c, u, MFA_METHOD_WEBAUTHN)
+}
+
+//
+func routeAccountWebauthnBegin(c *gin.Context) {
+
+	webauthnRegistrationBegin(c)
+}
+
+//
+func routeAccountWebauthnNewPost(c *gin.Context) {
+
+	w, err := webauthnRegistrationFinish(c, getCookieInt64Value(c, "user_id"))
+	if err != nil {
+		loadAccountData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, err)), "")
+		return
+	}
+
+	writeAudit(c, AUDIT_WEBAUTHN_ADD, AUDIT_TARGET_WEBAUTHN, convertInt64ToString(w.ID), w.Name)
+
+	loadAccountData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Security key registered")), "")
+}
+
+//
+func routeAccountWebauthnDeletePost(c *gin.Context) {
+
+	id, successful := processInt64Parameter(c.Param("id"))
+	if successful == false {
+		loadAccountData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Invalid security key")), "")
+		return
+	}
+
+	w := &WebauthnCredential{ID: id, UserID: getCookieInt64Value(c, "user_id")}
+	err := w.Delete()
+	if err != nil {
+		log.Printf("Error deleting webauthn credential: %v\n", err)
+		loadAccountData(c, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Unable to remove security key")), "")
+		return
+	}
+
+	writeAudit(c, AUDIT_WEBAUTHN_DELETE, AUDIT_TARGET_WEBAUTHN, convertInt64ToString(id), "")
+
+	loadAccountData(c, template.HTML(fmt.Sprintf(ALERT_GREEN, "Security key removed")), "")
+}
+
+// routeVerifyWebauthnBegin returns the options for navigator.credentials.get
+func routeVerifyWebauthnBegin(c *gin.Context) {
+
+	if webauthnRP == nil {
+		abortApiRequest(c, http.StatusNotFound, "Security keys are not enabled")
+		return
+	}
+
+	creds, err := getWebauthnCredentials(getCookieInt64Value(c, "user_id"))
+	if err != nil {
+		log.Printf("Error loading webauthn credentials: %v\n", err)
+		abortApiRequest(c, http.StatusInternalServerError, "Unable to load security keys")
+		return
+	}
+
+	if len(creds) == 0 {
+		abortApiRequest(c, http.StatusBadRequest, "No security keys registered")
+		return
+	}
+
+	allow := make([]gin.H, 0, len(creds))
+	for _, w := range creds {
+		allow = append(allow, gin.H{"type": "public-key", "id": w.CredentialID})
+	}
+
+	challenge, err := startWebauthnCeremony(c)
+	if err != nil {
+		log.Printf("Error starting webauthn assertion: %v\n", err)
+		abortApiRequest(c, http.StatusInternalServerError, "Unable to start verification")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"publicKey": gin.H{
+		"rpId":             webauthnRP.ID,
+		"challenge":        challenge,
+		"timeout":          WEBAUTHN_TIMEOUT_MS,
+		"allowCredentials": allow,
+		"userVerification": "discouraged",
+	}})
+}
+
+//
+func routeVerifyWebauthnPost(c *gin.Context) {
+
+	if webauthnRP == nil {
+		abortApiRequest(c, http.StatusNotFound, "Security keys are not enabled")
+		return
+	}
+
+	challenge := finishWebauthnCeremony(c)
+
+	u, err := NewUserByID(getCookieInt64Value(c, "user_id"))
+	if err != nil {
+		log.Printf("Error loading user details for verify: %v\n", err)
+		goToErrorPage(c, "Unable perform verify")
+		return
+	}
+
+	if u.Locked == true {
+		endLockedSession(c)
+		return
+	}
+
+	err = verifyWebauthnAssertion(c, u, challenge)
+	if err != nil {
+		log.Printf("Error verifying webauthn assertion: %v (%s)\n", err, u.Username)
+
+		auditFailedAttempt(c, u, AUDIT_MFA_VERIFY_FAILURE, MFA_METHOD_WEBAUTHN)
+		if u.Locked == true {
+			endLockedSession(c)
+			return
+		}
+
+		loadVerifyData(c, u, template.HTML(fmt.Sprintf(ALERT_YELLOW, "Unable to verify security key")))
+		return
+	}
+
+	completeVerify(c, u, MFA_METHOD_WEBAUTHN)
+}
+
+// verifyWebauthnAssertion verifies the assertion form against the user's stored credential
+func verifyWebauthnAssertion(c *gin.Context, u *User, challenge string) error {
+
+	w, err := NewWebauthnCredential(u.ID, c.PostForm("credential_id"))
+	if err != nil {
+		return err
+	}
+
+	clientData, err := decodeBase64Url(c.PostForm("client_data"))
+	if err != nil {
+		return errors.New("Invalid client data")
+	}
+
+	authenticatorData, err := decodeBase64Url(c.PostForm("authenticator_data"))
+	if err != nil {
+		return errors.New("Invalid authenticator data")
+	}
+
+	signature, err := decodeBase64Url(c.PostForm("signature"))
+	if err != nil {
+		return errors.New("Invalid signature")
+	}
+
+	signCount, err := webauthnRP.VerifyAssertion(w, challenge, clientData, authenticatorData, signature)
+	if err != nil {
+		return err
+	}
+
+	return w.UpdateSignCount(signCount)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// ##### Software Authenticator ###############################################
+
+const (
+	TEST_WEBAUTHN_RP_ID  = "arl.example.com"
+	TEST_WEBAUTHN_ORIGIN = "https://arl.example.com"
+)
+
+// testAuthenticator is a software security key using an ECDSA P-256 (ES256) key pair
+type testAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	rpID         string
+	origin       string
+	flags        byte
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+
+	return &testAuthenticator{
+		key:          key,
+		credentialID: credentialID,
+		rpID:         TEST_WEBAUTHN_RP_ID,
+		origin:       TEST_WEBAUTHN_ORIGIN,
+		flags:        WEBAUTHN_FLAG_USER_PRESENT | WEBAUTHN_FLAG_USER_VERIFIED,
+	}
+}
+
+func newTestRelyingParty() *WebauthnRelyingParty {
+
+	return &WebauthnRelyingParty{ID: TEST_WEBAUTHN_RP_ID, Name: "Test", Origins: []string{TEST_WEBAUTHN_ORIGIN}}
+}
+
+// coseKey returns the COSE encoding of the public key
+func (a *testAuthenticator) coseKey() []byte {
+
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+
+	return cborMap(
+		cborInt(COSE_KEY_KTY), cborInt(COSE_KTY_EC2),
+		cborInt(COSE_KEY_ALG), cborInt(COSE_ALG_ES256),
+		cborInt(COSE_KEY_CRV), cborInt(COSE_CRV_P256),
+		cborInt(COSE_KEY_X), cborBytes(x),
+		cborInt(COSE_KEY_Y), cborBytes(y))
+}
+
+// authenticatorData returns the authenticator data, including the attested credential data for registrations
+func (a *testAuthenticator) authenticatorData(attested bool) []byte {
+
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	flags := a.flags
+	if attested == true {
+		flags |= WEBAUTHN_FLAG_ATTESTED_DATA
+	}
+
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+
+	if attested == true {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = append(data, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+
+	return data
+}
+
+func (a *testAuthenticator) clientData(ceremonyType string, challenge string) []byte {
+
+	data, _ := json.Marshal(WebauthnClientData{Type: ceremonyType, Challenge: challenge, Origin: a.origin})
+	return data
+}
+
+// create performs a registration ceremony, returning the client data and "none" attestation object
+func (a *testAuthenticator) create(challenge string) ([]byte, []byte) {
+
+	attestationObject := cborMap(
+		cborText("fmt"), cborText("none"),
+		cborText("attStmt"), cborMap(),
+		cborText("authData"), cborBytes(a.authenticatorData(true)))
+
+	return a.clientData("webauthn.create", challenge), attestationObject
+}
+
+// get performs an authentication ceremony, incrementing the counter and returning the client data,
+// authenticator data and signature
+func (a *testAuthenticator) get(t *testing.T, challenge string) ([]byte, []byte, []byte) {
+
+	a.signCount++
+	clientDataJSON := a.clientData("webauthn.get", challenge)
+	authenticatorData := a.authenticatorData(false)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authenticatorData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("Error signing: %v", err)
+	}
+
+	return clientDataJSON, authenticatorData, signature
+}
+
+// register returns the credential stored for the authenticator
+func (a *testAuthenticator) register(t *testing.T, rp *WebauthnRelyingParty) *WebauthnCredential {
+
+	challenge, _ := generateWebauthnChallenge()
+	clientDataJSON, attestationObject := a.create(challenge)
+
+	cred, err := rp.VerifyRegistration(challenge, a.credentialID, clientDataJSON, attestationObject)
+	if err != nil {
+		t.Fatalf("Error verifying registration: %v", err)
+	}
+
+	return cred
+}
+
+// ##### Tests ################################################################
+
+func TestWebauthnRegistration(t *testing.T) {
+
+	rp := newTestRelyingParty()
+	a := newTestAuthenticator(t)
+	a.signCount = 3
+
+	cred := a.register(t, rp)
+
+	credentialID, _ := decodeBase64Url(cred.CredentialID)
+	if string(credentialID) != string(a.credentialID) {
+		t.Errorf("Credential ID = % x, expected % x", credentialID, a.credentialID)
+	}
+
+	publicKey, _ := decodeBase64Url(cred.PublicKey)
+	if string(publicKey) != string(a.coseKey()) {
+		t.Error("Stored public key does not match the COSE key")
+	}
+
+	if cred.SignCount != 3 {
+		t.Errorf("Sign count = %d, expected 3", cred.SignCount)
+	}
+}
+
+func TestWebauthnRegistrationFailures(t *testing.T) {
+
+	rp := newTestRelyingParty()
+
+	tests := []struct {
+		name     string
+		setup    func(a *testAuthenticator)
+		expected string
+	}{
+		{"wrong origin", func(a *testAuthenticator) { a.origin = "https://evil.example.com" }, "Invalid origin"},
+		{"wrong rpIdHash", func(a *testAuthenticator) { a.rpID = "evil.example.com" }, "Invalid relying party ID hash"},
+		{"user presence missing", func(a *testAuthenticator) { a.flags = WEBAUTHN_FLAG_USER_VERIFIED }, "User presence not confirmed"},
+	}
+
+	for _, test := range tests {
+		a := newTestAuthenticator(t)
+		test.setup(a)
+
+		challenge, _ := generateWebauthnChallenge()
+		clientDataJSON, attestationObject := a.create(challenge)
+
+		_, err := rp.VerifyRegistration(challenge, a.credentialID, clientDataJSON, attestationObject)
+		if err == nil || strings.Contains(err.Error(), test.expected) == false {
+			t.Errorf("%s: error = %v, expected %q", test.name, err, test.expected)
+		}
+	}
+
+	a := newTestAuthenticator(t)
+	challenge, _ := generateWebauthnChallenge()
+	clientDataJSON, attestationObject := a.create(challenge)
+
+	other, _ := generateWebauthnChallenge()
+	_, err := rp.VerifyRegistration(other, a.credentialID, clientDataJSON, attestationObject)
+	if err == nil || strings.Contains(err.Error(), "Invalid challenge") == false {
+		t.Errorf("Wrong challenge: error = %v", err)
+	}
+
+	_, err = rp.VerifyRegistration(challenge, []byte("other"), clientDataJSON, attestationObject)
+	if err == nil || strings.Contains(err.Error(), "Credential ID mismatch") == false {
+		t.Errorf("Wrong credential ID: error = %v", err)
+	}
+
+	_, err = rp.VerifyRegistration(challenge, a.credentialID, clientDataJSON, attestationObject[:len(attestationObject)-1])
+	if err == nil {
+		t.Error("Truncated attestation object: expected an error")
+	}
+}
+
+func TestWebauthnAssertion(t *testing.T) {
+
+	rp := newTestRelyingParty()
+	a := newTestAuthenticator(t)
+	cred := a.register(t, rp)
+
+	for i := 1; i <= 2; i++ {
+		challenge, _ := generateWebauthnChallenge()
+		clientDataJSON, authenticatorData, signature := a.get(t, challenge)
+
+		signCount, err := rp.VerifyAssertion(cred, challenge, clientDataJSON, authenticatorData, signature)
+		if err != nil {
+			t.Fatalf("Error verifying assertion %d: %v", i, err)
+		}
+
+		if signCount != int64(i) {
+			t.Errorf("Sign count = %d, expected %d", signCount, i)
+		}
+		cred.SignCount = signCount
+	}
+}
+
+func TestWebauthnAssertionFailures(t *testing.T) {
+
+	rp := newTestRelyingParty()
+
+	tests := []struct {
+		name     string
+		setup    func(a *testAuthenticator, cred *WebauthnCredential)
+		expected string
+	}{
+		{"wrong origin", func(a *testAuthenticator, cred *WebauthnCredential) { a.origin = "https://arl.example.com.evil.com" }, "Invalid origin"},
+		{"wrong rpIdHash", func(a *testAuthenticator, cred *WebauthnCredential) { a.rpID = "example.com" }, "Invalid relying party ID hash"},
+		{"user presence missing", func(a *testAuthenticator, cred *WebauthnCredential) { a.flags = 0 }, "User presence not confirmed"},
+		{"sign count not increased", func(a *testAuthenticator, cred *WebauthnCredential) { cred.SignCount = 5; a.signCount = 4 }, "Signature counter did not increase"},
+		{"sign count regressed", func(a *testAuthenticator, cred *WebauthnCredential) { cred.SignCount = 10; a.signCount = 2 }, "Signature counter did not increase"},
+		{"different key", func(a *testAuthenticator, cred *WebauthnCredential) {
+			other := newTestAuthenticator(t)
+			a.key = other.key
+		}, "Invalid signature"},
+	}
+
+	for _, test := range tests {
+		a := newTestAuthenticator(t)
+		cred := a.register(t, rp)
+		test.setup(a, cred)
+
+		challenge, _ := generateWebauthnChallenge()
+		clientDataJSON, authenticatorData, signature := a.get(t, challenge)
+
+		_, err := rp.VerifyAssertion(cred, challenge, clientDataJSON, authenticatorData, signature)
+		if err == nil || strings.Contains(err.Error(), test.expected) == false {
+			t.Errorf("%s: error = %v, expected %q", test.name, err, test.expected)
+		}
+	}
+}
+
+func TestWebauthnAssertionBadSignature(t *testing.T) {
+
+	rp := newTestRelyingParty()
+	a := newTestAuthenticator(t)
+	cred := a.register(t, rp)
+
+	challenge, _ := generateWebauthnChallenge()
+	clientDataJSON, authenticatorData, signature := a.get(t, challenge)
+
+	// A corrupted signature
+	corrupted := append([]byte{}, signature...)
+	corrupted[len(corrupted)-1] ^= 0x01
+	_, err := rp.VerifyAssertion(cred, challenge, clientDataJSON, authenticatorData, corrupted)
+	if err == nil || err.Error() != "Invalid signature" {
+		t.Errorf("Corrupted signature: error = %v", err)
+	}
+
+	// The signature covers the authenticator data, so the counter cannot be altered
+	altered := append([]byte{}, authenticatorData...)
+	altered[36]++
+	_, err = rp.VerifyAssertion(cred, challenge, clientDataJSON, altered, signature)
+	if err == nil || err.Error() != "Invalid signature" {
+		t.Errorf("Altered authenticator data: error = %v", err)
+	}
+
+	// The signature is bound to the challenge via the client data hash
+	other, _ := generateWebauthnChallenge()
+	_, err = rp.VerifyAssertion(cred, other, clientDataJSON, authenticatorData, signature)
+	if err == nil || strings.Contains(err.Error(), "Invalid challenge") == false {
+		t.Errorf("Wrong challenge: error = %v", err)
+	}
+
+	// A registration response cannot be used as an assertion
+	createClientData, _ := a.create(challenge)
+	_, err = rp.VerifyAssertion(cred, challenge, createClientData, authenticatorData, signature)
+	if err == nil || strings.Contains(err.Error(), "Invalid client data type") == false {
+		t.Errorf("Registration client data: error = %v", err)
+	}
+
+	_, err = rp.VerifyAssertion(cred, challenge, clientDataJSON, authenticatorData, signature)
+	if err != nil {
+		t.Errorf("Error verifying the unaltered assertion: %v", err)
+	}
+}
+
+func TestVerifyWebauthnNotEnabled(t *testing.T) {
+
+	d := newTestDatabase(t)
+	router := newTestLogonRouter()
+	router.POST("/verify/webauthn", routeVerifyWebauthnPost)
+
+	rp := webauthnRP
+	webauthnRP = nil
+	t.Cleanup(func() { webauthnRP = rp })
+
+	// Posting an assertion when security keys are not enabled is not a failed attempt
+	cookies := logonTestUser(t, router)
+	w := postTestForm(router, "/verify/webauthn", cookies, url.Values{"credential_id": {"x"}})
+	if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "Security keys are not enabled") == false {
+		t.Errorf("Status = %d (%s), expected security keys not enabled", w.Code, w.Body.String())
+	}
+
+	if d.value("is_locked") != false || d.value("login_attempts") != int64(0) {
+		t.Errorf("Locked %v, login attempts %v, expected the account to be unchanged", d.value("is_locked"), d.value("login_attempts"))
+	}
+}
+
+func TestParseCosePublicKeyInvalid(t *testing.T) {
+
+	a := newTestAuthenticator(t)
+	x := make([]byte, 32)
+	a.key.X.FillBytes(x)
+
+	tests := map[string][]byte{
+		"not a map":     cborArray(cborInt(1)),
+		"trailing data": append(a.coseKey(), 0x00),
+		"missing y": cborMap(
+			cborInt(COSE_KEY_KTY), cborInt(COSE_KTY_EC2),
+			cborInt(COSE_KEY_ALG), cborInt(COSE_ALG_ES256),
+			cborInt(COSE_KEY_CRV), cborInt(COSE_CRV_P256),
+			cborInt(COSE_KEY_X), cborBytes(x)),
+		"point not on curve": cborMap(
+			cborInt(COSE_KEY_KTY), cborInt(COSE_KTY_EC2),
+			cborInt(COSE_KEY_ALG), cborInt(COSE_ALG_ES256),
+			cborInt(COSE_KEY_CRV), cborInt(COSE_CRV_P256),
+			cborInt(COSE_KEY_X), cborBytes(x),
+			cborInt(COSE_KEY_Y), cborBytes(x)),
+		"unsupported algorithm": cborMap(
+			cborInt(COSE_KEY_KTY), cborInt(COSE_KTY_EC2),
+			cborInt(COSE_KEY_ALG), cborInt(-35),
+			cborInt(COSE_KEY_CRV), cborInt(2)),
+	}
+
+	for name, data := range tests {
+		_, _, err := parseCosePublicKey(data)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}